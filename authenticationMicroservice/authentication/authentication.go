@@ -1,15 +1,25 @@
 package authentication
 
 import (
+	"authenticationMicroservice/lockout"
+	"common/middleware"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,7 +27,9 @@ import (
 var db *sql.DB
 var jwtSecret string // JWT secret key loaded from environment variables
 
-func init() {
+// Init connects to the authentication database and loads the JWT secret from .env. The authentication
+// service calls it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -51,11 +63,35 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-// LoginResponse represents the structure of a login response
+// LoginResponse represents the structure of a login or refresh response
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
 }
 
+const (
+	accessTokenTTL  = 15 * time.Minute   // Lifetime of an access token
+	refreshTokenTTL = 7 * 24 * time.Hour // Lifetime of a refresh token
+)
+
+// TokenClaims represents the identity claims embedded in a JWT by generateJWT
+type TokenClaims struct {
+	UserID        int      `json:"user_id"`
+	Name          string   `json:"name"`
+	Email         string   `json:"email"`
+	ContactNumber string   `json:"contact_number"`
+	Address       string   `json:"address"`
+	Roles         []string `json:"roles"`
+	jwt.RegisteredClaims
+}
+
+// validRoles lists the values accepted by the roles column of the User table
+var validRoles = []string{middleware.RoleCustomer, middleware.RoleFleetOperator, middleware.RoleFinance, middleware.RoleAdmin}
+
+// ErrInvalidToken is returned when a token fails signature, expiry or session checks
+var ErrInvalidToken = errors.New("invalid or expired token")
+
 // AuthenticateUser handles user login by verifying credentials and returning a JWT token
 func AuthenticateUser(w http.ResponseWriter, r *http.Request) {
 	log.Println("Handling /login request...")
@@ -68,15 +104,30 @@ func AuthenticateUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Parsed login request: %+v", loginRequest)
+	log.Printf("Login attempt for %s", loginRequest.Email)
+
+	// Reject the attempt while the account or client IP is locked out
+	attemptKeys := []lockout.Key{lockout.AccountKey("login", loginRequest.Email), lockout.IPKey("login", r)}
+	retryAfter, err := lockout.Check(attemptKeys...)
+	if err != nil {
+		log.Printf("Error checking lockout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		log.Printf("Login for %s rejected, locked out for %s", loginRequest.Email, retryAfter)
+		lockout.TooManyAttempts(w, retryAfter)
+		return
+	}
 
 	// Fetch user details from the `User` table
-	var hashedPassword, name, email, contactNumber, address string
+	var hashedPassword, name, email, contactNumber, address, roles string
 	var userID int
 	log.Println("Fetching user details from the User table...")
-	err = db.QueryRow("SELECT user_id, password, name, email, contact_number, address FROM User WHERE email = ?", loginRequest.Email).Scan(&userID, &hashedPassword, &name, &email, &contactNumber, &address)
+	err = db.QueryRow("SELECT user_id, password, name, email, contact_number, address, roles FROM User WHERE email = ?", loginRequest.Email).Scan(&userID, &hashedPassword, &name, &email, &contactNumber, &address, &roles)
 	if err == sql.ErrNoRows {
 		log.Println("Email not found.")
+		recordFailedAttempt(r, attemptKeys)
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -97,44 +148,216 @@ func AuthenticateUser(w http.ResponseWriter, r *http.Request) {
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(loginRequest.Password))
 	if err != nil {
 		log.Println("Invalid password.")
+		recordFailedAttempt(r, attemptKeys)
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT token
-	log.Println("Generating JWT token...")
-	token, expiryTime, err := generateJWT(userID, name, email, contactNumber, address)
+	// Clear the account's failed attempts after a successful login
+	if err := lockout.Reset(attemptKeys[0]); err != nil {
+		log.Printf("Error resetting failed attempts: %v", err)
+	}
+
+	// Start a new token family for this login session
+	familyID, err := generateRandomToken(16)
+	if err != nil {
+		log.Printf("Error generating token family: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error generating JWT token: %v", err)
+		log.Printf("Error starting transaction: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	// Store the token in the `Authentication` table
-	log.Println("Storing token in the Authentication table...")
-	_, err = db.Exec(`
-		INSERT INTO Authentication (user_id, auth_token, token_expiry)
-		VALUES (?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		auth_token = VALUES(auth_token), token_expiry = VALUES(token_expiry)`,
-		userID, token, expiryTime)
+	// Generate and store the access and refresh tokens
+	log.Println("Issuing access and refresh tokens...")
+	response, err := issueTokens(tx, familyID, userID, name, email, contactNumber, address, parseRoles(roles))
 	if err != nil {
-		log.Printf("Error storing token in the database: %v", err)
+		log.Printf("Error issuing tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing tokens: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with the token
-	log.Println("Login successful. Returning token...")
-	response := LoginResponse{Token: token}
+	// Respond with the tokens
+	log.Println("Login successful. Returning tokens...")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
+// recordFailedAttempt counts a failed login against the account and client IP
+func recordFailedAttempt(r *http.Request, attemptKeys []lockout.Key) {
+	if err := lockout.RecordFailure(r, attemptKeys...); err != nil {
+		log.Printf("Error recording failed attempt: %v", err)
+	}
+}
+
+// RefreshToken exchanges a single-use refresh token for a new access and refresh token pair.
+// Presenting a refresh token that was already used revokes its whole token family.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /refresh request...")
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		log.Printf("Error parsing request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the refresh token row so concurrent refreshes cannot both rotate it
+	var refreshID, userID int
+	var familyID string
+	var used, revoked, active bool
+	err = tx.QueryRow(`
+		SELECT refresh_id, user_id, family_id, used_at IS NOT NULL, revoked_at IS NOT NULL, expires_at > ?
+		FROM RefreshToken WHERE token_hash = ? FOR UPDATE`,
+		time.Now(), hashToken(request.RefreshToken)).Scan(&refreshID, &userID, &familyID, &used, &revoked, &active)
+	if err == sql.ErrNoRows {
+		log.Println("Refresh token not found.")
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if used {
+		// A rotated token was replayed, so the family is assumed to be compromised
+		log.Printf("Refresh token reuse detected for user_id=%d, revoking token family %s", userID, familyID)
+		if err := revokeTokenFamily(tx, familyID); err != nil {
+			log.Printf("Error revoking token family: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing token family revocation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if revoked || !active {
+		log.Println("Refresh token revoked or expired.")
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Mark the presented token as used
+	_, err = tx.Exec("UPDATE RefreshToken SET used_at = ? WHERE refresh_id = ?", time.Now(), refreshID)
+	if err != nil {
+		log.Printf("Error marking refresh token as used: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the latest user details for the new access token
+	var name, email, contactNumber, address, roles string
+	err = tx.QueryRow("SELECT name, email, contact_number, address, roles FROM User WHERE user_id = ?", userID).Scan(&name, &email, &contactNumber, &address, &roles)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := issueTokens(tx, familyID, userID, name, email, contactNumber, address, parseRoles(roles))
+	if err != nil {
+		log.Printf("Error issuing tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Tokens refreshed for user_id=%d", userID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// issueTokens mints an access token and a refresh token in the given token family and stores both
+func issueTokens(tx *sql.Tx, familyID string, userID int, name, email, contactNumber, address string, roles []string) (LoginResponse, error) {
+	token, expiryTime, err := generateJWT(userID, name, email, contactNumber, address, roles)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	// Store the access token in the `Authentication` table
+	_, err = tx.Exec(`
+		INSERT INTO Authentication (user_id, auth_token, token_expiry, family_id)
+		VALUES (?, ?, ?, ?)`,
+		userID, token, expiryTime, familyID)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	// Store only the hash of the refresh token in the `RefreshToken` table
+	refreshToken, err := generateRandomToken(32)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO RefreshToken (user_id, family_id, token_hash, expires_at)
+		VALUES (?, ?, ?, ?)`,
+		userID, familyID, hashToken(refreshToken), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revokeTokenFamily revokes every refresh and access token issued in a token family
+func revokeTokenFamily(tx *sql.Tx, familyID string) error {
+	now := time.Now()
+	_, err := tx.Exec("UPDATE RefreshToken SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, familyID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE Authentication SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, familyID)
+	return err
+}
+
 // generateJWT generates a JWT token for an authenticated user and returns the token and its expiry time
-func generateJWT(userID int, name, email, contactNumber, address string) (string, time.Time, error) {
-	expiryTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
+func generateJWT(userID int, name, email, contactNumber, address string, roles []string) (string, time.Time, error) {
+	expiryTime := time.Now().Add(accessTokenTTL) // Access tokens are short-lived and renewed via refresh tokens
+
+	// A unique token ID keeps tokens minted within the same second distinct
+	tokenID, err := generateRandomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
 	claims := jwt.MapClaims{
 		"user_id":        userID,
@@ -142,8 +365,10 @@ func generateJWT(userID int, name, email, contactNumber, address string) (string
 		"email":          email,
 		"contact_number": contactNumber,
 		"address":        address,
+		"roles":          roles,
 		"exp":            expiryTime.Unix(),
 		"iat":            time.Now().Unix(),
+		"jti":            tokenID,
 	}
 
 	// Create a new JWT token with the claims
@@ -152,4 +377,295 @@ func generateJWT(userID int, name, email, contactNumber, address string) (string
 	// Sign the token with the JWT secret key
 	signedToken, err := token.SignedString([]byte(jwtSecret))
 	return signedToken, expiryTime, err
-}
\ No newline at end of file
+}
+
+// parseRoles splits the value of the roles SET column into individual roles
+func parseRoles(roles string) []string {
+	if roles == "" {
+		return []string{}
+	}
+	return strings.Split(roles, ",")
+}
+
+// generateRandomToken returns n cryptographically random bytes encoded as URL-safe base64
+func generateRandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken returns the hex-encoded SHA-256 hash of a token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateToken verifies the HS256 signature and expiry of a JWT minted by generateJWT
+// and confirms that it is still an active session in the Authentication table
+func ValidateToken(tokenString string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		log.Printf("Token verification failed: %v", err)
+		return nil, ErrInvalidToken
+	}
+
+	// Check the token against the Authentication table
+	var storedUserID int
+	err = db.QueryRow(`
+		SELECT user_id FROM Authentication
+		WHERE auth_token = ? AND token_expiry > ? AND revoked_at IS NULL`,
+		tokenString, time.Now()).Scan(&storedUserID)
+	if err == sql.ErrNoRows {
+		log.Println("Token not found in the Authentication table, expired or revoked.")
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if storedUserID != claims.UserID {
+		log.Printf("Token user_id %d does not match stored user_id %d", claims.UserID, storedUserID)
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// Identify validates a token for middleware.RequireAuth against this service's own sessions and
+// returns the identity of its holder
+func Identify(tokenString string) (middleware.Identity, error) {
+	claims, err := ValidateToken(tokenString)
+	if err == ErrInvalidToken {
+		return middleware.Identity{}, middleware.ErrInvalidToken
+	} else if err != nil {
+		return middleware.Identity{}, err
+	}
+	return middleware.Identity{UserID: claims.UserID, Name: claims.Name, Email: claims.Email, Roles: claims.Roles}, nil
+}
+
+// VerifyToken validates the bearer token of the request and returns the caller's identity.
+// Other microservices call this endpoint to confirm that a token is still an active session.
+func VerifyToken(w http.ResponseWriter, r *http.Request) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err == ErrInvalidToken {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error validating token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": claims.UserID,
+		"name":    claims.Name,
+		"email":   claims.Email,
+		"roles":   claims.Roles,
+	})
+}
+
+// Logout revokes the session of the bearer token used for the request
+func Logout(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /logout request...")
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	// Revoke the token family of this session so its refresh token can no longer be used
+	var familyID sql.NullString
+	err := db.QueryRow("SELECT family_id FROM Authentication WHERE auth_token = ?", tokenString).Scan(&familyID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE Authentication SET revoked_at = ?
+		WHERE auth_token = ? AND revoked_at IS NULL`,
+		time.Now(), tokenString)
+	if err == nil && familyID.Valid {
+		err = revokeTokenFamily(tx, familyID.String)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error revoking token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Session revoked successfully.")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Logged out successfully"}`))
+}
+
+// LogoutAll revokes every active session belonging to the owner of the bearer token
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /logout-all request...")
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM Authentication WHERE auth_token = ?", tokenString).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Revoke access and refresh tokens together, so that no session can be renewed after a partial logout
+	now := time.Now()
+	var revoked int64
+	result, err := tx.Exec(`
+		UPDATE Authentication SET revoked_at = ?
+		WHERE user_id = ? AND revoked_at IS NULL`,
+		now, userID)
+	if err == nil {
+		revoked, _ = result.RowsAffected()
+		_, err = tx.Exec(`
+			UPDATE RefreshToken SET revoked_at = ?
+			WHERE user_id = ? AND revoked_at IS NULL`,
+			now, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error revoking tokens for user_id=%d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked %d sessions for user_id=%d", revoked, userID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Logged out of all sessions successfully",
+		"revoked_sessions": revoked,
+	})
+}
+
+// UpdateUserRoles replaces the roles granted to a user. The user's access tokens are revoked
+// so that the new roles take effect on the next refresh rather than when the tokens expire.
+func UpdateUserRoles(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /users/{id}/roles request...")
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error parsing request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(request.Roles) == 0 {
+		http.Error(w, "At least one role is required", http.StatusBadRequest)
+		return
+	}
+	for _, role := range request.Roles {
+		if !isValidRole(role) {
+			http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE User SET roles = ? WHERE user_id = ? AND password IS NOT NULL", strings.Join(request.Roles, ","), userID)
+	if err != nil {
+		log.Printf("Error updating roles for user_id=%d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		// Distinguish an unknown user from roles that were already set
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM User WHERE user_id = ? AND password IS NOT NULL)", userID).Scan(&exists)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE Authentication SET revoked_at = ?
+		WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now(), userID)
+	if err != nil {
+		log.Printf("Error revoking tokens for user_id=%d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing role update: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Roles for user_id=%d set to %v", userID, request.Roles)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"roles":   request.Roles,
+	})
+}
+
+// isValidRole reports whether role is one of the roles that can be granted
+func isValidRole(role string) bool {
+	for _, valid := range validRoles {
+		if role == valid {
+			return true
+		}
+	}
+	return false
+}
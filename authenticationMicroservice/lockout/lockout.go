@@ -0,0 +1,182 @@
+package lockout
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+const (
+	accountThreshold = 5                // Failures tolerated per account before it is locked
+	ipThreshold      = 20               // Failures tolerated per client IP before it is locked
+	failureWindow    = time.Hour        // Failures older than this no longer count towards a lockout
+	baseLockout      = time.Minute      // Lockout applied when a threshold is first reached
+	maxLockout       = 60 * time.Minute // Upper bound for the exponential backoff
+)
+
+// Init connects to the authentication database configured in .env. The authentication service calls
+// it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	log.Println("Initializing database connection (lockout package)...")
+	db, err = sql.Open("mysql", os.Getenv("DB_CONNECTION"))
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (lockout package) successful.")
+}
+
+// Key identifies a failed-attempt counter and the number of failures it tolerates
+type Key struct {
+	ID        string
+	Threshold int
+}
+
+// AccountKey returns the counter key for an action performed against an account
+func AccountKey(action, email string) Key {
+	return Key{ID: action + ":account:" + strings.ToLower(strings.TrimSpace(email)), Threshold: accountThreshold}
+}
+
+// IPKey returns the counter key for an action performed from the client IP of the request
+func IPKey(action string, r *http.Request) Key {
+	return Key{ID: action + ":ip:" + ClientIP(r), Threshold: ipThreshold}
+}
+
+// ClientIP returns the IP address of the connection that sent the request
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Check returns how long the caller must wait before any of the keys may be attempted again
+func Check(keys ...Key) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, key := range keys {
+		var seconds int
+		err := db.QueryRow(`
+			SELECT GREATEST(TIMESTAMPDIFF(SECOND, ?, locked_until), 0)
+			FROM FailedAttempt WHERE attempt_key = ? AND locked_until IS NOT NULL`,
+			time.Now(), key.ID).Scan(&seconds)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if wait := time.Duration(seconds) * time.Second; wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// RecordFailure counts a failed attempt against each key and locks keys that reach their threshold.
+// The lockout doubles with every further failure, up to maxLockout, and each lockout is audited.
+func RecordFailure(r *http.Request, keys ...Key) error {
+	for _, key := range keys {
+		if err := recordFailure(r, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordFailure(r *http.Request, key Key) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Count the failure in a single statement, restarting the count when the previous failure is outside
+	// the window, so that concurrent failures are never lost. The row stays locked until commit.
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO FailedAttempt (attempt_key, failure_count, last_failure_at)
+		VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+		failure_count = IF(last_failure_at > ?, failure_count + 1, 1), last_failure_at = VALUES(last_failure_at)`,
+		key.ID, now, now.Add(-failureWindow))
+	if err != nil {
+		return err
+	}
+	var failureCount int
+	if err := tx.QueryRow("SELECT failure_count FROM FailedAttempt WHERE attempt_key = ?", key.ID).Scan(&failureCount); err != nil {
+		return err
+	}
+
+	var lockedUntil sql.NullTime
+	if duration := lockDuration(failureCount, key.Threshold); duration > 0 {
+		lockedUntil = sql.NullTime{Time: now.Add(duration), Valid: true}
+	}
+	if _, err := tx.Exec("UPDATE FailedAttempt SET locked_until = ? WHERE attempt_key = ?", lockedUntil, key.ID); err != nil {
+		return err
+	}
+
+	if lockedUntil.Valid {
+		log.Printf("Locking %s until %s after %d failed attempts", key.ID, lockedUntil.Time.Format(time.RFC3339), failureCount)
+		_, err = tx.Exec(`
+			INSERT INTO LockoutAudit (attempt_key, failure_count, locked_until, ip_address)
+			VALUES (?, ?, ?, ?)`,
+			key.ID, failureCount, lockedUntil.Time, ClientIP(r))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockDuration returns how long a key is locked after failureCount failures within the window: not at
+// all below its threshold, then baseLockout doubled for every further failure, up to maxLockout
+func lockDuration(failureCount, threshold int) time.Duration {
+	if failureCount < threshold {
+		return 0
+	}
+	duration := baseLockout << uint(failureCount-threshold)
+	if duration > maxLockout || duration <= 0 {
+		return maxLockout
+	}
+	return duration
+}
+
+// Reset clears the failed-attempt counters of the keys after a successful attempt
+func Reset(keys ...Key) error {
+	for _, key := range keys {
+		if _, err := db.Exec("DELETE FROM FailedAttempt WHERE attempt_key = ?", key.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TooManyAttempts responds with 429 and a Retry-After header
+func TooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed attempts. Please try again later.", http.StatusTooManyRequests)
+}
@@ -0,0 +1,74 @@
+package lockout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		name         string
+		failureCount int
+		threshold    int
+		want         time.Duration
+	}{
+		{name: "no failures", failureCount: 0, threshold: accountThreshold, want: 0},
+		{name: "one below the account threshold", failureCount: 4, threshold: accountThreshold, want: 0},
+		{name: "at the account threshold", failureCount: 5, threshold: accountThreshold, want: time.Minute},
+		{name: "one past the threshold doubles", failureCount: 6, threshold: accountThreshold, want: 2 * time.Minute},
+		{name: "four past the threshold", failureCount: 9, threshold: accountThreshold, want: 16 * time.Minute},
+		{name: "last doubling below the cap", failureCount: 10, threshold: accountThreshold, want: 32 * time.Minute},
+		{name: "capped", failureCount: 11, threshold: accountThreshold, want: maxLockout},
+		{name: "capped when the shift overflows", failureCount: 200, threshold: accountThreshold, want: maxLockout},
+		{name: "below the IP threshold", failureCount: 19, threshold: ipThreshold, want: 0},
+		{name: "at the IP threshold", failureCount: 20, threshold: ipThreshold, want: time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := lockDuration(test.failureCount, test.threshold); got != test.want {
+				t.Errorf("lockDuration(%d, %d) = %v, want %v", test.failureCount, test.threshold, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	// Accounts are counted regardless of how the email is typed
+	if a, b := AccountKey("login", " Alice@Example.com "), AccountKey("login", "alice@example.com"); a != b {
+		t.Errorf("AccountKey differs by case and spacing: %q and %q", a.ID, b.ID)
+	}
+	if a, b := AccountKey("login", "alice@example.com"), AccountKey("password-reset", "alice@example.com"); a.ID == b.ID {
+		t.Errorf("AccountKey shares %q between actions", a.ID)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/authentication/login", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	if key := IPKey("login", r); key.ID != "login:ip:203.0.113.7" || key.Threshold != ipThreshold {
+		t.Errorf("IPKey = %+v, want login:ip:203.0.113.7 with threshold %d", key, ipThreshold)
+	}
+}
+
+func TestTooManyAttempts(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{retryAfter: time.Minute, want: "60"},
+		{retryAfter: 90*time.Second + time.Millisecond, want: "91"},
+		{retryAfter: time.Millisecond, want: "1"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		TooManyAttempts(w, test.retryAfter)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("TooManyAttempts(%v) status = %d, want %d", test.retryAfter, w.Code, http.StatusTooManyRequests)
+		}
+		if got := w.Header().Get("Retry-After"); got != test.want {
+			t.Errorf("TooManyAttempts(%v) Retry-After = %q, want %q", test.retryAfter, got, test.want)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
-	"authenticationMicroservice/registration"
 	"authenticationMicroservice/authentication"
+	"authenticationMicroservice/lockout"
+	"authenticationMicroservice/registration"
+	"common/emailtemplate"
+	"common/idempotency"
+	"common/mailer"
+	"common/middleware"
 	"log"
 	"net/http"
 
@@ -11,24 +16,67 @@ import (
 )
 
 func main() {
+	// Load the JWT secret and internal API key used to authenticate requests
+	if err := middleware.Init(); err != nil {
+		log.Fatalf("Error initialising middleware: %v", err)
+	}
+
+	// Connect to the database storing idempotency keys
+	if err := idempotency.Init(); err != nil {
+		log.Fatalf("Error initialising idempotency keys: %v", err)
+	}
+
+	// Select the mail backend emails are delivered with
+	if err := mailer.Init(); err != nil {
+		log.Fatalf("Error configuring mailer: %v", err)
+	}
+
+	// Load the email template overrides
+	if err := emailtemplate.Init(); err != nil {
+		log.Fatalf("Error loading email templates: %v", err)
+	}
+
+	// Connect to the authentication database and load the JWT secret
+	authentication.Init()
+	registration.Init()
+	lockout.Init()
+
+	// Tokens are checked against this service's own sessions rather than through its verify endpoint
+	middleware.ValidateToken = authentication.Identify
+
 	// Initialize the router
 	router := mux.NewRouter()
 
 	// Registration endpoints
 	router.HandleFunc("/api/v1/authentication/send-verification", registration.SendVerificationCode).Methods("POST")
-	router.HandleFunc("/api/v1/authentication/register-user", registration.RegisterUser).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/register-user", idempotency.Wrap(registration.RegisterUser)).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/password-reset/request", registration.RequestPasswordReset).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/password-reset/confirm", registration.ConfirmPasswordReset).Methods("POST")
 
-	// Authentication endpoint
+	// Authentication endpoints
 	router.HandleFunc("/api/v1/authentication/login", authentication.AuthenticateUser).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/refresh", authentication.RefreshToken).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/verify", authentication.VerifyToken).Methods("GET")
+	router.HandleFunc("/api/v1/authentication/logout", middleware.RequireAuth(authentication.Logout)).Methods("POST")
+	router.HandleFunc("/api/v1/authentication/logout-all", middleware.RequireAuth(authentication.LogoutAll)).Methods("POST")
 
+	// Administration endpoints
+	router.HandleFunc("/api/v1/authentication/users/{id}/roles", middleware.RequireRole(authentication.UpdateUserRoles, middleware.RoleAdmin)).Methods("PUT")
 
 	// Add CORS support
 	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://127.0.0.1:5050"}), // Add allowed origins here
-		handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"}), // Add allowed HTTP methods
-		handlers.AllowedHeaders([]string{"Content-Type"}),           // Add allowed headers
+		handlers.AllowedOrigins([]string{"http://127.0.0.1:5050"}),                            // Add allowed origins here
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "OPTIONS"}),                    // Add allowed HTTP methods
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Idempotency-Key"}), // Add allowed headers
+		handlers.ExposedHeaders([]string{"Retry-After"}),                                      // Expose lockout back-off to the browser
 	)(router)
 
+	// Purge expired idempotency keys
+	go idempotency.StartCleanup()
+
+	// Propagate reset passwords the userMicroservice has not accepted yet
+	go registration.StartPasswordSync()
+
 	// Start the server
 	log.Println("Authentication Microservice is running on port 5050...")
 	log.Fatal(http.ListenAndServe(":5050", corsHandler))
@@ -1,15 +1,20 @@
 package registration
 
 import (
+	"authenticationMicroservice/lockout"
 	"bytes"
+	"common/emailtemplate"
+	"common/mailer"
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"math/big"
 	"net/http"
-	"net/smtp"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -20,6 +25,7 @@ import (
 // User represents the structure of the data in the User table.
 type User struct {
 	ID               int    `json:"id"`
+	Name             string `json:"name"` // Only used to greet the user in the verification email
 	Email            string `json:"email"`
 	VerificationCode string `json:"verification_code"`
 	CreatedAt        string `json:"created_at"`
@@ -28,7 +34,20 @@ type User struct {
 // DB connection details
 var db *sql.DB
 
-func init() {
+const (
+	codeValidity    = 10 * time.Minute // How long an emailed verification or password reset code remains valid
+	resendCooldown  = time.Minute      // Minimum interval between two codes sent to the same email
+	maxCodeAttempts = 5                // Wrong guesses allowed before a code is invalidated
+
+	syncInterval   = 30 * time.Second // How often the worker looks for passwords the userMicroservice is missing
+	syncBatchSize  = 10               // Passwords synced per poll
+	syncLease      = time.Minute      // How long a claimed password is hidden from other workers while it is sent
+	syncMaxBackoff = time.Hour        // Upper bound for the retry delay, which doubles from syncInterval
+)
+
+// Init connects to the authentication database configured in .env. The authentication service calls
+// it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -62,21 +81,54 @@ func SendVerificationCode(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Parsed request: %+v", user)
+	log.Printf("Verification code requested for %s", user.Email)
+
+	// Enforce the resend cooldown so the endpoint cannot be used to spam an inbox
+	var dbCreatedAt string
+	err = db.QueryRow("SELECT created_at FROM User WHERE email = ? AND verification_code IS NOT NULL", user.Email).Scan(&dbCreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		createdAt, err := time.Parse("2006-01-02 15:04:05", dbCreatedAt)
+		if err != nil {
+			log.Printf("Error parsing created_at timestamp: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if wait := resendCooldown - time.Since(createdAt); wait > 0 {
+			log.Printf("Verification code for %s requested again within the cooldown.", user.Email)
+			tooManyRequests(w, wait, "Please wait before requesting another code")
+			return
+		}
+	}
 
 	// Generate a random 6-digit verification code
-	rand.Seed(time.Now().UnixNano())
-	verificationCode := fmt.Sprintf("%06d", rand.Intn(1000000))
-	log.Printf("Generated verification code: %s", verificationCode)
+	verificationCode, err := generateVerificationCode()
+	if err != nil {
+		log.Printf("Error generating verification code: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only a hash of the code is stored
+	hashedCode, err := bcrypt.GenerateFromPassword([]byte(verificationCode), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing verification code: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	// Insert or update email and verification code in the database
 	log.Println("Inserting or updating verification code in the database...")
 	_, err = db.Exec(`
-		INSERT INTO User (email, verification_code, created_at)
-		VALUES (?, ?, ?)
+		INSERT INTO User (email, verification_code, verification_attempts, created_at)
+		VALUES (?, ?, 0, ?)
 		ON DUPLICATE KEY UPDATE
-		verification_code = VALUES(verification_code), created_at = VALUES(created_at)
-	`, user.Email, verificationCode, time.Now().Format("2006-01-02 15:04:05"))
+		verification_code = VALUES(verification_code), verification_attempts = 0, created_at = VALUES(created_at)
+	`, user.Email, string(hashedCode), time.Now().Format("2006-01-02 15:04:05"))
 	if err != nil {
 		log.Printf("Error inserting or updating database: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -86,7 +138,7 @@ func SendVerificationCode(w http.ResponseWriter, r *http.Request) {
 
 	// Send the verification code via email
 	log.Printf("Sending verification code to %s...", user.Email)
-	err = sendEmail(user.Email, verificationCode)
+	err = sendCodeEmail(r, "verification_code", user.Email, user.Name, verificationCode)
 	if err != nil {
 		log.Printf("Error sending email: %v", err)
 		http.Error(w, "Failed to send email", http.StatusInternalServerError)
@@ -100,84 +152,41 @@ func SendVerificationCode(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "Verification code sent successfully"}`))
 }
 
-// sendEmail sends an email containing the verification code.
-func sendEmail(to, code string) error {
-	// SMTP configuration from .env
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-
-	// Email content (HTML)
-	from := "EcoDrive <" + smtpUser + ">"
-	subject := "Your Verification Code"
-	body := fmt.Sprintf(`
-		<!DOCTYPE html>
-		<html lang="en">
-		<head>
-			<meta charset="UTF-8">
-			<meta name="viewport" content="width=device-width, initial-scale=1.0">
-			<title>Verification Code</title>
-			<style>
-				body {
-					font-family: Arial, sans-serif;
-					background-color: #f9f9f9;
-					color: #333;
-					margin: 0;
-					padding: 0;
-				}
-				.container {
-					width: 100%%;
-					max-width: 600px;
-					margin: 0 auto;
-					background: #ffffff;
-					padding: 20px;
-					border-radius: 10px;
-					box-shadow: 0 4px 6px rgba(0, 0, 0, 0.1);
-				}
-				h1 {
-					color: #4CAF50;
-				}
-				.code {
-					font-size: 20px;
-					font-weight: bold;
-					color: #4CAF50;
-					margin: 20px 0;
-				}
-				.footer {
-					margin-top: 20px;
-					font-size: 12px;
-					color: #777;
-				}
-			</style>
-		</head>
-		<body>
-			<div class="container">
-				<h1>EcoDrive Verification Code</h1>
-				<p>Dear User,</p>
-				<p>Thank you for signing up with EcoDrive! Please use the following verification code to complete your registration:</p>
-				<div class="code">%s</div>
-				<p>If you did not request this email, please ignore it.</p>
-				<p>Best regards,</p>
-				<p>The EcoDrive Team</p>
-				<div class="footer">
-					<p>EcoDrive &copy; 2024. All Rights Reserved.</p>
-				</div>
-			</div>
-		</body>
-		</html>
-	`, code)
-
-	// Combine headers and body
-	message := fmt.Sprintf(
-		"From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n%s",
-		from, to, subject, body)
-
-	// Authentication
-	auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
-
-	// Send email
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, smtpUser, []string{to}, []byte(message))
+// generateVerificationCode returns a random 6-digit code drawn from crypto/rand.
+func generateVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// tooManyRequests responds with 429 and a Retry-After header.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// codeEmail holds the data rendered into verification and password reset emails.
+type codeEmail struct {
+	Name         string
+	Code         string
+	ValidMinutes int
+}
+
+// sendCodeEmail renders a one-time code email in the requester's language and sends it through the configured mailer.
+func sendCodeEmail(r *http.Request, template, to, name, code string) error {
+	rendered, err := emailtemplate.Render(template, r.Header.Get("Accept-Language"), codeEmail{
+		Name:         name,
+		Code:         code,
+		ValidMinutes: int(codeValidity / time.Minute),
+	})
+	if err != nil {
+		log.Printf("Error rendering %s email: %v", template, err)
+		return err
+	}
+
+	err = mailer.Send(mailer.Message{To: to, Subject: rendered.Subject, HTMLBody: rendered.HTML, TextBody: rendered.Text})
 	if err != nil {
 		log.Printf("Error sending email: %v", err)
 		return err
@@ -191,12 +200,12 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the incoming request
 	var user struct {
-		Email           string `json:"email"`
+		Email            string `json:"email"`
 		VerificationCode string `json:"verification_code"`
-		Name            string `json:"name"`
-		Password        string `json:"password"`
-		ContactNumber   string `json:"contact_number"`
-		Address         string `json:"address"`
+		Name             string `json:"name"`
+		Password         string `json:"password"`
+		ContactNumber    string `json:"contact_number"`
+		Address          string `json:"address"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
@@ -204,17 +213,24 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Parsed request: %+v", user)
+	log.Printf("Registration requested for %s", user.Email)
+
+	// Reject the attempt while the email or client IP is locked out
+	attemptKeys := []lockout.Key{lockout.AccountKey("verification", user.Email), lockout.IPKey("verification", r)}
+	if !checkLockout(w, attemptKeys) {
+		return
+	}
 
 	// Verify the provided verification code and timestamp
-	var dbVerificationCode string
+	var dbVerificationCode sql.NullString
 	var dbCreatedAt string
+	var attempts int
 
 	log.Println("Checking verification code in the database...")
 	err = db.QueryRow(
-		"SELECT verification_code, created_at FROM User WHERE email = ?",
+		"SELECT verification_code, verification_attempts, created_at FROM User WHERE email = ?",
 		user.Email,
-	).Scan(&dbVerificationCode, &dbCreatedAt)
+	).Scan(&dbVerificationCode, &attempts, &dbCreatedAt)
 	if err == sql.ErrNoRows {
 		log.Println("Email not found.")
 		http.Error(w, "Email not found or verification code invalid", http.StatusNotFound)
@@ -224,7 +240,14 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Database values: verification_code=%s, created_at=%s", dbVerificationCode, dbCreatedAt)
+	log.Printf("Database values: verification_attempts=%d, created_at=%s", attempts, dbCreatedAt)
+
+	// Codes are single-use and invalidated after too many wrong guesses
+	if !dbVerificationCode.Valid || attempts >= maxCodeAttempts {
+		log.Println("No active verification code.")
+		http.Error(w, "Verification code invalid or already used. Please request a new code", http.StatusUnauthorized)
+		return
+	}
 
 	// Convert dbCreatedAt from string to time.Time
 	createdAt, err := time.Parse("2006-01-02 15:04:05", dbCreatedAt)
@@ -234,15 +257,36 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Count the attempt before comparing, so that concurrent guesses cannot exceed the limit
+	result, err := db.Exec(`
+		UPDATE User SET verification_attempts = verification_attempts + 1
+		WHERE email = ? AND verification_code IS NOT NULL AND verification_attempts < ?`,
+		user.Email, maxCodeAttempts)
+	var claimed int64
+	if err == nil {
+		claimed, err = result.RowsAffected()
+	}
+	if err != nil {
+		log.Printf("Error recording verification attempt: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if claimed == 0 {
+		log.Println("No active verification code.")
+		http.Error(w, "Verification code invalid or already used. Please request a new code", http.StatusUnauthorized)
+		return
+	}
+
 	// Check if the verification code matches
-	if dbVerificationCode != user.VerificationCode {
+	if bcrypt.CompareHashAndPassword([]byte(dbVerificationCode.String), []byte(user.VerificationCode)) != nil {
 		log.Println("Verification code mismatch.")
+		recordFailedAttempt(r, attemptKeys)
 		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
 		return
 	}
 
 	// Check if the code is still valid (within 10 minutes)
-	if time.Since(createdAt) > 10*time.Minute {
+	if time.Since(createdAt) > codeValidity {
 		log.Println("Verification code expired.")
 		http.Error(w, "Verification code expired", http.StatusUnauthorized)
 		return
@@ -259,10 +303,10 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Password hashed successfully.")
 
 	// Update the local User table
-	log.Println("Updating local User table...")
+	log.Println("Updating local User table and consuming the verification code...")
 	_, err = db.Exec(`
 		UPDATE User
-		SET name = ?, password = ?, contact_number = ?, address = ?
+		SET name = ?, password = ?, contact_number = ?, address = ?, verification_code = NULL
 		WHERE email = ?`,
 		user.Name, string(hashedPassword), user.ContactNumber, user.Address, user.Email)
 	if err != nil {
@@ -272,6 +316,10 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Local User table updated successfully.")
 
+	if err := lockout.Reset(attemptKeys[0]); err != nil {
+		log.Printf("Error resetting failed attempts: %v", err)
+	}
+
 	// Call the userMicroservice to add the user record
 	log.Println("Calling userMicroservice to create the user record...")
 	err = callUserMicroservice(user.Name, user.Email, user.ContactNumber, user.Address, string(hashedPassword))
@@ -287,6 +335,28 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "User registered successfully in both systems"}`))
 }
 
+// checkLockout responds with 429 and returns false while any of the attempt keys is locked out
+func checkLockout(w http.ResponseWriter, attemptKeys []lockout.Key) bool {
+	retryAfter, err := lockout.Check(attemptKeys...)
+	if err != nil {
+		log.Printf("Error checking lockout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if retryAfter > 0 {
+		log.Printf("Attempt rejected, locked out for %s", retryAfter)
+		lockout.TooManyAttempts(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+// recordFailedAttempt counts a failed code guess against the email and client IP
+func recordFailedAttempt(r *http.Request, attemptKeys []lockout.Key) {
+	if err := lockout.RecordFailure(r, attemptKeys...); err != nil {
+		log.Printf("Error recording failed attempt: %v", err)
+	}
+}
 
 // callUserMicroservice sends a request to userMicroservice to create a new user record
 func callUserMicroservice(name, email, contactNumber, address, password string) error {
@@ -308,8 +378,16 @@ func callUserMicroservice(name, email, contactNumber, address, password string)
 		return err
 	}
 
-	// Create the HTTP POST request
-	resp, err := http.Post(userMicroserviceURL, "application/json", bytes.NewBuffer(payloadBytes))
+	// Create the HTTP POST request; user records may only be created by other microservices
+	req, err := http.NewRequest("POST", userMicroserviceURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Error sending request to userMicroservice: %v", err)
 		return err
@@ -325,3 +403,354 @@ func callUserMicroservice(name, email, contactNumber, address, password string)
 	log.Println("User record created successfully in userMicroservice.")
 	return nil
 }
+
+// RequestPasswordReset emails a one-time code that allows the user to choose a new password. Every
+// request gets the same response, whether or not the email is registered, within the resend cooldown
+// or failed to be sent, so that the endpoint cannot be used to discover accounts.
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /password-reset/request request...")
+
+	var request struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error parsing request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := sendPasswordReset(r, request.Email); err != nil {
+		log.Printf("Error sending password reset code: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "If the email is registered, a reset code has been sent"}`))
+}
+
+// sendPasswordReset stores a new reset code for a registered email and sends it, at most once per
+// resendCooldown for each email, registered or not, so that the endpoint cannot be used to spam an inbox
+func sendPasswordReset(r *http.Request, email string) error {
+	now := time.Now()
+	cooldownKey := strings.ToLower(strings.TrimSpace(email))
+	result, err := db.Exec("INSERT IGNORE INTO PasswordResetRequest (email, requested_at) VALUES (?, ?)", cooldownKey, now)
+	if err != nil {
+		return err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		result, err = db.Exec("UPDATE PasswordResetRequest SET requested_at = ? WHERE email = ? AND requested_at <= ?", now, cooldownKey, now.Add(-resendCooldown))
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			log.Println("Password reset requested again within the cooldown.")
+			return nil
+		}
+	}
+
+	// Only registered users with a password can reset it
+	var userID int
+	var name string
+	err = db.QueryRow("SELECT user_id, COALESCE(name, '') FROM User WHERE email = ? AND password IS NOT NULL", email).Scan(&userID, &name)
+	if err == sql.ErrNoRows {
+		log.Println("Password reset requested for an unknown email.")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	resetCode, err := generateVerificationCode()
+	if err != nil {
+		return err
+	}
+
+	// Only a hash of the code is stored
+	hashedCode, err := bcrypt.GenerateFromPassword([]byte(resetCode), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Storing password reset code in the database...")
+	_, err = db.Exec(`
+		INSERT INTO PasswordReset (user_id, reset_code, attempts, created_at, used_at)
+		VALUES (?, ?, 0, ?, NULL)
+		ON DUPLICATE KEY UPDATE
+		reset_code = VALUES(reset_code), attempts = 0, created_at = VALUES(created_at), used_at = NULL`,
+		userID, string(hashedCode), now)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending password reset code to %s...", email)
+	return sendCodeEmail(r, "password_reset", email, name, resetCode)
+}
+
+// ConfirmPasswordReset verifies a reset code, stores the new password and revokes all existing sessions.
+// The new password hash is queued for the userMicroservice in the same transaction, so that it is
+// propagated, and retried by StartPasswordSync, if and only if the reset commits.
+func ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /password-reset/confirm request...")
+
+	var request struct {
+		Email       string `json:"email"`
+		ResetCode   string `json:"reset_code"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error parsing request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.NewPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+
+	// Reject the attempt while the email or client IP is locked out
+	attemptKeys := []lockout.Key{lockout.AccountKey("password-reset", request.Email), lockout.IPKey("password-reset", r)}
+	if !checkLockout(w, attemptKeys) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Verify the reset code and that it was issued within the validity window
+	var userID, attempts int
+	var resetCode string
+	var withinWindow, unused bool
+	err = tx.QueryRow(`
+		SELECT u.user_id, pr.reset_code, pr.attempts, pr.created_at > ?, pr.used_at IS NULL
+		FROM PasswordReset pr
+		JOIN User u ON pr.user_id = u.user_id
+		WHERE u.email = ? FOR UPDATE`,
+		time.Now().Add(-codeValidity), request.Email).Scan(&userID, &resetCode, &attempts, &withinWindow, &unused)
+	if err == sql.ErrNoRows {
+		log.Println("No password reset requested for this email.")
+		http.Error(w, "Invalid reset code", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if !unused || attempts >= maxCodeAttempts {
+		log.Println("Reset code already used or invalidated.")
+		http.Error(w, "Reset code invalid or already used. Please request a new code", http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(resetCode), []byte(request.ResetCode)) != nil {
+		log.Println("Reset code mismatch.")
+		recordFailedAttempt(r, attemptKeys)
+		_, err := tx.Exec("UPDATE PasswordReset SET attempts = attempts + 1 WHERE user_id = ?", userID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error recording reset attempt: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Invalid reset code", http.StatusUnauthorized)
+		return
+	}
+	if !withinWindow {
+		log.Println("Reset code expired.")
+		http.Error(w, "Reset code expired", http.StatusUnauthorized)
+		return
+	}
+
+	// Hash the new password
+	log.Println("Hashing the new password...")
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Store the new password, queue it for the userMicroservice, consume the code and revoke every
+	// existing session. A later reset replaces a hash that has not been propagated yet.
+	now := time.Now()
+	_, err = tx.Exec("UPDATE User SET password = ? WHERE user_id = ?", string(hashedPassword), userID)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO PasswordSync (user_id, email, password_hash, status, next_attempt_at)
+			VALUES (?, ?, ?, 'Pending', ?)
+			ON DUPLICATE KEY UPDATE email = VALUES(email), password_hash = VALUES(password_hash), status = 'Pending',
+				attempts = 0, next_attempt_at = VALUES(next_attempt_at), last_error = NULL`,
+			userID, request.Email, string(hashedPassword), now)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE PasswordReset SET used_at = ? WHERE user_id = ?", now, userID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE Authentication SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE RefreshToken SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Local password updated and sessions revoked.")
+
+	if err := lockout.Reset(attemptKeys[0]); err != nil {
+		log.Printf("Error resetting failed attempts: %v", err)
+	}
+
+	// Propagate the new password hash to the userMicroservice straight away. A failure leaves it
+	// queued for the sync worker, as the reset itself has already taken effect.
+	log.Println("Calling userMicroservice to update the password...")
+	if err := syncPassword(userID); err != nil {
+		log.Printf("Error propagating password of user %d, left for retry: %v", userID, err)
+	}
+
+	log.Println("Password reset successful.")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Password reset successfully"}`))
+}
+
+// callUserMicroserviceUpdatePassword sends the new password hash to userMicroservice
+func callUserMicroserviceUpdatePassword(email, password string) error {
+	userMicroserviceURL := "http://user:5100/api/v1/user/password"
+
+	payloadBytes, err := json.Marshal(map[string]string{
+		"email":    email,
+		"password": password,
+	})
+	if err != nil {
+		log.Printf("Error marshalling payload: %v", err)
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", userMicroserviceURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending request to userMicroservice: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Unexpected status from userMicroservice: %v", resp.Status)
+		return fmt.Errorf("failed to update password, status: %v", resp.Status)
+	}
+
+	log.Println("Password updated successfully in userMicroservice.")
+	return nil
+}
+
+// StartPasswordSync sends password hashes the userMicroservice is missing until the process exits
+func StartPasswordSync() {
+	log.Println("Starting password sync worker...")
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := syncPendingPasswords(); err != nil {
+			log.Printf("Error syncing passwords: %v", err)
+		}
+	}
+}
+
+// syncPendingPasswords attempts up to syncBatchSize due password hashes
+func syncPendingPasswords() error {
+	rows, err := db.Query(`
+		SELECT user_id FROM PasswordSync
+		WHERE status = 'Pending' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at
+		LIMIT ?`,
+		time.Now(), syncBatchSize)
+	if err != nil {
+		return err
+	}
+	var due []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range due {
+		if err := syncPassword(userID); err != nil {
+			log.Printf("Password sync of user %d failed: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// syncPassword claims the queued password hash of a user and sends it to the userMicroservice. The
+// claim pushes the next attempt back by syncLease, so that no other worker sends it in the meantime,
+// and no lock is held while the userMicroservice is called. The hash is only marked as synced if no
+// later reset has replaced it. It does nothing if the hash is not pending or another worker has
+// claimed it.
+func syncPassword(userID int) error {
+	now := time.Now()
+	result, err := db.Exec(`
+		UPDATE PasswordSync SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE user_id = ? AND status = 'Pending' AND next_attempt_at <= ?`,
+		now.Add(syncLease), userID, now)
+	if err != nil {
+		return err
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		return nil
+	}
+
+	var email, passwordHash string
+	var attempts int
+	err = db.QueryRow("SELECT email, password_hash, attempts FROM PasswordSync WHERE user_id = ?", userID).
+		Scan(&email, &passwordHash, &attempts)
+	if err != nil {
+		return err
+	}
+
+	if sendErr := callUserMicroserviceUpdatePassword(email, passwordHash); sendErr != nil {
+		_, err = db.Exec("UPDATE PasswordSync SET next_attempt_at = ?, last_error = ? WHERE user_id = ? AND password_hash = ?",
+			time.Now().Add(syncBackoff(attempts)), sendErr.Error(), userID, passwordHash)
+		if err != nil {
+			return err
+		}
+		return sendErr
+	}
+
+	_, err = db.Exec("UPDATE PasswordSync SET status = 'Completed', synced_at = ?, last_error = NULL WHERE user_id = ? AND password_hash = ?",
+		time.Now(), userID, passwordHash)
+	return err
+}
+
+// syncBackoff returns the delay before the next attempt after the given number of failures
+func syncBackoff(attempts int) time.Duration {
+	delay := syncInterval << uint(attempts-1)
+	if delay > syncMaxBackoff || delay <= 0 {
+		return syncMaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,162 @@
+package emailtemplate
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/joho/godotenv"
+)
+
+// DefaultLocale is used when no supported locale is requested
+const DefaultLocale = "en"
+
+// supportedLocales lists the locales with template variants
+var supportedLocales = []string{"en", "zh", "ms", "ta"}
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+var (
+	overrideTemplates fs.FS // Templates from EMAIL_TEMPLATE_DIR that take precedence over the embedded ones
+	cacheMu           sync.Mutex
+	cache             = map[string]*parsedTemplate{}
+)
+
+// parsedTemplate holds the HTML and plain-text variants of a template for one locale
+type parsedTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// Rendered represents an email rendered from a template
+type Rendered struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Init loads the template overrides configured in .env. Each service that renders emails calls it
+// from main.
+func Init() error {
+	if err := godotenv.Load(".env"); err != nil {
+		return fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	// Templates in EMAIL_TEMPLATE_DIR override the embedded defaults file by file
+	if dir := os.Getenv("EMAIL_TEMPLATE_DIR"); dir != "" {
+		log.Printf("Loading email template overrides from %s", dir)
+		overrideTemplates = os.DirFS(dir)
+	}
+	return nil
+}
+
+// NegotiateLocale returns the first supported locale in an Accept-Language header, or DefaultLocale
+func NegotiateLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		primary := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		for _, locale := range supportedLocales {
+			if primary == locale {
+				return locale
+			}
+		}
+	}
+	return DefaultLocale
+}
+
+// Render renders the subject, HTML and plain-text bodies of the named template in the given locale.
+// Locales without a variant of the template fall back to DefaultLocale.
+func Render(name, locale string, data interface{}) (Rendered, error) {
+	tmpl, err := load(name, NegotiateLocale(locale))
+	if err != nil {
+		return Rendered{}, err
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Rendered{}, err
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return Rendered{}, err
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return Rendered{}, err
+	}
+
+	return Rendered{
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// load parses and caches the template variants for a locale
+func load(name, locale string) (*parsedTemplate, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	key := locale + "/" + name
+	if tmpl, ok := cache[key]; ok {
+		return tmpl, nil
+	}
+
+	textSource, err := readLocalized(name+".txt.tmpl", locale)
+	if err != nil {
+		return nil, err
+	}
+	htmlSource, err := readLocalized(name+".html.tmpl", locale)
+	if err != nil {
+		return nil, err
+	}
+	layoutSource, err := readTemplate("layout.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := texttemplate.New(name).Parse(string(textSource))
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New("layout").Funcs(htmltemplate.FuncMap{
+		"locale": func() string { return locale },
+	}).Parse(string(layoutSource))
+	if err == nil {
+		_, err = html.Parse(string(htmlSource))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &parsedTemplate{html: html, text: text}
+	cache[key] = tmpl
+	return tmpl, nil
+}
+
+// readLocalized reads a template file for the locale, falling back to DefaultLocale
+func readLocalized(file, locale string) ([]byte, error) {
+	source, err := readTemplate(path.Join(locale, file))
+	if err != nil && locale != DefaultLocale {
+		log.Printf("Template %s not available in %s, falling back to %s", file, locale, DefaultLocale)
+		return readTemplate(path.Join(DefaultLocale, file))
+	}
+	return source, err
+}
+
+// readTemplate reads a template file from the override directory or the embedded defaults
+func readTemplate(file string) ([]byte, error) {
+	if overrideTemplates != nil {
+		if source, err := fs.ReadFile(overrideTemplates, file); err == nil {
+			return source, nil
+		}
+	}
+	return fs.ReadFile(embeddedTemplates, path.Join("templates", file))
+}
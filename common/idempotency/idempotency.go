@@ -0,0 +1,257 @@
+package idempotency
+
+import (
+	"bytes"
+	"common/middleware"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+// HeaderName is the request header carrying the client's idempotency key
+const HeaderName = "Idempotency-Key"
+
+const (
+	maxKeyLength    = 255             // Longest idempotency key accepted
+	cleanupInterval = time.Hour       // How often expired keys are purged
+	processingLease = 2 * time.Minute // How long a request may run before a repeat can take over its key
+)
+
+// retention is how long a stored response is replayed, configurable with IDEMPOTENCY_RETENTION_HOURS
+var retention = 24 * time.Hour
+
+// Init connects to the database configured in .env that stores idempotency keys. Each service that
+// wraps handlers with Wrap calls it from main.
+func Init() error {
+	if err := godotenv.Load(".env"); err != nil {
+		return fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		return errors.New("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (idempotency package)...")
+	var err error
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		return fmt.Errorf("error connecting to database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("database connection test failed: %v", err)
+	}
+	log.Println("Database connection (idempotency package) successful.")
+
+	if hours := os.Getenv("IDEMPOTENCY_RETENTION_HOURS"); hours != "" {
+		value, err := strconv.Atoi(hours)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid IDEMPOTENCY_RETENTION_HOURS: %q", hours)
+		}
+		retention = time.Duration(value) * time.Hour
+	}
+	return nil
+}
+
+// storedResponse holds the first response to an idempotency key
+type storedResponse struct {
+	requestHash string
+	status      string
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// responseRecorder passes a response through to the client while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Wrap makes a handler idempotent for requests carrying an Idempotency-Key header. The first response
+// to a key is stored per caller and replayed for repeats of the same request within the retention
+// window. Reusing a key for a different request is rejected with 422, and repeats that arrive while
+// the first request is still running are rejected with 409 until its processingLease runs out, after
+// which a request that crashed is retried. Server errors are not stored, so the client may retry them
+// with the same key. Requests without the header are passed straight through.
+func Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HeaderName)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		// Fingerprint the request so that a reused key with a different request is detected
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+		scope := callerScope(r, requestHash)
+
+		claimed, err := claim(scope, key, requestHash)
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			replay(w, scope, key, requestHash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		complete(scope, key, rec)
+	}
+}
+
+// callerScope returns the namespace of the caller's keys: the authenticated user, or for endpoints that
+// do not require a login the request itself, so that anonymous callers choosing the same key cannot
+// replay each other's responses
+func callerScope(r *http.Request, requestHash string) string {
+	if identity, ok := middleware.IdentityFromContext(r.Context()); ok {
+		return "user:" + strconv.Itoa(identity.UserID)
+	}
+	return "anonymous:" + requestHash[:32]
+}
+
+// claim records a key as being processed for processingLease, returning false if it was already
+// recorded and has not expired
+func claim(scope, key, requestHash string) (bool, error) {
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO IdempotencyKeys (scope, idempotency_key, request_hash, status, expires_at)
+		VALUES (?, ?, ?, 'Processing', ?)`,
+		scope, key, requestHash, now.Add(processingLease))
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		// Take over an expired key or the lease of a request that never finished; otherwise the caller
+		// replays the stored response
+		result, err := db.Exec(`
+			UPDATE IdempotencyKeys
+			SET request_hash = ?, status = 'Processing', response_status = NULL, content_type = NULL, response_body = NULL, expires_at = ?
+			WHERE scope = ? AND idempotency_key = ? AND expires_at <= ?`,
+			requestHash, now.Add(processingLease), scope, key, now)
+		if err != nil {
+			return false, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		return rowsAffected == 1, err
+	}
+	return err == nil, err
+}
+
+// replay writes the stored response to a repeated request
+func replay(w http.ResponseWriter, scope, key, requestHash string) {
+	var stored storedResponse
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err := db.QueryRow(`
+		SELECT request_hash, status, response_status, content_type, response_body
+		FROM IdempotencyKeys WHERE scope = ? AND idempotency_key = ?`, scope, key).
+		Scan(&stored.requestHash, &stored.status, &statusCode, &contentType, &stored.body)
+	if err == sql.ErrNoRows {
+		// The first request failed with a server error in the meantime, so the client may retry
+		http.Error(w, "The original request with this Idempotency-Key failed, please retry", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving idempotency key: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	stored.statusCode, stored.contentType = int(statusCode.Int64), contentType.String
+
+	if stored.requestHash != requestHash {
+		log.Printf("Rejected reuse of idempotency key by %s for a different request", scope)
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.status != "Completed" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Replaying response to idempotency key of %s", scope)
+	if stored.contentType != "" {
+		w.Header().Set("Content-Type", stored.contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.statusCode)
+	w.Write(stored.body)
+}
+
+// complete stores the response to a claimed key for the retention window, or releases the key if the
+// handler failed
+func complete(scope, key string, rec *responseRecorder) {
+	statusCode := rec.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	var err error
+	if statusCode >= http.StatusInternalServerError {
+		_, err = db.Exec("DELETE FROM IdempotencyKeys WHERE scope = ? AND idempotency_key = ?", scope, key)
+	} else {
+		_, err = db.Exec(`
+			UPDATE IdempotencyKeys SET status = 'Completed', response_status = ?, content_type = ?, response_body = ?, expires_at = ?
+			WHERE scope = ? AND idempotency_key = ?`,
+			statusCode, rec.Header().Get("Content-Type"), rec.body.Bytes(), time.Now().Add(retention), scope, key)
+	}
+	if err != nil {
+		log.Printf("Error storing response to idempotency key: %v", err)
+	}
+}
+
+// StartCleanup purges expired idempotency keys until the process exits
+func StartCleanup() {
+	log.Println("Starting idempotency key cleanup...")
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := db.Exec("DELETE FROM IdempotencyKeys WHERE expires_at <= ?", time.Now())
+		if err != nil {
+			log.Printf("Error purging expired idempotency keys: %v", err)
+			continue
+		}
+		if purged, _ := result.RowsAffected(); purged > 0 {
+			log.Printf("Purged %d expired idempotency keys.", purged)
+		}
+	}
+}
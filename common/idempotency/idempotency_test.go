@@ -0,0 +1,179 @@
+package idempotency
+
+import (
+	"common/middleware"
+	"common/sqltest"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	testPath = "/api/v1/vehicle/booking"
+	testBody = `{"vehicle_id": 3}`
+)
+
+// requestHash returns the fingerprint Wrap computes for a POST of body to testPath
+func requestHash(body string) string {
+	hash := sha256.Sum256([]byte("POST " + testPath + "\n" + body))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestWrap(t *testing.T) {
+	hash := requestHash(testBody)
+	scope := "anonymous:" + hash[:32]
+	claimed := sqltest.Statement{
+		Contains:     "INSERT INTO IdempotencyKeys",
+		Args:         []driver.Value{scope, "key-1", hash, sqltest.Any},
+		RowsAffected: 1,
+	}
+	duplicate := sqltest.Statement{Contains: "INSERT INTO IdempotencyKeys", Err: &mysql.MySQLError{Number: 1062}}
+	notExpired := sqltest.Statement{Contains: "UPDATE IdempotencyKeys", RowsAffected: 0}
+	stored := func(requestHash, status string) sqltest.Statement {
+		return sqltest.Statement{
+			Contains: "SELECT request_hash",
+			Args:     []driver.Value{scope, "key-1"},
+			Columns:  []string{"request_hash", "status", "response_status", "content_type", "response_body"},
+			Rows:     [][]driver.Value{{requestHash, status, int64(http.StatusCreated), "application/json", []byte(`{"booking_id": 1}`)}},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		key          string
+		handlerCode  int
+		statements   []sqltest.Statement
+		wantCalled   bool
+		wantCode     int
+		wantReplayed bool
+	}{
+		{
+			name:        "no key",
+			handlerCode: http.StatusCreated,
+			wantCalled:  true,
+			wantCode:    http.StatusCreated,
+		},
+		{
+			name:        "first request stores its response",
+			key:         "key-1",
+			handlerCode: http.StatusCreated,
+			statements: []sqltest.Statement{claimed, {
+				Contains: "SET status = 'Completed'",
+				Args:     []driver.Value{int64(http.StatusCreated), "application/json", []byte(`{"booking_id": 1}`), sqltest.Any, scope, "key-1"},
+			}},
+			wantCalled: true,
+			wantCode:   http.StatusCreated,
+		},
+		{
+			name:        "server error releases the key",
+			key:         "key-1",
+			handlerCode: http.StatusInternalServerError,
+			statements: []sqltest.Statement{claimed, {
+				Contains: "DELETE FROM IdempotencyKeys",
+				Args:     []driver.Value{scope, "key-1"},
+			}},
+			wantCalled: true,
+			wantCode:   http.StatusInternalServerError,
+		},
+		{
+			name:         "repeat replays the stored response",
+			key:          "key-1",
+			statements:   []sqltest.Statement{duplicate, notExpired, stored(hash, "Completed")},
+			wantCode:     http.StatusCreated,
+			wantReplayed: true,
+		},
+		{
+			name:       "repeat while the first request runs",
+			key:        "key-1",
+			statements: []sqltest.Statement{duplicate, notExpired, stored(hash, "Processing")},
+			wantCode:   http.StatusConflict,
+		},
+		{
+			name:       "key reused for a different request",
+			key:        "key-1",
+			statements: []sqltest.Statement{duplicate, notExpired, stored(requestHash(`{"vehicle_id": 4}`), "Completed")},
+			wantCode:   http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "expired key is taken over",
+			key:         "key-1",
+			handlerCode: http.StatusCreated,
+			statements: []sqltest.Statement{duplicate, {Contains: "UPDATE IdempotencyKeys", RowsAffected: 1}, {
+				Contains: "SET status = 'Completed'",
+			}},
+			wantCalled: true,
+			wantCode:   http.StatusCreated,
+		},
+		{
+			name:     "key too long",
+			key:      strings.Repeat("k", maxKeyLength+1),
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db = sqltest.Open(t, test.statements...)
+			called := false
+			handler := Wrap(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.handlerCode)
+				w.Write([]byte(`{"booking_id": 1}`))
+			})
+
+			r := httptest.NewRequest(http.MethodPost, testPath, strings.NewReader(testBody))
+			if test.key != "" {
+				r.Header.Set(HeaderName, test.key)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if called != test.wantCalled {
+				t.Errorf("handler called = %v, want %v", called, test.wantCalled)
+			}
+			if w.Code != test.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, test.wantCode)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != test.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, test.wantReplayed)
+			}
+			if test.wantReplayed && w.Body.String() != `{"booking_id": 1}` {
+				t.Errorf("replayed body = %q, want the stored response", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWrapScopesKeysByUser(t *testing.T) {
+	validateToken := middleware.ValidateToken
+	defer func() { middleware.ValidateToken = validateToken }()
+	middleware.ValidateToken = func(token string) (middleware.Identity, error) {
+		return middleware.Identity{UserID: 5}, nil
+	}
+
+	db = sqltest.Open(t, sqltest.Statement{
+		Contains:     "INSERT INTO IdempotencyKeys",
+		Args:         []driver.Value{"user:5", "key-1", requestHash(testBody), sqltest.Any},
+		RowsAffected: 1,
+	}, sqltest.Statement{Contains: "SET status = 'Completed'"})
+
+	handler := middleware.RequireAuth(Wrap(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	r := httptest.NewRequest(http.MethodPost, testPath, strings.NewReader(testBody))
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set(HeaderName, "key-1")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusCreated)
+	}
+}
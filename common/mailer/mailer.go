@@ -0,0 +1,358 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Attachment represents a file attached to an email
+type Attachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// Message represents an email to be delivered by a Mailer
+type Message struct {
+	To          string
+	Subject     string
+	HTMLBody    string
+	TextBody    string // Optional plain-text alternative to HTMLBody
+	Attachments []Attachment
+}
+
+// Mailer delivers email messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var defaultMailer Mailer
+
+// Init selects the mail backend configured in .env. Each service that sends email calls it from main.
+func Init() error {
+	if err := godotenv.Load(".env"); err != nil {
+		return fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	var err error
+	defaultMailer, err = NewFromEnv()
+	return err
+}
+
+// NewFromEnv returns the backend selected by MAIL_BACKEND: smtp (default), file or memory
+func NewFromEnv() (Mailer, error) {
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "smtp":
+		log.Println("Using SMTP mail backend.")
+		return NewSMTPMailerFromEnv(), nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		log.Printf("Using file mail backend in %s.", dir)
+		return NewFileMailer(dir, os.Getenv("SMTP_FROM"))
+	case "memory":
+		log.Println("Using in-memory mail backend.")
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+// Send delivers a message through the default mailer
+func Send(msg Message) error {
+	return defaultMailer.Send(msg)
+}
+
+// SetDefault replaces the default mailer, e.g. with a MemoryMailer in tests
+func SetDefault(m Mailer) {
+	defaultMailer = m
+}
+
+// SMTPMailer delivers messages through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	TLSMode  string // "starttls" (default), "tls" for implicit TLS, or "none"
+	User     string
+	Password string
+	From     string
+}
+
+// NewSMTPMailerFromEnv configures an SMTPMailer from SMTP_HOST, SMTP_PORT, SMTP_TLS, SMTP_USER, SMTP_PASSWORD and SMTP_FROM
+func NewSMTPMailerFromEnv() *SMTPMailer {
+	m := &SMTPMailer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		TLSMode:  os.Getenv("SMTP_TLS"),
+		User:     os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	if m.Host == "" {
+		m.Host = "smtp.gmail.com"
+	}
+	if m.Port == "" {
+		m.Port = "587"
+	}
+	if m.TLSMode == "" {
+		m.TLSMode = "starttls"
+	}
+	return m
+}
+
+// Send delivers the message to the SMTP server
+func (m *SMTPMailer) Send(msg Message) error {
+	from := senderAddress(m.From, m.User)
+	data, err := msg.Bytes(from)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	if m.TLSMode == "tls" {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.TLSMode == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.User != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.User, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(envelopeAddress(from)); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Email sent to %s via SMTP.", msg.To)
+	return client.Quit()
+}
+
+// FileMailer writes each message as an .eml file into a maildir-style directory for local development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// NewFileMailer creates the tmp and new subdirectories of dir and returns a FileMailer writing into them
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+// Send writes the message into the new subdirectory
+func (m *FileMailer) Send(msg Message) error {
+	data, err := msg.Bytes(senderAddress(m.From, ""))
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.eml", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write to tmp first so readers of new never see a partial file
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(m.Dir, "new", name)); err != nil {
+		return err
+	}
+
+	log.Printf("Email to %s written to %s.", msg.To, filepath.Join(m.Dir, "new", name))
+	return nil
+}
+
+// MemoryMailer captures messages in memory for tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemoryMailer returns an empty MemoryMailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send records the message
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	log.Printf("Email to %s captured in memory.", msg.To)
+	return nil
+}
+
+// Messages returns a copy of the captured messages
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset discards the captured messages
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
+
+// Bytes renders the message as a MIME document sent from the given address
+func (msg Message) Bytes(from string) ([]byte, error) {
+	message := bytes.NewBuffer(nil)
+	message.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	message.WriteString(fmt.Sprintf("To: %s\r\n", msg.To))
+	message.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", msg.Subject)))
+	message.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	message.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(msg.Attachments) == 0 {
+		if err := msg.writeBody(message); err != nil {
+			return nil, err
+		}
+		return message.Bytes(), nil
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return nil, err
+	}
+	message.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", boundary))
+	message.WriteString("\r\n--" + boundary + "\r\n")
+	if err := msg.writeBody(message); err != nil {
+		return nil, err
+	}
+	for _, attachment := range msg.Attachments {
+		message.WriteString("\r\n--" + boundary + "\r\n")
+		message.WriteString(fmt.Sprintf("Content-Type: %s\r\n", attachment.ContentType))
+		message.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", attachment.FileName))
+		message.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		message.WriteString(encodeToBase64(attachment.Data))
+	}
+	message.WriteString("\r\n--" + boundary + "--\r\n")
+
+	return message.Bytes(), nil
+}
+
+// writeBody writes the Content-Type header and content of the message body, using
+// multipart/alternative when a plain-text version is available
+func (msg Message) writeBody(message *bytes.Buffer) error {
+	if msg.TextBody == "" {
+		message.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+		message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+		message.WriteString(msg.HTMLBody)
+		return nil
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return err
+	}
+	message.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%s\r\n", boundary))
+	message.WriteString("\r\n--" + boundary + "\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(msg.TextBody)
+	message.WriteString("\r\n--" + boundary + "\r\n")
+	message.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(msg.HTMLBody)
+	message.WriteString("\r\n--" + boundary + "--\r\n")
+	return nil
+}
+
+// senderAddress returns the configured From header, defaulting to the SMTP user
+func senderAddress(from, user string) string {
+	if from != "" {
+		return from
+	}
+	if user == "" {
+		user = "no-reply@ecodrive.local"
+	}
+	return "EcoDrive <" + user + ">"
+}
+
+// envelopeAddress extracts the bare address from a From header such as "EcoDrive <a@b.c>"
+func envelopeAddress(from string) string {
+	if start, end := strings.LastIndex(from, "<"), strings.LastIndex(from, ">"); start >= 0 && end > start {
+		return from[start+1 : end]
+	}
+	return from
+}
+
+// newBoundary returns a random MIME boundary
+func newBoundary() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "EcoDrive-" + hex.EncodeToString(buf), nil
+}
+
+// encodeToBase64 encodes bytes to base64 wrapped at 76 characters per line
+func encodeToBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+	return wrapped.String()
+}
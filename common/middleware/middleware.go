@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/joho/godotenv"
+)
+
+type contextKey string
+
+const identityKey contextKey = "identity"
+
+// verifyURL is the authentication service endpoint that checks a token against the Authentication table
+const verifyURL = "http://authentication:5050/api/v1/authentication/verify"
+
+var jwtSecret string      // JWT secret key shared with the authentication service
+var internalAPIKey string // Shared key that other microservices present for internal-only endpoints
+
+// ErrInvalidToken is returned by ValidateToken for tokens that are not an active session
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ValidateToken checks the bearer tokens of RequireAuth, returning the identity of their holder. It
+// confirms each token with the authentication service, which replaces it with a check against its
+// own sessions.
+var ValidateToken = validateToken
+
+// Init loads the JWT secret and the internal API key from .env. Each service calls it from main before
+// serving requests.
+func Init() error {
+	if err := godotenv.Load(".env"); err != nil {
+		return fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	jwtSecret = os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return errors.New("JWT_SECRET not set in .env")
+	}
+
+	internalAPIKey = os.Getenv("INTERNAL_API_KEY")
+	if internalAPIKey == "" {
+		return errors.New("INTERNAL_API_KEY not set in .env")
+	}
+	return nil
+}
+
+// Roles that can be granted to a user in the authentication service
+const (
+	RoleCustomer      = "customer"
+	RoleFleetOperator = "fleet_operator"
+	RoleFinance       = "finance"
+	RoleAdmin         = "admin"
+)
+
+// Identity represents the authenticated caller extracted from a verified JWT
+type Identity struct {
+	UserID int      `json:"user_id"`
+	Name   string   `json:"name"`
+	Email  string   `json:"email"`
+	Roles  []string `json:"roles"`
+}
+
+// HasRole reports whether the identity holds any of the given roles
+func (identity Identity) HasRole(roles ...string) bool {
+	for _, held := range identity.Roles {
+		for _, role := range roles {
+			if held == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenClaims mirrors the claims minted by the authentication service
+type tokenClaims struct {
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// RequireAuth rejects requests without a valid bearer token and injects the caller's identity into the request context
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			log.Println("Missing or invalid Authorization header.")
+			http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+		if err == ErrInvalidToken {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("Error validating token: %v", err)
+			http.Error(w, "Failed to verify token", http.StatusBadGateway)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), identityKey, identity)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequireRole rejects requests unless the authenticated caller holds at least one of the given roles
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := IdentityFromContext(r.Context())
+		if !identity.HasRole(roles...) {
+			log.Printf("Rejected request from user_id=%d without any of the roles %v", identity.UserID, roles)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireInternal rejects requests that do not carry the internal API key shared between microservices
+func RequireInternal(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !IsInternal(r) {
+			log.Println("Rejected internal request with a missing or invalid API key.")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireInternalOrRole accepts requests from other microservices carrying the internal API key,
+// and otherwise requires an authenticated caller holding at least one of the given roles
+func RequireInternalOrRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	withRole := RequireRole(next, roles...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if IsInternal(r) {
+			next(w, r)
+			return
+		}
+		withRole(w, r)
+	}
+}
+
+// IsInternal reports whether the request carries the internal API key, for handlers that accept some
+// fields only from other microservices
+func IsInternal(r *http.Request) bool {
+	providedKey := r.Header.Get("X-Internal-Api-Key")
+	return internalAPIKey != "" && subtle.ConstantTimeCompare([]byte(providedKey), []byte(internalAPIKey)) == 1
+}
+
+// IdentityFromContext returns the identity injected by RequireAuth
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// AuthorizeUser reports whether the authenticated caller is the user identified by userID
+func AuthorizeUser(r *http.Request, userID int) bool {
+	identity, ok := IdentityFromContext(r.Context())
+	return ok && identity.UserID == userID
+}
+
+// AuthorizeUserOrRole reports whether the authenticated caller is the user identified by userID
+// or holds one of the given roles, such as staff acting on a customer's behalf
+func AuthorizeUserOrRole(r *http.Request, userID int, roles ...string) bool {
+	identity, ok := IdentityFromContext(r.Context())
+	return ok && (identity.UserID == userID || identity.HasRole(roles...))
+}
+
+// validateToken checks the HS256 signature and expiry locally, then confirms with the
+// authentication service that the token is still an active session
+func validateToken(tokenString string) (Identity, error) {
+	claims := &tokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		log.Printf("Token verification failed: %v", err)
+		return Identity{}, ErrInvalidToken
+	}
+
+	req, err := http.NewRequest("GET", verifyURL, nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return Identity{}, ErrInvalidToken
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, errors.New("unexpected status from authentication service: " + resp.Status)
+	}
+
+	var identity Identity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return Identity{}, err
+	}
+	if identity.UserID != claims.UserID {
+		log.Printf("Token user_id %d does not match verified user_id %d", claims.UserID, identity.UserID)
+		return Identity{}, ErrInvalidToken
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,196 @@
+// Package sqltest provides a database/sql driver that answers statements from a script, so that code
+// running SQL can be tested without a database server.
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Any matches any value of a statement argument, e.g. the current time
+var Any = anyValue{}
+
+type anyValue struct{}
+
+// Statement is a statement the code under test is expected to run, and the result it gets
+type Statement struct {
+	Contains     string           // Text the statement must contain
+	Args         []driver.Value   // Arguments it must be run with after conversion (ints as int64), unchecked if nil
+	Columns      []string         // Columns of the rows returned by a query
+	Rows         [][]driver.Value // Rows returned by a query; a query without rows scans as sql.ErrNoRows
+	RowsAffected int64            // Rows affected by an exec
+	LastInsertID int64            // ID returned by an exec that inserts a row
+	Err          error            // Error returned instead of a result
+}
+
+// Open returns a database that expects the statements in order. Any other statement fails the test,
+// as does any expected statement that has not run by the end of the test. Transactions begin, commit
+// and roll back without statements of their own.
+func Open(t testing.TB, statements ...Statement) *sql.DB {
+	t.Helper()
+	s := &script{t: t, statements: statements}
+	db := sql.OpenDB(s)
+	t.Cleanup(func() {
+		db.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, statement := range s.statements[s.next:] {
+			t.Errorf("expected statement containing %q was not run", statement.Contains)
+		}
+	})
+	return db
+}
+
+// script is the connector of a scripted database, shared by all its connections
+type script struct {
+	t          testing.TB
+	mu         sync.Mutex
+	statements []Statement
+	next       int
+}
+
+func (s *script) Connect(context.Context) (driver.Conn, error) {
+	return &conn{script: s}, nil
+}
+
+func (s *script) Driver() driver.Driver {
+	return scriptDriver{}
+}
+
+// run matches a statement against the next one expected and returns it
+func (s *script) run(query string, args []driver.Value) (Statement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next == len(s.statements) {
+		s.t.Errorf("unexpected statement %q with %v", query, args)
+		return Statement{}, fmt.Errorf("sqltest: unexpected statement %q", query)
+	}
+	expected := s.statements[s.next]
+	if !strings.Contains(query, expected.Contains) {
+		s.t.Errorf("statement %d is %q, want one containing %q", s.next+1, query, expected.Contains)
+		return Statement{}, fmt.Errorf("sqltest: unexpected statement %q", query)
+	}
+	s.next++
+	if expected.Args != nil && !argsMatch(expected.Args, args) {
+		s.t.Errorf("statement containing %q run with %v, want %v", expected.Contains, args, expected.Args)
+	}
+	return expected, expected.Err
+}
+
+func argsMatch(expected, actual []driver.Value) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if expected[i] != Any && !reflect.DeepEqual(expected[i], actual[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptDriver is only returned to satisfy driver.Connector; databases are opened with Open
+type scriptDriver struct{}
+
+func (scriptDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("sqltest: open databases with sqltest.Open")
+}
+
+type conn struct {
+	script *script
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{script: c.script, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error {
+	return nil
+}
+
+func (tx) Rollback() error {
+	return nil
+}
+
+type stmt struct {
+	script *script
+	query  string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	statement, err := s.script.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return result{lastInsertID: statement.LastInsertID, rowsAffected: statement.RowsAffected}, nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	statement, err := s.script.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: statement.Columns, values: statement.Rows}, nil
+}
+
+type result struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next == len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
@@ -16,14 +16,32 @@ CREATE TABLE Authentication (
     user_id SMALLINT UNSIGNED NOT NULL,                             -- Associated user ID
     auth_token VARCHAR(500) NOT NULL UNIQUE,                        -- Authentication token
     token_expiry TIMESTAMP NOT NULL,                                -- Expiry timestamp of the token
+    revoked_at TIMESTAMP NULL DEFAULT NULL,                         -- Revocation timestamp (NULL while the session is active)
+    family_id VARCHAR(32) NULL,                                     -- Token family shared with the session's refresh tokens
     INDEX idx_user_id (user_id),                                    -- Index to optimise lookups by user_id
-    INDEX idx_token_expiry (token_expiry)                           -- Index to optimise expiry checks
+    INDEX idx_token_expiry (token_expiry),                          -- Index to optimise expiry checks
+    INDEX idx_family_id (family_id)                                 -- Index to optimise token family revocation
 );
 
 -- Insert example data into the Authentication table
 INSERT INTO Authentication (user_id, auth_token, token_expiry) VALUES
 (1, "random_generated_token", "2024-12-31 23:59:59");
 
+-- Create the RefreshToken table
+-- PURPOSE: Stores hashed single-use refresh tokens grouped into token families
+CREATE TABLE RefreshToken (
+    refresh_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,    -- Unique ID for the refresh token
+    user_id SMALLINT UNSIGNED NOT NULL,                             -- Associated user ID
+    family_id VARCHAR(32) NOT NULL,                                 -- Token family (one per login session)
+    token_hash CHAR(64) NOT NULL UNIQUE,                            -- SHA-256 hash of the refresh token
+    expires_at TIMESTAMP NOT NULL,                                  -- Expiry timestamp of the refresh token
+    used_at TIMESTAMP NULL DEFAULT NULL,                            -- Set once the token has been rotated
+    revoked_at TIMESTAMP NULL DEFAULT NULL,                         -- Set when the token family is revoked
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                 -- Record creation timestamp
+    INDEX idx_user_id (user_id),                                    -- Index to optimise lookups by user_id
+    INDEX idx_family_id (family_id)                                 -- Index to optimise token family revocation
+);
+
 
 -- Create the User table
 -- PURPOSE: Stores user registration details (previously named Registration)
@@ -34,15 +52,87 @@ CREATE TABLE User (
     password VARCHAR(255) NULL,                                    -- User's password (hashed)
     contact_number VARCHAR(15),                                    -- User's contact number
     address TEXT,                                                  -- User's address
-    verification_code VARCHAR(10) NOT NULL,                        -- Verification code
+    verification_code VARCHAR(255) NULL,                           -- Hash of the pending verification code (NULL once used)
+    verification_attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,     -- Wrong guesses against the pending code
+    roles SET('customer', 'fleet_operator', 'finance', 'admin') NOT NULL DEFAULT 'customer', -- Roles embedded in the user's access tokens
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                -- Record creation timestamp
     INDEX idx_email (email),                                       -- Index to optimise lookups by email
     INDEX idx_created_at (created_at)                              -- Index to optimise recent user lookups
 );
 
--- Insert example data into the User table
-INSERT INTO User (name, email, password, contact_number, address, verification_code, created_at) VALUES
-("John Tan", "john@gmail.com", "$2a$10$LEL8btFg0WcO7BaUBI5JJ.3kqEv/hv6s1bM2u6DV0to71cIkDaadK", "12345678", "123 Main St, Singapore", "123456", NOW());
+-- Insert example data into the User table; the example user is also an admin so that roles can be granted
+INSERT INTO User (name, email, password, contact_number, address, verification_code, roles, created_at) VALUES
+("John Tan", "john@gmail.com", "$2a$10$LEL8btFg0WcO7BaUBI5JJ.3kqEv/hv6s1bM2u6DV0to71cIkDaadK", "12345678", "123 Main St, Singapore", NULL, "customer,admin", NOW());
+
+-- Create the PasswordReset table
+-- PURPOSE: Stores the latest one-time password reset code for each user
+CREATE TABLE PasswordReset (
+    reset_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,      -- Unique ID for the reset request
+    user_id SMALLINT UNSIGNED NOT NULL UNIQUE,                      -- Associated user ID
+    reset_code VARCHAR(255) NOT NULL,                               -- Hash of the one-time reset code
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                   -- Wrong guesses against the code
+    created_at TIMESTAMP NOT NULL,                                  -- Time the code was issued
+    used_at TIMESTAMP NULL DEFAULT NULL,                            -- Set once the code has been used
+    INDEX idx_created_at (created_at)                               -- Index to optimise expiry checks
+);
+
+-- Create the PasswordResetRequest table
+-- PURPOSE: Enforces the resend cooldown of password reset requests by email, whether or not the email is registered
+CREATE TABLE PasswordResetRequest (
+    email VARCHAR(255) NOT NULL PRIMARY KEY,                        -- Lower-cased email the reset was requested for
+    requested_at DATETIME NOT NULL                                  -- When a code was last requested for the email
+);
+
+-- Create the PasswordSync table
+-- PURPOSE: Queues the latest password hash of each user for the userMicroservice, committed with the password reset
+CREATE TABLE PasswordSync (
+    user_id SMALLINT UNSIGNED NOT NULL PRIMARY KEY,                 -- User whose password changed
+    email VARCHAR(255) NOT NULL,                                    -- Email the userMicroservice identifies the user by
+    password_hash VARCHAR(255) NOT NULL,                            -- Latest password hash, replaced by a later reset
+    status ENUM('Pending', 'Completed') NOT NULL DEFAULT 'Pending', -- 'Pending' until the userMicroservice has the latest hash
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                   -- Delivery attempts made for the latest hash
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,   -- Earliest time of the next attempt, pushed back while an attempt is in flight
+    last_error TEXT,                                                -- Error from the most recent failed attempt
+    synced_at TIMESTAMP NULL DEFAULT NULL,                          -- When the userMicroservice accepted the latest hash
+    INDEX idx_status_next_attempt (status, next_attempt_at)         -- Index for the worker's polling query
+);
+
+-- Create the FailedAttempt table
+-- PURPOSE: Tracks failed login and code attempts per account and per client IP
+CREATE TABLE FailedAttempt (
+    attempt_key VARCHAR(255) NOT NULL PRIMARY KEY,                  -- Action and account or IP, e.g. "login:ip:10.0.0.1"
+    failure_count INT UNSIGNED NOT NULL DEFAULT 0,                  -- Consecutive failures within the failure window
+    last_failure_at TIMESTAMP NOT NULL,                             -- Time of the most recent failure
+    locked_until TIMESTAMP NULL DEFAULT NULL                        -- Attempts are rejected until this time
+);
+
+-- Create the LockoutAudit table
+-- PURPOSE: Records every lockout applied for security review
+CREATE TABLE LockoutAudit (
+    audit_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,      -- Unique ID for the audit record
+    attempt_key VARCHAR(255) NOT NULL,                              -- Locked account or IP key
+    failure_count INT UNSIGNED NOT NULL,                            -- Failures that triggered the lockout
+    locked_until TIMESTAMP NOT NULL,                                -- End of the lockout
+    ip_address VARCHAR(45),                                         -- Client IP of the failed attempt
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                 -- Record creation timestamp
+    INDEX idx_attempt_key (attempt_key)                             -- Index to optimise lookups by key
+);
+
+-- Create the IdempotencyKeys table
+-- PURPOSE: Stores the first response to each Idempotency-Key so that retried requests are replayed
+CREATE TABLE IdempotencyKeys (
+    scope VARCHAR(64) NOT NULL,                                       -- Caller the key belongs to ('user:<id>', or 'anonymous:<request hash prefix>' without a login)
+    idempotency_key VARCHAR(255) NOT NULL,                            -- Key sent by the client in the Idempotency-Key header
+    request_hash CHAR(64) NOT NULL,                                   -- SHA-256 of the method, path and body of the first request
+    status ENUM('Processing', 'Completed') NOT NULL DEFAULT 'Processing', -- Whether the first request has finished
+    response_status SMALLINT UNSIGNED NULL,                           -- HTTP status of the stored response
+    content_type VARCHAR(100) NULL,                                   -- Content-Type of the stored response
+    response_body MEDIUMBLOB NULL,                                    -- Body of the stored response
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    expires_at DATETIME NOT NULL,                                     -- When the key may be reused, or taken over if its request is still 'Processing'
+    PRIMARY KEY (scope, idempotency_key),                             -- One stored response per caller and key
+    INDEX idx_expires_at (expires_at)                                 -- Index for purging expired keys
+);
 
 
 -- **************************************************
@@ -108,8 +198,24 @@ CREATE TABLE Bookings (
     booking_date DATETIME NOT NULL,                                   -- Date and time of booking
     return_date DATETIME NOT NULL,                                    -- Date and time of return
     total_price DECIMAL(10, 2) NOT NULL,                              -- Total price of the booking
+    status ENUM('pending_payment', 'confirmed', 'active', 'completed', 'cancelled', 'no_show')
+        NOT NULL DEFAULT 'pending_payment',                           -- Lifecycle state of the booking
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- When the booking was created (pending payment)
+    confirmed_at DATETIME NULL,                                       -- When payment confirmed the booking
+    started_at DATETIME NULL,                                         -- When the trip was started
+    completed_at DATETIME NULL,                                       -- When the trip was ended (actual return)
+    cancelled_at DATETIME NULL,                                       -- When the booking was cancelled
+    no_show_at DATETIME NULL,                                         -- When the booking was marked as a no-show
+    payment_reference VARCHAR(64) NULL UNIQUE,                        -- Reference of the payment saga that created the booking
+    promo_code VARCHAR(32) NULL,                                      -- Promo code applied to the booking, kept when it is modified
+    return_charge_level TINYINT UNSIGNED NULL,                        -- Battery charge level when the vehicle was returned
+    return_cleanliness_status ENUM('Clean', 'Needs Cleaning') NULL,   -- Cleanliness of the vehicle when it was returned, set once the return is billed
+    inspected_at DATETIME NULL,                                       -- When a fleet operator inspected the returned vehicle, NULL if billed without inspection
     FOREIGN KEY (vehicle_id) REFERENCES Vehicles(vehicle_id),         -- Foreign key relationship
-    INDEX idx_user_booking_date (user_id, booking_date)               -- Composite index for user and booking date
+    INDEX idx_user_booking_date (user_id, booking_date),              -- Composite index for user and booking date
+    INDEX idx_vehicle_status (vehicle_id, status),                    -- Index for overlap checks on live bookings
+    INDEX idx_status_completed_at (status, completed_at),             -- Index for the sweeper's uninspected returns query
+    INDEX idx_status_created_at (status, created_at)                  -- Index for the sweeper's abandoned bookings query
 );
 
 -- Insert example data into the Vehicles table
@@ -121,10 +227,65 @@ INSERT INTO Vehicles (model, location, charge_level, cleanliness_status, rental_
 ("Ford Mustang", "Suntec City Carpark F", 70, "Needs Cleaning", 40.00);
 
 -- Insert example data into the Bookings table
-INSERT INTO Bookings (vehicle_id, user_id, booking_date, return_date, total_price) VALUES
-(1, 1, '2025-01-01 10:00:00', '2025-01-05 14:00:00', 100.00),
-(1, 1, '2024-06-01 10:00:00', '2024-06-05 14:00:00', 100.00),
-(1, 1, '2024-01-01 10:00:00', '2024-01-05 14:00:00', 100.00);
+INSERT INTO Bookings (vehicle_id, user_id, booking_date, return_date, total_price, status, confirmed_at, started_at, completed_at, return_charge_level, return_cleanliness_status, inspected_at) VALUES
+(1, 1, '2025-01-01 10:00:00', '2025-01-05 14:00:00', 100.00, 'confirmed', '2024-12-01 09:00:00', NULL, NULL, NULL, NULL, NULL),
+(1, 1, '2024-06-01 10:00:00', '2024-06-05 14:00:00', 100.00, 'completed', '2024-05-01 09:00:00', '2024-06-01 10:05:00', '2024-06-05 13:50:00', 90, 'Clean', '2024-06-05 14:30:00'),
+(1, 1, '2024-01-01 10:00:00', '2024-01-05 14:00:00', 100.00, 'completed', '2023-12-01 09:00:00', '2024-01-01 10:02:00', '2024-01-05 13:55:00', 85, 'Clean', '2024-01-05 14:20:00');
+
+-- Create the BookingModifications table
+-- PURPOSE: Rescheduling requests of bookings, applied to the booking once the payment service has settled their price difference
+CREATE TABLE BookingModifications (
+    booking_id SMALLINT UNSIGNED NOT NULL,                            -- Booking being rescheduled
+    modification SMALLINT UNSIGNED NOT NULL,                          -- Sequence number of the modification within its booking
+    vehicle_id SMALLINT UNSIGNED NOT NULL,                            -- Vehicle of the booking, for overlap checks while the modification is pending
+    booking_date DATETIME NOT NULL,                                   -- New date and time of booking
+    return_date DATETIME NOT NULL,                                    -- New date and time of return
+    total_price DECIMAL(10, 2) NOT NULL,                              -- New total price of the booking
+    promo_code VARCHAR(32) NULL,                                      -- Promo code of the booking after the modification, NULL if it no longer applies
+    status ENUM('Pending', 'Applied', 'Rejected') NOT NULL DEFAULT 'Pending', -- 'Pending' until the settlement is confirmed or declined
+    rejection_reason TEXT,                                            -- Why the payment service declined the settlement
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    resolved_at DATETIME NULL,                                        -- When the modification was applied or rejected
+    PRIMARY KEY (booking_id, modification),                           -- One row per modification of a booking
+    INDEX idx_vehicle_status (vehicle_id, status),                    -- Index for overlap checks on pending modifications
+    FOREIGN KEY (booking_id) REFERENCES Bookings(booking_id)          -- Foreign key relationship
+);
+
+-- Create the IdempotencyKeys table
+-- PURPOSE: Stores the first response to each Idempotency-Key so that retried requests are replayed
+CREATE TABLE IdempotencyKeys (
+    scope VARCHAR(64) NOT NULL,                                       -- Caller the key belongs to ('user:<id>', or 'anonymous:<request hash prefix>' without a login)
+    idempotency_key VARCHAR(255) NOT NULL,                            -- Key sent by the client in the Idempotency-Key header
+    request_hash CHAR(64) NOT NULL,                                   -- SHA-256 of the method, path and body of the first request
+    status ENUM('Processing', 'Completed') NOT NULL DEFAULT 'Processing', -- Whether the first request has finished
+    response_status SMALLINT UNSIGNED NULL,                           -- HTTP status of the stored response
+    content_type VARCHAR(100) NULL,                                   -- Content-Type of the stored response
+    response_body MEDIUMBLOB NULL,                                    -- Body of the stored response
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    expires_at DATETIME NOT NULL,                                     -- When the key may be reused, or taken over if its request is still 'Processing'
+    PRIMARY KEY (scope, idempotency_key),                             -- One stored response per caller and key
+    INDEX idx_expires_at (expires_at)                                 -- Index for purging expired keys
+);
+
+-- Create the PaymentOutbox table
+-- PURPOSE: Queues refunds, settlements and final bills for the payment service, committed with the booking change that needs them
+CREATE TABLE PaymentOutbox (
+    request_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,      -- Unique ID for the queued request
+    booking_id SMALLINT UNSIGNED NOT NULL,                            -- Booking the request is about
+    kind ENUM('Refund', 'Settle', 'Finalise') NOT NULL,               -- Payment service endpoint the request is posted to
+    modification SMALLINT UNSIGNED NOT NULL DEFAULT 0,                -- Booking modification a settlement is for, 0 for other kinds
+    payload JSON NOT NULL,                                            -- JSON body of the request
+    locale VARCHAR(64) NULL,                                          -- Accept-Language the customer is answered in
+    status ENUM('Pending', 'Completed', 'Rejected', 'Dead') NOT NULL DEFAULT 'Pending', -- Delivery status ('Rejected' when a charge is declined, 'Dead' after exhausting retries)
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                     -- Delivery attempts made so far
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,     -- Earliest time of the next attempt, pushed back while an attempt is in flight
+    last_error TEXT,                                                  -- Error from the most recent failed attempt
+    response JSON NULL,                                               -- Response of the payment service once completed
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    completed_at TIMESTAMP NULL DEFAULT NULL,                         -- Completion timestamp
+    UNIQUE KEY uq_booking_kind (booking_id, kind, modification),      -- One request of each kind per booking, and one settlement per modification
+    INDEX idx_status_next_attempt (status, next_attempt_at)           -- Index for the worker's polling query
+);
 
 
 -- **************************************************
@@ -144,20 +305,78 @@ CREATE TABLE BookingPayment (
     payment_id SMALLINT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,  -- Unique ID for payment
     user_id SMALLINT UNSIGNED NOT NULL,                                -- Associated user ID
     booking_id SMALLINT UNSIGNED NOT NULL,                             -- Booking reference ID
-    amount DECIMAL(10, 2) NOT NULL,                                    -- Payment amount
+    payment_type ENUM('Booking', 'Supplementary Charge', 'Modification Refund', 'Discount Adjustment') NOT NULL DEFAULT 'Booking', -- Original payment, a settlement of a modification or a change to its discounts
+    parent_payment_id SMALLINT UNSIGNED NULL,                          -- Original booking payment a settlement belongs to
+    amount DECIMAL(10, 2) NOT NULL,                                    -- Price before discounts (amount - discount = final_amount), a signed change for discount adjustments
     payment_method ENUM('Card', 'PayNow'),                             -- Payment method used
-    payment_status ENUM('Pending', 'Completed', 'Refunded'),           -- Status of the payment
-    discount DECIMAL(10, 2) DEFAULT 0.00,                              -- Discount amount
-    final_amount DECIMAL(10, 2) DEFAULT 0.00,                          -- Final amount after discount
+    payment_status ENUM('Pending', 'Authorised', 'Completed', 'Failed', 'Partially Refunded', 'Refunded', 'Voided'), -- Status of the payment
+    discount DECIMAL(10, 2) DEFAULT 0.00,                              -- Member and promo code discounts taken off the amount
+    final_amount DECIMAL(10, 2) DEFAULT 0.00,                          -- Amount charged after discounts
+    refund_amount DECIMAL(10, 2) DEFAULT 0.00,                         -- Amount refunded from this charge by the payment provider
+    refunded_at DATETIME NULL,                                         -- When the cancellation refund was issued
+    provider_payment_id VARCHAR(255) NULL,                             -- Payment ID at the payment provider
+    provider_payment_method VARCHAR(255) NULL,                         -- Provider token of the payment method, saved to the user's PaymentCustomers entry for supplementary charges
+    authorised_amount DECIMAL(10, 2) NULL,                             -- Amount held by the pre-authorisation at booking
+    final_bill JSON NULL,                                              -- Itemised final bill computed at trip end
+    settled_modification SMALLINT UNSIGNED NOT NULL DEFAULT 0,         -- Last booking modification settled against this payment, so a retried settlement is made once
+    finalised_at DATETIME NULL,                                        -- When the final bill was captured
+    email VARCHAR(255),                                                -- Email address invoices and credit notes are sent to
     invoice_pdf TEXT,                                                  -- Path to the invoice PDF
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                    -- Record creation timestamp
-    INDEX idx_user_payment_status (user_id, payment_status)            -- Composite index for user and payment status
+    INDEX idx_user_payment_status (user_id, payment_status),           -- Composite index for user and payment status
+    INDEX idx_booking_payment_type (booking_id, payment_type)          -- Composite index for payments of a booking
 );
 
 -- Insert example data into the BookingPayment table
 INSERT INTO BookingPayment (user_id, booking_id, amount, payment_method, payment_status, discount, final_amount) VALUES
 (1, 101, 100.50, "Card", "Completed", 10.00, 90.50);
 
+-- Create the BookingRefunds table
+-- PURPOSE: Refunds of booking charges recorded with a cancellation or settlement, made by the payment provider after it commits
+CREATE TABLE BookingRefunds (
+    refund_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,      -- Unique ID for the refund
+    booking_id SMALLINT UNSIGNED NOT NULL,                            -- Booking the refunded charge belongs to
+    payment_id SMALLINT UNSIGNED NOT NULL,                            -- BookingPayment charge being refunded
+    provider_payment_id VARCHAR(255) NOT NULL,                        -- Payment ID of the charge at the payment provider
+    amount DECIMAL(10, 2) NOT NULL,                                   -- Amount refunded from the charge
+    idempotency_key VARCHAR(255) NOT NULL UNIQUE,                     -- Idempotency key sent to the provider, so a retried refund is made once
+    status ENUM('Pending', 'Completed') NOT NULL DEFAULT 'Pending',   -- 'Pending' until the provider has made the refund
+    provider_refund_id VARCHAR(255) NULL,                             -- Refund ID at the payment provider
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                     -- Failed attempts to make the refund
+    last_error TEXT,                                                  -- Error from the most recent failed attempt
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    refunded_at DATETIME NULL,                                        -- When the provider made the refund
+    INDEX idx_booking (booking_id),                                   -- Index for the refunds of a booking
+    INDEX idx_status_created (status, created_at)                     -- Index for the retry worker's polling query
+);
+
+-- Create the BookingHoldSettlements table
+-- PURPOSE: Captures and voids of pre-authorisation holds recorded with a cancellation or final bill, made by the payment provider after it commits
+CREATE TABLE BookingHoldSettlements (
+    settlement_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,  -- Unique ID for the settlement
+    booking_id SMALLINT UNSIGNED NOT NULL,                            -- Booking the hold belongs to
+    payment_id SMALLINT UNSIGNED NOT NULL,                            -- BookingPayment holding the funds
+    provider_payment_id VARCHAR(255) NOT NULL,                        -- Payment ID of the hold at the payment provider
+    action ENUM('Capture', 'Void') NOT NULL,                          -- Capture part of the hold and release the rest, or release all of it
+    amount DECIMAL(10, 2) NOT NULL DEFAULT 0.00,                      -- Amount captured, 0 for a void
+    idempotency_key VARCHAR(255) NOT NULL UNIQUE,                     -- Idempotency key sent to the provider, so a retried settlement is made once
+    status ENUM('Pending', 'Completed') NOT NULL DEFAULT 'Pending',   -- 'Pending' until the provider has settled the hold
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                     -- Failed attempts to settle the hold
+    last_error TEXT,                                                  -- Error from the most recent failed attempt
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    settled_at DATETIME NULL,                                         -- When the provider settled the hold
+    INDEX idx_booking (booking_id),                                   -- Index for the settlements of a booking
+    INDEX idx_status_created (status, created_at)                     -- Index for the retry worker's polling query
+);
+
+-- Create the PaymentCustomers table
+-- PURPOSE: Customer of each user at the payment provider, which card payment methods are saved to for later charges
+CREATE TABLE PaymentCustomers (
+    user_id SMALLINT UNSIGNED NOT NULL PRIMARY KEY,                   -- Associated user ID
+    provider_customer_id VARCHAR(255) NOT NULL,                       -- Customer ID at the payment provider
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP                    -- Record creation timestamp
+);
+
 -- Create the MembershipPayment table
 -- PURPOSE: Tracks payments related to membership plans
 CREATE TABLE MembershipPayment (
@@ -165,19 +384,49 @@ CREATE TABLE MembershipPayment (
     user_id SMALLINT UNSIGNED NOT NULL,                                -- Associated user ID
     membership_level ENUM('Basic', 'Premium', 'VIP') NOT NULL,         -- Membership tier purchased
     amount DECIMAL(10, 2) NOT NULL,                                    -- Payment amount for membership
+    plan_price DECIMAL(10, 2) NULL,                                    -- Price of the plan before credit for unused days, NULL if it is amount
+    refund_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,                   -- Amount refunded as credit for unused days on a plan change
+    refund_due DECIMAL(10, 2) NOT NULL DEFAULT 0,                      -- Refund of a plan change the provider has not made yet, retried by the scheduler
     payment_method ENUM('Card', 'PayNow'),                             -- Payment method used
-    payment_status ENUM('Pending', 'Completed', 'Refunded'),           -- Status of the payment
+    payment_status ENUM('Pending', 'Processing', 'Completed', 'Failed', 'Refunded'), -- Status of the payment ('Processing' while a card is charged, 'Pending' while the customer pays by PayNow)
+    provider_payment_id VARCHAR(255) NULL,                             -- Payment ID at the payment provider
+    provider_payment_method VARCHAR(255) NULL,                         -- Payment method at the provider, charged again on renewal
+    auto_renew BOOLEAN NOT NULL DEFAULT FALSE,                         -- Whether the membership renews automatically at end_date
+    renewal_of SMALLINT UNSIGNED NULL UNIQUE,                          -- Membership payment this payment renews
+    superseded_by SMALLINT UNSIGNED NULL,                              -- Membership payment that replaced this one on a plan change
+    proration JSON NULL,                                               -- Quote of the plan change paid for, applied once the payment completes
+    email VARCHAR(255),                                                -- Email address the invoice is sent to
+    user_name VARCHAR(100),                                            -- Name used to greet the user in the invoice email
+    locale VARCHAR(100),                                               -- Accept-Language of the payment request
     start_date DATE NOT NULL,                                          -- Membership start date
     end_date DATE NOT NULL,                                            -- Membership end date
+    reminder_sent_at DATETIME NULL,                                    -- When the renewal reminder was sent
+    expired_at DATETIME NULL,                                          -- When the user was downgraded after the membership ended
     invoice_pdf TEXT,                                                  -- Path to the invoice PDF
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                    -- Record creation timestamp
-    INDEX idx_user_membership_level (user_id, membership_level)        -- Composite index for user and membership level
+    INDEX idx_user_membership_level (user_id, membership_level),       -- Composite index for user and membership level
+    INDEX idx_membership_end_date (end_date)                           -- Index for the renewal, reminder and expiry jobs
 );
 
 -- Insert example data into the MembershipPayment table
 INSERT INTO MembershipPayment (user_id, membership_level, amount, payment_method, payment_status, start_date, end_date) VALUES
 (2, 'Premium', 150.00, "Card", "Completed", '2024-01-01', '2024-12-31');
 
+-- Create the MembershipPlans table
+-- PURPOSE: Catalogue of membership plans that membership payments are priced from
+CREATE TABLE MembershipPlans (
+    membership_level ENUM('Basic', 'Premium', 'VIP') NOT NULL PRIMARY KEY, -- Membership tier
+    price DECIMAL(10, 2) NOT NULL,                                     -- Price of one membership period, 0 for the free plan
+    duration_months TINYINT UNSIGNED NOT NULL,                         -- Length of one membership period in months
+    perks JSON NOT NULL                                                -- Benefits of the plan, listed on the membership page
+);
+
+-- Insert the membership plans into the MembershipPlans table
+INSERT INTO MembershipPlans (membership_level, price, duration_months, perks) VALUES
+('Basic', 0.00, 0, '["5% discount off car rentals", "Book cars up to 1 month in advance", "1 active booking at any time"]'),
+('Premium', 150.00, 1, '["10% discount off car rentals", "Book cars up to 6 months in advance", "3 active bookings at any time"]'),
+('VIP', 350.00, 12, '["20% discount off car rentals", "Book cars up to 1 year in advance", "10 active bookings at any time"]');
+
 -- Create the Discounts table
 -- PURPOSE: Manages promotional discounts by membership level
 CREATE TABLE Discounts (
@@ -192,3 +441,117 @@ INSERT INTO Discounts (membership_level, discount_percentage) VALUES
 ('Basic', 5.00),
 ('Premium', 10.00),
 ('VIP', 20.00);
+
+-- Create the PromoCodes table
+-- PURPOSE: Promotion and voucher codes customers can apply to a booking at checkout
+CREATE TABLE PromoCodes (
+    promo_id SMALLINT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,   -- Unique ID for the promo code
+    code VARCHAR(32) NOT NULL UNIQUE,                                 -- Code entered at checkout, stored in upper case
+    description VARCHAR(255) NOT NULL,                                -- Description shown on the quote and invoice
+    discount_type ENUM('Percentage', 'Fixed') NOT NULL,               -- Whether discount_value is a percentage or an amount
+    discount_value DECIMAL(10, 2) NOT NULL,                           -- Percentage off or amount off the booking
+    max_discount DECIMAL(10, 2) NULL,                                 -- Cap on a percentage discount, NULL for no cap
+    min_spend DECIMAL(10, 2) NOT NULL DEFAULT 0,                      -- Rental price the booking must reach before discounts
+    valid_from DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,           -- When the code can first be redeemed
+    valid_until DATETIME NULL,                                        -- When the code stops being redeemable, NULL for never
+    global_limit INT UNSIGNED NULL,                                   -- Redemptions allowed across all users, NULL for unlimited
+    per_user_limit INT UNSIGNED NULL,                                 -- Redemptions allowed per user, NULL for unlimited
+    allowed_vehicle_ids JSON NULL,                                    -- Vehicles the code applies to, NULL for all vehicles
+    allowed_locations JSON NULL,                                      -- Vehicle locations the code applies to, NULL for all locations
+    stackable BOOLEAN NOT NULL DEFAULT FALSE,                         -- Whether the code applies on top of the member discount
+    active BOOLEAN NOT NULL DEFAULT TRUE,                             -- Whether the code can be redeemed at all
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP                    -- Record creation timestamp
+);
+
+-- Insert example data into the PromoCodes table
+INSERT INTO PromoCodes (code, description, discount_type, discount_value, max_discount, min_spend, valid_until, global_limit, per_user_limit, allowed_vehicle_ids, allowed_locations, stackable) VALUES
+('WELCOME10', '10% off your first booking', 'Percentage', 10.00, 20.00, 0.00, NULL, NULL, 1, NULL, NULL, TRUE),
+('ECO15', '$15 off bookings of $60 or more', 'Fixed', 15.00, NULL, 60.00, '2026-12-31 23:59:59', 500, 3, NULL, NULL, FALSE),
+('ORCHARD25', '25% off vehicles at ION Orchard', 'Percentage', 25.00, 50.00, 0.00, NULL, NULL, NULL, NULL, '["ION Orchard Car Park"]', FALSE),
+('TESLA20', '$20 off the Tesla Model 3', 'Fixed', 20.00, NULL, 100.00, NULL, 100, 1, '[2]', NULL, TRUE);
+
+-- Create the PromoRedemptions table
+-- PURPOSE: Records each use of a promo code, counted against its global and per-user limits
+CREATE TABLE PromoRedemptions (
+    redemption_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,   -- Unique ID for the redemption
+    promo_id SMALLINT UNSIGNED NOT NULL,                              -- Promo code redeemed
+    user_id SMALLINT UNSIGNED NOT NULL,                               -- User who redeemed the code
+    booking_id SMALLINT UNSIGNED NOT NULL,                            -- Booking the code was applied to
+    payment_id SMALLINT UNSIGNED NOT NULL,                            -- BookingPayment recording the discount
+    discount DECIMAL(10, 2) NOT NULL,                                 -- Amount taken off the booking by the code
+    status ENUM('Redeemed', 'Released') NOT NULL DEFAULT 'Redeemed',  -- 'Released' once the checkout was rolled back
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    released_at DATETIME NULL,                                        -- When the redemption was released
+    INDEX idx_promo_status_user (promo_id, status, user_id),          -- Index for counting redemptions against the limits
+    INDEX idx_booking (booking_id)                                    -- Index for releasing the redemption of a booking
+);
+
+-- Create the EmailOutbox table
+-- PURPOSE: Queues outbound emails for delivery by the background worker
+CREATE TABLE EmailOutbox (
+    email_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,        -- Unique ID for the queued email
+    recipient VARCHAR(255) NOT NULL,                                  -- Recipient email address
+    subject VARCHAR(255) NOT NULL,                                    -- Email subject
+    payload LONGTEXT NOT NULL,                                        -- JSON-encoded message including attachments
+    status ENUM('Pending', 'Sent', 'Dead') NOT NULL DEFAULT 'Pending',-- Delivery status ('Dead' after exhausting retries)
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                     -- Delivery attempts made so far
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,     -- Earliest time of the next attempt
+    last_error TEXT,                                                  -- Error from the most recent failed attempt
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    sent_at TIMESTAMP NULL DEFAULT NULL,                              -- Delivery timestamp
+    INDEX idx_status_next_attempt (status, next_attempt_at)           -- Index for the worker's polling query
+);
+
+-- Create the BookingSaga table
+-- PURPOSE: Persists the progress of each payment and booking saga so that it can be recovered after a crash
+CREATE TABLE BookingSaga (
+    saga_id INT UNSIGNED NOT NULL PRIMARY KEY AUTO_INCREMENT,         -- Unique ID for the saga
+    reference VARCHAR(64) NOT NULL UNIQUE,                            -- Reference passed to the vehicle service with the booking
+    status ENUM('Started', 'BookingCreated', 'PaymentRecorded', 'AwaitingPayment', 'Completed', 'Aborted', 'Compensating', 'Compensated', 'Failed')
+        NOT NULL DEFAULT 'Started',                                   -- Last step reached ('Failed' needs manual attention)
+    user_id SMALLINT UNSIGNED NOT NULL,                               -- Paying user ID
+    vehicle_id SMALLINT UNSIGNED NOT NULL,                            -- Vehicle being booked
+    booking_date DATETIME NOT NULL,                                   -- Requested start of the booking
+    return_date DATETIME NOT NULL,                                    -- Requested end of the booking
+    payment_method VARCHAR(20) NOT NULL,                              -- Payment method chosen at checkout
+    email VARCHAR(255),                                               -- Email address for the invoice
+    user_name VARCHAR(100),                                           -- Name used to greet the user in the invoice email
+    locale VARCHAR(100),                                              -- Accept-Language of the checkout request
+    booking_id SMALLINT UNSIGNED NULL,                                -- Booking created by the saga
+    payment_id SMALLINT UNSIGNED NULL,                                -- BookingPayment recorded by the saga
+    base_price DECIMAL(10, 2) NULL,                                   -- Rental price of the booking before discounts
+    member_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,                -- Amount taken off the booking by the member's tier discount
+    total_price DECIMAL(10, 2) NULL,                                  -- Price charged for the booking
+    promo_code VARCHAR(32) NULL,                                      -- Promo code entered at checkout, as applied by the vehicle service
+    promo_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,                 -- Amount taken off the booking by the promo code
+    attempts TINYINT UNSIGNED NOT NULL DEFAULT 0,                     -- Recovery attempts made so far
+    last_error TEXT,                                                  -- Error that caused the latest compensation or retry
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, -- When the saga last made progress
+    INDEX idx_status_updated (status, updated_at)                     -- Index for the recovery worker's polling query
+);
+
+-- Create the PaymentWebhookEvents table
+-- PURPOSE: Records the payment provider webhook events already processed, so that redeliveries are ignored
+CREATE TABLE PaymentWebhookEvents (
+    event_id VARCHAR(255) NOT NULL PRIMARY KEY,                       -- Event ID assigned by the payment provider
+    event_type VARCHAR(100) NOT NULL,                                 -- Event type, e.g. 'payment_intent.succeeded'
+    provider_payment_id VARCHAR(255) NULL,                            -- Payment the event is about
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP                   -- When the event was processed
+);
+
+-- Create the IdempotencyKeys table
+-- PURPOSE: Stores the first response to each Idempotency-Key so that retried requests are replayed
+CREATE TABLE IdempotencyKeys (
+    scope VARCHAR(64) NOT NULL,                                       -- Caller the key belongs to ('user:<id>', or 'anonymous:<request hash prefix>' without a login)
+    idempotency_key VARCHAR(255) NOT NULL,                            -- Key sent by the client in the Idempotency-Key header
+    request_hash CHAR(64) NOT NULL,                                   -- SHA-256 of the method, path and body of the first request
+    status ENUM('Processing', 'Completed') NOT NULL DEFAULT 'Processing', -- Whether the first request has finished
+    response_status SMALLINT UNSIGNED NULL,                           -- HTTP status of the stored response
+    content_type VARCHAR(100) NULL,                                   -- Content-Type of the stored response
+    response_body MEDIUMBLOB NULL,                                    -- Body of the stored response
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                   -- Record creation timestamp
+    expires_at DATETIME NOT NULL,                                     -- When the key may be reused, or taken over if its request is still 'Processing'
+    PRIMARY KEY (scope, idempotency_key),                             -- One stored response per caller and key
+    INDEX idx_expires_at (expires_at)                                 -- Index for purging expired keys
+);
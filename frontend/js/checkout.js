@@ -70,44 +70,109 @@ document.addEventListener("DOMContentLoaded", () => {
     totalPrice
   ).toFixed(2)}`;
 
-  // Fetch membership level
-  fetch(`http://localhost:5100/api/v1/user/profile?user_id=${userId}`)
-    .then((response) => {
+  // Fetch the server-side quote; the total and promo code shown here are the ones sent back with the payment
+  let quotedTotal = null;
+  let appliedPromoCode = "";
+
+  function showQuote(quote) {
+    quotedTotal = quote.total_price;
+    document.getElementById("membershipLevel").textContent =
+      quote.membership_level;
+    document.getElementById(
+      "rentalDuration"
+    ).textContent = `${quote.duration_hours} hours`;
+    document.getElementById("pricePerHour").textContent = `$${parseFloat(
+      quote.price_per_hour
+    ).toFixed(2)}`;
+    document.getElementById("totalPrice").textContent = `$${parseFloat(
+      quote.base_price
+    ).toFixed(2)}`;
+    document.getElementById("discount").textContent = `$${parseFloat(
+      quote.discount
+    ).toFixed(2)}`;
+
+    // List the rental lines of the quote; discounts are shown separately below
+    const priceBreakdown = document.getElementById("priceBreakdown");
+    priceBreakdown.innerHTML = "";
+    quote.line_items
+      .filter((item) => item.kind === "rental" || item.kind === "daily_cap")
+      .forEach((item) => {
+        const line = document.createElement("li");
+        const amount = `$${Math.abs(item.amount).toFixed(2)}`;
+        line.textContent = `${item.description}: ${
+          item.amount < 0 ? "-" : ""
+        }${amount}`;
+        priceBreakdown.appendChild(line);
+      });
+    if (quote.surge_multiplier > 1) {
+      const line = document.createElement("li");
+      line.textContent = `High demand at this location: rates include a ${quote.surge_multiplier}x surge`;
+      priceBreakdown.appendChild(line);
+    }
+    document.getElementById("finalPrice").textContent = `$${parseFloat(
+      quote.total_price
+    ).toFixed(2)}`;
+
+    // Show what the promo code takes off; a code that replaces the member discount zeroes it
+    appliedPromoCode = quote.promo_code || "";
+    const promoDiscount = document.getElementById("promoDiscount");
+    if (appliedPromoCode) {
+      promoDiscount.textContent = `${appliedPromoCode}: -$${parseFloat(
+        quote.promo_discount
+      ).toFixed(2)}`;
+      promoDiscount.classList.remove("d-none");
+    } else {
+      promoDiscount.classList.add("d-none");
+    }
+  }
+
+  function fetchQuote(promoCode) {
+    return fetch(
+      `http://localhost:5150/api/v1/vehicle/quote?vehicle_id=${vehicleId}&start_date=${encodeURIComponent(
+        startDate
+      )}&end_date=${encodeURIComponent(endDate)}&promo_code=${encodeURIComponent(
+        promoCode
+      )}`,
+      {
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem("token")}`,
+        },
+      }
+    ).then(async (response) => {
+      if (response.status === 422) {
+        // The promo code cannot be applied to this booking
+        const data = await response.json();
+        throw new Error(data.error);
+      }
       if (!response.ok) {
-        throw new Error("Failed to fetch user details");
+        throw new Error("Failed to fetch quote");
       }
       return response.json();
-    })
-    .then((userData) => {
-      const membershipLevel = userData.membership_level;
-      document.getElementById("membershipLevel").textContent = membershipLevel;
-
-      // Fetch discount using the membership level
-      fetch(
-        `http://localhost:5200/api/v1/payment/real-time-bill?membership_level=${membershipLevel}&duration_hours=${rentalDuration}&price_per_hour=${pricePerHour}`
-      )
-        .then((response) => {
-          if (!response.ok) {
-            throw new Error("Failed to fetch discount");
-          }
-          return response.json();
-        })
-        .then((data) => {
-          document.getElementById("discount").textContent = `$${parseFloat(
-            data.discount
-          ).toFixed(2)}`;
-          document.getElementById("finalPrice").textContent = `$${parseFloat(
-            data.final_price
-          ).toFixed(2)}`;
-        })
-        .catch((error) => {
-          console.error("Error fetching discount:", error);
-        });
-    })
+    });
+  }
+
+  fetchQuote("")
+    .then(showQuote)
     .catch((error) => {
-      console.error("Error fetching user details:", error);
+      console.error("Error fetching quote:", error);
     });
 
+  // Re-price the booking with the promo code entered
+  document.getElementById("applyPromoButton").addEventListener("click", () => {
+    const promoCode = document.getElementById("promoCode").value.trim();
+    fetchQuote(promoCode)
+      .then((quote) => {
+        showQuote(quote);
+        if (promoCode) {
+          showCustomAlert(`Promo code ${quote.promo_code} applied.`);
+        }
+      })
+      .catch((error) => {
+        console.error("Error applying promo code:", error);
+        showCustomAlert(error.message);
+      });
+  });
+
   // Toggle payment method content
   const cardDetails = document.getElementById("cardDetails");
   const paynowQRCode = document.getElementById("paynowQRCode");
@@ -155,6 +220,9 @@ document.addEventListener("DOMContentLoaded", () => {
     );
   }
 
+  // Repeated clicks reuse the key so that the server processes the payment only once
+  let idempotencyKey = crypto.randomUUID();
+
   // Handle payment submission
   document.getElementById("payButton").addEventListener("click", () => {
     const paymentMethod = document.querySelector(
@@ -183,19 +251,54 @@ document.addEventListener("DOMContentLoaded", () => {
       end_date: endDate,
       rental_duration: rentalDuration,
       price_per_hour: pricePerHour,
-      total_price: totalPrice,
+      total_price: String(quotedTotal ?? totalPrice),
+      promo_code: appliedPromoCode,
       payment_method: paymentMethod,
       email: email,
     };
 
     fetch("http://localhost:5200/api/v1/payment/process", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${localStorage.getItem("token")}`,
+        "Idempotency-Key": idempotencyKey,
+      },
       body: JSON.stringify(payload),
     })
-      .then((response) => {
+      .then(async (response) => {
+        if (!response.ok) {
+          // The next attempt is a new request, possibly with changed details
+          idempotencyKey = crypto.randomUUID();
+        }
+        if (response.status === 409) {
+          const data = await response.json();
+          throw new Error(bookingConflictMessage(data.conflict));
+        }
+        if (response.status === 422) {
+          const data = await response.json();
+          if (!data.quote) {
+            // The promo code can no longer be applied, e.g. it was used up in the meantime, or the
+            // membership discount changed; refresh the price shown before the customer retries
+            fetchQuote(appliedPromoCode)
+              .then(showQuote)
+              .catch((error) => console.error("Error fetching quote:", error));
+            throw new Error(data.error);
+          }
+          // The price changed since the quote was shown; display the new one
+          showQuote(data.quote);
+          throw new Error(
+            `The price has changed to $${data.quote.total_price.toFixed(
+              2
+            )}. Please review it and confirm again.`
+          );
+        }
+        if (response.status === 402) {
+          // The card or account was declined by the payment provider
+          throw new Error(await response.text());
+        }
         if (!response.ok) {
-          throw new Error("Payment processing failed");
+          throw new Error("Payment failed. Please try again.");
         }
         return response.json();
       })
@@ -213,10 +316,21 @@ document.addEventListener("DOMContentLoaded", () => {
           end_date: endDate,
           rental_duration: rentalDuration,
           price_per_hour: pricePerHour,
-          total_price: totalPrice,
+          total_price: quotedTotal ?? totalPrice,
           payment_method: paymentMethod,
         }).toString();
 
+        // PayNow payments are confirmed once the customer has paid in their banking app
+        if (data.payment_status === "Pending") {
+          showCustomAlert(
+            "Please complete the PayNow payment in your banking app. Your booking will be confirmed once it is received."
+          );
+          setTimeout(() => {
+            window.location.href = "./myBookings.html";
+          }, 3000);
+          return;
+        }
+
         // Redirect to confirmation.html with query parameters
         showCustomAlert("Payment successful!");
         setTimeout(() => {
@@ -225,7 +339,12 @@ document.addEventListener("DOMContentLoaded", () => {
       })
       .catch((error) => {
         console.error("Payment error:", error);
-        showCustomAlert("Payment failed. Please try again.");
+        showCustomAlert(error.message);
       });
   });
+
+  // Describe the booking that already occupies the requested slot
+  function bookingConflictMessage(conflict) {
+    return `This vehicle is already booked from ${conflict.booking_date} to ${conflict.return_date}. Please choose another time.`;
+  }
 });
@@ -35,8 +35,9 @@ document.addEventListener("DOMContentLoaded", function () {
       const data = await response.json(); // Parse the response JSON
 
       if (response.ok) {
-        // If login is successful, store the JWT token
+        // If login is successful, store the access and refresh tokens
         localStorage.setItem("token", data.token);
+        localStorage.setItem("refreshToken", data.refresh_token);
         showCustomAlert("Login successful!", "./memberHome.html");
       } else {
         // If login fails, show an error message
@@ -37,12 +37,19 @@ document.addEventListener("DOMContentLoaded", () => {
     )}`;
 
     try {
-      const response = await fetch(apiURL);
+      const response = await fetch(apiURL, {
+        headers: {
+          Authorization: `Bearer ${token}`,
+        },
+      });
       if (!response.ok) {
         throw new Error(`HTTP error! Status: ${response.status}`);
       }
       const data = await response.json();
       updateMembershipUI(data.membership_level);
+      if (data.subscription) {
+        showSubscription(userID, data.membership_level, data.subscription);
+      }
     } catch (error) {
       console.error("Error fetching membership status:", error);
     }
@@ -78,9 +85,16 @@ document.addEventListener("DOMContentLoaded", () => {
             '<div class="current-plan fw-bold mt-3">This is your current plan</div>'
           );
         }
+        // Paid plans can be renewed early, from the end of the period already paid for
         const button = card.querySelector(".btn");
         if (button) {
-          button.style.display = "none";
+          button.textContent = "Renew now";
+        }
+      } else if (tier !== "Basic" && tiers.indexOf(tier) < tiers.indexOf(currentMembership)) {
+        // Lower paid tiers can be switched to, with credit for the unused days of the current plan
+        const button = card.querySelector(".btn");
+        if (button) {
+          button.textContent = "Switch to this plan";
         }
       } else if (tiers.indexOf(tier) < tiers.indexOf(currentMembership)) {
         // For lower tiers, remove "This is your current plan" and add a friendly message
@@ -103,6 +117,67 @@ document.addEventListener("DOMContentLoaded", () => {
     });
   }
 
+  // Show the active period of a paid membership on its card, with a switch for automatic renewal
+  function showSubscription(userID, currentMembership, subscription) {
+    const card = Array.from(document.querySelectorAll(".card")).find((currentCard) => {
+      const header = currentCard.querySelector("h3");
+      return header && header.textContent.trim() === currentMembership;
+    });
+    const cardBody = card && card.querySelector(".card-body");
+    if (!cardBody) {
+      return;
+    }
+
+    cardBody.insertAdjacentHTML(
+      "beforeend",
+      `<div class="text-muted mt-2">Active from ${subscription.start_date} to ${subscription.end_date}</div>`
+    );
+    if (subscription.paid_until !== subscription.end_date) {
+      cardBody.insertAdjacentHTML(
+        "beforeend",
+        `<div class="text-muted">Renewed until ${subscription.paid_until}</div>`
+      );
+    }
+
+    // Only memberships paid by card can renew automatically
+    if (subscription.payment_method !== "Card") {
+      return;
+    }
+    cardBody.insertAdjacentHTML(
+      "beforeend",
+      `<div class="form-check form-switch d-inline-block mt-2">
+        <input class="form-check-input" type="checkbox" id="autoRenew" ${subscription.auto_renew ? "checked" : ""} />
+        <label class="form-check-label" for="autoRenew">Renew automatically</label>
+      </div>`
+    );
+
+    const toggle = document.getElementById("autoRenew");
+    toggle.addEventListener("change", async () => {
+      try {
+        const response = await fetch("http://localhost:5200/api/v1/membership/auto-renew", {
+          method: "PUT",
+          headers: {
+            "Content-Type": "application/json",
+            Authorization: `Bearer ${localStorage.getItem("token")}`,
+          },
+          body: JSON.stringify({ user_id: userID, auto_renew: toggle.checked }),
+        });
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+        showCustomAlert(
+          toggle.checked
+            ? `Your membership will renew automatically on ${subscription.paid_until}.`
+            : `Automatic renewal is off. Your membership ends on ${subscription.paid_until}.`
+        );
+      } catch (error) {
+        console.error("Error updating automatic renewal:", error);
+        toggle.checked = !toggle.checked;
+        showCustomAlert(error.message);
+      }
+    });
+  }
+
   // Function to redirect to membershipCheckout.html with the selected plan
   function redirectToCheckout(plan) {
     const url = `membershipCheckout.html?plan=${encodeURIComponent(plan)}`;
@@ -118,6 +193,39 @@ document.addEventListener("DOMContentLoaded", () => {
     redirectToCheckout("VIP");
   });
 
-  // Fetch membership status on page load
+  // Show the prices and perks of the membership plan catalogue on the plan cards
+  async function fetchPlans() {
+    try {
+      const response = await fetch("http://localhost:5200/api/v1/membership/plans");
+      if (!response.ok) {
+        throw new Error(`HTTP error! Status: ${response.status}`);
+      }
+      const plans = await response.json();
+      plans.forEach((plan) => {
+        const card = Array.from(document.querySelectorAll(".card")).find((currentCard) => {
+          const header = currentCard.querySelector("h3");
+          return header && header.textContent.trim() === plan.membership_level;
+        });
+        if (!card) {
+          return;
+        }
+
+        card.querySelector(".card-title").textContent =
+          plan.price === 0
+            ? "Free"
+            : `$${plan.price.toFixed(0)} / ${
+                plan.duration_months === 1 ? "month" : `${plan.duration_months} months`
+              }`;
+        card.querySelector("ul").innerHTML = plan.perks
+          .map((perk) => `<li><i class="fas fa-check-circle text-success"></i> ${perk}</li>`)
+          .join("");
+      });
+    } catch (error) {
+      console.error("Error fetching membership plans:", error);
+    }
+  }
+
+  // Fetch the plans and membership status on page load
+  fetchPlans();
   fetchMembershipStatus();
 });
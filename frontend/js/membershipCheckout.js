@@ -1,18 +1,4 @@
 document.addEventListener("DOMContentLoaded", () => {
-  // Map for membership plans and prices
-  const membershipPlans = {
-    Premium: {
-      price: "$150 / month",
-      duration: 1, // Duration in months
-      amount: 150.0,
-    },
-    VIP: {
-      price: "$350 / month",
-      duration: 12, // Duration in months
-      amount: 350.0,
-    },
-  };
-
   // Function to get query parameters
   function getQueryParam(param) {
     const urlParams = new URLSearchParams(window.location.search);
@@ -63,31 +49,65 @@ document.addEventListener("DOMContentLoaded", () => {
   // Retrieve membership plan from query parameters
   const membershipPlan = getQueryParam("plan");
 
-  // Set Membership Plan, Final Price, Start Date, and End Date
-  let startDate, endDate, amount;
-  if (membershipPlan && membershipPlans[membershipPlan]) {
-    const planDetails = membershipPlans[membershipPlan];
-    document.getElementById("membershipLevel").textContent = membershipPlan;
-    document.getElementById("finalPrice").textContent = planDetails.price;
-
-    // Calculate Membership Start and End Dates
-    startDate = new Date();
-    endDate = new Date();
-    endDate.setMonth(startDate.getMonth() + planDetails.duration);
-    amount = planDetails.amount;
-
-    document.getElementById("membershipStartDate").textContent =
-      formatDate(startDate);
-    document.getElementById("membershipEndDate").textContent =
-      formatDate(endDate);
-  } else {
-    // Default values for Basic plan
-    document.getElementById("membershipLevel").textContent = "Basic";
-    document.getElementById("finalPrice").textContent = "$0.00";
-    document.getElementById("membershipStartDate").textContent = "N/A";
-    document.getElementById("membershipEndDate").textContent = "N/A";
+  // Show the quoted plan, price and period. Credit for the unused days of the current membership is
+  // deducted from the price, and credit beyond it is refunded.
+  let amount;
+  function showQuote(quote) {
+    amount = quote.amount_due;
+    if (quote.current_level === quote.membership_level) {
+      document.getElementById("membershipLevel").textContent = `${quote.membership_level} (renewal)`;
+    } else if (quote.current_level === "Basic") {
+      document.getElementById("membershipLevel").textContent = quote.membership_level;
+    } else {
+      document.getElementById("membershipLevel").textContent = `${quote.current_level} → ${quote.membership_level}`;
+    }
+
+    let finalPrice = `$${quote.amount_due.toFixed(2)}`;
+    if (quote.credit > 0) {
+      finalPrice += ` ($${quote.price.toFixed(2)} less $${quote.credit.toFixed(
+        2
+      )} credit for the unused days of your ${quote.current_level} membership)`;
+    }
+    if (quote.refund > 0) {
+      finalPrice += `. $${quote.refund.toFixed(2)} will be refunded to you.`;
+    }
+    document.getElementById("finalPrice").textContent = finalPrice;
+    document.getElementById("membershipStartDate").textContent = formatDate(
+      new Date(quote.start_date)
+    );
+    document.getElementById("membershipEndDate").textContent = formatDate(
+      new Date(quote.end_date)
+    );
   }
 
+  // Price the plan server-side from the membership plan catalogue
+  const payButton = document.getElementById("payButton");
+  payButton.disabled = true;
+  fetch(
+    `http://localhost:5200/api/v1/membership/quote?user_id=${encodeURIComponent(
+      userId
+    )}&membership_level=${encodeURIComponent(membershipPlan || "")}`,
+    {
+      headers: {
+        Authorization: `Bearer ${token}`,
+      },
+    }
+  )
+    .then(async (response) => {
+      if (!response.ok) {
+        throw new Error(await response.text());
+      }
+      return response.json();
+    })
+    .then((quote) => {
+      showQuote(quote);
+      payButton.disabled = false;
+    })
+    .catch((error) => {
+      console.error("Error fetching membership quote:", error);
+      showCustomAlert(error.message, "../membership.html");
+    });
+
   // Toggle payment method content
   const cardDetails = document.getElementById("cardDetails");
   const paynowQRCode = document.getElementById("paynowQRCode");
@@ -152,6 +172,9 @@ document.addEventListener("DOMContentLoaded", () => {
     }
   });
 
+  // Repeated clicks reuse the key so that the server processes the payment only once
+  let idempotencyKey = crypto.randomUUID();
+
   // Handle payment submission
   document.getElementById("payButton").addEventListener("click", () => {
     const selectedPaymentMethod = document.querySelector(
@@ -173,12 +196,13 @@ document.addEventListener("DOMContentLoaded", () => {
     // Prepare payment payload
     const payload = {
       user_id: userId,
-      membership_level: membershipPlan || "Basic",
-      amount: amount || 0.0,
+      membership_level: membershipPlan,
+      amount: amount,
       payment_method: selectedPaymentMethod,
-      start_date: startDate.toISOString().split("T")[0],
-      end_date: endDate.toISOString().split("T")[0],
       email: email,
+      auto_renew:
+        selectedPaymentMethod === "Card" &&
+        document.getElementById("autoRenew").checked,
     };
 
     // Send payment data to server
@@ -186,16 +210,40 @@ document.addEventListener("DOMContentLoaded", () => {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        Authorization: `Bearer ${localStorage.getItem("token")}`,
+        "Idempotency-Key": idempotencyKey,
       },
       body: JSON.stringify(payload),
     })
-      .then((response) => {
+      .then(async (response) => {
         if (!response.ok) {
-          throw new Error("Payment processing failed");
+          // The next attempt is a new request, possibly with changed details
+          idempotencyKey = crypto.randomUUID();
+          if (response.status === 422) {
+            // The price changed since the quote was shown; display the new one
+            const data = await response.json();
+            showQuote(data.quote);
+            throw new Error(
+              `The price has changed to $${data.quote.amount_due.toFixed(
+                2
+              )}. Please review it and confirm again.`
+            );
+          }
+          if (response.status === 402) {
+            throw new Error(await response.text());
+          }
+          throw new Error("Payment failed. Please try again.");
         }
         return response.json();
       })
       .then((data) => {
+        if (data.payment_status === "Pending") {
+          showCustomAlert(
+            "Please complete the PayNow payment in your banking app. Your membership will be upgraded once it is received.",
+            "../membership.html"
+          );
+          return;
+        }
         showCustomAlert(
           "Payment processed successfully!",
           "../membership.html"
@@ -204,7 +252,7 @@ document.addEventListener("DOMContentLoaded", () => {
       })
       .catch((error) => {
         console.error("Payment error:", error);
-        showCustomAlert("Payment failed. Please try again.");
+        showCustomAlert(error.message);
       });
   });
 });
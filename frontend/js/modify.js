@@ -8,7 +8,10 @@ document.addEventListener("DOMContentLoaded", () => {
 
     fetch(`http://localhost:5150/api/v1/vehicle/booking/${bookingId}`, {
       method: "PUT",
-      headers: { "Content-Type": "application/json" },
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${localStorage.getItem("token")}`,
+      },
       body: JSON.stringify({ return_date: newReturnDate }),
     })
       .then((response) => response.text())
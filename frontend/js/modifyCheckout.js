@@ -146,11 +146,10 @@ document.addEventListener("DOMContentLoaded", () => {
       }
     }
 
-    // Construct payload for API call
+    // Construct payload for API call; the new total is priced by the server
     const payload = {
       start_date_time: newBookingDatetime,
       end_date_time: newReturnDatetime,
-      total_price: parseFloat(extraAmountToPay || 0),
     };
 
     // Make API call to update booking
@@ -158,14 +157,31 @@ document.addEventListener("DOMContentLoaded", () => {
       method: "PUT",
       headers: {
         "Content-Type": "application/json",
+        Authorization: `Bearer ${localStorage.getItem("token")}`,
       },
       body: JSON.stringify(payload),
     })
-      .then((response) => {
+      .then(async (response) => {
+        if (response.status === 409) {
+          const data = await response.json();
+          throw new Error(
+            `This vehicle is already booked from ${data.conflict.booking_date} to ${data.conflict.return_date}. Please choose another time.`
+          );
+        }
+        if (response.status === 402) {
+          // The charge for the price difference was declined
+          throw new Error(await response.text());
+        }
         if (!response.ok) {
-          throw new Error("Failed to modify booking.");
+          throw new Error("Failed to update booking. Please try again.");
         }
 
+        // The server settles the difference against the original payment
+        const result = await response.json();
+        const settledAmount = result.settlement
+          ? result.settlement.difference
+          : parseFloat(extraAmountToPay || 0);
+
         // Construct query parameters for the modifyConfirmation page
         const queryParams = new URLSearchParams({
           booking_id: bookingId,
@@ -174,23 +190,29 @@ document.addEventListener("DOMContentLoaded", () => {
           originalBookingDateTime: originalBookingDateTime,
           originalReturnDateTime: originalReturnDateTime,
           additionalHours: additionalHours,
-          extraAmountToPay: extraAmountToPay,
+          extraAmountToPay: settledAmount.toFixed(2),
           rentalPricePerHour: rentalPricePerHour,
           location,
           chargeLevel: chargeLevel,
           totalDuration: totalDuration,
-          totalPrice: totalPrice,
+          totalPrice: result.total_price ?? totalPrice,
         });
 
+        // Tell the customer if their promo code no longer applies to the new times
+        const promoNotice =
+          result.quote && result.quote.promo_rejection
+            ? ` Your promo code was removed: ${result.quote.promo_rejection}.`
+            : "";
+
         // Show success alert and redirect to modifyConfirmation
         showCustomAlert(
-          "Your payment was successful! Redirecting to the next step...",
+          `Your payment was successful!${promoNotice} Redirecting to the next step...`,
           `../modifyConfirmation.html?${queryParams.toString()}`
         );
       })
       .catch((error) => {
         console.error("Error updating booking:", error);
-        alert("Failed to update booking. Please try again.");
+        alert(error.message);
       });
   });
 
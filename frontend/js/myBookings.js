@@ -32,7 +32,11 @@ document.addEventListener("DOMContentLoaded", () => {
   const userId = decodedToken.user_id;
 
   // Fetch bookings for the user
-  fetch(`http://localhost:5150/api/v1/vehicle/booking/user/${userId}`)
+  fetch(`http://localhost:5150/api/v1/vehicle/booking/user/${userId}`, {
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem("token")}`,
+    },
+  })
     .then((response) => {
       if (!response.ok) {
         throw new Error("Failed to fetch bookings.");
@@ -48,14 +52,13 @@ document.addEventListener("DOMContentLoaded", () => {
         return;
       }
 
-      const now = new Date();
-
-      // Separate active and past bookings
-      const activeBookings = bookings.filter(
-        (booking) => new Date(booking.return_date) > now
+      // Separate bookings that are still upcoming or in progress from finished ones
+      const openStatuses = ["pending_payment", "confirmed", "active"];
+      const activeBookings = bookings.filter((booking) =>
+        openStatuses.includes(booking.status)
       );
       const pastBookings = bookings.filter(
-        (booking) => new Date(booking.return_date) <= now
+        (booking) => !openStatuses.includes(booking.status)
       );
 
       // Render Active Bookings
@@ -84,6 +87,9 @@ document.addEventListener("DOMContentLoaded", () => {
                 <i class="fas fa-id-badge"></i> Booking ID: ${
                   booking.booking_id
                 } <br />
+                <i class="fas fa-info-circle"></i> Status: ${formatStatus(
+                  booking.status
+                )} <br />
                 <i class="fas fa-car"></i> Vehicle ID: ${
                   booking.vehicle_id
                 } <br />
@@ -124,18 +130,31 @@ document.addEventListener("DOMContentLoaded", () => {
                 )}
               </p>  
               <div class="button-group text-center mt-3">
+                ${
+                  booking.status === "active"
+                    ? `<button class="btn btn-success" onclick="endTrip(${booking.booking_id})">
+                  <i class="fas fa-flag-checkered"></i> End Trip
+                </button>`
+                    : `${
+                        booking.status === "confirmed"
+                          ? `<button class="btn btn-success me-2" onclick="startTrip(${booking.booking_id})">
+                  <i class="fas fa-key"></i> Start Trip
+                </button>`
+                          : ""
+                      }
                 <button class="btn btn-warning me-2" onclick="openModifyModal(${
                   booking.booking_id
                 }, '${booking.booking_date}', '${booking.return_date}', ${
-            booking.rental_price_per_hour
-          }, '${booking.vehicle_id}')">
+                        booking.rental_price_per_hour
+                      }, '${booking.vehicle_id}')">
                   <i class="fas fa-edit"></i> Modify
                 </button>
                 <button class="btn btn-danger" onclick="cancelBooking(${
                   booking.booking_id
                 })">
                   <i class="fas fa-trash-alt"></i> Cancel
-                </button>
+                </button>`
+                }
               </div>
             </div>
           </div>`;
@@ -169,6 +188,9 @@ document.addEventListener("DOMContentLoaded", () => {
                 <i class="fas fa-id-badge"></i> Booking ID: ${
                   booking.booking_id
                 } <br />
+                <i class="fas fa-info-circle"></i> Status: ${formatStatus(
+                  booking.status
+                )} <br />
                 <i class="fas fa-car"></i> Vehicle ID: ${
                   booking.vehicle_id
                 } <br />
@@ -527,20 +549,91 @@ document.addEventListener("DOMContentLoaded", () => {
 });
 
 // Cancel booking function
+// Human-readable label for a booking status
+function formatStatus(status) {
+  const labels = {
+    pending_payment: "Pending Payment",
+    confirmed: "Confirmed",
+    active: "In Progress",
+    completed: "Completed",
+    cancelled: "Cancelled",
+    no_show: "No-Show",
+  };
+  return labels[status] || status;
+}
+
+// Start or end a trip and refresh the booking list. The success message may be a function of the
+// response.
+function updateTrip(bookingId, action, successMessage) {
+  fetch(`http://localhost:5150/api/v1/vehicle/booking/${bookingId}/${action}`, {
+    method: "POST",
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem("token")}`,
+    },
+  })
+    .then(async (response) => {
+      if (!response.ok) {
+        throw new Error(await response.text());
+      }
+      const result = await response.json();
+      showCustomAlert(typeof successMessage === "function" ? successMessage(result) : successMessage);
+      setTimeout(() => window.location.reload(), 3000); // Refresh the page to update the booking list
+    })
+    .catch((error) => {
+      console.error(`Error calling ${action} trip:`, error);
+      showCustomAlert(error.message);
+    });
+}
+
+function startTrip(bookingId) {
+  updateTrip(bookingId, "start", "Trip started. Enjoy your drive!");
+}
+
+function endTrip(bookingId) {
+  if (!confirm("Are you sure you want to end this trip?")) {
+    return;
+  }
+
+  // The final bill follows once the vehicle has been inspected
+  updateTrip(
+    bookingId,
+    "end",
+    "Trip ended. Your final bill will be issued once the vehicle has been inspected. Thank you for driving with EcoDrive!"
+  );
+}
+
 function cancelBooking(bookingId) {
-  if (!confirm("Are you sure you want to cancel this booking?")) {
+  if (
+    !confirm(
+      "Are you sure you want to cancel this booking?\n\nCancellations more than 24 hours before the start are refunded in full, later cancellations are partially refunded and bookings that have started are not refunded."
+    )
+  ) {
     return;
   }
 
   fetch(`http://localhost:5150/api/v1/vehicle/booking/${bookingId}`, {
     method: "DELETE",
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem("token")}`,
+    },
   })
     .then((response) => {
       if (!response.ok) {
         throw new Error("Failed to cancel the booking.");
       }
-      showCustomAlert("Booking cancelled successfully.");
-      window.location.reload(); // Refresh the page to update the booking list
+      return response.json();
+    })
+    .then((result) => {
+      if (result.refund && result.refund.refund_amount > 0) {
+        showCustomAlert(
+          `Booking cancelled. $${result.refund.refund_amount.toFixed(2)} will be refunded and a credit note has been emailed to you.`
+        );
+      } else if (result.refund) {
+        showCustomAlert("Booking cancelled. This cancellation is not eligible for a refund.");
+      } else {
+        showCustomAlert("Booking cancelled successfully.");
+      }
+      setTimeout(() => window.location.reload(), 3000); // Refresh the page to update the booking list
     })
     .catch((error) => {
       console.error(error);
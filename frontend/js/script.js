@@ -18,9 +18,65 @@ document.addEventListener("DOMContentLoaded", () => {
   const navbarUrl = token ? "./memberNavbar.html" : "./navbar.html";
   loadComponent(navbarUrl, "navbar-container");
 
+  // Exchange the refresh token for a new access token shortly before it expires
+  const scheduleTokenRefresh = (accessToken) => {
+    try {
+      const { exp } = JSON.parse(atob(accessToken.split(".")[1]));
+      const delay = Math.max(exp * 1000 - Date.now() - 60000, 0);
+      setTimeout(refreshAccessToken, delay);
+    } catch (error) {
+      console.error("Error decoding token:", error);
+    }
+  };
+
+  const refreshAccessToken = () => {
+    fetch("http://localhost:5050/api/v1/authentication/refresh", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        refresh_token: localStorage.getItem("refreshToken"),
+      }),
+    })
+      .then((response) => {
+        if (!response.ok) {
+          throw new Error("Session expired.");
+        }
+        return response.json();
+      })
+      .then((data) => {
+        localStorage.setItem("token", data.token);
+        localStorage.setItem("refreshToken", data.refresh_token);
+        scheduleTokenRefresh(data.token);
+      })
+      .catch((error) => {
+        console.error("Error refreshing token:", error);
+        localStorage.clear();
+        window.location.href = "login.html";
+      });
+  };
+
+  if (token && localStorage.getItem("refreshToken")) {
+    scheduleTokenRefresh(token);
+  }
+
   // Load Footer
   loadComponent("./footer.html", "footer-container");
 
+  // Revoke the session on the server before clearing local state
+  window.signOut = function () {
+    fetch("http://localhost:5050/api/v1/authentication/logout", {
+      method: "POST",
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem("token")}`,
+      },
+    })
+      .catch((error) => console.error("Error signing out:", error))
+      .finally(() => {
+        localStorage.clear();
+        window.location.href = "index.html";
+      });
+  };
+
   // Load the customAlert.html into the container
   $("#customAlertContainer").load("./customAlert.html");
 
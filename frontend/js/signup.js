@@ -26,7 +26,10 @@ document.addEventListener("DOMContentLoaded", function () {
       headers: {
         "Content-Type": "application/json",
       },
-      body: JSON.stringify({ email: email }),
+      body: JSON.stringify({
+        email: email,
+        name: document.getElementById("firstName").value.trim(),
+      }),
     })
       .then((response) => {
         if (!response.ok) {
@@ -55,6 +58,9 @@ document.addEventListener("DOMContentLoaded", function () {
     return emailRegex.test(email);
   }
 
+  // Repeated submissions reuse the key so that the account is registered only once
+  let idempotencyKey = crypto.randomUUID();
+
   document.querySelector("form").addEventListener("submit", async (e) => {
     e.preventDefault();
 
@@ -72,7 +78,10 @@ document.addEventListener("DOMContentLoaded", function () {
       "http://localhost:5050/api/v1/authentication/register-user",
       {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+          "Content-Type": "application/json",
+          "Idempotency-Key": idempotencyKey,
+        },
         body: JSON.stringify({
           email,
           verification_code: verificationCode,
@@ -88,6 +97,7 @@ document.addEventListener("DOMContentLoaded", function () {
     if (response.ok) {
       showCustomAlert(data.message, "login.html");
     } else {
+      idempotencyKey = crypto.randomUUID();
       showCustomAlert(`Error: ${data.message || "Failed to register"}`);
     }
   });
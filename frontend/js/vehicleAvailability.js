@@ -19,7 +19,8 @@ document.addEventListener("DOMContentLoaded", async () => {
     const membershipResponse = await fetch(
       `http://localhost:5100/api/v1/user/membership/status?user_id=${encodeURIComponent(
         userId
-      )}`
+      )}`,
+      { headers: { Authorization: `Bearer ${token}` } }
     );
 
     if (!membershipResponse.ok) {
@@ -30,7 +31,8 @@ document.addEventListener("DOMContentLoaded", async () => {
 
     // Fetch active bookings for the user
     const bookingResponse = await fetch(
-      `http://localhost:5150/api/v1/vehicle/booking/user/${userId}`
+      `http://localhost:5150/api/v1/vehicle/booking/user/${userId}`,
+      { headers: { Authorization: `Bearer ${token}` } }
     );
 
     if (!bookingResponse.ok) {
@@ -130,7 +132,8 @@ document.addEventListener("DOMContentLoaded", async () => {
       const membershipResponse = await fetch(
         `http://localhost:5100/api/v1/user/membership/status?user_id=${encodeURIComponent(
           userId
-        )}`
+        )}`,
+        { headers: { Authorization: `Bearer ${token}` } }
       );
 
       if (!membershipResponse.ok) {
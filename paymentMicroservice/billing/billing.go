@@ -0,0 +1,147 @@
+package billing
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Trip billing policy, configurable with the environment variables named beside each rule
+var (
+	holdBufferPercent        = 20.0             // TRIP_HOLD_BUFFER_PERCENT: held above the booked price to cover fees at return
+	lateReturnGrace          = 15 * time.Minute // LATE_RETURN_GRACE_MINUTES: returns this late are not charged
+	lateReturnMultiplier     = 1.5              // LATE_RETURN_RATE_MULTIPLIER: each started late hour is billed at this multiple of its rental price
+	earlyReturnCreditPercent = 50.0             // EARLY_RETURN_CREDIT_PERCENT: share of the price of the unused whole hours credited on early return
+	minReturnChargeLevel     = 20               // MIN_RETURN_CHARGE_LEVEL: battery percentage vehicles must be returned with
+	lowChargeFeePerPercent   = 0.50             // LOW_CHARGE_FEE_PER_PERCENT: fee per percentage point below the minimum
+	cleaningFee              = 30.00            // CLEANING_FEE: charged when the vehicle is returned needing cleaning
+)
+
+// Init loads the trip billing policy from .env. The payment service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Load the billing policy, keeping the defaults for unset variables
+	holdBufferPercent = envFloat("TRIP_HOLD_BUFFER_PERCENT", holdBufferPercent, 0, 100)
+	lateReturnGrace = time.Duration(envFloat("LATE_RETURN_GRACE_MINUTES", lateReturnGrace.Minutes(), 0, 24*60) * float64(time.Minute))
+	lateReturnMultiplier = envFloat("LATE_RETURN_RATE_MULTIPLIER", lateReturnMultiplier, 0, 10)
+	earlyReturnCreditPercent = envFloat("EARLY_RETURN_CREDIT_PERCENT", earlyReturnCreditPercent, 0, 100)
+	minReturnChargeLevel = int(envFloat("MIN_RETURN_CHARGE_LEVEL", float64(minReturnChargeLevel), 0, 100))
+	lowChargeFeePerPercent = envFloat("LOW_CHARGE_FEE_PER_PERCENT", lowChargeFeePerPercent, 0, 100)
+	cleaningFee = envFloat("CLEANING_FEE", cleaningFee, 0, 1000)
+	log.Printf("Trip billing policy: %.0f%% hold buffer, late returns after %v billed at %.2fx, %.0f%% early return credit, %d%% minimum charge level at $%.2f per point, $%.2f cleaning fee.",
+		holdBufferPercent, lateReturnGrace, lateReturnMultiplier, earlyReturnCreditPercent, minReturnChargeLevel, lowChargeFeePerPercent, cleaningFee)
+}
+
+// envFloat reads a numeric environment variable between min and max, returning def if it is unset
+func envFloat(name string, def, min, max float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < min || parsed > max {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return parsed
+}
+
+// Trip describes a finished trip to be billed
+type Trip struct {
+	BookedPrice   float64   // Price agreed for the booked period, after discounts and modifications
+	LatePrice     float64   // Rental price of the started hours returned late, priced by rate period
+	UnusedPrice   float64   // What the unused whole hours contributed to the rental price, after any daily cap
+	BookingDate   time.Time // Booked start
+	ReturnDate    time.Time // Booked return
+	ReturnedAt    time.Time // Actual return
+	ChargeLevel   int       // Battery percentage at return
+	NeedsCleaning bool      // Whether the vehicle was returned needing cleaning
+}
+
+// LineItem represents one line of an itemised bill
+type LineItem struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// Bill represents the final bill of a trip
+type Bill struct {
+	BookedPrice       float64    `json:"booked_price"`
+	LateFee           float64    `json:"late_fee"`
+	EarlyReturnCredit float64    `json:"early_return_credit"`
+	LowChargeFee      float64    `json:"low_charge_fee"`
+	CleaningFee       float64    `json:"cleaning_fee"`
+	Total             float64    `json:"total"`
+	ReturnedAt        string     `json:"returned_at"`
+	LineItems         []LineItem `json:"line_items"`
+}
+
+// HoldAmount returns the amount pre-authorised when booking at price, leaving room for fees at return
+func HoldAmount(price float64) float64 {
+	return roundCents(price * (1 + holdBufferPercent/100))
+}
+
+// FinalBill computes the final bill of a trip from the booked price and the state of the return. Late
+// returns past the grace period are billed the rental price of each started hour at the late multiplier,
+// early returns are credited part of what the unused whole hours cost, and returning the vehicle with a low battery or needing
+// cleaning adds a fee.
+func FinalBill(trip Trip) Bill {
+	bill := Bill{
+		BookedPrice: roundCents(trip.BookedPrice),
+		ReturnedAt:  trip.ReturnedAt.Format("2006-01-02 15:04:05"),
+		LineItems:   []LineItem{{Description: "Booked rental", Amount: roundCents(trip.BookedPrice)}},
+	}
+
+	if late := trip.ReturnedAt.Sub(trip.ReturnDate); late > lateReturnGrace {
+		hours := math.Ceil(late.Hours())
+		bill.LateFee = roundCents(trip.LatePrice * lateReturnMultiplier)
+		bill.LineItems = append(bill.LineItems, LineItem{
+			Description: fmt.Sprintf("Late return, %.0f hours at %.2fx the rental price", hours, lateReturnMultiplier),
+			Amount:      bill.LateFee,
+		})
+	}
+
+	// Unused time is measured from the later of the booked start and the actual return
+	unusedFrom := trip.ReturnedAt
+	if unusedFrom.Before(trip.BookingDate) {
+		unusedFrom = trip.BookingDate
+	}
+	if hours := math.Floor(trip.ReturnDate.Sub(unusedFrom).Hours()); hours >= 1 && earlyReturnCreditPercent > 0 {
+		credit := roundCents(trip.UnusedPrice * earlyReturnCreditPercent / 100)
+		bill.EarlyReturnCredit = math.Min(credit, bill.BookedPrice)
+		bill.LineItems = append(bill.LineItems, LineItem{
+			Description: fmt.Sprintf("Early return credit, %.0f unused hours at %.0f%%", hours, earlyReturnCreditPercent),
+			Amount:      -bill.EarlyReturnCredit,
+		})
+	}
+
+	if missing := minReturnChargeLevel - trip.ChargeLevel; missing > 0 {
+		bill.LowChargeFee = roundCents(float64(missing) * lowChargeFeePerPercent)
+		bill.LineItems = append(bill.LineItems, LineItem{
+			Description: fmt.Sprintf("Low charge fee, returned at %d%% (minimum %d%%)", trip.ChargeLevel, minReturnChargeLevel),
+			Amount:      bill.LowChargeFee,
+		})
+	}
+
+	if trip.NeedsCleaning {
+		bill.CleaningFee = roundCents(cleaningFee)
+		bill.LineItems = append(bill.LineItems, LineItem{Description: "Cleaning fee", Amount: bill.CleaningFee})
+	}
+
+	bill.Total = roundCents(bill.BookedPrice + bill.LateFee - bill.EarlyReturnCredit + bill.LowChargeFee + bill.CleaningFee)
+	return bill
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
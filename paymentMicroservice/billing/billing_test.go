@@ -0,0 +1,80 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinalBill(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+
+	tests := []struct {
+		name  string
+		trip  Trip
+		want  Bill
+		lines int
+	}{
+		{
+			name:  "returned on time",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: end, ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, Total: 100},
+			lines: 1,
+		},
+		{
+			name:  "late within the grace period",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: end.Add(10 * time.Minute), ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, Total: 100},
+			lines: 1,
+		},
+		{
+			name:  "late past the grace period bills the price of each started hour",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: end.Add(61 * time.Minute), LatePrice: 50, ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, LateFee: 75, Total: 175},
+			lines: 2,
+		},
+		{
+			name:  "early return credits the price of unused whole hours",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: start.Add(90 * time.Minute), UnusedPrice: 50, ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, EarlyReturnCredit: 25, Total: 75},
+			lines: 2,
+		},
+		{
+			name:  "returned before the booked start",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: start.Add(-time.Hour), UnusedPrice: 100, ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, EarlyReturnCredit: 50, Total: 50},
+			lines: 2,
+		},
+		{
+			name:  "early return credit limited to what the unused hours added to a capped price",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: start.Add(24 * time.Hour), ReturnedAt: start.Add(time.Hour), UnusedPrice: 75, ChargeLevel: 80},
+			want:  Bill{BookedPrice: 100, EarlyReturnCredit: 37.5, Total: 62.5},
+			lines: 2,
+		},
+		{
+			name:  "low charge and cleaning fees",
+			trip:  Trip{BookedPrice: 100, BookingDate: start, ReturnDate: end, ReturnedAt: end, ChargeLevel: 10, NeedsCleaning: true},
+			want:  Bill{BookedPrice: 100, LowChargeFee: 5, CleaningFee: 30, Total: 135},
+			lines: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bill := FinalBill(test.trip)
+			if bill.BookedPrice != test.want.BookedPrice || bill.LateFee != test.want.LateFee || bill.EarlyReturnCredit != test.want.EarlyReturnCredit ||
+				bill.LowChargeFee != test.want.LowChargeFee || bill.CleaningFee != test.want.CleaningFee || bill.Total != test.want.Total {
+				t.Errorf("FinalBill() = %+v, want %+v", bill, test.want)
+			}
+			if len(bill.LineItems) != test.lines {
+				t.Errorf("FinalBill() has %d line items, want %d: %+v", len(bill.LineItems), test.lines, bill.LineItems)
+			}
+		})
+	}
+}
+
+func TestHoldAmount(t *testing.T) {
+	if got := HoldAmount(100); got != 120 {
+		t.Errorf("HoldAmount(100) = %v, want 120", got)
+	}
+}
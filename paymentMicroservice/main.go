@@ -1,30 +1,103 @@
 package main
 
 import (
+	"common/emailtemplate"
+	"common/idempotency"
+	"common/mailer"
+	"common/middleware"
 	"log"
 	"net/http"
+	"paymentMicroservice/billing"
+	"paymentMicroservice/outbox"
 	"paymentMicroservice/payment"
+	"paymentMicroservice/promotion"
+	"paymentMicroservice/provider"
+	"paymentMicroservice/saga"
+	"paymentMicroservice/subscription"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	// Load the JWT secret and internal API key used to authenticate requests
+	if err := middleware.Init(); err != nil {
+		log.Fatalf("Error initialising middleware: %v", err)
+	}
+
+	// Connect to the database storing idempotency keys
+	if err := idempotency.Init(); err != nil {
+		log.Fatalf("Error initialising idempotency keys: %v", err)
+	}
+
+	// Select the mail backend emails are delivered with
+	if err := mailer.Init(); err != nil {
+		log.Fatalf("Error configuring mailer: %v", err)
+	}
+
+	// Load the email template overrides
+	if err := emailtemplate.Init(); err != nil {
+		log.Fatalf("Error loading email templates: %v", err)
+	}
+
+	// Load the billing policy, select the payment provider and connect the promotion and subscription stores
+	billing.Init()
+	provider.Init()
+	promotion.Init()
+	subscription.Init()
+
+	// Connect to the payment database and load the cancellation policy
+	payment.Init()
+	saga.Init()
+	outbox.Init()
+
 	router := mux.NewRouter()
 
 	// Payment endpoints
 	router.HandleFunc("/api/v1/payment/real-time-bill", payment.CalculateRealTimeBill).Methods("GET")
-	router.HandleFunc("/api/v1/payment/process", payment.ProcessPayment).Methods("POST")
-	router.HandleFunc("/api/v1/membership/payment", payment.ProcessMembershipPayment).Methods("POST")
+	router.HandleFunc("/api/v1/payment/discount", payment.GetDiscount).Methods("GET")
+	router.HandleFunc("/api/v1/payment/process", middleware.RequireAuth(idempotency.Wrap(payment.ProcessPayment))).Methods("POST")
+	router.HandleFunc("/api/v1/payment/promo/evaluate", middleware.RequireInternal(promotion.EvaluatePromo)).Methods("POST")
+	router.HandleFunc("/api/v1/payment/booking/{id:[0-9]+}/refund", middleware.RequireInternal(payment.RefundBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/payment/booking/{id:[0-9]+}/settle", middleware.RequireInternal(payment.SettleBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/payment/booking/{id:[0-9]+}/finalise", middleware.RequireInternal(payment.FinaliseBooking)).Methods("POST")
+	// Payment provider webhooks are authenticated by their signature rather than a token
+	router.HandleFunc("/api/v1/payment/webhook", payment.HandleWebhook).Methods("POST")
+	router.HandleFunc("/api/v1/membership/payment", middleware.RequireAuth(idempotency.Wrap(payment.ProcessMembershipPayment))).Methods("POST")
+	router.HandleFunc("/api/v1/membership/plans", subscription.ListPlans).Methods("GET")
+	router.HandleFunc("/api/v1/membership/quote", middleware.RequireAuth(subscription.GetQuote)).Methods("GET")
+	router.HandleFunc("/api/v1/membership/subscription", middleware.RequireInternal(subscription.GetSubscription)).Methods("GET")
+	router.HandleFunc("/api/v1/membership/auto-renew", middleware.RequireAuth(subscription.SetAutoRenew)).Methods("PUT")
 
+	// Email outbox endpoints for inspecting and replaying failed sends
+	router.HandleFunc("/api/v1/payment/outbox", middleware.RequireInternalOrRole(outbox.ListEmails, middleware.RoleFinance, middleware.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/api/v1/payment/outbox/{id}/replay", middleware.RequireInternalOrRole(outbox.ReplayEmail, middleware.RoleFinance, middleware.RoleAdmin)).Methods("POST")
+
+	// Payment saga endpoint for inspecting checkouts that were compensated or need attention
+	router.HandleFunc("/api/v1/payment/sagas", middleware.RequireInternalOrRole(saga.ListSagas, middleware.RoleFinance, middleware.RoleAdmin)).Methods("GET")
 
 	// Add CORS support
 	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://127.0.0.1:5200"}), // Allowed origins
-		handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"}), // Allowed methods
-		handlers.AllowedHeaders([]string{"Content-Type"}),           // Allowed headers
+		handlers.AllowedOrigins([]string{"http://127.0.0.1:5200"}),                            // Allowed origins
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "OPTIONS"}),                    // Allowed methods
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Idempotency-Key"}), // Allowed headers
 	)(router)
 
+	// Deliver queued emails in the background
+	go outbox.StartWorker()
+
+	// Finish or roll back checkouts left in flight by a crash
+	go saga.StartRecovery(payment.ResumeBookingSaga)
+
+	// Retry refunds of booking charges and settlements of holds the payment provider failed to make
+	go payment.StartRefundWorker()
+
+	// Purge expired idempotency keys
+	go idempotency.StartCleanup()
+
+	// Renew, remind about and expire memberships, cancel unpaid membership payments and retry plan change refunds
+	go subscription.StartScheduler(payment.RenewMembership, payment.RemindMembershipRenewal, payment.ExpireMembership, payment.CancelMembershipPayment, payment.RefundReplacedMembership)
+
 	// Start the server
 	log.Println("Payment Microservice is running on port 5200...")
 	log.Fatal(http.ListenAndServe(":5200", corsHandler))
@@ -0,0 +1,270 @@
+package outbox
+
+import (
+	"common/mailer"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+const (
+	pollInterval = 5 * time.Second  // How often the worker looks for due emails
+	batchSize    = 10               // Emails claimed per poll
+	maxAttempts  = 8                // Attempts before an email is dead-lettered
+	baseBackoff  = 30 * time.Second // Delay after the first failed attempt, doubled on every retry
+	maxBackoff   = time.Hour        // Upper bound for the retry delay
+	claimLease   = 5 * time.Minute  // How long a claimed email is hidden from other workers while it is sent
+)
+
+// Init connects to the payment database configured in .env. The payment service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (outbox package)...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (outbox package) successful.")
+}
+
+// Email represents a row of the EmailOutbox table without its payload
+type Email struct {
+	EmailID       int     `json:"email_id"`
+	Recipient     string  `json:"recipient"`
+	Subject       string  `json:"subject"`
+	Status        string  `json:"status"`
+	Attempts      int     `json:"attempts"`
+	NextAttemptAt string  `json:"next_attempt_at"`
+	LastError     *string `json:"last_error,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	SentAt        *string `json:"sent_at,omitempty"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Enqueue stores a message in the outbox for delivery by the background worker. Given the transaction
+// that records what the email is about, the email is queued if and only if the transaction commits.
+func Enqueue(e execer, msg mailer.Message) (int64, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := e.Exec(`
+		INSERT INTO EmailOutbox (recipient, subject, payload, status, next_attempt_at)
+		VALUES (?, ?, ?, 'Pending', ?)`,
+		msg.To, msg.Subject, payload, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	emailID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Email %d to %s queued in the outbox.", emailID, msg.To)
+	return emailID, nil
+}
+
+// StartWorker delivers due outbox emails until the process exits
+func StartWorker() {
+	log.Println("Starting email outbox worker...")
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := processBatch(); err != nil {
+			log.Printf("Error processing email outbox: %v", err)
+		}
+	}
+}
+
+// processBatch attempts up to batchSize due emails
+func processBatch() error {
+	rows, err := db.Query(`
+		SELECT email_id FROM EmailOutbox
+		WHERE status = 'Pending' AND next_attempt_at <= ?
+		ORDER BY email_id
+		LIMIT ?`,
+		time.Now(), batchSize)
+	if err != nil {
+		return err
+	}
+	var due []int
+	for rows.Next() {
+		var emailID int
+		if err := rows.Scan(&emailID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, emailID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, emailID := range due {
+		if err := attempt(emailID); err != nil {
+			log.Printf("Error attempting outbox email %d: %v", emailID, err)
+		}
+	}
+	return nil
+}
+
+// attempt claims a pending email and sends it, recording the outcome. The claim pushes the email's
+// next attempt back by claimLease, so that several service replicas drain the outbox without sending
+// twice, and no lock is held while the SMTP server is called. An email that is not pending or that
+// another worker has claimed is skipped.
+func attempt(emailID int) error {
+	now := time.Now()
+	result, err := db.Exec(`
+		UPDATE EmailOutbox SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE email_id = ? AND status = 'Pending' AND next_attempt_at <= ?`,
+		now.Add(claimLease), emailID, now)
+	if err != nil {
+		return err
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		return nil
+	}
+
+	var payload []byte
+	var attempts int
+	err = db.QueryRow("SELECT payload, attempts FROM EmailOutbox WHERE email_id = ?", emailID).Scan(&payload, &attempts)
+	if err != nil {
+		return err
+	}
+
+	var msg mailer.Message
+	sendErr := json.Unmarshal(payload, &msg)
+	if sendErr == nil {
+		sendErr = mailer.Send(msg)
+	}
+
+	switch {
+	case sendErr == nil:
+		_, err = db.Exec("UPDATE EmailOutbox SET status = 'Sent', sent_at = ?, last_error = NULL WHERE email_id = ?", time.Now(), emailID)
+		log.Printf("Outbox email %d sent.", emailID)
+	case attempts >= maxAttempts:
+		_, err = db.Exec("UPDATE EmailOutbox SET status = 'Dead', last_error = ? WHERE email_id = ?", sendErr.Error(), emailID)
+		log.Printf("Outbox email %d dead-lettered after %d attempts: %v", emailID, attempts, sendErr)
+	default:
+		_, err = db.Exec("UPDATE EmailOutbox SET next_attempt_at = ?, last_error = ? WHERE email_id = ?",
+			time.Now().Add(backoff(attempts)), sendErr.Error(), emailID)
+		log.Printf("Outbox email %d failed (attempt %d), will retry: %v", emailID, attempts, sendErr)
+	}
+	return err
+}
+
+// backoff returns the delay before the next attempt after the given number of failures
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff << uint(attempts-1)
+	if delay > maxBackoff || delay <= 0 {
+		return maxBackoff
+	}
+	return delay
+}
+
+// ListEmails returns outbox emails, optionally filtered by status (Pending, Sent or Dead)
+func ListEmails(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	query := `
+		SELECT email_id, recipient, subject, status, attempts, next_attempt_at, last_error, created_at, sent_at
+		FROM EmailOutbox`
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY email_id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying email outbox: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	emails := []Email{}
+	for rows.Next() {
+		var email Email
+		var lastError, sentAt sql.NullString
+		if err := rows.Scan(&email.EmailID, &email.Recipient, &email.Subject, &email.Status, &email.Attempts,
+			&email.NextAttemptAt, &lastError, &email.CreatedAt, &sentAt); err != nil {
+			log.Printf("Error scanning email outbox row: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if lastError.Valid {
+			email.LastError = &lastError.String
+		}
+		if sentAt.Valid {
+			email.SentAt = &sentAt.String
+		}
+		emails = append(emails, email)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(emails)
+}
+
+// ReplayEmail puts a dead-lettered or sent email back into the queue for immediate delivery
+func ReplayEmail(w http.ResponseWriter, r *http.Request) {
+	emailID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE EmailOutbox SET status = 'Pending', attempts = 0, next_attempt_at = ?, last_error = NULL
+		WHERE email_id = ?`,
+		time.Now(), emailID)
+	if err != nil {
+		log.Printf("Error replaying outbox email %d: %v", emailID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Outbox email %d queued for replay.", emailID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf(`{"message": "Email queued for replay", "email_id": %d}`, emailID)))
+}
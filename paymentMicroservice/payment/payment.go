@@ -2,26 +2,75 @@ package payment
 
 import (
 	"bytes"
+	"common/emailtemplate"
+	"common/mailer"
+	"common/middleware"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"net/smtp"
 	"os"
+	"paymentMicroservice/billing"
+	"paymentMicroservice/outbox"
+	"paymentMicroservice/promotion"
+	"paymentMicroservice/provider"
+	"paymentMicroservice/saga"
+	"paymentMicroservice/subscription"
 	"strconv"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/jung-kurt/gofpdf"
 )
 
 var db *sql.DB
 
-func init() {
+// execer is satisfied by both *sql.DB and *sql.Tx, so that emails can be queued in a caller's transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// pendingPaymentError is returned by chargeSagaPayment while the customer has yet to complete an
+// asynchronous payment or authenticate a card payment, whose outcome arrives by webhook
+type pendingPaymentError struct {
+	ClientSecret string // Lets the client complete the payment, if it has to act on it
+}
+
+func (err *pendingPaymentError) Error() string {
+	return "payment is awaiting confirmation by the customer"
+}
+
+// errNoSavedPaymentMethod is returned when a customer who is not present is to be charged without a
+// payment method saved for later charges
+var errNoSavedPaymentMethod = errors.New("no payment method saved for later charges")
+
+// errPriceChanged is returned when the member discount derived at payment no longer agrees with the
+// price the booking was quoted at, e.g. because the membership changed during checkout
+var errPriceChanged = errors.New("your membership discount has changed since the booking was priced, please review the new price")
+
+// maxWebhookSize is the largest webhook payload accepted
+const maxWebhookSize = 64 << 10
+
+const (
+	refundInterval  = time.Minute // How often the refund worker retries refunds the provider has not made
+	refundBatchSize = 20          // Refunds retried per run
+)
+
+// Cancellation policy, configurable with CANCELLATION_FULL_REFUND_HOURS and CANCELLATION_PARTIAL_REFUND_PERCENT
+var (
+	fullRefundWindow     = 24 * time.Hour // Cancellations more than this long before the start are refunded in full
+	partialRefundPercent = 50.0           // Share refunded for later cancellations made before the start
+)
+
+// Init connects to the payment database and loads the cancellation policy from .env. The payment
+// service calls it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -46,368 +95,2318 @@ func init() {
 		log.Fatalf("Database connection test failed: %v", err)
 	}
 	log.Println("Database connection successful.")
+
+	// Load the cancellation policy, keeping the defaults for unset variables
+	if hours := os.Getenv("CANCELLATION_FULL_REFUND_HOURS"); hours != "" {
+		value, err := strconv.ParseFloat(hours, 64)
+		if err != nil || value < 0 {
+			log.Fatalf("Invalid CANCELLATION_FULL_REFUND_HOURS: %q", hours)
+		}
+		fullRefundWindow = time.Duration(value * float64(time.Hour))
+	}
+	if percent := os.Getenv("CANCELLATION_PARTIAL_REFUND_PERCENT"); percent != "" {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 || value > 100 {
+			log.Fatalf("Invalid CANCELLATION_PARTIAL_REFUND_PERCENT: %q", percent)
+		}
+		partialRefundPercent = value
+	}
+	log.Printf("Cancellation policy: full refund more than %v before start, %.0f%% refund until start.", fullRefundWindow, partialRefundPercent)
+}
+
+// TierBasedPricing applies the discount of a membership level to a rental price, returning the final
+// price and the discount. Levels without a discount row are not discounted.
+func TierBasedPricing(membershipLevel string, rentalPrice float64) (float64, float64, error) {
+	var discountPercentage float64
+	err := db.QueryRow("SELECT discount_percentage FROM Discounts WHERE membership_level = ?", membershipLevel).Scan(&discountPercentage)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+
+	// Calculate the discount to the cent, as the vehicle service does when quoting
+	discount := rentalPrice * discountPercentage / 100
+	discount = math.Round(discount*100) / 100
+	finalPrice := math.Round((rentalPrice-discount)*100) / 100
+	return finalPrice, discount, nil
+}
+
+// fetchMembershipLevel asks the user service for the membership level of a user
+func fetchMembershipLevel(userID int) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://user:5100/api/v1/user/membership/level?user_id=%d", userID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("membership level API returned status %d: %s", resp.StatusCode, string(body))
+	}
+	var status struct {
+		MembershipLevel string `json:"membership_level"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", err
+	}
+	return status.MembershipLevel, nil
+}
+
+// GetDiscount returns the discount percentage for a membership level.
+// The vehicle service calls it when quoting a booking.
+func GetDiscount(w http.ResponseWriter, r *http.Request) {
+	membershipLevel := r.URL.Query().Get("membership_level")
+	if membershipLevel == "" {
+		http.Error(w, "membership_level query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// Levels without a discount row are not discounted
+	var discountPercentage float64
+	err := db.QueryRow("SELECT discount_percentage FROM Discounts WHERE membership_level = ?", membershipLevel).Scan(&discountPercentage)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error fetching discount percentage: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"membership_level":    membershipLevel,
+		"discount_percentage": discountPercentage,
+	})
+}
+
+// CalculateRealTimeBill handles real-time billing calculation
+func CalculateRealTimeBill(w http.ResponseWriter, r *http.Request) {
+	membershipLevel := r.URL.Query().Get("membership_level")
+	durationHours, _ := strconv.Atoi(r.URL.Query().Get("duration_hours"))
+	pricePerHour, _ := strconv.ParseFloat(r.URL.Query().Get("price_per_hour"), 64)
+
+	var discountPercentage float64
+
+	// Fetch discount percentage
+	err := db.QueryRow("SELECT discount_percentage FROM Discounts WHERE membership_level = ?", membershipLevel).Scan(&discountPercentage)
+	if err != nil {
+		log.Printf("Error fetching discount percentage: %v", err)
+		http.Error(w, "Invalid membership level", http.StatusBadRequest)
+		return
+	}
+
+	// Calculate total price and discount
+	totalPrice := pricePerHour * float64(durationHours)
+	discount := totalPrice * (discountPercentage / 100)
+	finalPrice := totalPrice - discount
+
+	response := map[string]interface{}{
+		"final_price": finalPrice,
+		"discount":    discount,
+		"total_price": totalPrice,
+		"membership":  membershipLevel,
+		"duration":    durationHours,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func ProcessPayment(w http.ResponseWriter, r *http.Request) {
+	var payment struct {
+		UserID          int    `json:"user_id"`
+		VehicleID       string `json:"vehicle_id"`
+		StartDate       string `json:"start_date"`
+		EndDate         string `json:"end_date"`
+		PaymentMethod   string `json:"payment_method"`
+		PaymentMethodID string `json:"payment_method_id"`
+		PricePerHour    string `json:"price_per_hour"`
+		RentalDuration  string `json:"rental_duration"`
+		TotalPrice      string `json:"total_price"`
+		PromoCode       string `json:"promo_code"`
+		Email           string `json:"email"`
+	}
+
+	// Decode incoming JSON request
+	err := json.NewDecoder(r.Body).Decode(&payment)
+	if err != nil {
+		log.Printf("Error decoding payment request: %v", err)
+		http.Error(w, "Invalid payment request", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Processing payment for user_id=%d, vehicle_id=%s", payment.UserID, payment.VehicleID)
+
+	// Payments may only be made by the authenticated user
+	if !middleware.AuthorizeUser(r, payment.UserID) {
+		log.Printf("Rejected payment for user_id=%d from another user", payment.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Parse required fields to correct types
+	vehicleID, err := strconv.Atoi(payment.VehicleID)
+	if err != nil {
+		log.Printf("Error parsing vehicle_id: %v", err)
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	totalPrice, err := strconv.ParseFloat(payment.TotalPrice, 64)
+	if err != nil {
+		log.Printf("Error parsing total price: %v", err)
+		http.Error(w, "Invalid total price", http.StatusBadRequest)
+		return
+	}
+
+	// Convert dates to expected format (if needed)
+	startDate, err := time.Parse("2006-01-02T15:04", payment.StartDate)
+	if err != nil {
+		log.Printf("Error parsing start_date: %v", err)
+		http.Error(w, "Invalid start date format", http.StatusBadRequest)
+		return
+	}
+	endDate, err := time.Parse("2006-01-02T15:04", payment.EndDate)
+	if err != nil {
+		log.Printf("Error parsing end_date: %v", err)
+		http.Error(w, "Invalid end date format", http.StatusBadRequest)
+		return
+	}
+
+	// The booking and its payment are created by a saga whose progress is persisted, so that a
+	// failure part-way is compensated and a crash is recovered by saga.StartRecovery
+	s := &saga.Saga{
+		UserID:        payment.UserID,
+		VehicleID:     vehicleID,
+		BookingDate:   startDate,
+		ReturnDate:    endDate,
+		PaymentMethod: payment.PaymentMethod,
+		Email:         payment.Email,
+		UserName:      userName(r),
+		Locale:        r.Header.Get("Accept-Language"),
+		PromoCode:     promotion.Normalise(payment.PromoCode),
+	}
+	if err := saga.Create(s); err != nil {
+		log.Printf("Error starting payment saga: %v", err)
+		http.Error(w, "Failed to process payment", http.StatusInternalServerError)
+		return
+	}
+
+	// Reserve the booking with the vehicle service, which prices it server-side
+	rejection, err := createSagaBooking(s, r.Header.Get("Authorization"), totalPrice)
+	if err != nil {
+		log.Printf("Error creating booking for saga %d: %v", s.SagaID, err)
+		compensateBookingSaga(s, err.Error())
+		http.Error(w, "Failed to notify booking service", http.StatusInternalServerError)
+		return
+	}
+	if rejection != nil {
+		// Relay the clashing interval or the updated quote so the client can adjust its booking
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(rejection.StatusCode)
+		w.Write(rejection.Body)
+		return
+	}
+
+	// Apply the member's tier discount, which must agree with the price the vehicle service booked
+	if err := applyTierDiscount(s); err != nil {
+		log.Printf("Error applying the member discount for saga %d: %v", s.SagaID, err)
+		compensateBookingSaga(s, err.Error())
+		if err == errPriceChanged {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		http.Error(w, "Failed to apply membership discount", http.StatusBadGateway)
+		return
+	}
+
+	// Charge the price computed by the vehicle service rather than the client's total
+	paymentMethodID := payment.PaymentMethodID
+	if paymentMethodID == "" {
+		paymentMethodID = provider.DefaultPaymentMethod(payment.PaymentMethod)
+	}
+	if err := recordSagaPayment(s, paymentMethodID); err != nil {
+		log.Printf("Error storing payment details for saga %d: %v", s.SagaID, err)
+		compensateBookingSaga(s, err.Error())
+		if rejected, ok := err.(*promotion.RejectedError); ok {
+			// The promo code reached its limits since the booking was quoted
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": rejected.Reason,
+			})
+			return
+		}
+		http.Error(w, "Failed to store payment details", http.StatusInternalServerError)
+		return
+	}
+	err = chargeSagaPayment(s)
+	if pending, ok := err.(*pendingPaymentError); ok {
+		// The booking is confirmed by HandleWebhook once the customer has paid
+		s.Status = saga.StatusAwaitingPayment
+		if err := saga.Save(s); err != nil {
+			log.Printf("Error saving saga %d: %v", s.SagaID, err)
+		}
+		response := map[string]interface{}{
+			"message":        "Payment is awaiting confirmation",
+			"booking_id":     s.BookingID,
+			"payment_id":     s.PaymentID,
+			"payment_status": "Pending",
+		}
+		if pending.ClientSecret != "" {
+			response["client_secret"] = pending.ClientSecret
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	} else if err != nil {
+		log.Printf("Error charging payment_id %d for saga %d: %v", s.PaymentID, s.SagaID, err)
+		compensateBookingSaga(s, err.Error())
+		if declined, ok := err.(*provider.DeclinedError); ok {
+			http.Error(w, "Payment declined: "+declined.Message, http.StatusPaymentRequired)
+			return
+		}
+		http.Error(w, "Failed to charge payment", http.StatusBadGateway)
+		return
+	}
+
+	// Move the booking out of pending_payment now that it has been paid for
+	if err := completeBookingSaga(s); err != nil {
+		log.Printf("Error confirming booking_id %d for saga %d: %v", s.BookingID, s.SagaID, err)
+		compensateBookingSaga(s, err.Error())
+		http.Error(w, "Failed to confirm booking", http.StatusBadGateway)
+		return
+	}
+
+	// Respond with a JSON object
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Payment processed successfully",
+		"booking_id": s.BookingID,
+		"payment_id": s.PaymentID,
+	})
+}
+
+// bookingRejection holds a booking service response that the client has to act on
+type bookingRejection struct {
+	StatusCode int
+	Body       []byte
+}
+
+// createSagaBooking reserves the saga's booking with the vehicle service. A booking that clashes with
+// another or whose price changed is returned as a rejection and aborts the saga.
+func createSagaBooking(s *saga.Saga, authHeader string, clientTotal float64) (*bookingRejection, error) {
+	bookingPayload := map[string]interface{}{
+		"vehicle_id":        s.VehicleID,
+		"user_id":           s.UserID,
+		"booking_date":      s.BookingDate.Format("2006-01-02 15:04:05"),
+		"return_date":       s.ReturnDate.Format("2006-01-02 15:04:05"),
+		"total_price":       clientTotal,
+		"promo_code":        s.PromoCode,
+		"payment_reference": s.Reference,
+	}
+	log.Printf("Creating booking for saga %s", s.Reference)
+
+	jsonPayload, _ := json.Marshal(bookingPayload)
+	req, err := http.NewRequest("POST", "http://vehicle:5150/api/v1/vehicle/booking", bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authHeader)
+	req.Header.Set("Idempotency-Key", s.Reference)
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusUnprocessableEntity {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Booking API rejected the booking with status %d: %s", resp.StatusCode, string(body))
+		s.Status = saga.StatusAborted
+		s.LastError = fmt.Sprintf("booking rejected with status %d", resp.StatusCode)
+		if err := saga.Save(s); err != nil {
+			log.Printf("Error saving saga %d: %v", s.SagaID, err)
+		}
+		return &bookingRejection{StatusCode: resp.StatusCode, Body: body}, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("booking API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Parse the booking ID, the server-side price and the promo code it applied from the API response
+	var bookingResponse struct {
+		BookingID  int     `json:"booking_id"`
+		TotalPrice float64 `json:"total_price"`
+		Quote      struct {
+			BasePrice     float64 `json:"base_price"`
+			Discount      float64 `json:"discount"`
+			PromoCode     string  `json:"promo_code"`
+			PromoDiscount float64 `json:"promo_discount"`
+		} `json:"quote"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bookingResponse); err != nil {
+		return nil, fmt.Errorf("error decoding booking API response: %v", err)
+	}
+	log.Printf("Received booking ID from API: %d", bookingResponse.BookingID)
+
+	s.BookingID = bookingResponse.BookingID
+	s.BasePrice = bookingResponse.Quote.BasePrice
+	s.MemberDiscount = bookingResponse.Quote.Discount
+	s.TotalPrice = bookingResponse.TotalPrice
+	s.PromoCode = bookingResponse.Quote.PromoCode
+	s.PromoDiscount = bookingResponse.Quote.PromoDiscount
+	s.Status = saga.StatusBookingCreated
+	return nil, saga.Save(s)
+}
+
+// applyTierDiscount derives the level of the saga's user from the user service and applies its tier discount to the
+// rental price of the saga's booking. A promo code that does not stack with the member discount replaces
+// it, which the vehicle service's quote shows as a zero member discount. The booking was priced from the
+// same sources, so a total that no longer agrees returns errPriceChanged.
+func applyTierDiscount(s *saga.Saga) error {
+	membershipLevel, err := fetchMembershipLevel(s.UserID)
+	if err != nil {
+		return fmt.Errorf("error fetching membership level: %v", err)
+	}
+	_, discount, err := TierBasedPricing(membershipLevel, s.BasePrice)
+	if err != nil {
+		return fmt.Errorf("error fetching discount: %v", err)
+	}
+	if s.PromoCode != "" && s.MemberDiscount == 0 {
+		discount = 0
+	}
+
+	totalPrice := math.Round((s.BasePrice-discount-s.PromoDiscount)*100) / 100
+	if math.Abs(totalPrice-s.TotalPrice) >= 0.005 {
+		log.Printf("Saga %d was priced at $%.2f but the %s discount gives $%.2f", s.SagaID, s.TotalPrice, membershipLevel, totalPrice)
+		return errPriceChanged
+	}
+	s.MemberDiscount = discount
+	return nil
+}
+
+// recordSagaPayment stores the pending payment of the saga's booking before it is charged, together with
+// the redemption of its promo code. The payment, the redemption and the saga state are committed together,
+// so a recovered saga knows exactly whether the payment exists. A promo code that reached its limits since
+// the booking was quoted returns a *promotion.RejectedError.
+func recordSagaPayment(s *saga.Saga, paymentMethodID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+			INSERT INTO BookingPayment (user_id, booking_id, amount, payment_method, payment_status, discount, final_amount, email, provider_payment_method)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.UserID, s.BookingID, s.BasePrice, s.PaymentMethod, "Pending", s.MemberDiscount+s.PromoDiscount, s.TotalPrice, s.Email, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if s.PromoCode != "" {
+		if err := promotion.Redeem(tx, s.PromoCode, s.UserID, s.BookingID, int(paymentID), s.PromoDiscount); err != nil {
+			return err
+		}
+	}
+
+	s.PaymentID = int(paymentID)
+	s.Status = saga.StatusPaymentRecorded
+	if err := saga.SaveTx(tx, s); err != nil {
+		s.PaymentID = 0
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		s.PaymentID = 0
+		return err
+	}
+
+	log.Printf("Payment recorded for user_id: %d, booking_id: %d, payment_id: %d", s.UserID, s.BookingID, s.PaymentID)
+	return nil
+}
+
+// sagaAuthoriseRequest returns the authorisation of the saga's payment. Cards are held for the booked
+// price plus a buffer for fees at return and saved to the user's customer at the provider, so that
+// modifications and the final bill can charge them later, while asynchronous payments are collected
+// for the booked price. Its idempotency key is derived from the saga reference, so repeating the
+// request never authorises the payment twice.
+func sagaAuthoriseRequest(s *saga.Saga, paymentMethodID string) (provider.AuthoriseRequest, error) {
+	amount := billing.HoldAmount(s.TotalPrice)
+	customerID := ""
+	if s.PaymentMethod == "PayNow" {
+		amount = s.TotalPrice
+	} else {
+		var err error
+		if customerID, err = customerFor(s.UserID, s.Email); err != nil {
+			return provider.AuthoriseRequest{}, err
+		}
+	}
+	return provider.AuthoriseRequest{
+		Amount:        amount,
+		PaymentMethod: paymentMethodID,
+		Description:   fmt.Sprintf("EcoDrive booking %d", s.BookingID),
+		Metadata: map[string]string{
+			"booking_id": strconv.Itoa(s.BookingID),
+			"payment_id": strconv.Itoa(s.PaymentID),
+			"reference":  s.Reference,
+		},
+		IdempotencyKey: s.Reference + "-authorise",
+		Asynchronous:   s.PaymentMethod == "PayNow",
+		Customer:       customerID,
+		SaveForLater:   customerID != "",
+	}, nil
+}
+
+// chargeSagaPayment places the pre-authorisation hold of the saga's payment with the payment provider,
+// unless the status recorded on the payment shows that a recovered saga already did. The hold is
+// captured by FinaliseBooking at trip end. A declined payment is marked as failed and returned as a
+// *provider.DeclinedError, and a payment the customer has yet to complete returns a
+// *pendingPaymentError.
+func chargeSagaPayment(s *saga.Saga) error {
+	var status, paymentMethodID string
+	err := db.QueryRow(`
+		SELECT payment_status, COALESCE(provider_payment_method, '')
+		FROM BookingPayment WHERE payment_id = ?`, s.PaymentID).Scan(&status, &paymentMethodID)
+	if err != nil {
+		return err
+	}
+
+	if status == "Pending" {
+		req, err := sagaAuthoriseRequest(s, paymentMethodID)
+		if err != nil {
+			return err
+		}
+		result, err := provider.Authorise(req)
+		if _, declined := err.(*provider.DeclinedError); declined {
+			if _, err := db.Exec("UPDATE BookingPayment SET payment_status = 'Failed' WHERE payment_id = ?", s.PaymentID); err != nil {
+				log.Printf("Error marking payment_id %d as failed: %v", s.PaymentID, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if result.Status == provider.StatusPending || result.Status == provider.StatusActionRequired {
+			if _, err := db.Exec("UPDATE BookingPayment SET provider_payment_id = ? WHERE payment_id = ?", result.ID, s.PaymentID); err != nil {
+				return err
+			}
+			log.Printf("Payment_id %d is awaiting payment as %s.", s.PaymentID, result.ID)
+			return &pendingPaymentError{ClientSecret: result.ClientSecret}
+		}
+		if result.Status != provider.StatusAuthorised {
+			return fmt.Errorf("payment %s was not authorised: %s", result.ID, result.Status)
+		}
+
+		_, err = db.Exec("UPDATE BookingPayment SET payment_status = 'Authorised', provider_payment_id = ?, authorised_amount = ? WHERE payment_id = ?", result.ID, result.Amount, s.PaymentID)
+		if err != nil {
+			return err
+		}
+		log.Printf("Payment processed successfully for user_id: %d, booking_id: %d, payment_id: %d: $%.2f held as %s", s.UserID, s.BookingID, s.PaymentID, result.Amount, result.ID)
+		return nil
+	}
+
+	switch status {
+	case "Authorised", "Completed":
+		return nil
+	default:
+		return fmt.Errorf("payment_id %d cannot be charged with status %s", s.PaymentID, status)
+	}
+}
+
+// completeBookingSaga confirms the saga's booking and queues its invoice in the transaction that
+// completes the saga, so the invoice is queued once. Only a failure to confirm is returned; the
+// booking is paid for and confirmed by then, so later failures are logged.
+func completeBookingSaga(s *saga.Saga) error {
+	if err := confirmBooking(s.BookingID); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		// Recovery will confirm the booking again, which is harmless, and then queue the invoice
+		log.Printf("Error starting transaction for saga %d: %v", s.SagaID, err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	err = generateInvoiceAndQueueEmail(
+		tx,
+		s.BookingID,
+		s.PaymentID,
+		s.UserID,
+		s.BasePrice,
+		s.MemberDiscount+s.PromoDiscount,
+		s.TotalPrice,
+		s.PaymentMethod,
+		s.Email,
+		s.UserName,
+		s.Locale,
+		s.BookingDate,
+		s.ReturnDate,
+	)
+	if err != nil {
+		log.Printf("Error queueing invoice email for payment_id %d: %v", s.PaymentID, err)
+	}
+
+	s.Status = saga.StatusCompleted
+	s.LastError = ""
+	if err := saga.SaveTx(tx, s); err != nil {
+		log.Printf("Error saving saga %d: %v", s.SagaID, err)
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing saga %d: %v", s.SagaID, err)
+	}
+	return nil
+}
+
+// compensateBookingSaga undoes the steps a saga has taken by voiding its payment, giving back its promo
+// code and releasing its booking. All actions are safe to repeat, so a failed compensation is retried by
+// the recovery worker.
+func compensateBookingSaga(s *saga.Saga, reason string) error {
+	log.Printf("Compensating saga %d from %s: %s", s.SagaID, s.Status, reason)
+	s.Status = saga.StatusCompensating
+	s.LastError = reason
+	if err := saga.Save(s); err != nil {
+		log.Printf("Error saving saga %d: %v", s.SagaID, err)
+	}
+
+	if s.PaymentID != 0 {
+		if err := voidSagaPayment(s); err != nil {
+			log.Printf("Error voiding payment_id %d of saga %d: %v", s.PaymentID, s.SagaID, err)
+			return err
+		}
+	}
+	if s.BookingID != 0 {
+		if err := promotion.Release(db, s.BookingID); err != nil {
+			log.Printf("Error releasing promo code of saga %d: %v", s.SagaID, err)
+			return err
+		}
+	}
+	if err := releaseBooking(s.Reference); err != nil {
+		log.Printf("Error releasing booking of saga %d: %v", s.SagaID, err)
+		return err
+	}
+
+	s.Status = saga.StatusCompensated
+	return saga.Save(s)
+}
+
+// ResumeBookingSaga drives a stalled saga to a terminal state for the recovery worker. A recorded
+// payment is charged and rolled forward; earlier steps are rolled back, since the user's token that
+// created the booking is no longer available to carry on.
+func ResumeBookingSaga(s *saga.Saga) error {
+	switch s.Status {
+	case saga.StatusPaymentRecorded:
+		err := chargeSagaPayment(s)
+		if _, pending := err.(*pendingPaymentError); pending {
+			s.Status = saga.StatusAwaitingPayment
+			return saga.Save(s)
+		} else if err != nil {
+			return compensateBookingSaga(s, err.Error())
+		}
+		if err := completeBookingSaga(s); err != nil {
+			return compensateBookingSaga(s, err.Error())
+		}
+		return nil
+	case saga.StatusAwaitingPayment:
+		// The webhook may have completed the payment without finishing the saga
+		var status string
+		if err := db.QueryRow("SELECT payment_status FROM BookingPayment WHERE payment_id = ?", s.PaymentID).Scan(&status); err != nil {
+			return err
+		}
+		if status != "Completed" && status != "Authorised" {
+			return compensateBookingSaga(s, "the payment was not completed in time")
+		}
+		if err := completeBookingSaga(s); err != nil {
+			return compensateBookingSaga(s, err.Error())
+		}
+		return nil
+	case saga.StatusCompensating:
+		return compensateBookingSaga(s, s.LastError)
+	default:
+		return compensateBookingSaga(s, "checkout was interrupted before the payment was recorded")
+	}
+}
+
+// voidSagaPayment voids the payment of a saga that is being rolled back, releasing the hold on an
+// authorised payment or refunding a captured one. A payment still pending may have been authorised
+// before the saga stopped, so its authorisation is replayed to find out.
+func voidSagaPayment(s *saga.Saga) error {
+	var status, providerPaymentID, paymentMethodID string
+	var finalAmount float64
+	err := db.QueryRow(`
+		SELECT payment_status, COALESCE(provider_payment_id, ''), COALESCE(provider_payment_method, ''), final_amount
+		FROM BookingPayment WHERE payment_id = ?`, s.PaymentID).Scan(&status, &providerPaymentID, &paymentMethodID, &finalAmount)
+	if err != nil {
+		return err
+	}
+
+	if status == "Pending" {
+		req, err := sagaAuthoriseRequest(s, paymentMethodID)
+		if err != nil {
+			return err
+		}
+		result, err := provider.Authorise(req)
+		if _, declined := err.(*provider.DeclinedError); declined {
+			_, err := db.Exec("UPDATE BookingPayment SET payment_status = 'Failed' WHERE payment_id = ?", s.PaymentID)
+			return err
+		} else if err != nil {
+			return err
+		}
+		providerPaymentID, status = result.ID, "Authorised"
+		if result.Status == provider.StatusCaptured {
+			status = "Completed"
+		}
+	}
+
+	switch status {
+	case "Authorised":
+		if _, err := provider.Void(providerPaymentID, s.Reference+"-void"); err != nil {
+			return err
+		}
+	case "Completed":
+		if _, err := provider.Refund(providerPaymentID, finalAmount, s.Reference+"-refund"); err != nil {
+			return err
+		}
+	default:
+		// Failed and voided payments hold no funds
+		return nil
+	}
+
+	_, err = db.Exec("UPDATE BookingPayment SET payment_status = 'Voided', provider_payment_id = ? WHERE payment_id = ?", providerPaymentID, s.PaymentID)
+	return err
+}
+
+// releaseBooking asks the vehicle service to cancel the booking created with a saga reference, if any
+func releaseBooking(reference string) error {
+	apiURL := fmt.Sprintf("http://vehicle:5150/api/v1/vehicle/booking/reference/%s/release", reference)
+	req, err := http.NewRequest("POST", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// No booking means the vehicle service never created one, so there is nothing to release
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("booking release returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// HandleWebhook receives payment provider webhooks. Each event is verified against the webhook secret
+// and recorded by ID in the same transaction that applies it, so a redelivered event is acknowledged
+// without being applied twice. Pending booking and membership payments are completed or failed, and
+// the booking or membership they pay for is only confirmed once the payment has succeeded.
+func HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+	event, err := provider.ParseWebhook(payload, r.Header.Get(provider.SignatureHeader))
+	if err == provider.ErrInvalidSignature {
+		log.Printf("Rejected webhook with an invalid signature from %s", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error decoding webhook: %v", err)
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	var paymentStatus string
+	switch event.Type {
+	case provider.EventPaymentAuthorised:
+		// A card payment the customer authenticated, e.g. with 3D Secure
+		paymentStatus = "Authorised"
+	case provider.EventPaymentSucceeded:
+		paymentStatus = "Completed"
+	case provider.EventPaymentFailed:
+		paymentStatus = "Failed"
+	default:
+		// Voids are made synchronously, so their events need no action
+		log.Printf("Ignoring webhook event %s of type %s", event.ID, event.Type)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"received": true})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO PaymentWebhookEvents (event_id, event_type, provider_payment_id) VALUES (?, ?, ?)", event.ID, event.Type, event.PaymentID)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		log.Printf("Ignoring redelivered webhook event %s", event.ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"received": true, "duplicate": true})
+		return
+	} else if err != nil {
+		log.Printf("Error recording webhook event %s: %v", event.ID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply the event to the payment it is about, and carry on with its booking or membership once committed
+	var followUp func()
+	if _, ok := event.Metadata["membership_payment_id"]; ok {
+		followUp, err = applyMembershipWebhook(tx, event, paymentStatus)
+	} else {
+		followUp, err = applyBookingWebhook(tx, event, paymentStatus)
+	}
+	if err == sql.ErrNoRows {
+		// Not one of ours, e.g. a payment made from the provider's dashboard
+		log.Printf("No payment found for webhook event %s about %s", event.ID, event.PaymentID)
+	} else if err != nil {
+		log.Printf("Error applying webhook event %s: %v", event.ID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing webhook event %s: %v", event.ID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if followUp != nil {
+		followUp()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"received": true})
+}
+
+// applyBookingWebhook records the outcome of an asynchronous booking payment and returns the step that
+// completes or rolls back its saga. A payment that succeeds after its saga was rolled back is refunded.
+func applyBookingWebhook(tx *sql.Tx, event provider.Event, paymentStatus string) (func(), error) {
+	var paymentID int
+	var status string
+	err := tx.QueryRow("SELECT payment_id, payment_status FROM BookingPayment WHERE provider_payment_id = ? FOR UPDATE", event.PaymentID).
+		Scan(&paymentID, &status)
+	if err == sql.ErrNoRows && event.Metadata["payment_id"] != "" {
+		// The webhook arrived before the provider's payment ID was stored
+		err = tx.QueryRow("SELECT payment_id, payment_status FROM BookingPayment WHERE payment_id = ? AND provider_payment_id IS NULL FOR UPDATE", event.Metadata["payment_id"]).
+			Scan(&paymentID, &status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status != "Pending" {
+		if paymentStatus == "Completed" && (status == "Voided" || status == "Failed") {
+			log.Printf("Refunding late payment %s of payment_id %d with status %s", event.PaymentID, paymentID, status)
+			if _, err := provider.Refund(event.PaymentID, event.Amount, "webhook-"+event.ID+"-refund"); err != nil {
+				return nil, err
+			}
+		}
+		if paymentStatus == "Authorised" && (status == "Voided" || status == "Failed") {
+			log.Printf("Voiding late hold %s of payment_id %d with status %s", event.PaymentID, paymentID, status)
+			if _, err := provider.Void(event.PaymentID, "webhook-"+event.ID+"-void"); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	if paymentStatus == "Authorised" {
+		_, err = tx.Exec("UPDATE BookingPayment SET payment_status = ?, provider_payment_id = ?, authorised_amount = ? WHERE payment_id = ?", paymentStatus, event.PaymentID, event.Amount, paymentID)
+	} else {
+		_, err = tx.Exec("UPDATE BookingPayment SET payment_status = ?, provider_payment_id = ? WHERE payment_id = ?", paymentStatus, event.PaymentID, paymentID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Payment_id %d is %s after webhook event %s", paymentID, paymentStatus, event.ID)
+
+	return func() {
+		s, err := saga.FindByPaymentID(paymentID)
+		if err != nil {
+			log.Printf("Error retrieving saga of payment_id %d: %v", paymentID, err)
+			return
+		}
+		if s.Status != saga.StatusAwaitingPayment && s.Status != saga.StatusPaymentRecorded {
+			return
+		}
+		if paymentStatus == "Failed" {
+			compensateBookingSaga(s, "payment failed: "+event.FailureMessage)
+			return
+		}
+		if err := completeBookingSaga(s); err != nil {
+			log.Printf("Error confirming booking_id %d for saga %d: %v", s.BookingID, s.SagaID, err)
+			compensateBookingSaga(s, err.Error())
+		}
+	}, nil
+}
+
+// applyMembershipWebhook records the outcome of an asynchronous membership payment and returns the
+// step that activates the membership. Only Pending payments are applied; a Processing card payment is
+// completed by the request charging it. A card payment the customer authenticated is marked Processing
+// and captured once the event is committed. A payment that succeeds after it was failed is refunded.
+func applyMembershipWebhook(tx *sql.Tx, event provider.Event, paymentStatus string) (func(), error) {
+	var m membershipPayment
+	var status, startDate, endDate string
+	var proration []byte
+	err := tx.QueryRow(`
+		SELECT membership_payment_id, user_id, membership_level, amount, COALESCE(payment_method, ''), payment_status,
+			COALESCE(email, ''), COALESCE(user_name, ''), COALESCE(locale, ''), start_date, end_date, proration
+		FROM MembershipPayment
+		WHERE provider_payment_id = ? OR (membership_payment_id = ? AND provider_payment_id IS NULL)
+		FOR UPDATE`, event.PaymentID, event.Metadata["membership_payment_id"]).
+		Scan(&m.PaymentID, &m.UserID, &m.MembershipLevel, &m.Amount, &m.PaymentMethod, &status,
+			&m.Email, &m.UserName, &m.Locale, &startDate, &endDate, &proration)
+	if err != nil {
+		return nil, err
+	}
+	if proration != nil {
+		m.Proration = &subscription.Quote{}
+		if err := json.Unmarshal(proration, m.Proration); err != nil {
+			return nil, err
+		}
+	}
+	m.ProviderPaymentID = event.PaymentID
+	if m.StartDate, err = time.Parse("2006-01-02", startDate); err != nil {
+		return nil, err
+	}
+	if m.EndDate, err = time.Parse("2006-01-02", endDate); err != nil {
+		return nil, err
+	}
+
+	if status != "Pending" {
+		if paymentStatus == "Completed" && status == "Failed" {
+			log.Printf("Refunding late payment %s of membership payment_id %d", event.PaymentID, m.PaymentID)
+			if _, err := provider.Refund(event.PaymentID, event.Amount, "webhook-"+event.ID+"-refund"); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	if paymentStatus == "Authorised" {
+		// Payments that time out while Processing are voided by the membership scheduler
+		_, err = tx.Exec("UPDATE MembershipPayment SET payment_status = 'Processing', provider_payment_id = ? WHERE membership_payment_id = ?", event.PaymentID, m.PaymentID)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Membership payment_id %d is authorised after webhook event %s", m.PaymentID, event.ID)
+		return func() { captureMembershipPayment(m) }, nil
+	}
+
+	_, err = tx.Exec("UPDATE MembershipPayment SET payment_status = ?, provider_payment_id = ? WHERE membership_payment_id = ?", paymentStatus, event.PaymentID, m.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Membership payment_id %d is %s after webhook event %s", m.PaymentID, paymentStatus, event.ID)
+
+	if paymentStatus != "Completed" {
+		return nil, nil
+	}
+	return func() {
+		if err := activateMembership(m); err != nil {
+			log.Printf("Error activating membership of payment_id %d: %v", m.PaymentID, err)
+		}
+	}, nil
+}
+
+// captureMembershipPayment collects a membership payment authorised by the customer after checkout and
+// activates the membership. A hold that cannot be captured is voided and its payment failed.
+func captureMembershipPayment(m membershipPayment) {
+	idempotencyKey := fmt.Sprintf("membership-%d", m.PaymentID)
+	if _, err := provider.Capture(m.ProviderPaymentID, m.Amount, idempotencyKey+"-capture"); err != nil {
+		log.Printf("[ERROR] Capturing membership payment_id %d: %v", m.PaymentID, err)
+		if _, err := provider.Void(m.ProviderPaymentID, idempotencyKey+"-void"); err != nil {
+			log.Printf("[ERROR] Voiding membership payment %s: %v", m.ProviderPaymentID, err)
+		}
+		setMembershipPaymentStatus(m.PaymentID, "Failed")
+		return
+	}
+	result, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Completed' WHERE membership_payment_id = ? AND payment_status = 'Processing'", m.PaymentID)
+	if err != nil {
+		log.Printf("[ERROR] Completing membership payment_id %d: %v", m.PaymentID, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		// Cancelled by the scheduler in the meantime, which refunds what was captured
+		return
+	}
+	if err := activateMembership(m); err != nil {
+		log.Printf("Error activating membership of payment_id %d: %v", m.PaymentID, err)
+	}
+}
+
+// generateInvoice generates an invoice PDF and returns it as a byte slice. The rental price, discount
+// and total match the amount, discount and final amount recorded on the payment.
+func generateInvoice(bookingID int, paymentID int, userID int, amount, discount, totalPrice float64, paymentMethod string, startDate, endDate time.Time) ([]byte, error) {
+	// Create a new PDF document
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 16)
+
+	// Header
+	pdf.SetFillColor(25, 135, 84) // Green colour scheme
+	pdf.SetTextColor(255, 255, 255)
+	pdf.CellFormat(0, 10, "EcoDrive Invoice", "1", 1, "C", true, 0, "")
+
+	// Add content
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetFont("Arial", "", 12)
+
+	// Booking and payment details
+	pdf.Ln(10)
+	pdf.Cell(40, 10, fmt.Sprintf("Booking ID: %d", bookingID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Payment ID: %d", paymentID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("User ID: %d", userID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Rental Price: $%.2f", amount))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Discount: -$%.2f", discount))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Total Price: $%.2f", totalPrice))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Payment Method: %s", paymentMethod))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Start Date: %s", startDate.Format("2006-01-02 15:04:05")))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("End Date: %s", endDate.Format("2006-01-02 15:04:05")))
+
+	// Footer
+	pdf.Ln(20)
+	pdf.SetFont("Arial", "I", 10)
+	pdf.SetTextColor(128, 128, 128)
+	pdf.CellFormat(0, 10, "Thank you for choosing EcoDrive. Drive safe!", "", 1, "C", false, 0, "")
+
+	// Write PDF to memory buffer
+	buf := new(bytes.Buffer)
+	err := pdf.Output(buf)
+	if err != nil {
+		log.Printf("Error generating PDF: %v", err)
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// confirmBooking tells the vehicle service that a booking has been paid for
+func confirmBooking(bookingID int) error {
+	apiURL := fmt.Sprintf("http://vehicle:5150/api/v1/vehicle/booking/%d/confirm", bookingID)
+	req, err := http.NewRequest("POST", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("booking confirmation returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// queueEmailWithAttachment queues an email with a PDF attachment in the outbox for asynchronous delivery
+func queueEmailWithAttachment(e execer, to string, email emailtemplate.Rendered, fileName string, fileBytes []byte) error {
+	_, err := outbox.Enqueue(e, mailer.Message{
+		To:       to,
+		Subject:  email.Subject,
+		HTMLBody: email.HTML,
+		TextBody: email.Text,
+		Attachments: []mailer.Attachment{
+			{FileName: fileName, ContentType: "application/pdf", Data: fileBytes},
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing email with attachment: %v", err)
+		return err
+	}
+	return nil
+}
+
+// userName returns the name of the authenticated user, used to greet them in emails
+func userName(r *http.Request) string {
+	identity, ok := middleware.IdentityFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return identity.Name
+}
+
+// bookingInvoiceEmail holds the data rendered into the booking invoice email
+type bookingInvoiceEmail struct {
+	Name       string
+	BookingID  int
+	PaymentID  int
+	Amount     float64
+	Discount   float64
+	TotalPrice float64
+}
+
+// membershipInvoiceEmail holds the data rendered into the membership invoice email
+type membershipInvoiceEmail struct {
+	Name            string
+	PaymentID       int
+	MembershipLevel string
+	Amount          float64
+	PaymentMethod   string
+	StartDate       string
+	EndDate         string
+}
+
+// generateInvoiceAndQueueEmail generates an invoice and queues it as an email attachment
+func generateInvoiceAndQueueEmail(e execer, bookingID int, paymentID int, userID int, amount, discount, totalPrice float64, paymentMethod, userEmail, userName, locale string, startDate, endDate time.Time) error {
+	// Generate the invoice in memory
+	fileBytes, err := generateInvoice(bookingID, paymentID, userID, amount, discount, totalPrice, paymentMethod, startDate, endDate)
+	if err != nil {
+		return err
+	}
+
+	// Email content in the user's language
+	email, err := emailtemplate.Render("booking_invoice", locale, bookingInvoiceEmail{
+		Name:       userName,
+		BookingID:  bookingID,
+		PaymentID:  paymentID,
+		Amount:     amount,
+		Discount:   discount,
+		TotalPrice: totalPrice,
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering invoice email: %v", err)
+	}
+
+	// Send the email with the invoice attached
+	fileName := fmt.Sprintf("Invoice_%d.pdf", paymentID)
+	return queueEmailWithAttachment(e, userEmail, email, fileName, fileBytes)
+}
+
+// RefundBooking refunds the payment of a cancelled booking according to the cancellation policy, releases
+// its promo code and emails a credit note for the refunded amount. Only the vehicle service calls it.
+func RefundBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	var cancellation struct {
+		BookingDate string `json:"booking_date"`
+		CancelledAt string `json:"cancelled_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cancellation); err != nil {
+		log.Printf("Error decoding refund request: %v", err)
+		http.Error(w, "Invalid refund request", http.StatusBadRequest)
+		return
+	}
+	startDate, err := time.Parse("2006-01-02 15:04:05", cancellation.BookingDate)
+	if err != nil {
+		http.Error(w, "Invalid booking date format", http.StatusBadRequest)
+		return
+	}
+	cancelledAt, err := time.Parse("2006-01-02 15:04:05", cancellation.CancelledAt)
+	if err != nil {
+		http.Error(w, "Invalid cancellation date format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the original payment of the booking so that concurrent cancellations cannot refund it twice
+	original, err := lockBookingPayment(tx, bookingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving payment of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	paymentID, paymentStatus := original.PaymentID, original.Status
+	// The vehicle service retries refunds it has not heard back about, so a refunded cancellation is
+	// answered again rather than rejected
+	alreadyRefunded := paymentStatus == "Refunded" || paymentStatus == "Partially Refunded"
+	if paymentStatus != "Completed" && paymentStatus != "Authorised" && !alreadyRefunded {
+		log.Printf("Rejected refund of payment_id %d with status %s", paymentID, paymentStatus)
+		http.Error(w, fmt.Sprintf("A payment with status %s cannot be refunded", paymentStatus), http.StatusConflict)
+		return
+	}
+
+	// Refund what was paid overall, including settlements of earlier modifications
+	finalAmount, err := netBookingPayments(tx, bookingID)
+	if err != nil {
+		log.Printf("Error totalling payments of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	refundPercentage := cancellationRefundPercentage(startDate, cancelledAt)
+	refundAmount := math.Round(finalAmount*refundPercentage) / 100
+	respond := func() {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"booking_id":        bookingID,
+			"payment_id":        paymentID,
+			"payment_status":    paymentStatus,
+			"refund_percentage": refundPercentage,
+			"refund_amount":     refundAmount,
+		})
+	}
+	if alreadyRefunded {
+		respond()
+		return
+	}
+
+	// A held payment is settled by capturing the cancellation fee and releasing the rest, while a
+	// collected payment is refunded. Cancellations that are not refunded leave the payment completed.
+	if original.Status == "Authorised" {
+		if err := settleCancelledHold(tx, original, bookingID, finalAmount-refundAmount); err != nil {
+			log.Printf("Error recording the settlement of the hold of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		paymentStatus = "Completed"
+	}
+	if refundAmount > 0 {
+		if original.Status == "Authorised" {
+			_, err = tx.Exec("UPDATE BookingPayment SET refund_amount = ? WHERE payment_id = ?", refundAmount, paymentID)
+		} else {
+			err = refundBookingCharges(tx, bookingID, refundAmount, fmt.Sprintf("booking-%d-cancellation", bookingID))
+		}
+		if err != nil {
+			log.Printf("Error recording refund of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		paymentStatus = "Partially Refunded"
+		if refundAmount >= finalAmount {
+			paymentStatus = "Refunded"
+		}
+	}
+	if paymentStatus != original.Status {
+		_, err = tx.Exec("UPDATE BookingPayment SET payment_status = ?, refunded_at = IF(? > 0, ?, NULL) WHERE payment_id = ?",
+			paymentStatus, refundAmount, cancelledAt, paymentID)
+		if err != nil {
+			log.Printf("Error refunding payment_id %d: %v", paymentID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	// The cancelled booking no longer uses its promo code, so the code counts against its limits no more
+	if err := promotion.Release(tx, bookingID); err != nil {
+		log.Printf("Error releasing promo code of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// The credit note is queued with the refund, but a failure to queue it does not hold the refund up
+	if refundAmount > 0 && original.Email != "" {
+		err = generateCreditNoteAndQueueEmail(tx, bookingID, paymentID, original.UserID, finalAmount, refundPercentage, refundAmount, original.PaymentMethod, original.Email, r.Header.Get("Accept-Language"), cancelledAt)
+		if err != nil {
+			log.Printf("Error queueing credit note email for payment_id %d: %v", paymentID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing refund of payment_id %d: %v", paymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Booking_id %d cancelled: refunded $%.2f (%.0f%%) of payment_id %d", bookingID, refundAmount, refundPercentage, paymentID)
+	makeHoldSettlements(bookingID)
+	makeBookingRefunds(bookingID)
+
+	respond()
+}
+
+// settleCancelledHold records the capture of the cancellation fee of a booking paid by a
+// pre-authorisation hold, releasing the rest of the hold, or the void of the hold if there is no fee
+func settleCancelledHold(tx *sql.Tx, original bookingPayment, bookingID int, fee float64) error {
+	return recordHoldSettlement(tx, original, bookingID, math.Min(fee, original.AuthorisedAmount), fmt.Sprintf("booking-%d-cancellation", bookingID))
+}
+
+// cancellationRefundPercentage returns the share of the payment refunded for a booking starting at
+// start that is cancelled at cancelledAt: all of it well in advance, part of it shortly before the
+// start and nothing once the booking has started.
+func cancellationRefundPercentage(start, cancelledAt time.Time) float64 {
+	switch {
+	case !cancelledAt.Before(start):
+		return 0
+	case start.Sub(cancelledAt) > fullRefundWindow:
+		return 100
+	default:
+		return partialRefundPercent
+	}
+}
+
+// bookingCreditNoteEmail holds the data rendered into the booking credit note email
+type bookingCreditNoteEmail struct {
+	BookingID        int
+	PaymentID        int
+	PaidAmount       float64
+	RefundPercentage float64
+	RefundAmount     float64
+}
+
+// generateCreditNoteAndQueueEmail generates a credit note and queues it as an email attachment
+func generateCreditNoteAndQueueEmail(e execer, bookingID int, paymentID int, userID int, paidAmount, refundPercentage, refundAmount float64, paymentMethod, userEmail, locale string, cancelledAt time.Time) error {
+	fileBytes, err := generateCreditNote(bookingID, paymentID, userID, paidAmount, refundPercentage, refundAmount, paymentMethod, cancelledAt)
+	if err != nil {
+		return err
+	}
+
+	// The booking may be cancelled by staff, so the email does not greet the caller by name
+	email, err := emailtemplate.Render("booking_credit_note", locale, bookingCreditNoteEmail{
+		BookingID:        bookingID,
+		PaymentID:        paymentID,
+		PaidAmount:       paidAmount,
+		RefundPercentage: refundPercentage,
+		RefundAmount:     refundAmount,
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering credit note email: %v", err)
+	}
+
+	fileName := fmt.Sprintf("CreditNote_%d.pdf", paymentID)
+	return queueEmailWithAttachment(e, userEmail, email, fileName, fileBytes)
+}
+
+// generateCreditNote generates a credit note PDF for a refunded booking payment and returns it as a byte slice
+func generateCreditNote(bookingID int, paymentID int, userID int, paidAmount, refundPercentage, refundAmount float64, paymentMethod string, cancelledAt time.Time) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 16)
+
+	// Header
+	pdf.SetFillColor(25, 135, 84) // Green colour scheme
+	pdf.SetTextColor(255, 255, 255)
+	pdf.CellFormat(0, 10, "EcoDrive Credit Note", "1", 1, "C", true, 0, "")
+
+	// Add content
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetFont("Arial", "", 12)
+
+	// Refund details
+	pdf.Ln(10)
+	pdf.Cell(40, 10, fmt.Sprintf("Booking ID: %d", bookingID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Original Payment ID: %d", paymentID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("User ID: %d", userID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Amount Paid: $%.2f", paidAmount))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Refund: %.0f%%", refundPercentage))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Amount Refunded: $%.2f", refundAmount))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Refunded To: %s", paymentMethod))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Cancelled At: %s", cancelledAt.Format("2006-01-02 15:04:05")))
+
+	// Footer
+	pdf.Ln(20)
+	pdf.SetFont("Arial", "I", 10)
+	pdf.SetTextColor(128, 128, 128)
+	pdf.CellFormat(0, 10, "We hope to see you on the road with EcoDrive again soon.", "", 1, "C", false, 0, "")
+
+	// Write PDF to memory buffer
+	buf := new(bytes.Buffer)
+	if err := pdf.Output(buf); err != nil {
+		log.Printf("Error generating credit note PDF: %v", err)
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SettleBooking settles the price difference of a modified booking. A booking that now costs more
+// than was paid gets a supplementary charge, and one that costs less gets a modification refund,
+// both linked to the original payment and followed by an amended invoice. A booking still held by its
+// pre-authorisation has its hold replaced instead. Each settlement is for a numbered modification of
+// the booking, whose number also keys the provider calls, so the vehicle service's outbox can retry it
+// and a modification already settled is not settled again.
+// The optional discount is the booking's new total discount, whose change is recorded alongside the
+// price difference so that amount - discount = final_amount holds for every payment row. The optional
+// promo code and promo discount are those of the modified booking; its redemption is released if the
+// code no longer applies, or updated with the new discount. Only the vehicle service calls it.
+func SettleBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	var settlement struct {
+		Modification  int      `json:"modification"` // Sequence number of the booking modification being settled
+		TotalPrice    float64  `json:"total_price"`
+		Discount      *float64 `json:"discount"`   // Member and promo code discounts of the modified booking
+		PromoCode     *string  `json:"promo_code"` // Promo code of the modified booking, empty if it no longer applies
+		PromoDiscount float64  `json:"promo_discount"`
+		BookingDate   string   `json:"booking_date"`
+		ReturnDate    string   `json:"return_date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&settlement); err != nil {
+		log.Printf("Error decoding settlement request: %v", err)
+		http.Error(w, "Invalid settlement request", http.StatusBadRequest)
+		return
+	}
+	if settlement.Modification <= 0 {
+		http.Error(w, "Missing modification number", http.StatusBadRequest)
+		return
+	}
+	startDate, err := time.Parse("2006-01-02 15:04:05", settlement.BookingDate)
+	if err != nil {
+		http.Error(w, "Invalid booking date format", http.StatusBadRequest)
+		return
+	}
+	endDate, err := time.Parse("2006-01-02 15:04:05", settlement.ReturnDate)
+	if err != nil {
+		http.Error(w, "Invalid return date format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the original payment so that settlements of the same booking are serialised
+	original, err := lockBookingPayment(tx, bookingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving payment of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if original.Status != "Completed" && original.Status != "Authorised" {
+		log.Printf("Rejected settlement of payment_id %d with status %s", original.PaymentID, original.Status)
+		http.Error(w, fmt.Sprintf("A payment with status %s cannot be settled", original.Status), http.StatusConflict)
+		return
+	}
+
+	// A retried settlement of a modification that was already settled returns the booking's totals
+	var settledModification int
+	if err := tx.QueryRow("SELECT settled_modification FROM BookingPayment WHERE payment_id = ?", original.PaymentID).Scan(&settledModification); err != nil {
+		log.Printf("Error retrieving settled modification of payment_id %d: %v", original.PaymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if settlement.Modification <= settledModification {
+		total, err := netBookingPayments(tx, bookingID)
+		if err != nil {
+			log.Printf("Error totalling payments of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Modification %d of booking_id %d already settled", settlement.Modification, bookingID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"booking_id":        bookingID,
+			"modification":      settlement.Modification,
+			"parent_payment_id": original.PaymentID,
+			"total_price":       total,
+			"already_settled":   true,
+		})
+		return
+	}
+	_, err = tx.Exec("UPDATE BookingPayment SET settled_modification = ? WHERE payment_id = ?", settlement.Modification, original.PaymentID)
+	if err != nil {
+		log.Printf("Error recording settled modification of payment_id %d: %v", original.PaymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	previousTotal, err := netBookingPayments(tx, bookingID)
+	if err != nil {
+		log.Printf("Error totalling payments of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	previousDiscount, err := netBookingDiscounts(tx, bookingID)
+	if err != nil {
+		log.Printf("Error totalling discounts of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	newTotal := math.Round(settlement.TotalPrice*100) / 100
+	difference := math.Round((newTotal-previousTotal)*100) / 100
+	newDiscount := previousDiscount
+	if settlement.Discount != nil {
+		newDiscount = math.Round(*settlement.Discount*100) / 100
+	}
+	discountDifference := math.Round((newDiscount-previousDiscount)*100) / 100
+
+	// Keep the promo code redemption in line with the modified booking
+	if settlement.PromoCode != nil {
+		if err := promotion.Update(tx, bookingID, *settlement.PromoCode, math.Round(settlement.PromoDiscount*100)/100); err != nil {
+			log.Printf("Error updating promo code of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := map[string]interface{}{
+		"booking_id":        bookingID,
+		"modification":      settlement.Modification,
+		"parent_payment_id": original.PaymentID,
+		"previous_total":    previousTotal,
+		"previous_discount": previousDiscount,
+		"total_price":       newTotal,
+		"discount":          newDiscount,
+		"difference":        difference,
+	}
+	if difference == 0 {
+		// The price is unchanged but its discounts may have moved, e.g. a promo code replaced the member discount
+		if discountDifference != 0 {
+			if original.Status == "Authorised" {
+				_, err = tx.Exec("UPDATE BookingPayment SET amount = final_amount + ?, discount = ? WHERE payment_id = ?", newDiscount, newDiscount, original.PaymentID)
+			} else {
+				err = recordDiscountAdjustment(tx, original, bookingID, discountDifference)
+			}
+			if err != nil {
+				log.Printf("Error storing discount adjustment of booking_id %d: %v", bookingID, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing settlement of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A booking still held by its pre-authorisation is charged at trip end, so the modification only
+	// replaces the hold with one for the new price
+	if original.Status == "Authorised" {
+		err := replaceBookingHold(tx, original, bookingID, newTotal, newDiscount)
+		if declined, ok := err.(*provider.DeclinedError); ok {
+			log.Printf("New hold for booking_id %d declined: %v", bookingID, err)
+			http.Error(w, "Payment declined: "+declined.Message, http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("Error replacing the hold of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Failed to update payment hold", http.StatusBadGateway)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing settlement of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Booking_id %d hold replaced for a total of $%.2f", bookingID, newTotal)
+		response["payment_id"] = original.PaymentID
+		response["payment_type"] = "Hold Adjustment"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A modification refund is recorded as a positive amount that is subtracted from the booking's totals.
+	// The change to the discounts is recorded separately, as it may move the other way to the price.
+	paymentType, paymentStatus := "Supplementary Charge", "Completed"
+	if difference < 0 {
+		paymentType, paymentStatus = "Modification Refund", "Refunded"
+	}
+	amount := math.Abs(difference)
+	result, err := tx.Exec(`
+		INSERT INTO BookingPayment (user_id, booking_id, payment_type, parent_payment_id, amount, payment_method, payment_status, discount, final_amount, email)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''))`,
+		original.UserID, bookingID, paymentType, original.PaymentID, amount, original.PaymentMethod, paymentStatus, 0.00, amount, original.Email)
+	if err != nil {
+		log.Printf("Error storing settlement of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error retrieving settlement payment ID: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if discountDifference != 0 {
+		if err := recordDiscountAdjustment(tx, original, bookingID, discountDifference); err != nil {
+			log.Printf("Error storing discount adjustment of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Collect a supplementary charge with the payment method of the original payment, or return a
+	// modification refund from the charges collected so far. The key is derived from the modification,
+	// so a settlement retried after a failed commit reuses the charge the provider already made.
+	settlementKey := fmt.Sprintf("booking-%d-modification-%d", bookingID, settlement.Modification)
+	if difference > 0 {
+		providerPaymentID, err := chargeSettlement(bookingID, original.UserID, original.ProviderPaymentMethod, amount, settlementKey)
+		if declined, ok := err.(*provider.DeclinedError); ok {
+			log.Printf("Supplementary charge of booking_id %d declined: %v", bookingID, err)
+			http.Error(w, "Payment declined: "+declined.Message, http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("Error charging settlement of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Failed to charge payment", http.StatusBadGateway)
+			return
+		}
+		_, err = tx.Exec("UPDATE BookingPayment SET provider_payment_id = ?, provider_payment_method = ? WHERE payment_id = ?", providerPaymentID, original.ProviderPaymentMethod, paymentID)
+		if err != nil {
+			log.Printf("Error storing provider payment of payment_id %d: %v", paymentID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	} else if err := refundBookingCharges(tx, bookingID, amount, settlementKey); err != nil {
+		log.Printf("Error recording refund of settlement of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The amended invoice is queued with the settlement, but a failure to queue it does not hold the
+	// settlement up
+	if original.Email != "" {
+		err = generateAmendedInvoiceAndQueueEmail(tx, bookingID, int(paymentID), original.PaymentID, original.UserID, previousTotal, newTotal, difference, original.PaymentMethod, original.Email, r.Header.Get("Accept-Language"), startDate, endDate)
+		if err != nil {
+			log.Printf("Error queueing amended invoice email for payment_id %d: %v", paymentID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing settlement of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Booking_id %d settled from $%.2f to $%.2f with %s payment_id %d", bookingID, previousTotal, newTotal, paymentType, paymentID)
+	if difference < 0 {
+		makeBookingRefunds(bookingID)
+	}
+
+	response["payment_id"] = paymentID
+	response["payment_type"] = paymentType
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// FinaliseBooking bills a trip once the vehicle has been returned. The final bill is computed from the
+// actual return time, the charge level and the cleanliness of the vehicle, and is captured against
+// the pre-authorisation hold, releasing the rest of it. A bill above the hold is charged separately,
+// and a booking paid in full upfront is charged or refunded the difference. Finalising a booking
+// again returns its bill. Only the vehicle service calls it.
+func FinaliseBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	var trip struct {
+		BookingDate       string  `json:"booking_date"`
+		ReturnDate        string  `json:"return_date"`
+		ReturnedAt        string  `json:"returned_at"`
+		LatePrice         float64 `json:"late_price"`
+		UnusedPrice       float64 `json:"unused_price"`
+		ChargeLevel       int     `json:"charge_level"`
+		CleanlinessStatus string  `json:"cleanliness_status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&trip); err != nil {
+		log.Printf("Error decoding finalise request: %v", err)
+		http.Error(w, "Invalid finalise request", http.StatusBadRequest)
+		return
+	}
+	startDate, err := time.Parse("2006-01-02 15:04:05", trip.BookingDate)
+	if err != nil {
+		http.Error(w, "Invalid booking date format", http.StatusBadRequest)
+		return
+	}
+	endDate, err := time.Parse("2006-01-02 15:04:05", trip.ReturnDate)
+	if err != nil {
+		http.Error(w, "Invalid return date format", http.StatusBadRequest)
+		return
+	}
+	returnedAt, err := time.Parse("2006-01-02 15:04:05", trip.ReturnedAt)
+	if err != nil {
+		http.Error(w, "Invalid return time format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the original payment so that the trip is billed once
+	original, err := lockBookingPayment(tx, bookingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving payment of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var finalBill sql.NullString
+	if err := tx.QueryRow("SELECT final_bill FROM BookingPayment WHERE payment_id = ?", original.PaymentID).Scan(&finalBill); err != nil {
+		log.Printf("Error retrieving final bill of payment_id %d: %v", original.PaymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if finalBill.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(finalBill.String))
+		return
+	}
+	if original.Status != "Completed" && original.Status != "Authorised" {
+		log.Printf("Rejected finalising payment_id %d with status %s", original.PaymentID, original.Status)
+		http.Error(w, fmt.Sprintf("A payment with status %s cannot be finalised", original.Status), http.StatusConflict)
+		return
+	}
+
+	bookedPrice, err := netBookingPayments(tx, bookingID)
+	if err != nil {
+		log.Printf("Error totalling payments of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	bill := billing.FinalBill(billing.Trip{
+		BookedPrice:   bookedPrice,
+		LatePrice:     trip.LatePrice,
+		UnusedPrice:   trip.UnusedPrice,
+		BookingDate:   startDate,
+		ReturnDate:    endDate,
+		ReturnedAt:    returnedAt,
+		ChargeLevel:   trip.ChargeLevel,
+		NeedsCleaning: trip.CleanlinessStatus == "Needs Cleaning",
+	})
+
+	// Capture the bill against the hold, or settle the difference from what was paid upfront
+	var captured, charged, refunded, outstanding float64
+	difference := bill.Total - bookedPrice
+	keyPrefix := fmt.Sprintf("booking-%d-final", bookingID)
+	if original.Status == "Authorised" {
+		// The hold is captured or voided once the bill commits
+		captured = math.Max(math.Min(bill.Total, original.AuthorisedAmount), 0)
+		if err := recordHoldSettlement(tx, original, bookingID, captured, keyPrefix); err != nil {
+			log.Printf("Error recording the capture of the hold of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// The fees and credits of the final bill change the price before discounts, not the discount
+		_, err = tx.Exec("UPDATE BookingPayment SET payment_status = 'Completed', amount = discount + ?, final_amount = ? WHERE payment_id = ?", captured, captured, original.PaymentID)
+		if err != nil {
+			log.Printf("Error storing capture of payment_id %d: %v", original.PaymentID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		difference = bill.Total - captured
+	}
+	difference = math.Round(difference*100) / 100
+
+	if difference > 0 {
+		// The capture above stands if the rest is declined, leaving the rest outstanding. Other failures
+		// roll the bill back, and the vehicle service retries it with the same idempotency keys.
+		status, err := chargeFinalBill(tx, original, bookingID, difference, keyPrefix)
+		if err != nil {
+			log.Printf("Error charging the final bill of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Failed to charge final bill", http.StatusBadGateway)
+			return
+		}
+		if status == "Completed" {
+			charged = difference
+		} else {
+			outstanding = difference
+		}
+	} else if difference < 0 {
+		_, err := tx.Exec(`
+			INSERT INTO BookingPayment (user_id, booking_id, payment_type, parent_payment_id, amount, payment_method, payment_status, discount, final_amount, email)
+			VALUES (?, ?, 'Modification Refund', ?, ?, NULLIF(?, ''), 'Refunded', ?, ?, NULLIF(?, ''))`,
+			original.UserID, bookingID, original.PaymentID, -difference, original.PaymentMethod, 0.00, -difference, original.Email)
+		if err == nil {
+			err = refundBookingCharges(tx, bookingID, -difference, keyPrefix)
+		}
+		if err != nil {
+			log.Printf("Error recording refund of the final bill of booking_id %d: %v", bookingID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		refunded = -difference
+	}
+
+	response := map[string]interface{}{
+		"booking_id":  bookingID,
+		"payment_id":  original.PaymentID,
+		"bill":        bill,
+		"captured":    captured,
+		"charged":     charged,
+		"refunded":    refunded,
+		"outstanding": outstanding,
+	}
+	responseJSON, _ := json.Marshal(response)
+	_, err = tx.Exec("UPDATE BookingPayment SET final_bill = ?, finalised_at = ? WHERE payment_id = ?", string(responseJSON), returnedAt, original.PaymentID)
+	if err != nil {
+		log.Printf("Error storing final bill of payment_id %d: %v", original.PaymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing final bill of booking_id %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Booking_id %d finalised at $%.2f: captured $%.2f, charged $%.2f, refunded $%.2f, outstanding $%.2f", bookingID, bill.Total, captured, charged, refunded, outstanding)
+	makeHoldSettlements(bookingID)
+	if refunded > 0 {
+		makeBookingRefunds(bookingID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// chargeFinalBill charges the part of a final bill that the hold or upfront payment did not cover as a
+// supplementary charge, returning its status. A declined charge, or one without a saved payment method,
+// is recorded as failed so that the amount remains visible as outstanding. Other errors, such as
+// timeouts, are returned for the caller to retry with the same idempotency key.
+func chargeFinalBill(tx *sql.Tx, original bookingPayment, bookingID int, amount float64, keyPrefix string) (string, error) {
+	status := "Completed"
+	providerPaymentID, err := chargeSettlement(bookingID, original.UserID, original.ProviderPaymentMethod, amount, keyPrefix+"-charge")
+	if _, declined := err.(*provider.DeclinedError); declined || errors.Is(err, errNoSavedPaymentMethod) {
+		log.Printf("Supplementary charge of $%.2f for booking_id %d failed: %v", amount, bookingID, err)
+		status = "Failed"
+	} else if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO BookingPayment (user_id, booking_id, payment_type, parent_payment_id, amount, payment_method, payment_status, discount, final_amount, email, provider_payment_id, provider_payment_method)
+		VALUES (?, ?, 'Supplementary Charge', ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))`,
+		original.UserID, bookingID, original.PaymentID, amount, original.PaymentMethod, status, 0.00, amount, original.Email, providerPaymentID, original.ProviderPaymentMethod)
+	return status, err
+}
+
+// bookingPayment holds the original payment of a booking
+type bookingPayment struct {
+	PaymentID             int
+	UserID                int
+	PaymentMethod         string
+	ProviderPaymentMethod string
+	ProviderPaymentID     string
+	AuthorisedAmount      float64
+	Status                string
+	Email                 string
+}
+
+// lockBookingPayment locks and returns the original payment of a booking, or sql.ErrNoRows if it was never paid for
+func lockBookingPayment(tx *sql.Tx, bookingID int) (bookingPayment, error) {
+	var payment bookingPayment
+	err := tx.QueryRow(`
+		SELECT payment_id, user_id, COALESCE(payment_method, ''), COALESCE(provider_payment_method, ''), COALESCE(provider_payment_id, ''),
+			COALESCE(authorised_amount, 0), payment_status, COALESCE(email, '')
+		FROM BookingPayment WHERE booking_id = ? AND payment_type = 'Booking'
+		ORDER BY payment_id DESC LIMIT 1 FOR UPDATE`, bookingID).
+		Scan(&payment.PaymentID, &payment.UserID, &payment.PaymentMethod, &payment.ProviderPaymentMethod, &payment.ProviderPaymentID,
+			&payment.AuthorisedAmount, &payment.Status, &payment.Email)
+	return payment, err
+}
+
+// recordDiscountAdjustment records a change to the discounts of a booking paid upfront that moves no
+// money. Its amount and discount are the signed change, negative when the discounts fell, so the
+// booking's discounts add up whichever way its price moved.
+func recordDiscountAdjustment(tx *sql.Tx, original bookingPayment, bookingID int, discountDifference float64) error {
+	_, err := tx.Exec(`
+		INSERT INTO BookingPayment (user_id, booking_id, payment_type, parent_payment_id, amount, payment_method, payment_status, discount, final_amount, email)
+		VALUES (?, ?, 'Discount Adjustment', ?, ?, NULLIF(?, ''), 'Completed', ?, ?, NULLIF(?, ''))`,
+		original.UserID, bookingID, original.PaymentID, discountDifference, original.PaymentMethod, discountDifference, 0.00, original.Email)
+	return err
+}
+
+// netBookingDiscounts returns the discount given on a booking after the settlements of its modifications
+func netBookingDiscounts(tx *sql.Tx, bookingID int) (float64, error) {
+	var total float64
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN payment_type = 'Modification Refund' THEN -discount ELSE discount END), 0)
+		FROM BookingPayment WHERE booking_id = ? AND payment_status NOT IN ('Pending', 'Failed', 'Voided')`, bookingID).Scan(&total)
+	return math.Round(total*100) / 100, err
+}
+
+// netBookingPayments returns the amount paid for a booking after the settlements of its modifications
+func netBookingPayments(tx *sql.Tx, bookingID int) (float64, error) {
+	var total float64
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN payment_type = 'Modification Refund' THEN -final_amount ELSE final_amount END), 0)
+		FROM BookingPayment WHERE booking_id = ? AND payment_status NOT IN ('Pending', 'Failed', 'Voided')`, bookingID).Scan(&total)
+	return math.Round(total*100) / 100, err
+}
+
+// replaceBookingHold authorises a new hold for the modified price of a booking and voids the previous
+// hold, recording the new price and discount on the payment. The new hold is placed first, so a
+// declined payment leaves the booking held as before.
+func replaceBookingHold(tx *sql.Tx, original bookingPayment, bookingID int, newTotal, newDiscount float64) error {
+	// The keys are derived from the hold being replaced, so each replacement is made only once
+	keyPrefix := fmt.Sprintf("booking-%d-hold-%s", bookingID, original.ProviderPaymentID)
+	customerID, err := offSessionCustomer(original.UserID)
+	if err != nil {
+		return err
+	}
+	result, err := provider.Authorise(provider.AuthoriseRequest{
+		Amount:         billing.HoldAmount(newTotal),
+		PaymentMethod:  original.ProviderPaymentMethod,
+		Description:    fmt.Sprintf("EcoDrive booking %d", bookingID),
+		Metadata:       map[string]string{"booking_id": strconv.Itoa(bookingID)},
+		IdempotencyKey: keyPrefix + "-authorise",
+		Customer:       customerID,
+		OffSession:     true,
+	})
+	if err != nil {
+		return err
+	}
+	if result.Status != provider.StatusAuthorised {
+		return fmt.Errorf("payment %s was not authorised: %s", result.ID, result.Status)
+	}
+
+	if _, err := provider.Void(original.ProviderPaymentID, keyPrefix+"-void"); err != nil {
+		// Release the new hold rather than hold the customer's funds twice
+		if _, err := provider.Void(result.ID, keyPrefix+"-release"); err != nil {
+			log.Printf("Error releasing hold %s of booking_id %d: %v", result.ID, bookingID, err)
+		}
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE BookingPayment SET amount = ?, discount = ?, final_amount = ?, provider_payment_id = ?, authorised_amount = ? WHERE payment_id = ?",
+		newTotal+newDiscount, newDiscount, newTotal, result.ID, result.Amount, original.PaymentID)
+	return err
+}
+
+// chargeSettlement authorises and captures a supplementary charge with the payment provider and
+// returns the provider's payment ID. The customer is not present, so the payment method saved to
+// their customer at checkout is charged off-session. A declined charge is returned as a
+// *provider.DeclinedError, and a customer without a saved payment method as errNoSavedPaymentMethod.
+func chargeSettlement(bookingID, userID int, paymentMethodID string, amount float64, idempotencyKey string) (string, error) {
+	if paymentMethodID == "" {
+		return "", fmt.Errorf("booking_id %d: %w", bookingID, errNoSavedPaymentMethod)
+	}
+	customerID, err := offSessionCustomer(userID)
+	if err != nil {
+		return "", err
+	}
+	result, err := provider.Authorise(provider.AuthoriseRequest{
+		Amount:         amount,
+		PaymentMethod:  paymentMethodID,
+		Description:    fmt.Sprintf("EcoDrive booking %d modification", bookingID),
+		Metadata:       map[string]string{"booking_id": strconv.Itoa(bookingID)},
+		IdempotencyKey: idempotencyKey + "-authorise",
+		Customer:       customerID,
+		OffSession:     true,
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := provider.Capture(result.ID, amount, idempotencyKey+"-capture"); err != nil {
+		return "", err
+	}
+	return result.ID, nil
 }
 
-// TierBasedPricing calculates pricing based on membership level and rental duration
-func TierBasedPricing(userID int, durationHours int, pricePerHour float64) (float64, float64) {
-	var membershipLevel string
-	var discountPercentage float64
-
-	// Fetch membership level
-	err := db.QueryRow("SELECT membership_level FROM ecoDrive_user_db.User WHERE user_id = ?", userID).Scan(&membershipLevel)
-	if err != nil {
-		log.Printf("Error fetching membership level: %v", err)
-		return pricePerHour * float64(durationHours), 0.00
+// customerFor returns the customer of a user at the payment provider, creating it at their first card
+// payment. Its idempotency key is derived from the user, so concurrent checkouts create one customer.
+func customerFor(userID int, email string) (string, error) {
+	var customerID string
+	err := db.QueryRow("SELECT provider_customer_id FROM PaymentCustomers WHERE user_id = ?", userID).Scan(&customerID)
+	if err != sql.ErrNoRows {
+		return customerID, err
 	}
 
-	// Fetch discount percentage
-	err = db.QueryRow("SELECT discount_percentage FROM Discounts WHERE membership_level = ?", membershipLevel).Scan(&discountPercentage)
+	customerID, err = provider.CreateCustomer(email, map[string]string{"user_id": strconv.Itoa(userID)}, fmt.Sprintf("customer-%d", userID))
 	if err != nil {
-		log.Printf("Error fetching discount percentage: %v", err)
-		return pricePerHour * float64(durationHours), 0.00
+		return "", err
 	}
-
-	// Calculate total price and discount
-	totalPrice := pricePerHour * float64(durationHours)
-	discount := totalPrice * (discountPercentage / 100)
-	finalPrice := totalPrice - discount
-	return finalPrice, discount
+	// A concurrent checkout may have stored the customer first
+	if _, err := db.Exec("INSERT IGNORE INTO PaymentCustomers (user_id, provider_customer_id) VALUES (?, ?)", userID, customerID); err != nil {
+		return "", err
+	}
+	err = db.QueryRow("SELECT provider_customer_id FROM PaymentCustomers WHERE user_id = ?", userID).Scan(&customerID)
+	return customerID, err
 }
 
-// CalculateRealTimeBill handles real-time billing calculation
-func CalculateRealTimeBill(w http.ResponseWriter, r *http.Request) {
-	membershipLevel := r.URL.Query().Get("membership_level")
-	durationHours, _ := strconv.Atoi(r.URL.Query().Get("duration_hours"))
-	pricePerHour, _ := strconv.ParseFloat(r.URL.Query().Get("price_per_hour"), 64)
-
-	var discountPercentage float64
+// offSessionCustomer returns the customer at the payment provider whose saved payment method is
+// charged while the user is not present
+func offSessionCustomer(userID int) (string, error) {
+	var customerID string
+	err := db.QueryRow("SELECT provider_customer_id FROM PaymentCustomers WHERE user_id = ?", userID).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("user_id %d: %w", userID, errNoSavedPaymentMethod)
+	}
+	return customerID, err
+}
 
-	// Fetch discount percentage
-	err := db.QueryRow("SELECT discount_percentage FROM Discounts WHERE membership_level = ?", membershipLevel).Scan(&discountPercentage)
+// refundBookingCharges records the refund of amount from the captured charges of a booking, newest
+// first, and on each charge how much of it was refunded. The provider is not called while the charges
+// are locked: makeBookingRefunds makes the refunds once the transaction commits. The idempotency keys
+// are derived from keyPrefix, so a retried refund does not refund a charge twice.
+func refundBookingCharges(tx *sql.Tx, bookingID int, amount float64, keyPrefix string) error {
+	rows, err := tx.Query(`
+		SELECT payment_id, provider_payment_id, final_amount - refund_amount
+		FROM BookingPayment
+		WHERE booking_id = ? AND payment_type IN ('Booking', 'Supplementary Charge') AND payment_status = 'Completed' AND provider_payment_id IS NOT NULL
+		ORDER BY payment_id DESC FOR UPDATE`, bookingID)
 	if err != nil {
-		log.Printf("Error fetching discount percentage: %v", err)
-		http.Error(w, "Invalid membership level", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	// Calculate total price and discount
-	totalPrice := pricePerHour * float64(durationHours)
-	discount := totalPrice * (discountPercentage / 100)
-	finalPrice := totalPrice - discount
+	type charge struct {
+		paymentID         int
+		providerPaymentID string
+		refundable        float64
+	}
+	var charges []charge
+	for rows.Next() {
+		var c charge
+		if err := rows.Scan(&c.paymentID, &c.providerPaymentID, &c.refundable); err != nil {
+			rows.Close()
+			return err
+		}
+		charges = append(charges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-	response := map[string]interface{}{
-		"final_price":  finalPrice,
-		"discount":     discount,
-		"total_price":  totalPrice,
-		"membership":   membershipLevel,
-		"duration":     durationHours,
+	remaining := math.Round(amount*100) / 100
+	for _, c := range charges {
+		if remaining <= 0 {
+			break
+		}
+		refund := math.Min(remaining, c.refundable)
+		if refund <= 0 {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO BookingRefunds (booking_id, payment_id, provider_payment_id, amount, idempotency_key)
+			VALUES (?, ?, ?, ?, ?)`, bookingID, c.paymentID, c.providerPaymentID, refund, fmt.Sprintf("%s-%d", keyPrefix, c.paymentID))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE BookingPayment SET refund_amount = refund_amount + ? WHERE payment_id = ?", refund, c.paymentID); err != nil {
+			return err
+		}
+		remaining = math.Round((remaining-refund)*100) / 100
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	if remaining > 0 {
+		return fmt.Errorf("$%.2f of the refund exceeds the captured charges of booking_id %d", remaining, bookingID)
+	}
+	return nil
 }
 
-func ProcessPayment(w http.ResponseWriter, r *http.Request) {
-	var payment struct {
-		UserID        int     `json:"user_id"`
-		VehicleID     string  `json:"vehicle_id"`
-		StartDate     string  `json:"start_date"`
-		EndDate       string  `json:"end_date"`
-		PaymentMethod string  `json:"payment_method"`
-		PricePerHour  string  `json:"price_per_hour"`
-		RentalDuration string `json:"rental_duration"`
-		TotalPrice    string  `json:"total_price"`
-		Email         string  `json:"email"`
-	}
+// bookingRefund is a refund of a booking charge recorded by refundBookingCharges
+type bookingRefund struct {
+	RefundID          int
+	BookingID         int
+	ProviderPaymentID string
+	Amount            float64
+	IdempotencyKey    string
+}
 
-	// Decode incoming JSON request
-	err := json.NewDecoder(r.Body).Decode(&payment)
+// makeBookingRefunds asks the payment provider to make the pending refunds of a booking once they are
+// committed. A refund the provider fails to make is left for the refund worker to retry.
+func makeBookingRefunds(bookingID int) {
+	refunds, err := pendingRefunds("booking_id = ?", bookingID)
 	if err != nil {
-		log.Printf("Error decoding payment request: %v", err)
-		http.Error(w, "Invalid payment request", http.StatusBadRequest)
+		log.Printf("Error retrieving refunds of booking_id %d, the refund worker will retry: %v", bookingID, err)
 		return
 	}
-	log.Printf("Decoded payment payload: %+v", payment)
+	for _, refund := range refunds {
+		makeRefund(refund)
+	}
+}
 
-	// Parse required fields to correct types
-	vehicleID, err := strconv.Atoi(payment.VehicleID)
-	if err != nil {
-		log.Printf("Error parsing vehicle_id: %v", err)
-		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
-		return
+// StartRefundWorker retries the refunds of booking charges and the captures and voids of holds that the
+// payment provider failed to make after they were committed
+func StartRefundWorker() {
+	log.Println("Starting booking refund worker...")
+	ticker := time.NewTicker(refundInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Leave settlements and refunds just committed to the request that recorded them
+		settlements, err := pendingHoldSettlements("created_at < NOW() - INTERVAL 1 MINUTE LIMIT ?", refundBatchSize)
+		if err != nil {
+			log.Printf("Error retrieving pending hold settlements: %v", err)
+		}
+		for _, settlement := range settlements {
+			makeHoldSettlement(settlement)
+		}
+
+		refunds, err := pendingRefunds("created_at < NOW() - INTERVAL 1 MINUTE LIMIT ?", refundBatchSize)
+		if err != nil {
+			log.Printf("Error retrieving pending refunds: %v", err)
+			continue
+		}
+		for _, refund := range refunds {
+			makeRefund(refund)
+		}
 	}
+}
 
-	totalPrice, err := strconv.ParseFloat(payment.TotalPrice, 64)
+// pendingRefunds returns the refunds the payment provider has yet to make that match condition
+func pendingRefunds(condition string, args ...interface{}) ([]bookingRefund, error) {
+	rows, err := db.Query(`
+		SELECT refund_id, booking_id, provider_payment_id, amount, idempotency_key
+		FROM BookingRefunds WHERE status = 'Pending' AND `+condition, args...)
 	if err != nil {
-		log.Printf("Error parsing total price: %v", err)
-		http.Error(w, "Invalid total price", http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	defer rows.Close()
+
+	var refunds []bookingRefund
+	for rows.Next() {
+		var refund bookingRefund
+		if err := rows.Scan(&refund.RefundID, &refund.BookingID, &refund.ProviderPaymentID, &refund.Amount, &refund.IdempotencyKey); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
 
-	// Convert dates to expected format (if needed)
-	startDate, err := time.Parse("2006-01-02T15:04", payment.StartDate)
+// makeRefund asks the payment provider to make a refund and records the outcome. The idempotency key
+// stored with the refund keeps a retried or concurrent attempt from refunding the charge twice.
+func makeRefund(refund bookingRefund) {
+	result, err := provider.Refund(refund.ProviderPaymentID, refund.Amount, refund.IdempotencyKey)
 	if err != nil {
-		log.Printf("Error parsing start_date: %v", err)
-		http.Error(w, "Invalid start date format", http.StatusBadRequest)
+		log.Printf("Error refunding $%.2f of booking_id %d with the payment provider, will retry: %v", refund.Amount, refund.BookingID, err)
+		if _, err := db.Exec("UPDATE BookingRefunds SET attempts = LEAST(attempts + 1, 255), last_error = ? WHERE refund_id = ?", err.Error(), refund.RefundID); err != nil {
+			log.Printf("Error recording failed refund_id %d: %v", refund.RefundID, err)
+		}
 		return
 	}
-	endDate, err := time.Parse("2006-01-02T15:04", payment.EndDate)
+	_, err = db.Exec("UPDATE BookingRefunds SET status = 'Completed', provider_refund_id = ?, refunded_at = NOW() WHERE refund_id = ? AND status = 'Pending'", result.ID, refund.RefundID)
 	if err != nil {
-		log.Printf("Error parsing end_date: %v", err)
-		http.Error(w, "Invalid end date format", http.StatusBadRequest)
-		return
+		log.Printf("Error recording refund_id %d as made: %v", refund.RefundID, err)
 	}
+}
 
-	// Notify booking service
-	apiURL := "http://vehicle:5150/api/v1/vehicle/booking"
-	bookingPayload := map[string]interface{}{
-		"vehicle_id":   vehicleID,
-		"user_id":      payment.UserID,
-		"booking_date": startDate.Format("2006-01-02 15:04:05"),
-		"return_date":  endDate.Format("2006-01-02 15:04:05"),
-		"total_price":  totalPrice,
-	}
-
-	// Log the booking payload for debugging
-	log.Printf("Booking payload: %+v", bookingPayload)
-
-	jsonPayload, _ := json.Marshal(bookingPayload)
-	log.Printf("Serialized JSON payload: %s", string(jsonPayload))
+// holdSettlement is a capture or void of a pre-authorisation hold recorded by recordHoldSettlement
+type holdSettlement struct {
+	SettlementID      int
+	BookingID         int
+	ProviderPaymentID string
+	Action            string
+	Amount            float64
+	IdempotencyKey    string
+}
 
-	req, _ := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonPayload))
-	req.Header.Set("Content-Type", "application/json")
+// recordHoldSettlement records the capture of amount from the hold of a booking, releasing the rest of
+// it, or the void of the hold if amount is not positive. Like refunds, the provider is not called while
+// the payment is locked: makeHoldSettlements settles the hold once the transaction commits. The
+// idempotency key is derived from keyPrefix, so a retried settlement takes effect once.
+func recordHoldSettlement(tx *sql.Tx, original bookingPayment, bookingID int, amount float64, keyPrefix string) error {
+	action, key := "Capture", keyPrefix+"-capture"
+	amount = math.Round(amount*100) / 100
+	if amount <= 0 {
+		action, key, amount = "Void", keyPrefix+"-void", 0
+	}
+	_, err := tx.Exec(`
+		INSERT INTO BookingHoldSettlements (booking_id, payment_id, provider_payment_id, action, amount, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, ?)`, bookingID, original.PaymentID, original.ProviderPaymentID, action, amount, key)
+	return err
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// makeHoldSettlements asks the payment provider to settle the pending holds of a booking once they are
+// committed. A settlement the provider fails to make is left for the refund worker to retry.
+func makeHoldSettlements(bookingID int) {
+	settlements, err := pendingHoldSettlements("booking_id = ?", bookingID)
 	if err != nil {
-		log.Printf("Error calling booking API: %v", err)
-		http.Error(w, "Failed to notify booking service", http.StatusInternalServerError)
+		log.Printf("Error retrieving hold settlements of booking_id %d, the refund worker will retry: %v", bookingID, err)
 		return
 	}
-	defer resp.Body.Close()
+	for _, settlement := range settlements {
+		makeHoldSettlement(settlement)
+	}
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Booking API returned non-OK status: %d, Response: %s", resp.StatusCode, string(body))
-		http.Error(w, "Failed to notify booking service", http.StatusInternalServerError)
-		return
+// pendingHoldSettlements returns the hold settlements the payment provider has yet to make that match condition
+func pendingHoldSettlements(condition string, args ...interface{}) ([]holdSettlement, error) {
+	rows, err := db.Query(`
+		SELECT settlement_id, booking_id, provider_payment_id, action, amount, idempotency_key
+		FROM BookingHoldSettlements WHERE status = 'Pending' AND `+condition, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var settlements []holdSettlement
+	for rows.Next() {
+		var settlement holdSettlement
+		if err := rows.Scan(&settlement.SettlementID, &settlement.BookingID, &settlement.ProviderPaymentID, &settlement.Action, &settlement.Amount, &settlement.IdempotencyKey); err != nil {
+			return nil, err
+		}
+		settlements = append(settlements, settlement)
+	}
+	return settlements, rows.Err()
+}
 
-	// Parse the booking ID from the API response
-	var bookingResponse struct {
-		BookingID int `json:"booking_id"`
+// makeHoldSettlement asks the payment provider to capture or void a hold and records the outcome. The
+// idempotency key stored with the settlement keeps a retried or concurrent attempt from taking effect twice.
+func makeHoldSettlement(settlement holdSettlement) {
+	var err error
+	if settlement.Action == "Capture" {
+		_, err = provider.Capture(settlement.ProviderPaymentID, settlement.Amount, settlement.IdempotencyKey)
+	} else {
+		_, err = provider.Void(settlement.ProviderPaymentID, settlement.IdempotencyKey)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&bookingResponse); err != nil {
-		log.Printf("Error decoding booking API response: %v", err)
-		http.Error(w, "Failed to process booking response", http.StatusInternalServerError)
+	if err != nil {
+		log.Printf("Error settling the hold of booking_id %d with the payment provider, will retry: %v", settlement.BookingID, err)
+		if _, err := db.Exec("UPDATE BookingHoldSettlements SET attempts = LEAST(attempts + 1, 255), last_error = ? WHERE settlement_id = ?", err.Error(), settlement.SettlementID); err != nil {
+			log.Printf("Error recording failed settlement_id %d: %v", settlement.SettlementID, err)
+		}
 		return
 	}
+	_, err = db.Exec("UPDATE BookingHoldSettlements SET status = 'Completed', settled_at = NOW() WHERE settlement_id = ? AND status = 'Pending'", settlement.SettlementID)
+	if err != nil {
+		log.Printf("Error recording settlement_id %d as made: %v", settlement.SettlementID, err)
+	}
+}
 
-	log.Printf("Received booking ID from API: %d", bookingResponse.BookingID)
+// bookingAmendedInvoiceEmail holds the data rendered into the amended booking invoice email
+type bookingAmendedInvoiceEmail struct {
+	BookingID         int
+	PaymentID         int
+	OriginalPaymentID int
+	PreviousTotal     float64
+	NewTotal          float64
+	Charged           float64
+	Refunded          float64
+}
 
-	// Insert payment details into the database
-	result, err := db.Exec(`
-			INSERT INTO BookingPayment (user_id, booking_id, amount, payment_method, payment_status, discount, final_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		payment.UserID, bookingResponse.BookingID, totalPrice, payment.PaymentMethod, "Completed", 0.00, totalPrice)
+// generateAmendedInvoiceAndQueueEmail generates an amended invoice and queues it as an email attachment
+func generateAmendedInvoiceAndQueueEmail(e execer, bookingID int, paymentID int, originalPaymentID int, userID int, previousTotal, newTotal, difference float64, paymentMethod, userEmail, locale string, startDate, endDate time.Time) error {
+	fileBytes, err := generateAmendedInvoice(bookingID, paymentID, originalPaymentID, userID, previousTotal, newTotal, difference, paymentMethod, startDate, endDate)
 	if err != nil {
-		log.Printf("Error storing payment details: %v", err)
-		http.Error(w, "Failed to store payment details", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	// Retrieve the last inserted payment ID
-	paymentID, err := result.LastInsertId()
+	data := bookingAmendedInvoiceEmail{
+		BookingID:         bookingID,
+		PaymentID:         paymentID,
+		OriginalPaymentID: originalPaymentID,
+		PreviousTotal:     previousTotal,
+		NewTotal:          newTotal,
+	}
+	if difference > 0 {
+		data.Charged = difference
+	} else {
+		data.Refunded = -difference
+	}
+	email, err := emailtemplate.Render("booking_amended_invoice", locale, data)
 	if err != nil {
-		log.Printf("Error retrieving payment ID: %v", err)
-		http.Error(w, "Failed to retrieve payment ID", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("error rendering amended invoice email: %v", err)
 	}
 
-	log.Printf("Payment processed successfully for user_id: %d, booking_id: %d, payment_id: %d", payment.UserID, bookingResponse.BookingID, paymentID)
+	fileName := fmt.Sprintf("Invoice_%d.pdf", paymentID)
+	return queueEmailWithAttachment(e, userEmail, email, fileName, fileBytes)
+}
 
-	// Generate and send invoice
-	err = generateInvoiceAndSendEmail(
-		bookingResponse.BookingID,
-		int(paymentID),
-		payment.UserID,
-		totalPrice,
-		payment.PaymentMethod,
-		payment.Email,
-		startDate,
-		endDate,
-	)
-	if err != nil {
-		log.Printf("Error sending invoice email: %v", err)
-		http.Error(w, "Failed to send invoice email", http.StatusInternalServerError)
-		return
+// generateAmendedInvoice generates an amended invoice PDF for a modified booking and returns it as a byte slice
+func generateAmendedInvoice(bookingID int, paymentID int, originalPaymentID int, userID int, previousTotal, newTotal, difference float64, paymentMethod string, startDate, endDate time.Time) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 16)
+
+	// Header
+	pdf.SetFillColor(25, 135, 84) // Green colour scheme
+	pdf.SetTextColor(255, 255, 255)
+	pdf.CellFormat(0, 10, "EcoDrive Amended Invoice", "1", 1, "C", true, 0, "")
+
+	// Add content
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetFont("Arial", "", 12)
+
+	// Booking and settlement details
+	pdf.Ln(10)
+	pdf.Cell(40, 10, fmt.Sprintf("Booking ID: %d", bookingID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Payment ID: %d", paymentID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Original Payment ID: %d", originalPaymentID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("User ID: %d", userID))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Previous Total: $%.2f", previousTotal))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("New Total: $%.2f", newTotal))
+	pdf.Ln(6)
+	if difference > 0 {
+		pdf.Cell(40, 10, fmt.Sprintf("Additional Charge: $%.2f", difference))
+	} else {
+		pdf.Cell(40, 10, fmt.Sprintf("Amount Refunded: $%.2f", -difference))
 	}
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Payment Method: %s", paymentMethod))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("Start Date: %s", startDate.Format("2006-01-02 15:04:05")))
+	pdf.Ln(6)
+	pdf.Cell(40, 10, fmt.Sprintf("End Date: %s", endDate.Format("2006-01-02 15:04:05")))
 
-	// Respond with a JSON object
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":    "Payment processed successfully",
-		"booking_id": bookingResponse.BookingID,
-		"payment_id": paymentID,
-	})
-}
+	// Footer
+	pdf.Ln(20)
+	pdf.SetFont("Arial", "I", 10)
+	pdf.SetTextColor(128, 128, 128)
+	pdf.CellFormat(0, 10, "This invoice replaces earlier invoices for this booking.", "", 1, "C", false, 0, "")
 
+	// Write PDF to memory buffer
+	buf := new(bytes.Buffer)
+	if err := pdf.Output(buf); err != nil {
+		log.Printf("Error generating amended invoice PDF: %v", err)
+		return nil, err
+	}
 
-// generateInvoice generates an invoice PDF and returns it as a byte slice
-func generateInvoice(bookingID int, paymentID int, userID int, totalPrice float64, paymentMethod string, startDate, endDate time.Time) ([]byte, error) {
-    // Create a new PDF document
-    pdf := gofpdf.New("P", "mm", "A4", "")
-    pdf.AddPage()
-    pdf.SetFont("Arial", "B", 16)
-
-    // Header
-    pdf.SetFillColor(25, 135, 84) // Green colour scheme
-    pdf.SetTextColor(255, 255, 255)
-    pdf.CellFormat(0, 10, "EcoDrive Invoice", "1", 1, "C", true, 0, "")
-
-    // Add content
-    pdf.SetTextColor(0, 0, 0)
-    pdf.SetFont("Arial", "", 12)
-
-    // Booking and payment details
-    pdf.Ln(10)
-    pdf.Cell(40, 10, fmt.Sprintf("Booking ID: %d", bookingID))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("Payment ID: %d", paymentID))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("User ID: %d", userID))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("Total Price: $%.2f", totalPrice))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("Payment Method: %s", paymentMethod))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("Start Date: %s", startDate.Format("2006-01-02 15:04:05")))
-    pdf.Ln(6)
-    pdf.Cell(40, 10, fmt.Sprintf("End Date: %s", endDate.Format("2006-01-02 15:04:05")))
-
-    // Footer
-    pdf.Ln(20)
-    pdf.SetFont("Arial", "I", 10)
-    pdf.SetTextColor(128, 128, 128)
-    pdf.CellFormat(0, 10, "Thank you for choosing EcoDrive. Drive safe!", "", 1, "C", false, 0, "")
-
-    // Write PDF to memory buffer
-    buf := new(bytes.Buffer)
-    err := pdf.Output(buf)
-    if err != nil {
-        log.Printf("Error generating PDF: %v", err)
-        return nil, err
-    }
-
-    return buf.Bytes(), nil
-}
-
-
-
-// sendEmailWithAttachment sends an email with a PDF attachment
-func sendEmailWithAttachment(to, subject, body string, fileName string, fileBytes []byte) error {
-    // SMTP configuration
-    smtpHost := "smtp.gmail.com"
-    smtpPort := "587"
-    smtpUser := os.Getenv("SMTP_USER")
-    smtpPassword := os.Getenv("SMTP_PASSWORD")
-
-    from := "EcoDrive <" + smtpUser + ">"
-
-    // Create the email with the attachment
-    boundary := "EcoDriveBoundary"
-    message := bytes.NewBuffer(nil)
-    message.WriteString(fmt.Sprintf("From: %s\r\n", from))
-    message.WriteString(fmt.Sprintf("To: %s\r\n", to))
-    message.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-    message.WriteString("MIME-Version: 1.0\r\n")
-    message.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", boundary))
-    message.WriteString("\r\n--" + boundary + "\r\n")
-    message.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-    message.WriteString("Content-Transfer-Encoding: 7bit\r\n\r\n")
-    message.WriteString(body)
-    message.WriteString("\r\n--" + boundary + "\r\n")
-    message.WriteString("Content-Type: application/pdf\r\n")
-    message.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", fileName))
-    message.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
-	message.WriteString(encodeToBase64(fileBytes))
-    message.WriteString("\r\n--" + boundary + "--\r\n")
-
-    // Send email
-    auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
-    err := smtp.SendMail(smtpHost+":"+smtpPort, auth, smtpUser, []string{to}, message.Bytes())
-    if err != nil {
-        log.Printf("Error sending email with attachment: %v", err)
-        return err
-    }
-
-    log.Println("Email sent successfully.")
-    return nil
-}
-
-// generateInvoiceAndSendEmail generates an invoice and sends it as an email attachment
-func generateInvoiceAndSendEmail(bookingID int, paymentID int, userID int, totalPrice float64, paymentMethod, userEmail string, startDate, endDate time.Time) error {
-    // Generate the invoice in memory
-    fileBytes, err := generateInvoice(bookingID, paymentID, userID, totalPrice, paymentMethod, startDate, endDate)
-    if err != nil {
-        return err
-    }
-
-    // Email content
-    subject := "Your EcoDrive Invoice"
-    body := fmt.Sprintf(`
-        <!DOCTYPE html>
-        <html lang="en">
-        <head>
-            <meta charset="UTF-8">
-            <meta name="viewport" content="width=device-width, initial-scale=1.0">
-            <title>Invoice</title>
-        </head>
-        <body>
-            <p>Dear User,</p>
-            <p>Thank you for using EcoDrive! Attached is your invoice for the recent transaction.</p>
-            <p>Details:</p>
-            <ul>
-                <li>Booking ID: %d</li>
-                <li>Payment ID: %d</li>
-                <li>Total Price: $%.2f</li>
-            </ul>
-            <p>We hope you had a pleasant experience!</p>
-            <p>Best regards,<br>The EcoDrive Team</p>
-        </body>
-        </html>
-    `, bookingID, paymentID, totalPrice)
-
-    // Send the email with the invoice attached
-    fileName := fmt.Sprintf("Invoice_%d.pdf", paymentID)
-    return sendEmailWithAttachment(userEmail, subject, body, fileName, fileBytes)
-}
-
-// encodeToBase64 encodes bytes to a base64 string
-func encodeToBase64(data []byte) string {
-    return base64.StdEncoding.EncodeToString(data)
-}
-
-// AddMembershipPayment adds a payment entry to the MembershipPayment table
-func AddMembershipPayment(userID int, membershipLevel string, amount float64, paymentMethod string, startDate, endDate time.Time) (int64, error) {
-    result, err := db.Exec(`
-        INSERT INTO MembershipPayment (user_id, membership_level, amount, payment_method, payment_status, start_date, end_date)
-        VALUES (?, ?, ?, ?, ?, ?, ?)`,
-        userID, membershipLevel, amount, paymentMethod, "Completed", startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
-    if err != nil {
-        log.Printf("Error inserting membership payment: %v", err)
-        return 0, err
-    }
-
-    // Retrieve the last inserted payment ID
-    membershipPaymentID, err := result.LastInsertId()
-    if err != nil {
-        log.Printf("Error retrieving membership payment ID: %v", err)
-        return 0, err
-    }
-
-    log.Printf("Membership payment successfully added. Payment ID: %d", membershipPaymentID)
-    return membershipPaymentID, nil
+	return buf.Bytes(), nil
 }
 
 func ProcessMembershipPayment(w http.ResponseWriter, r *http.Request) {
@@ -418,9 +2417,9 @@ func ProcessMembershipPayment(w http.ResponseWriter, r *http.Request) {
 		MembershipLevel string  `json:"membership_level"`
 		Amount          float64 `json:"amount"`
 		PaymentMethod   string  `json:"payment_method"`
-		StartDate       string  `json:"start_date"`
-		EndDate         string  `json:"end_date"`
+		PaymentMethodID string  `json:"payment_method_id"`
 		Email           string  `json:"email"`
+		AutoRenew       bool    `json:"auto_renew"`
 	}
 
 	// Decode incoming JSON request
@@ -433,30 +2432,58 @@ func ProcessMembershipPayment(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[DEBUG] Decoded payment request: %+v", payment)
 
-	// Parse dates to expected format
-	log.Println("[DEBUG] Parsing start_date and end_date")
-	startDate, err := time.Parse("2006-01-02", payment.StartDate)
-	if err != nil {
-		log.Printf("[ERROR] Parsing start_date: %v", err)
-		http.Error(w, "Invalid start date format", http.StatusBadRequest)
+	// Membership payments may only be made by the authenticated user
+	if !middleware.AuthorizeUser(r, payment.UserID) {
+		log.Printf("[ERROR] Rejected membership payment for user_id=%d from another user", payment.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	log.Printf("[DEBUG] Parsed start_date: %s", startDate)
 
-	endDate, err := time.Parse("2006-01-02", payment.EndDate)
-	if err != nil {
-		log.Printf("[ERROR] Parsing end_date: %v", err)
-		http.Error(w, "Invalid end date format", http.StatusBadRequest)
+	// Price the membership from the plan catalogue, crediting the unused days of the current one
+	quote, err := subscription.QuoteChange(payment.UserID, payment.MembershipLevel, time.Now())
+	if err == subscription.ErrUnknownPlan || err == subscription.ErrFreePlan {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] Quoting membership change: %v", err)
+		http.Error(w, "Failed to process membership payment", http.StatusInternalServerError)
+		return
+	}
+
+	// The client confirms the amount it was quoted; if that has changed, the new quote is returned
+	if math.Abs(payment.Amount-quote.AmountDue) > 0.005 {
+		log.Printf("[ERROR] Client amount $%.2f does not match quoted $%.2f", payment.Amount, quote.AmountDue)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "The membership price has changed",
+			"quote": quote,
+		})
+		return
+	}
+
+	startDate, _ := time.Parse("2006-01-02", quote.StartDate)
+	endDate, _ := time.Parse("2006-01-02", quote.EndDate)
+	proration, _ := json.Marshal(quote)
+
+	// Renewals are charged without the customer, which PayNow cannot do
+	if payment.AutoRenew && payment.PaymentMethod != "Card" {
+		http.Error(w, "Only memberships paid by card can renew automatically", http.StatusBadRequest)
 		return
 	}
-	log.Printf("[DEBUG] Parsed end_date: %s", endDate)
+	paymentMethodID := payment.PaymentMethodID
+	if paymentMethodID == "" {
+		paymentMethodID = provider.DefaultPaymentMethod(payment.PaymentMethod)
+	}
 
-	// Step 1: Insert into MembershipPayment table
+	// Step 1: Insert into MembershipPayment table until the provider has charged it. A card is charged
+	// by this request, so its payment is Processing and ignored by webhooks; a PayNow payment is Pending
+	// until the provider's webhook reports it.
 	log.Println("[DEBUG] Inserting membership payment into the database")
 	result, err := db.Exec(`
-		INSERT INTO MembershipPayment (user_id, membership_level, amount, payment_method, start_date, end_date)
-		VALUES (?, ?, ?, ?, ?, ?)`,
-		payment.UserID, payment.MembershipLevel, payment.Amount, payment.PaymentMethod, startDate, endDate)
+		INSERT INTO MembershipPayment (user_id, membership_level, amount, plan_price, payment_method, payment_status, provider_payment_method, auto_renew, proration, email, user_name, locale, start_date, end_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		payment.UserID, payment.MembershipLevel, quote.AmountDue, quote.Price, payment.PaymentMethod, subscription.InitialStatus(payment.PaymentMethod), paymentMethodID, payment.AutoRenew, proration, payment.Email, userName(r), r.Header.Get("Accept-Language"), startDate, endDate)
 	if err != nil {
 		log.Printf("[ERROR] Inserting membership payment: %v", err)
 		http.Error(w, "Failed to process membership payment", http.StatusInternalServerError)
@@ -472,105 +2499,393 @@ func ProcessMembershipPayment(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[DEBUG] Membership payment inserted successfully. Payment ID: %d", paymentID)
 
-	// Step 2: Call API to update the user's membership level
+	// Step 2: Charge the payment with the payment provider, unless credit for unused days covers it
+	charge := provider.Result{Status: provider.StatusCaptured}
+	if quote.AmountDue > 0 {
+		customerID, err := membershipCustomer(payment.UserID, payment.Email, payment.PaymentMethod, false)
+		if err == nil {
+			charge, err = chargeMembershipPayment(paymentID, payment.MembershipLevel, quote.AmountDue, payment.PaymentMethod, paymentMethodID, customerID, false)
+		}
+		if declined, ok := err.(*provider.DeclinedError); ok {
+			log.Printf("[ERROR] Membership payment_id %d declined: %v", paymentID, err)
+			setMembershipPaymentStatus(paymentID, "Failed")
+			http.Error(w, "Payment declined: "+declined.Message, http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("[ERROR] Charging membership payment_id %d: %v", paymentID, err)
+			setMembershipPaymentStatus(paymentID, "Failed")
+			http.Error(w, "Failed to charge payment", http.StatusBadGateway)
+			return
+		}
+	}
+
+	membership := membershipPayment{
+		PaymentID:         paymentID,
+		UserID:            payment.UserID,
+		MembershipLevel:   payment.MembershipLevel,
+		Amount:            quote.AmountDue,
+		PaymentMethod:     payment.PaymentMethod,
+		ProviderPaymentID: charge.ID,
+		Email:             payment.Email,
+		UserName:          userName(r),
+		Locale:            r.Header.Get("Accept-Language"),
+		StartDate:         startDate,
+		EndDate:           endDate,
+		Proration:         &quote,
+	}
+
+	// Asynchronous payments such as PayNow and card payments needing authentication are completed by
+	// the customer, and the membership is activated when the provider's webhook reports the payment
+	if charge.Status == provider.StatusPending || charge.Status == provider.StatusActionRequired {
+		if _, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Pending', provider_payment_id = ? WHERE membership_payment_id = ? AND payment_status IN ('Pending', 'Processing')", charge.ID, paymentID); err != nil {
+			log.Printf("[ERROR] Storing provider payment of membership payment_id %d: %v", paymentID, err)
+		}
+		response := map[string]interface{}{
+			"message":          "Membership payment is awaiting confirmation",
+			"membership_id":    paymentID,
+			"membership_level": payment.MembershipLevel,
+			"payment_status":   "Pending",
+			"quote":            quote,
+		}
+		if charge.ClientSecret != "" {
+			response["client_secret"] = charge.ClientSecret
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Completed', provider_payment_id = NULLIF(?, '') WHERE membership_payment_id = ?", charge.ID, paymentID); err != nil {
+		log.Printf("[ERROR] Storing provider payment of membership payment_id %d: %v", paymentID, err)
+	}
+
+	// Step 3: Update the user's membership level and queue the invoice
+	if err := activateMembership(membership); err != nil {
+		http.Error(w, "Failed to update membership level", http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with a JSON object
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Membership payment processed successfully",
+		"membership_id":    paymentID,
+		"membership_level": payment.MembershipLevel,
+		"quote":            quote,
+	})
+}
+
+// membershipPayment holds a paid membership payment
+type membershipPayment struct {
+	PaymentID         int64
+	UserID            int
+	MembershipLevel   string
+	Amount            float64
+	PaymentMethod     string
+	ProviderPaymentID string
+	Email             string
+	UserName          string
+	Locale            string
+	StartDate         time.Time
+	EndDate           time.Time
+	Proration         *subscription.Quote // Plan change paid for, nil for renewals
+}
+
+// activateMembership updates the user's membership level once the payment for it has been collected,
+// replaces the memberships credited by a plan change and queues the invoice. If the level cannot be
+// updated the payment is refunded.
+func activateMembership(m membershipPayment) error {
+	if err := updateMembershipTier(m.UserID, m.MembershipLevel); err != nil {
+		refundMembershipPayment(m.PaymentID, m.ProviderPaymentID, m.Amount)
+		return err
+	}
+
+	// The new membership is active, so those it replaces end now and excess credit is refunded
+	if m.Proration != nil {
+		err := subscription.Replace(*m.Proration, m.PaymentID, RefundReplacedMembership)
+		if err != nil {
+			log.Printf("[ERROR] Replacing memberships credited to membership payment_id %d: %v", m.PaymentID, err)
+		}
+	}
+
+	// The payment is already committed, so failures to queue the invoice are only logged
+	err := generateMembershipInvoiceAndQueueEmail(
+		db,
+		int(m.PaymentID),
+		m.UserID,
+		m.MembershipLevel,
+		m.Amount,
+		m.PaymentMethod,
+		m.Email,
+		m.UserName,
+		m.Locale,
+		m.StartDate,
+		m.EndDate,
+	)
+	if err != nil {
+		log.Printf("[ERROR] Queueing membership invoice email for payment_id %d: %v", m.PaymentID, err)
+	}
+	return nil
+}
+
+// RefundReplacedMembership refunds part of a membership that a plan change replaced, the excess of its
+// credit over the price of the new plan. The idempotency key names both memberships, so a retried
+// refund is made once.
+func RefundReplacedMembership(s subscription.Subscription, amount float64) error {
+	_, err := provider.Refund(s.ProviderPaymentID, amount, fmt.Sprintf("membership-%d-replaced-%d-refund", s.PaymentID, s.SupersededBy))
+	return err
+}
+
+// updateMembershipTier sets the membership level of a user through the user service
+func updateMembershipTier(userID int, membershipLevel string) error {
 	log.Println("[DEBUG] Updating user membership level via API")
 	apiURL := "http://user:5100/api/v1/user/membership/update"
 	payload := map[string]interface{}{
-		"user_id":         payment.UserID,
-		"membership_tier": payment.MembershipLevel,
+		"user_id":         userID,
+		"membership_tier": membershipLevel,
 	}
 	jsonPayload, _ := json.Marshal(payload)
 	log.Printf("[DEBUG] Serialized JSON payload for membership update: %s", string(jsonPayload))
 
 	req, _ := http.NewRequest("PUT", apiURL, bytes.NewBuffer(jsonPayload))
 	req.Header.Set("Content-Type", "application/json")
+	// Tier changes are restricted to admins and internal callers, so the payment service uses the internal API key
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("[ERROR] Calling membership update API: %v", err)
-		http.Error(w, "Failed to update membership level", http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("[ERROR] Membership update API returned non-OK status: %d, Response: %s", resp.StatusCode, string(body))
-		http.Error(w, "Failed to update membership level", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("membership update API returned status %d", resp.StatusCode)
 	}
 	log.Println("[DEBUG] User membership level updated successfully via API")
+	return nil
+}
 
-	// Step 3: Generate and send invoice email
-	log.Println("[DEBUG] Generating and sending membership invoice email")
-	err = generateMembershipInvoiceAndSendEmail(
-		int(paymentID),
-		payment.UserID,
-		payment.MembershipLevel,
-		payment.Amount,
-		payment.PaymentMethod,
-		payment.Email,
-		startDate,
-		endDate,
-	)
+// RenewMembership charges the renewal of a membership to the payment method it was paid with and
+// activates the new period. It is run by the membership scheduler, which fails the renewal if an
+// error is returned.
+func RenewMembership(renewal subscription.Subscription) error {
+	customerID, err := membershipCustomer(renewal.UserID, renewal.Email, renewal.PaymentMethod, true)
 	if err != nil {
-		log.Printf("[ERROR] Sending membership invoice email: %v", err)
-		http.Error(w, "Failed to send membership invoice email", http.StatusInternalServerError)
-		return
+		return err
+	}
+	charge, err := chargeMembershipPayment(renewal.PaymentID, renewal.MembershipLevel, renewal.Amount, renewal.PaymentMethod, renewal.ProviderPaymentMethod, customerID, true)
+	if err != nil {
+		return err
+	}
+	if charge.Status == provider.StatusActionRequired {
+		// The customer is not present to authenticate a renewal
+		if _, err := provider.Void(charge.ID, fmt.Sprintf("membership-%d-void", renewal.PaymentID)); err != nil {
+			log.Printf("[ERROR] Voiding membership payment %s: %v", charge.ID, err)
+		}
+		return fmt.Errorf("renewal payment %s requires the customer to authenticate", charge.ID)
 	}
-	log.Println("[DEBUG] Membership invoice email sent successfully")
 
-	// Respond with a JSON object
-	log.Println("[DEBUG] Sending success response to client")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":         "Membership payment processed successfully",
-		"membership_id":   paymentID,
-		"membership_level": payment.MembershipLevel,
+	m := membershipPayment{
+		PaymentID:         renewal.PaymentID,
+		UserID:            renewal.UserID,
+		MembershipLevel:   renewal.MembershipLevel,
+		Amount:            renewal.Amount,
+		PaymentMethod:     renewal.PaymentMethod,
+		ProviderPaymentID: charge.ID,
+		Email:             renewal.Email,
+		UserName:          renewal.UserName,
+		Locale:            renewal.Locale,
+		StartDate:         renewal.StartDate,
+		EndDate:           renewal.EndDate,
+	}
+
+	// A payment confirmed later is activated by the provider's webhook
+	if charge.Status == provider.StatusPending {
+		_, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Pending', provider_payment_id = ? WHERE membership_payment_id = ? AND payment_status = 'Processing'", charge.ID, renewal.PaymentID)
+		return err
+	}
+	if _, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Completed', provider_payment_id = ? WHERE membership_payment_id = ?", charge.ID, renewal.PaymentID); err != nil {
+		log.Printf("[ERROR] Storing provider payment of membership payment_id %d: %v", renewal.PaymentID, err)
+	}
+	return activateMembership(m)
+}
+
+// membershipRenewalReminderEmail holds the data rendered into the membership renewal reminder email
+type membershipRenewalReminderEmail struct {
+	Name            string
+	MembershipLevel string
+	Amount          float64
+	EndDate         string
+	AutoRenew       bool
+}
+
+// RemindMembershipRenewal queues an email reminding the user that their membership ends soon, and
+// whether it will renew automatically
+func RemindMembershipRenewal(s subscription.Subscription) error {
+	if s.Email == "" {
+		return nil
+	}
+
+	email, err := emailtemplate.Render("membership_renewal_reminder", s.Locale, membershipRenewalReminderEmail{
+		Name:            s.UserName,
+		MembershipLevel: s.MembershipLevel,
+		Amount:          s.Amount,
+		EndDate:         s.EndDate.Format("2006-01-02"),
+		AutoRenew:       s.AutoRenew,
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering renewal reminder email: %v", err)
+	}
+
+	_, err = outbox.Enqueue(db, mailer.Message{
+		To:       s.Email,
+		Subject:  email.Subject,
+		HTMLBody: email.HTML,
+		TextBody: email.Text,
 	})
-	log.Println("[DEBUG] Response sent successfully")
+	return err
+}
+
+// ExpireMembership downgrades the user of a membership that ended without being renewed to Basic
+func ExpireMembership(s subscription.Subscription) error {
+	return updateMembershipTier(s.UserID, "Basic")
+}
+
+// chargeMembershipPayment authorises and captures a membership payment with the payment provider.
+// A payment the customer has yet to complete is returned as pending or action required once they
+// have been asked to pay, and a declined payment is returned as a *provider.DeclinedError.
+func chargeMembershipPayment(paymentID int64, membershipLevel string, amount float64, paymentMethod, paymentMethodID, customerID string, renewal bool) (provider.Result, error) {
+	idempotencyKey := fmt.Sprintf("membership-%d", paymentID)
+	result, err := provider.Authorise(membershipAuthoriseRequest(paymentID, membershipLevel, amount, paymentMethod, paymentMethodID, customerID, renewal))
+	if err != nil || result.Status != provider.StatusAuthorised {
+		return result, err
+	}
+	captured, err := provider.Capture(result.ID, amount, idempotencyKey+"-capture")
+	if err != nil {
+		// Release the hold rather than leave the customer's funds tied up
+		if _, err := provider.Void(result.ID, idempotencyKey+"-void"); err != nil {
+			log.Printf("[ERROR] Voiding membership payment %s: %v", result.ID, err)
+		}
+		return provider.Result{}, err
+	}
+	return captured, nil
+}
+
+// membershipAuthoriseRequest builds the authorisation of a membership payment. A card paid at checkout
+// is saved to customerID for renewals, which charge it off-session. Its idempotency key is derived
+// from the payment, so replaying it returns the provider's payment instead of charging again.
+func membershipAuthoriseRequest(paymentID int64, membershipLevel string, amount float64, paymentMethod, paymentMethodID, customerID string, renewal bool) provider.AuthoriseRequest {
+	return provider.AuthoriseRequest{
+		Amount:         amount,
+		PaymentMethod:  paymentMethodID,
+		Description:    fmt.Sprintf("EcoDrive %s membership", membershipLevel),
+		Metadata:       map[string]string{"membership_payment_id": strconv.FormatInt(paymentID, 10)},
+		IdempotencyKey: fmt.Sprintf("membership-%d-authorise", paymentID),
+		Asynchronous:   paymentMethod == "PayNow",
+		Customer:       customerID,
+		SaveForLater:   customerID != "" && !renewal,
+		OffSession:     renewal,
+	}
+}
+
+// membershipCustomer returns the customer at the payment provider a membership payment is charged
+// with. A renewal charges the card saved to the user's customer when they paid at checkout; PayNow
+// payments are not saved.
+func membershipCustomer(userID int, email, paymentMethod string, renewal bool) (string, error) {
+	if renewal {
+		return offSessionCustomer(userID)
+	}
+	if paymentMethod != "Card" {
+		return "", nil
+	}
+	return customerFor(userID, email)
+}
+
+// CancelMembershipPayment releases the funds of a membership payment that the membership scheduler
+// failed because it was not completed in time. A payment interrupted before its provider payment was
+// stored is found by replaying its authorisation. An uncaptured payment is voided and a captured one
+// refunded.
+func CancelMembershipPayment(s subscription.Subscription) error {
+	if s.Amount <= 0 {
+		// Nothing was charged when credit covered the membership
+		return nil
+	}
+	providerPaymentID := s.ProviderPaymentID
+	if providerPaymentID == "" {
+		renewal := s.RenewalOf != 0
+		customerID, err := membershipCustomer(s.UserID, s.Email, s.PaymentMethod, renewal)
+		if err != nil {
+			return err
+		}
+		result, err := provider.Authorise(membershipAuthoriseRequest(s.PaymentID, s.MembershipLevel, s.Amount, s.PaymentMethod, s.ProviderPaymentMethod, customerID, renewal))
+		if _, declined := err.(*provider.DeclinedError); declined {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		providerPaymentID = result.ID
+	}
+
+	idempotencyKey := fmt.Sprintf("membership-%d", s.PaymentID)
+	if _, err := provider.Void(providerPaymentID, idempotencyKey+"-void"); err == nil {
+		return nil
+	}
+	// The payment can no longer be voided once it has been captured
+	_, err := provider.Refund(providerPaymentID, s.Amount, idempotencyKey+"-timeout-refund")
+	return err
 }
 
+// refundMembershipPayment refunds a membership payment whose upgrade could not be applied
+func refundMembershipPayment(paymentID int64, providerPaymentID string, amount float64) {
+	if providerPaymentID == "" {
+		// Nothing was charged when credit covered the membership
+		setMembershipPaymentStatus(paymentID, "Refunded")
+		return
+	}
+	if _, err := provider.Refund(providerPaymentID, amount, fmt.Sprintf("membership-%d-refund", paymentID)); err != nil {
+		log.Printf("[ERROR] Refunding membership payment_id %d: %v", paymentID, err)
+		return
+	}
+	setMembershipPaymentStatus(paymentID, "Refunded")
+}
 
+// setMembershipPaymentStatus records the status of a membership payment, logging failures
+func setMembershipPaymentStatus(paymentID int64, status string) {
+	if _, err := db.Exec("UPDATE MembershipPayment SET payment_status = ? WHERE membership_payment_id = ?", status, paymentID); err != nil {
+		log.Printf("[ERROR] Setting status of membership payment_id %d to %s: %v", paymentID, status, err)
+	}
+}
 
-func generateMembershipInvoiceAndSendEmail(paymentID int, userID int, membershipLevel string, amount float64, paymentMethod, userEmail string, startDate, endDate time.Time) error {
+// generateMembershipInvoiceAndQueueEmail generates a membership invoice and queues it as an email attachment
+func generateMembershipInvoiceAndQueueEmail(e execer, paymentID int, userID int, membershipLevel string, amount float64, paymentMethod, userEmail, userName, locale string, startDate, endDate time.Time) error {
 	// Generate the invoice in memory
 	fileBytes, err := generateMembershipInvoice(paymentID, userID, membershipLevel, amount, paymentMethod, startDate, endDate)
 	if err != nil {
 		return fmt.Errorf("error generating invoice: %v", err)
 	}
 
-	// Email content
-	subject := "Your EcoDrive Membership Invoice"
-	body := fmt.Sprintf(`
-        <!DOCTYPE html>
-        <html lang="en">
-        <head>
-            <meta charset="UTF-8">
-            <meta name="viewport" content="width=device-width, initial-scale=1.0">
-            <title>Invoice</title>
-        </head>
-        <body>
-            <p>Dear User,</p>
-            <p>Thank you for your EcoDrive membership purchase. Attached is your invoice:</p>
-            <ul>
-                <li><strong>Payment ID:</strong> %d</li>
-                <li><strong>Membership Level:</strong> %s</li>
-                <li><strong>Amount:</strong> $%.2f</li>
-                <li><strong>Payment Method:</strong> %s</li>
-                <li><strong>Start Date:</strong> %s</li>
-                <li><strong>End Date:</strong> %s</li>
-            </ul>
-            <p>We hope you enjoy your EcoDrive membership!</p>
-            <p>Best regards,<br>The EcoDrive Team</p>
-        </body>
-        </html>
-    `, paymentID, membershipLevel, amount, paymentMethod, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	// Email content in the user's language
+	email, err := emailtemplate.Render("membership_invoice", locale, membershipInvoiceEmail{
+		Name:            userName,
+		PaymentID:       paymentID,
+		MembershipLevel: membershipLevel,
+		Amount:          amount,
+		PaymentMethod:   paymentMethod,
+		StartDate:       startDate.Format("2006-01-02"),
+		EndDate:         endDate.Format("2006-01-02"),
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering invoice email: %v", err)
+	}
 
 	// Send the email with the invoice attached
 	fileName := fmt.Sprintf("Membership_Invoice_%d.pdf", paymentID)
-	return sendEmailWithAttachment(userEmail, subject, body, fileName, fileBytes)
+	return queueEmailWithAttachment(e, userEmail, email, fileName, fileBytes)
 }
 
 func generateMembershipInvoice(paymentID int, userID int, membershipLevel string, amount float64, paymentMethod string, startDate, endDate time.Time) ([]byte, error) {
@@ -614,4 +2929,4 @@ func generateMembershipInvoice(paymentID int, userID int, membershipLevel string
 	}
 
 	return buf.Bytes(), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,138 @@
+package payment
+
+import (
+	"common/sqltest"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"paymentMicroservice/provider"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const testWebhookSecret = "whsec_test"
+
+func TestMain(m *testing.M) {
+	// provider.Init reads the webhook secret from .env in the working directory
+	dir, err := os.MkdirTemp("", "payment-test")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, ".env"), []byte("PAYMENT_WEBHOOK_SECRET="+testWebhookSecret+"\nPAYMENT_PROVIDER=stripe\nPAYMENT_PROVIDER_SECRET_KEY=sk_test\n"), 0o600)
+	}
+	wd, _ := os.Getwd()
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+	provider.Init()
+	os.Chdir(wd)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// signWebhook returns the signature header the provider sends with a payload
+func signWebhook(secret string, payload []byte) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleWebhook(t *testing.T) {
+	succeeded := `{"id":"evt_1","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","amount":5000,"amount_received":5000}}}`
+	recordEvent := sqltest.Statement{
+		Contains:     "INSERT INTO PaymentWebhookEvents",
+		Args:         []driver.Value{"evt_1", provider.EventPaymentSucceeded, "pi_1"},
+		RowsAffected: 1,
+	}
+
+	tests := []struct {
+		name       string
+		payload    string
+		secret     string
+		statements []sqltest.Statement
+		wantCode   int
+		wantBody   string
+	}{
+		{
+			name:     "invalid signature",
+			payload:  succeeded,
+			secret:   "whsec_other",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "ignored event type",
+			payload:  `{"id":"evt_2","type":"payment_intent.canceled","data":{"object":{"id":"pi_1"}}}`,
+			secret:   testWebhookSecret,
+			wantCode: http.StatusOK,
+			wantBody: `"received":true`,
+		},
+		{
+			name:    "redelivered event",
+			payload: succeeded,
+			secret:  testWebhookSecret,
+			statements: []sqltest.Statement{{
+				Contains: "INSERT INTO PaymentWebhookEvents",
+				Args:     []driver.Value{"evt_1", provider.EventPaymentSucceeded, "pi_1"},
+				Err:      &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"},
+			}},
+			wantCode: http.StatusOK,
+			wantBody: `"duplicate":true`,
+		},
+		{
+			name:    "payment already applied",
+			payload: succeeded,
+			secret:  testWebhookSecret,
+			statements: []sqltest.Statement{recordEvent, {
+				Contains: "FROM BookingPayment WHERE provider_payment_id = ? FOR UPDATE",
+				Args:     []driver.Value{"pi_1"},
+				Columns:  []string{"payment_id", "payment_status"},
+				Rows:     [][]driver.Value{{int64(4), "Completed"}},
+			}},
+			wantCode: http.StatusOK,
+			wantBody: `"received":true`,
+		},
+		{
+			name:    "unknown payment",
+			payload: succeeded,
+			secret:  testWebhookSecret,
+			statements: []sqltest.Statement{recordEvent, {
+				Contains: "FROM BookingPayment WHERE provider_payment_id = ? FOR UPDATE",
+				Columns:  []string{"payment_id", "payment_status"},
+			}},
+			wantCode: http.StatusOK,
+			wantBody: `"received":true`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db = sqltest.Open(t, test.statements...)
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/payment/webhook", strings.NewReader(test.payload))
+			r.Header.Set(provider.SignatureHeader, signWebhook(test.secret, []byte(test.payload)))
+			w := httptest.NewRecorder()
+
+			HandleWebhook(w, r)
+
+			if w.Code != test.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.wantCode, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
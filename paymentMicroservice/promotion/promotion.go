@@ -0,0 +1,369 @@
+package promotion
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+// Discount types of a promo code
+const (
+	TypePercentage = "Percentage" // discount_value is a percentage of the rental price
+	TypeFixed      = "Fixed"      // discount_value is an amount off the rental price
+)
+
+// Redemption states
+const (
+	StatusRedeemed = "Redeemed" // Counted against the code's limits
+	StatusReleased = "Released" // Given back after the checkout was rolled back, the booking cancelled or the code dropped by a modification
+)
+
+// Init connects to the database configured in .env. The payment service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (promotion package)...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (promotion package) successful.")
+}
+
+// RejectedError is returned when a promo code cannot be applied, with a reason the customer can act on
+type RejectedError struct {
+	Reason string
+}
+
+func (err *RejectedError) Error() string {
+	return err.Reason
+}
+
+// Request describes the booking a promo code is applied to
+type Request struct {
+	Code           string  `json:"code"`
+	UserID         int     `json:"user_id"`
+	BookingID      int     `json:"booking_id"` // Booking being modified, whose own redemption does not count against the limits
+	VehicleID      int     `json:"vehicle_id"`
+	Location       string  `json:"location"`        // Location of the vehicle
+	Subtotal       float64 `json:"subtotal"`        // Rental price before any discount
+	MemberDiscount float64 `json:"member_discount"` // Discount of the customer's membership level
+}
+
+// Result is the outcome of applying a promo code to a booking
+type Result struct {
+	Code           string  `json:"code"`
+	Description    string  `json:"description"`
+	Discount       float64 `json:"discount"`        // Amount taken off by the promo code
+	MemberDiscount float64 `json:"member_discount"` // Member discount still applied alongside the code, 0 if the code replaces it
+	Stackable      bool    `json:"stackable"`
+}
+
+// promo represents a row of the PromoCodes table
+type promo struct {
+	ID                int
+	Code              string
+	Description       string
+	DiscountType      string
+	DiscountValue     float64
+	MaxDiscount       sql.NullFloat64
+	MinSpend          float64
+	GlobalLimit       sql.NullInt64
+	PerUserLimit      sql.NullInt64
+	AllowedVehicleIDs sql.NullString
+	AllowedLocations  sql.NullString
+	Stackable         bool
+	NotYetValid       bool
+	Expired           bool
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Normalise returns a promo code as it is stored, so that codes are matched regardless of case
+func Normalise(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Evaluate works out the discount a promo code gives on a booking. The member discount is kept when
+// the code is stackable, in which case the code applies to the price after it; otherwise the code
+// replaces the member discount and is rejected if it would save the customer less. A booking being
+// modified keeps a code it already redeemed, even if the code has since expired or reached its limits.
+func Evaluate(req Request) (Result, error) {
+	p, err := load(db, req.Code, false)
+	if err != nil {
+		return Result{}, err
+	}
+
+	redeemed := false
+	if req.BookingID != 0 {
+		err := db.QueryRow(`
+			SELECT COUNT(*) > 0 FROM PromoRedemptions
+			WHERE promo_id = ? AND booking_id = ? AND status = ?`, p.ID, req.BookingID, StatusRedeemed).Scan(&redeemed)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if !redeemed {
+		if err := checkAvailable(db, p, req.UserID); err != nil {
+			return Result{}, err
+		}
+	}
+	return p.apply(req)
+}
+
+// apply works out the discount of an available promo code on a booking, rejecting bookings the code
+// does not apply to
+func (p promo) apply(req Request) (Result, error) {
+	if req.Subtotal < p.MinSpend {
+		return Result{}, &RejectedError{Reason: fmt.Sprintf("Promo code %s requires a minimum spend of $%.2f", p.Code, p.MinSpend)}
+	}
+	if p.AllowedVehicleIDs.Valid {
+		var vehicleIDs []int
+		if err := json.Unmarshal([]byte(p.AllowedVehicleIDs.String), &vehicleIDs); err != nil {
+			return Result{}, fmt.Errorf("error decoding vehicles of promo code %s: %v", p.Code, err)
+		}
+		if !containsInt(vehicleIDs, req.VehicleID) {
+			return Result{}, &RejectedError{Reason: fmt.Sprintf("Promo code %s does not apply to this vehicle", p.Code)}
+		}
+	}
+	if p.AllowedLocations.Valid {
+		var locations []string
+		if err := json.Unmarshal([]byte(p.AllowedLocations.String), &locations); err != nil {
+			return Result{}, fmt.Errorf("error decoding locations of promo code %s: %v", p.Code, err)
+		}
+		if !containsFold(locations, req.Location) {
+			return Result{}, &RejectedError{Reason: fmt.Sprintf("Promo code %s does not apply to vehicles at %s", p.Code, req.Location)}
+		}
+	}
+
+	result := Result{
+		Code:           p.Code,
+		Description:    p.Description,
+		MemberDiscount: req.MemberDiscount,
+		Stackable:      p.Stackable,
+	}
+	if p.Stackable {
+		result.Discount = p.discountOn(req.Subtotal - req.MemberDiscount)
+		return result, nil
+	}
+
+	result.Discount = p.discountOn(req.Subtotal)
+	if result.Discount <= req.MemberDiscount {
+		return Result{}, &RejectedError{Reason: fmt.Sprintf("Promo code %s cannot be combined with your member discount, which already saves you more", p.Code)}
+	}
+	result.MemberDiscount = 0
+	return result, nil
+}
+
+// Redeem records the use of a promo code on a booking in the transaction that records its payment.
+// The code is locked while its limits are checked again, so that concurrent checkouts cannot redeem
+// it more often than allowed.
+func Redeem(tx *sql.Tx, code string, userID, bookingID, paymentID int, discount float64) error {
+	p, err := load(tx, code, true)
+	if err != nil {
+		return err
+	}
+	if err := checkAvailable(tx, p, userID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO PromoRedemptions (promo_id, user_id, booking_id, payment_id, discount, status)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		p.ID, userID, bookingID, paymentID, discount, StatusRedeemed)
+	if err != nil {
+		return err
+	}
+	log.Printf("Promo code %s redeemed by user_id %d on booking_id %d for $%.2f.", p.Code, userID, bookingID, discount)
+	return nil
+}
+
+// Release gives back the promo code redeemed on a booking whose checkout was rolled back or that was
+// cancelled, so that it no longer counts against the code's limits. Releasing a booking without a
+// redemption does nothing.
+func Release(e execer, bookingID int) error {
+	result, err := e.Exec(`
+		UPDATE PromoRedemptions SET status = ?, released_at = NOW()
+		WHERE booking_id = ? AND status = ?`, StatusReleased, bookingID, StatusRedeemed)
+	if err != nil {
+		return err
+	}
+	if released, _ := result.RowsAffected(); released > 0 {
+		log.Printf("Promo code redemption of booking_id %d released.", bookingID)
+	}
+	return nil
+}
+
+// Update keeps the redemption of a booking in line with its modification in the transaction that
+// settles it. The redemption is released if the modified booking no longer has a code, and otherwise
+// records the code's new discount. A redemption released by an earlier modification is restored when
+// a settlement is undone.
+func Update(tx *sql.Tx, bookingID int, code string, discount float64) error {
+	if code == "" {
+		return Release(tx, bookingID)
+	}
+	_, err := tx.Exec(`
+		UPDATE PromoRedemptions r JOIN PromoCodes p ON p.promo_id = r.promo_id
+		SET r.discount = ?, r.status = ?, r.released_at = NULL
+		WHERE r.booking_id = ? AND p.code = ?`, discount, StatusRedeemed, bookingID, Normalise(code))
+	return err
+}
+
+// load reads an active promo code, locking it if requested. An unknown or inactive code is rejected.
+func load(q queryer, code string, lock bool) (promo, error) {
+	statement := `
+		SELECT promo_id, code, description, discount_type, discount_value, max_discount, min_spend,
+			global_limit, per_user_limit, allowed_vehicle_ids, allowed_locations, stackable,
+			valid_from > NOW(), COALESCE(valid_until < NOW(), FALSE)
+		FROM PromoCodes WHERE code = ? AND active`
+	if lock {
+		statement += " FOR UPDATE"
+	}
+
+	var p promo
+	err := q.QueryRow(statement, Normalise(code)).Scan(&p.ID, &p.Code, &p.Description, &p.DiscountType, &p.DiscountValue,
+		&p.MaxDiscount, &p.MinSpend, &p.GlobalLimit, &p.PerUserLimit, &p.AllowedVehicleIDs, &p.AllowedLocations,
+		&p.Stackable, &p.NotYetValid, &p.Expired)
+	if err == sql.ErrNoRows {
+		return promo{}, &RejectedError{Reason: fmt.Sprintf("Promo code %s is not valid", Normalise(code))}
+	}
+	return p, err
+}
+
+// checkAvailable rejects a promo code outside its validity window or whose global or per-user
+// redemption limit has been reached
+func checkAvailable(q queryer, p promo, userID int) error {
+	if p.NotYetValid {
+		return &RejectedError{Reason: fmt.Sprintf("Promo code %s is not valid yet", p.Code)}
+	}
+	if p.Expired {
+		return &RejectedError{Reason: fmt.Sprintf("Promo code %s has expired", p.Code)}
+	}
+
+	if p.GlobalLimit.Valid {
+		var redemptions int64
+		err := q.QueryRow("SELECT COUNT(*) FROM PromoRedemptions WHERE promo_id = ? AND status = ?", p.ID, StatusRedeemed).Scan(&redemptions)
+		if err != nil {
+			return err
+		}
+		if redemptions >= p.GlobalLimit.Int64 {
+			return &RejectedError{Reason: fmt.Sprintf("Promo code %s has been fully redeemed", p.Code)}
+		}
+	}
+	if p.PerUserLimit.Valid {
+		var redemptions int64
+		err := q.QueryRow("SELECT COUNT(*) FROM PromoRedemptions WHERE promo_id = ? AND status = ? AND user_id = ?", p.ID, StatusRedeemed, userID).Scan(&redemptions)
+		if err != nil {
+			return err
+		}
+		if redemptions >= p.PerUserLimit.Int64 {
+			return &RejectedError{Reason: fmt.Sprintf("You have already used promo code %s the maximum number of times", p.Code)}
+		}
+	}
+	return nil
+}
+
+// discountOn returns the discount the promo code gives on an amount, which never exceeds the amount
+func (p promo) discountOn(amount float64) float64 {
+	if amount <= 0 {
+		return 0
+	}
+	discount := p.DiscountValue
+	if p.DiscountType == TypePercentage {
+		discount = amount * p.DiscountValue / 100
+		if p.MaxDiscount.Valid && discount > p.MaxDiscount.Float64 {
+			discount = p.MaxDiscount.Float64
+		}
+	}
+	return roundCents(math.Min(discount, amount))
+}
+
+// EvaluatePromo applies a promo code to a booking for the vehicle service's quote. A code that cannot
+// be applied is answered with 422 and the reason.
+func EvaluatePromo(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Code) == "" || req.Subtotal < 0 || req.MemberDiscount < 0 {
+		http.Error(w, "Missing or invalid fields in the input", http.StatusBadRequest)
+		return
+	}
+
+	result, err := Evaluate(req)
+	if rejected, ok := err.(*RejectedError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": rejected.Reason,
+		})
+		return
+	} else if err != nil {
+		log.Printf("Error evaluating promo code %q: %v", req.Code, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// containsInt reports whether values contains value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether values contains value, ignoring case and surrounding spaces
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,84 @@
+package promotion
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	percent := promo{Code: "ECO15", DiscountType: TypePercentage, DiscountValue: 15, MaxDiscount: sql.NullFloat64{Float64: 20, Valid: true}}
+	fixed := promo{Code: "TEN", DiscountType: TypeFixed, DiscountValue: 10, MinSpend: 50}
+	stackable := promo{Code: "STACK", DiscountType: TypePercentage, DiscountValue: 10, Stackable: true}
+	restricted := promo{
+		Code: "ORCHARD25", DiscountType: TypePercentage, DiscountValue: 25,
+		AllowedVehicleIDs: sql.NullString{String: "[1, 2]", Valid: true},
+		AllowedLocations:  sql.NullString{String: `["Orchard"]`, Valid: true},
+	}
+
+	tests := []struct {
+		name           string
+		promo          promo
+		req            Request
+		discount       float64
+		memberDiscount float64
+		rejected       bool
+	}{
+		{name: "percentage", promo: percent, req: Request{Subtotal: 100}, discount: 15},
+		{name: "percentage capped at the maximum discount", promo: percent, req: Request{Subtotal: 200}, discount: 20},
+		{name: "fixed amount", promo: fixed, req: Request{Subtotal: 60}, discount: 10},
+		{name: "below the minimum spend", promo: fixed, req: Request{Subtotal: 49.99}, rejected: true},
+		{name: "replaces a smaller member discount", promo: percent, req: Request{Subtotal: 100, MemberDiscount: 10}, discount: 15},
+		{name: "rejected when the member discount saves more", promo: percent, req: Request{Subtotal: 100, MemberDiscount: 15}, rejected: true},
+		{name: "stacks on the price after the member discount", promo: stackable, req: Request{Subtotal: 100, MemberDiscount: 20}, discount: 8, memberDiscount: 20},
+		{name: "allowed vehicle and location", promo: restricted, req: Request{Subtotal: 40, VehicleID: 2, Location: " orchard "}, discount: 10},
+		{name: "vehicle not allowed", promo: restricted, req: Request{Subtotal: 40, VehicleID: 3, Location: "Orchard"}, rejected: true},
+		{name: "location not allowed", promo: restricted, req: Request{Subtotal: 40, VehicleID: 1, Location: "Jurong"}, rejected: true},
+		{name: "fixed amount never exceeds the price", promo: promo{Code: "BIG", DiscountType: TypeFixed, DiscountValue: 50}, req: Request{Subtotal: 30}, discount: 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := test.promo.apply(test.req)
+			if test.rejected {
+				if _, ok := err.(*RejectedError); !ok {
+					t.Fatalf("apply() = %+v, %v, want a rejection", result, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if result.Discount != test.discount || result.MemberDiscount != test.memberDiscount {
+				t.Errorf("apply() = %+v, want discount %v and member discount %v", result, test.discount, test.memberDiscount)
+			}
+		})
+	}
+}
+
+func TestCheckAvailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		promo    promo
+		rejected bool
+	}{
+		{name: "within the validity window", promo: promo{Code: "OK"}},
+		{name: "not valid yet", promo: promo{Code: "SOON", NotYetValid: true}, rejected: true},
+		{name: "expired", promo: promo{Code: "OLD", Expired: true}, rejected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Codes without limits are checked without querying redemptions
+			err := checkAvailable(nil, test.promo, 1)
+			if _, ok := err.(*RejectedError); ok != test.rejected {
+				t.Errorf("checkAvailable() = %v, want rejected %v", err, test.rejected)
+			}
+		})
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	if got := Normalise("  welcome10 "); got != "WELCOME10" {
+		t.Errorf("Normalise() = %q, want WELCOME10", got)
+	}
+}
@@ -0,0 +1,908 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Payment statuses reported by a PaymentProvider
+const (
+	StatusPending        = "pending"         // The provider is processing the payment
+	StatusActionRequired = "action_required" // Waiting for the customer to complete the payment, e.g. 3D Secure or a PayNow QR code
+	StatusAuthorised     = "authorised"      // Funds are held and can be captured or voided
+	StatusCaptured       = "captured"        // Funds have been collected
+	StatusVoided         = "voided"          // The hold was released without collecting funds
+	StatusRefunded       = "refunded"        // Collected funds were returned
+)
+
+// Currency charged by EcoDrive
+const Currency = "sgd"
+
+// Webhook event types
+const (
+	EventPaymentAuthorised = "payment_intent.amount_capturable_updated" // Funds are held
+	EventPaymentSucceeded  = "payment_intent.succeeded"                 // Funds have been collected
+	EventPaymentFailed     = "payment_intent.payment_failed"            // The customer's payment attempt failed
+	EventPaymentCanceled   = "payment_intent.canceled"                  // The payment was voided
+)
+
+const (
+	// SignatureHeader is the request header carrying a webhook's signature
+	SignatureHeader = "Stripe-Signature"
+
+	signatureTolerance = 5 * time.Minute // Oldest webhook signature accepted, against replayed deliveries
+)
+
+// AuthoriseRequest describes a payment to authorise
+type AuthoriseRequest struct {
+	Amount         float64           // Amount in dollars
+	PaymentMethod  string            // Provider token of the customer's payment method, e.g. pm_card_visa
+	Description    string            // Shown on the provider's dashboard
+	Metadata       map[string]string // Stored with the payment for reconciliation
+	IdempotencyKey string            // Makes retries of the same authorisation safe
+	Asynchronous   bool              // Completed by the customer outside checkout, e.g. PayNow; the outcome arrives by webhook
+	Customer       string            // Provider ID of the customer the payment method is saved to, if any
+	SaveForLater   bool              // Saves the payment method to Customer so that it can be charged again without the customer
+	OffSession     bool              // Charges a payment method saved to Customer while the customer is not present
+}
+
+// Result describes the state of a payment or refund at the provider
+type Result struct {
+	ID           string  // Provider ID of the payment, or of the refund for Refund
+	Status       string  // One of the Status constants
+	Amount       float64 // Amount authorised, captured or refunded
+	ClientSecret string  // Lets the client complete a payment whose status is StatusActionRequired
+}
+
+// DeclinedError is returned when the provider declines a payment
+type DeclinedError struct {
+	Code    string
+	Message string
+}
+
+func (err *DeclinedError) Error() string {
+	return fmt.Sprintf("payment declined (%s): %s", err.Code, err.Message)
+}
+
+// PaymentProvider charges customers through a payment gateway. Every call takes an idempotency
+// key, so a call that is retried after a timeout or crash takes effect only once.
+type PaymentProvider interface {
+	Authorise(req AuthoriseRequest) (Result, error)
+	Capture(paymentID string, amount float64, idempotencyKey string) (Result, error)
+	Void(paymentID string, idempotencyKey string) (Result, error)
+	Refund(paymentID string, amount float64, idempotencyKey string) (Result, error)
+	CreateCustomer(email string, metadata map[string]string, idempotencyKey string) (string, error)
+}
+
+// Event is a webhook notification of a change to a payment
+type Event struct {
+	ID             string            // Unique event ID, repeated when the provider redelivers the event
+	Type           string            // One of the Event constants, or another type to be ignored
+	PaymentID      string            // Provider ID of the payment
+	Amount         float64           // Amount of the payment, or the amount collected once it succeeded
+	Metadata       map[string]string // Metadata passed to Authorise
+	FailureMessage string            // Why the payment failed, for EventPaymentFailed
+}
+
+// ErrInvalidSignature is returned by ParseWebhook for webhooks that are not signed by the provider
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+var (
+	defaultProvider PaymentProvider
+	webhookSecret   string
+)
+
+// Init loads the webhook secret from .env and selects the payment provider. The payment service calls
+// it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Webhooks are signed with PAYMENT_WEBHOOK_SECRET, including those of the mock provider
+	webhookSecret = os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		log.Fatalf("PAYMENT_WEBHOOK_SECRET environment variable is not set")
+	}
+
+	// Select the payment provider
+	defaultProvider, err = NewFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring payment provider: %v", err)
+	}
+}
+
+// NewFromEnv returns the provider selected by PAYMENT_PROVIDER, which must be set: stripe, or mock for
+// development, which charges nobody
+func NewFromEnv() (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "":
+		return nil, fmt.Errorf("PAYMENT_PROVIDER is not set")
+	case "mock":
+		addr := os.Getenv("MOCK_PROVIDER_ADDR")
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		webhookURL := os.Getenv("MOCK_PROVIDER_WEBHOOK_URL")
+		if webhookURL == "" {
+			webhookURL = "http://localhost:5200/api/v1/payment/webhook"
+		}
+		stateFile := os.Getenv("MOCK_PROVIDER_STATE_FILE")
+		if stateFile == "" {
+			stateFile = "mock_provider_state.json"
+		}
+		baseURL, err := StartMockServer(addr, webhookURL, webhookSecret, stateFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WARNING: using mock payment provider at %s, for development only. No payment is really charged.", baseURL)
+		return NewStripeProvider(baseURL, mockSecretKey), nil
+	case "stripe":
+		baseURL := os.Getenv("PAYMENT_PROVIDER_URL")
+		if baseURL == "" {
+			baseURL = "https://api.stripe.com"
+		}
+		secretKey := os.Getenv("PAYMENT_PROVIDER_SECRET_KEY")
+		if secretKey == "" {
+			return nil, fmt.Errorf("PAYMENT_PROVIDER_SECRET_KEY is not set")
+		}
+		log.Printf("Using Stripe payment provider at %s.", baseURL)
+		return NewStripeProvider(baseURL, secretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", name)
+	}
+}
+
+// Authorise authorises a payment with the default provider
+func Authorise(req AuthoriseRequest) (Result, error) {
+	return defaultProvider.Authorise(req)
+}
+
+// Capture captures an authorised payment with the default provider
+func Capture(paymentID string, amount float64, idempotencyKey string) (Result, error) {
+	return defaultProvider.Capture(paymentID, amount, idempotencyKey)
+}
+
+// Void releases an authorised payment with the default provider
+func Void(paymentID string, idempotencyKey string) (Result, error) {
+	return defaultProvider.Void(paymentID, idempotencyKey)
+}
+
+// Refund refunds a captured payment with the default provider
+func Refund(paymentID string, amount float64, idempotencyKey string) (Result, error) {
+	return defaultProvider.Refund(paymentID, amount, idempotencyKey)
+}
+
+// CreateCustomer creates a customer with the default provider and returns its provider ID
+func CreateCustomer(email string, metadata map[string]string, idempotencyKey string) (string, error) {
+	return defaultProvider.CreateCustomer(email, metadata, idempotencyKey)
+}
+
+// ParseWebhook verifies the signature of a webhook against PAYMENT_WEBHOOK_SECRET and decodes its
+// event. The signature header has the form "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<payload>">".
+func ParseWebhook(payload []byte, signature string) (Event, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 || webhookSecret == "" {
+		return Event{}, ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return Event{}, ErrInvalidSignature
+	}
+
+	expected := signPayload(webhookSecret, timestamp, payload)
+	valid := false
+	for _, candidate := range signatures {
+		if hmac.Equal([]byte(candidate), []byte(expected)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var raw stripeEvent
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return Event{}, err
+	}
+	event := Event{
+		ID:        raw.ID,
+		Type:      raw.Type,
+		PaymentID: raw.Data.Object.ID,
+		Amount:    fromCents(raw.Data.Object.Amount),
+		Metadata:  raw.Data.Object.Metadata,
+	}
+	if raw.Type == EventPaymentSucceeded {
+		event.Amount = fromCents(raw.Data.Object.AmountReceived)
+	}
+	if raw.Data.Object.LastPaymentError != nil {
+		event.FailureMessage = raw.Data.Object.LastPaymentError.Message
+	}
+	if event.ID == "" {
+		return Event{}, fmt.Errorf("webhook event has no ID")
+	}
+	return event, nil
+}
+
+// signPayload returns the hex HMAC-SHA256 signature of a webhook payload sent at timestamp
+func signPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DefaultPaymentMethod returns the payment method token used when the client does not supply one
+func DefaultPaymentMethod(paymentMethod string) string {
+	if paymentMethod == "PayNow" {
+		return "pm_paynow"
+	}
+	return "pm_card_visa"
+}
+
+// StripeProvider talks to the Stripe PaymentIntents, Refunds and Customers API, or to a server shaped like it
+type StripeProvider struct {
+	BaseURL   string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewStripeProvider returns a provider for the Stripe-shaped API at baseURL
+func NewStripeProvider(baseURL, secretKey string) *StripeProvider {
+	return &StripeProvider{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stripeObject holds the fields used from Stripe PaymentIntent, Refund and Customer objects
+type stripeObject struct {
+	ID               string        `json:"id"`
+	Object           string        `json:"object"`
+	Status           string        `json:"status"`
+	Amount           int64         `json:"amount"`
+	AmountReceived   int64         `json:"amount_received"`
+	ClientSecret     string        `json:"client_secret,omitempty"`
+	LastPaymentError *paymentError `json:"last_payment_error,omitempty"`
+}
+
+// paymentError holds the last payment error of a Stripe PaymentIntent
+type paymentError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// stripeEvent holds the fields used from Stripe webhook events about PaymentIntents
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object struct {
+			stripeObject
+			Metadata map[string]string `json:"metadata"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// stripeError holds a Stripe error response
+type stripeError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *StripeProvider) Authorise(req AuthoriseRequest) (Result, error) {
+	form := url.Values{
+		"amount":         {strconv.FormatInt(toCents(req.Amount), 10)},
+		"currency":       {Currency},
+		"payment_method": {req.PaymentMethod},
+		"capture_method": {"manual"},
+		"confirm":        {"true"},
+		"description":    {req.Description},
+	}
+	if req.Asynchronous {
+		// PayNow cannot hold funds, so it is collected in full once the customer pays
+		form.Set("capture_method", "automatic")
+		form.Set("payment_method_types[]", "paynow")
+	}
+	if req.Customer != "" {
+		form.Set("customer", req.Customer)
+	}
+	if req.SaveForLater {
+		form.Set("setup_future_usage", "off_session")
+	}
+	if req.OffSession {
+		form.Set("off_session", "true")
+	}
+	for key, value := range req.Metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+
+	intent, err := p.post("/v1/payment_intents", form, req.IdempotencyKey)
+	if err != nil {
+		return Result{}, err
+	}
+	return intentResult(intent)
+}
+
+func (p *StripeProvider) Capture(paymentID string, amount float64, idempotencyKey string) (Result, error) {
+	form := url.Values{"amount_to_capture": {strconv.FormatInt(toCents(amount), 10)}}
+	intent, err := p.post("/v1/payment_intents/"+url.PathEscape(paymentID)+"/capture", form, idempotencyKey)
+	if err != nil {
+		return Result{}, err
+	}
+	return intentResult(intent)
+}
+
+func (p *StripeProvider) Void(paymentID string, idempotencyKey string) (Result, error) {
+	intent, err := p.post("/v1/payment_intents/"+url.PathEscape(paymentID)+"/cancel", url.Values{}, idempotencyKey)
+	if err != nil {
+		return Result{}, err
+	}
+	return intentResult(intent)
+}
+
+func (p *StripeProvider) Refund(paymentID string, amount float64, idempotencyKey string) (Result, error) {
+	form := url.Values{
+		"payment_intent": {paymentID},
+		"amount":         {strconv.FormatInt(toCents(amount), 10)},
+	}
+	refund, err := p.post("/v1/refunds", form, idempotencyKey)
+	if err != nil {
+		return Result{}, err
+	}
+	if refund.Status != "succeeded" && refund.Status != "pending" {
+		return Result{}, fmt.Errorf("refund %s %s", refund.ID, refund.Status)
+	}
+	return Result{ID: refund.ID, Status: StatusRefunded, Amount: fromCents(refund.Amount)}, nil
+}
+
+func (p *StripeProvider) CreateCustomer(email string, metadata map[string]string, idempotencyKey string) (string, error) {
+	form := url.Values{}
+	if email != "" {
+		form.Set("email", email)
+	}
+	for key, value := range metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+	customer, err := p.post("/v1/customers", form, idempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	return customer.ID, nil
+}
+
+// post sends a form-encoded request to the API and decodes the returned object. Card errors are
+// returned as a *DeclinedError.
+func (p *StripeProvider) post(path string, form url.Values, idempotencyKey string) (stripeObject, error) {
+	req, err := http.NewRequest("POST", p.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return stripeObject{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return stripeObject{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return stripeObject{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr stripeError
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Type == "card_error" {
+			return stripeObject{}, &DeclinedError{Code: apiErr.Error.Code, Message: apiErr.Error.Message}
+		}
+		return stripeObject{}, fmt.Errorf("payment provider returned status %d for %s: %s", resp.StatusCode, path, string(body))
+	}
+
+	var object stripeObject
+	if err := json.Unmarshal(body, &object); err != nil {
+		return stripeObject{}, err
+	}
+	return object, nil
+}
+
+// intentResult maps a Stripe PaymentIntent onto a Result. A PaymentIntent whose payment attempt failed
+// is returned as a *DeclinedError, and one in a status the provider does not know as an error.
+func intentResult(intent stripeObject) (Result, error) {
+	result := Result{ID: intent.ID, Amount: fromCents(intent.Amount)}
+	switch intent.Status {
+	case "requires_capture":
+		result.Status = StatusAuthorised
+	case "succeeded":
+		result.Status = StatusCaptured
+		result.Amount = fromCents(intent.AmountReceived)
+	case "canceled":
+		result.Status = StatusVoided
+	case "processing":
+		result.Status = StatusPending
+	case "requires_action":
+		result.Status = StatusActionRequired
+		result.ClientSecret = intent.ClientSecret
+	case "requires_payment_method":
+		declined := &DeclinedError{Code: "payment_failed", Message: "The payment attempt failed."}
+		if intent.LastPaymentError != nil {
+			declined.Code, declined.Message = intent.LastPaymentError.Code, intent.LastPaymentError.Message
+		}
+		return Result{}, declined
+	default:
+		return Result{}, fmt.Errorf("payment intent %s has unexpected status %q", intent.ID, intent.Status)
+	}
+	return result, nil
+}
+
+// toCents converts an amount in dollars to the smallest currency unit
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// fromCents converts an amount in the smallest currency unit to dollars
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+const (
+	mockSecretKey  = "sk_test_mock"  // API key accepted by the mock server
+	mockAsyncDelay = 5 * time.Second // How long the mock's customers take to complete asynchronous payments
+	mockDeliveries = 3               // Attempts to deliver each mock webhook
+)
+
+// mockDeclines lists the payment method tokens the mock server declines, with the error code returned
+var mockDeclines = map[string]string{
+	"pm_card_chargeDeclined":    "card_declined",
+	"pm_card_insufficientFunds": "insufficient_funds",
+	"pm_card_expired":           "expired_card",
+}
+
+// mockAsynchronous lists the payment method tokens the mock server completes asynchronously when they
+// are captured automatically, with the error code of those whose payment attempt fails. Manually
+// captured payments with these tokens are authorised straight away.
+var mockAsynchronous = map[string]string{
+	"pm_paynow":         "",
+	"pm_paynow_expired": "payment_intent_payment_attempt_expired",
+}
+
+// MockServer is a deterministic imitation of the Stripe PaymentIntents, Refunds and Customers API for
+// development only. Payments with the tokens in mockDeclines are declined, those in mockAsynchronous are
+// completed after mockAsyncDelay and reported to WebhookURL, and all others succeed. Off-session
+// payments are refused unless their payment method was saved to the customer by an earlier payment. IDs are numbered in order
+// and requests with a repeated Idempotency-Key replay the first response. Its state is saved to
+// StateFile after every change, so that payments made before a restart can still be captured,
+// voided and refunded by saga recovery.
+type MockServer struct {
+	WebhookURL    string // Where webhooks are delivered, or empty to send none
+	WebhookSecret string // Secret webhooks are signed with
+	StateFile     string // Where the state is saved, or empty to keep it in memory
+
+	mu    sync.Mutex
+	state mockState
+}
+
+// mockState holds the payments and customers of a mock server and its stored idempotent responses
+type mockState struct {
+	Sequence  int                      `json:"sequence"`
+	Intents   map[string]*mockIntent   `json:"intents"`
+	Customers map[string]*mockCustomer `json:"customers"`
+	Responses map[string]mockResponse  `json:"responses"`
+}
+
+// mockCustomer holds a customer on the mock server and the payment methods saved to it
+type mockCustomer struct {
+	stripeObject
+	Email          string   `json:"email,omitempty"`
+	PaymentMethods []string `json:"payment_methods"`
+}
+
+// mockIntent holds the state of a PaymentIntent on the mock server
+type mockIntent struct {
+	stripeObject
+	PaymentMethod  string            `json:"payment_method"`
+	Customer       string            `json:"customer,omitempty"`
+	AmountRefunded int64             `json:"amount_refunded"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+// mockResponse holds a response stored for an idempotency key
+type mockResponse struct {
+	Status int    `json:"status"`
+	Body   []byte `json:"body"`
+}
+
+// NewMockServer returns an empty mock server
+func NewMockServer() *MockServer {
+	return &MockServer{state: mockState{Intents: map[string]*mockIntent{}, Customers: map[string]*mockCustomer{}, Responses: map[string]mockResponse{}}}
+}
+
+// StartMockServer serves a mock server on addr in the background and returns its base URL. The
+// server resumes from the state saved in stateFile, if any.
+func StartMockServer(addr, webhookURL, webhookSecret, stateFile string) (string, error) {
+	server := NewMockServer()
+	server.WebhookURL, server.WebhookSecret, server.StateFile = webhookURL, webhookSecret, stateFile
+	if err := server.load(); err != nil {
+		return "", err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		log.Fatal(http.Serve(listener, server))
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// load restores the state saved in StateFile, resuming asynchronous payments the customer had yet to
+// complete. A missing file leaves the server empty.
+func (m *MockServer) load() error {
+	if m.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state := mockState{Intents: map[string]*mockIntent{}, Customers: map[string]*mockCustomer{}, Responses: map[string]mockResponse{}}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error decoding %s: %v", m.StateFile, err)
+	}
+	if state.Customers == nil {
+		// Saved before the mock kept customers
+		state.Customers = map[string]*mockCustomer{}
+	}
+	m.state = state
+	for id, intent := range m.state.Intents {
+		if intent.Status == "requires_action" {
+			id := id
+			time.AfterFunc(mockAsyncDelay, func() { m.completeAsynchronous(id) })
+		}
+	}
+	log.Printf("Mock payment provider resumed with %d payments from %s.", len(m.state.Intents), m.StateFile)
+	return nil
+}
+
+// save writes the state to StateFile, replacing the file atomically. The caller must hold m.mu.
+func (m *MockServer) save() {
+	if m.StateFile == "" {
+		return
+	}
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		log.Printf("Error encoding mock payment provider state: %v", err)
+		return
+	}
+	if err := os.WriteFile(m.StateFile+".tmp", data, 0600); err != nil {
+		log.Printf("Error saving mock payment provider state: %v", err)
+		return
+	}
+	if err := os.Rename(m.StateFile+".tmp", m.StateFile); err != nil {
+		log.Printf("Error saving mock payment provider state: %v", err)
+	}
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+mockSecretKey {
+		writeMockError(w, http.StatusUnauthorized, "invalid_request_error", "", "Invalid API key provided")
+		return
+	}
+	if r.Method != "POST" {
+		writeMockError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "Only POST is supported")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeMockError(w, http.StatusBadRequest, "invalid_request_error", "", "Invalid form body")
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := r.Header.Get("Idempotency-Key")
+	if stored, ok := m.state.Responses[key]; ok && key != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return
+	}
+
+	status, body := m.handle(r)
+	if key != "" {
+		m.state.Responses[key] = mockResponse{Status: status, Body: body}
+	}
+	m.save()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// handle routes a request and returns the response status and body
+func (m *MockServer) handle(r *http.Request) (int, []byte) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "payment_intents":
+		return m.createIntent(r)
+	case len(parts) == 4 && parts[1] == "payment_intents" && parts[3] == "capture":
+		return m.captureIntent(r, parts[2])
+	case len(parts) == 4 && parts[1] == "payment_intents" && parts[3] == "cancel":
+		return m.cancelIntent(parts[2])
+	case len(parts) == 2 && parts[1] == "refunds":
+		return m.createRefund(r)
+	case len(parts) == 2 && parts[1] == "customers":
+		return m.createCustomer(r)
+	}
+	return mockError(http.StatusNotFound, "invalid_request_error", "", "Unrecognized request URL")
+}
+
+func (m *MockServer) createIntent(r *http.Request) (int, []byte) {
+	amount, err := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "parameter_invalid_integer", "Invalid amount")
+	}
+
+	paymentMethod, customerID := r.PostForm.Get("payment_method"), r.PostForm.Get("customer")
+	customer, ok := m.state.Customers[customerID]
+	if customerID != "" && !ok {
+		return mockError(http.StatusNotFound, "invalid_request_error", "resource_missing", "No such customer: "+customerID)
+	}
+	if r.PostForm.Get("off_session") == "true" && (customer == nil || !contains(customer.PaymentMethods, paymentMethod)) {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "payment_method_not_attached",
+			"The PaymentMethod must be attached to the customer to be used off-session.")
+	}
+
+	m.state.Sequence++
+	intent := &mockIntent{
+		stripeObject: stripeObject{
+			ID:           fmt.Sprintf("pi_mock_%06d", m.state.Sequence),
+			Object:       "payment_intent",
+			Amount:       amount,
+			ClientSecret: fmt.Sprintf("pi_mock_%06d_secret_mock", m.state.Sequence),
+		},
+		PaymentMethod: paymentMethod,
+		Customer:      customerID,
+		Metadata:      map[string]string{},
+	}
+	for key, values := range r.PostForm {
+		if strings.HasPrefix(key, "metadata[") && strings.HasSuffix(key, "]") {
+			intent.Metadata[strings.TrimSuffix(strings.TrimPrefix(key, "metadata["), "]")] = values[0]
+		}
+	}
+	m.state.Intents[intent.ID] = intent
+
+	if code, declined := mockDeclines[intent.PaymentMethod]; declined {
+		intent.Status = "requires_payment_method"
+		return mockError(http.StatusPaymentRequired, "card_error", code, "Your card was declined.")
+	}
+	if customer != nil && r.PostForm.Get("setup_future_usage") == "off_session" && !contains(customer.PaymentMethods, paymentMethod) {
+		customer.PaymentMethods = append(customer.PaymentMethods, paymentMethod)
+	}
+
+	if _, asynchronous := mockAsynchronous[intent.PaymentMethod]; asynchronous && r.PostForm.Get("capture_method") != "manual" {
+		// Wait for the customer to pay, e.g. by scanning a PayNow QR code
+		intent.Status = "requires_action"
+		time.AfterFunc(mockAsyncDelay, func() { m.completeAsynchronous(intent.ID) })
+	} else if r.PostForm.Get("capture_method") == "manual" {
+		intent.Status = "requires_capture"
+	} else {
+		intent.Status = "succeeded"
+		intent.AmountReceived = amount
+	}
+	return mockJSON(intent)
+}
+
+func (m *MockServer) captureIntent(r *http.Request, id string) (int, []byte) {
+	intent, ok := m.state.Intents[id]
+	if !ok {
+		return mockError(http.StatusNotFound, "invalid_request_error", "resource_missing", "No such payment_intent: "+id)
+	}
+	if intent.Status != "requires_capture" {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "payment_intent_unexpected_state",
+			"This PaymentIntent could not be captured because it has a status of "+intent.Status+".")
+	}
+
+	amount := intent.Amount
+	if value := r.PostForm.Get("amount_to_capture"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 || parsed > intent.Amount {
+			return mockError(http.StatusBadRequest, "invalid_request_error", "amount_too_large", "Invalid amount_to_capture")
+		}
+		amount = parsed
+	}
+	intent.Status = "succeeded"
+	intent.AmountReceived = amount
+	return mockJSON(intent)
+}
+
+func (m *MockServer) cancelIntent(id string) (int, []byte) {
+	intent, ok := m.state.Intents[id]
+	if !ok {
+		return mockError(http.StatusNotFound, "invalid_request_error", "resource_missing", "No such payment_intent: "+id)
+	}
+	if intent.Status == "succeeded" || intent.Status == "canceled" {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "payment_intent_unexpected_state",
+			"This PaymentIntent could not be canceled because it has a status of "+intent.Status+".")
+	}
+	intent.Status = "canceled"
+	return mockJSON(intent)
+}
+
+func (m *MockServer) createRefund(r *http.Request) (int, []byte) {
+	id := r.PostForm.Get("payment_intent")
+	intent, ok := m.state.Intents[id]
+	if !ok {
+		return mockError(http.StatusNotFound, "invalid_request_error", "resource_missing", "No such payment_intent: "+id)
+	}
+	if intent.Status != "succeeded" {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "charge_not_captured", "This PaymentIntent has not been captured.")
+	}
+
+	amount := intent.AmountReceived - intent.AmountRefunded
+	if value := r.PostForm.Get("amount"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return mockError(http.StatusBadRequest, "invalid_request_error", "parameter_invalid_integer", "Invalid amount")
+		}
+		amount = parsed
+	}
+	if amount > intent.AmountReceived-intent.AmountRefunded {
+		return mockError(http.StatusBadRequest, "invalid_request_error", "charge_exceeds_source_limit",
+			"Refund amount is greater than the unrefunded amount on the charge.")
+	}
+	intent.AmountRefunded += amount
+
+	m.state.Sequence++
+	return mockJSON(stripeObject{ID: fmt.Sprintf("re_mock_%06d", m.state.Sequence), Object: "refund", Status: "succeeded", Amount: amount})
+}
+
+func (m *MockServer) createCustomer(r *http.Request) (int, []byte) {
+	m.state.Sequence++
+	customer := &mockCustomer{
+		stripeObject:   stripeObject{ID: fmt.Sprintf("cus_mock_%06d", m.state.Sequence), Object: "customer"},
+		Email:          r.PostForm.Get("email"),
+		PaymentMethods: []string{},
+	}
+	m.state.Customers[customer.ID] = customer
+	return mockJSON(customer)
+}
+
+// contains reports whether values contains value
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// completeAsynchronous settles an asynchronous payment the customer has acted on and reports the
+// outcome by webhook
+func (m *MockServer) completeAsynchronous(id string) {
+	m.mu.Lock()
+	intent := m.state.Intents[id]
+	if intent.Status != "requires_action" {
+		// Voided before the customer paid
+		m.mu.Unlock()
+		return
+	}
+	eventType := EventPaymentSucceeded
+	if code := mockAsynchronous[intent.PaymentMethod]; code != "" {
+		eventType = EventPaymentFailed
+		intent.Status = "requires_payment_method"
+		intent.LastPaymentError = &paymentError{Code: code, Message: "The customer did not complete the payment in time."}
+	} else {
+		intent.Status = "succeeded"
+		intent.AmountReceived = intent.Amount
+	}
+
+	m.state.Sequence++
+	event := map[string]interface{}{
+		"id":      fmt.Sprintf("evt_mock_%06d", m.state.Sequence),
+		"object":  "event",
+		"type":    eventType,
+		"created": time.Now().Unix(),
+		"data":    map[string]interface{}{"object": intent},
+	}
+	payload, _ := json.Marshal(event)
+	m.save()
+	m.mu.Unlock()
+
+	m.deliverWebhook(payload)
+}
+
+// deliverWebhook posts a signed webhook to WebhookURL, retrying failed deliveries
+func (m *MockServer) deliverWebhook(payload []byte) {
+	if m.WebhookURL == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt := 1; attempt <= mockDeliveries; attempt++ {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req, err := http.NewRequest("POST", m.WebhookURL, bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Error creating mock webhook request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(SignatureHeader, "t="+timestamp+",v1="+signPayload(m.WebhookSecret, timestamp, payload))
+
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Error delivering mock webhook (attempt %d): %v", attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// mockJSON encodes a successful mock response
+func mockJSON(v interface{}) (int, []byte) {
+	body, _ := json.Marshal(v)
+	return http.StatusOK, body
+}
+
+// mockError encodes a Stripe-shaped error response
+func mockError(status int, errorType, code, message string) (int, []byte) {
+	var apiErr stripeError
+	apiErr.Error.Type, apiErr.Error.Code, apiErr.Error.Message = errorType, code, message
+	body, _ := json.Marshal(apiErr)
+	return status, body
+}
+
+// writeMockError writes a Stripe-shaped error response
+func writeMockError(w http.ResponseWriter, status int, errorType, code, message string) {
+	status, body := mockError(status, errorType, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,249 @@
+package provider
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseWebhook(t *testing.T) {
+	webhookSecret = "whsec_test"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	succeeded := []byte(`{"id":"evt_1","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","amount":5000,"amount_received":4500,"metadata":{"saga_reference":"abc"}}}}`)
+	failed := []byte(`{"id":"evt_2","type":"payment_intent.payment_failed","data":{"object":{"id":"pi_2","amount":1999,"last_payment_error":{"code":"expired","message":"Too late"}}}}`)
+	noID := []byte(`{"type":"payment_intent.succeeded","data":{"object":{"id":"pi_3"}}}`)
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature string
+		want      Event
+		wantErr   error
+		anyErr    bool
+	}{
+		{
+			name:      "valid signature",
+			payload:   succeeded,
+			signature: "t=" + now + ",v1=" + signPayload("whsec_test", now, succeeded),
+			want:      Event{ID: "evt_1", Type: EventPaymentSucceeded, PaymentID: "pi_1", Amount: 45, Metadata: map[string]string{"saga_reference": "abc"}},
+		},
+		{
+			name:      "one of several signatures valid",
+			payload:   failed,
+			signature: "t=" + now + ",v1=deadbeef,v1=" + signPayload("whsec_test", now, failed),
+			want:      Event{ID: "evt_2", Type: EventPaymentFailed, PaymentID: "pi_2", Amount: 19.99, FailureMessage: "Too late"},
+		},
+		{
+			name:      "signed with another secret",
+			payload:   succeeded,
+			signature: "t=" + now + ",v1=" + signPayload("whsec_other", now, succeeded),
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "payload altered after signing",
+			payload:   failed,
+			signature: "t=" + now + ",v1=" + signPayload("whsec_test", now, succeeded),
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "timestamp outside tolerance",
+			payload:   succeeded,
+			signature: "t=" + stale + ",v1=" + signPayload("whsec_test", stale, succeeded),
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "missing timestamp",
+			payload:   succeeded,
+			signature: "v1=" + signPayload("whsec_test", now, succeeded),
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "missing signature",
+			payload:   succeeded,
+			signature: "t=" + now,
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "empty header",
+			payload:   succeeded,
+			signature: "",
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "event without ID",
+			payload:   noID,
+			signature: "t=" + now + ",v1=" + signPayload("whsec_test", now, noID),
+			anyErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := ParseWebhook(test.payload, test.signature)
+			if test.wantErr != nil || test.anyErr {
+				if err == nil {
+					t.Fatalf("ParseWebhook() returned no error, want one")
+				}
+				if test.wantErr != nil && err != test.wantErr {
+					t.Fatalf("ParseWebhook() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			if event.ID != test.want.ID || event.Type != test.want.Type || event.PaymentID != test.want.PaymentID ||
+				event.Amount != test.want.Amount || event.FailureMessage != test.want.FailureMessage {
+				t.Errorf("ParseWebhook() = %+v, want %+v", event, test.want)
+			}
+			for key, value := range test.want.Metadata {
+				if event.Metadata[key] != value {
+					t.Errorf("ParseWebhook() metadata[%s] = %q, want %q", key, event.Metadata[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestMockServerResumesState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	first := NewMockServer()
+	first.StateFile = stateFile
+	server := httptest.NewServer(first)
+	authorised, err := NewStripeProvider(server.URL, mockSecretKey).Authorise(AuthoriseRequest{
+		Amount: 42.50, PaymentMethod: "pm_card_visa", IdempotencyKey: "authorise-1",
+	})
+	server.Close()
+	if err != nil {
+		t.Fatalf("Authorise() error = %v", err)
+	}
+
+	// A restarted server captures the payment and replays the stored authorisation
+	second := NewMockServer()
+	second.StateFile = stateFile
+	if err := second.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	server = httptest.NewServer(second)
+	defer server.Close()
+	stripe := NewStripeProvider(server.URL, mockSecretKey)
+
+	captured, err := stripe.Capture(authorised.ID, 40, "capture-1")
+	if err != nil {
+		t.Fatalf("Capture() after restart error = %v", err)
+	}
+	if captured.Status != StatusCaptured || captured.Amount != 40 {
+		t.Errorf("Capture() = %+v, want captured $40", captured)
+	}
+	replayed, err := stripe.Authorise(AuthoriseRequest{Amount: 42.50, PaymentMethod: "pm_card_visa", IdempotencyKey: "authorise-1"})
+	if err != nil || replayed.ID != authorised.ID {
+		t.Errorf("Authorise() replay = %+v, %v, want %s", replayed, err, authorised.ID)
+	}
+}
+
+func TestMockServerOffSession(t *testing.T) {
+	server := httptest.NewServer(NewMockServer())
+	defer server.Close()
+	stripe := NewStripeProvider(server.URL, mockSecretKey)
+
+	customer, err := stripe.CreateCustomer("alice@example.com", map[string]string{"user_id": "1"}, "customer-1")
+	if err != nil {
+		t.Fatalf("CreateCustomer() error = %v", err)
+	}
+
+	// A payment method used without being saved cannot be charged off-session
+	if _, err := stripe.Authorise(AuthoriseRequest{Amount: 10, PaymentMethod: "pm_card_visa", Customer: customer, IdempotencyKey: "checkout-1"}); err != nil {
+		t.Fatalf("Authorise() error = %v", err)
+	}
+	if _, err := stripe.Authorise(AuthoriseRequest{Amount: 5, PaymentMethod: "pm_card_visa", Customer: customer, OffSession: true, IdempotencyKey: "charge-1"}); err == nil {
+		t.Errorf("Authorise() off-session with an unsaved payment method returned no error, want one")
+	}
+
+	if _, err := stripe.Authorise(AuthoriseRequest{Amount: 10, PaymentMethod: "pm_card_visa", Customer: customer, SaveForLater: true, IdempotencyKey: "checkout-2"}); err != nil {
+		t.Fatalf("Authorise() saving the payment method error = %v", err)
+	}
+	charged, err := stripe.Authorise(AuthoriseRequest{Amount: 5, PaymentMethod: "pm_card_visa", Customer: customer, OffSession: true, IdempotencyKey: "charge-2"})
+	if err != nil || charged.Status != StatusAuthorised {
+		t.Errorf("Authorise() off-session = %+v, %v, want authorised", charged, err)
+	}
+	if _, err := stripe.Authorise(AuthoriseRequest{Amount: 5, PaymentMethod: "pm_card_visa", OffSession: true, IdempotencyKey: "charge-3"}); err == nil {
+		t.Errorf("Authorise() off-session without a customer returned no error, want one")
+	}
+}
+
+func TestIntentResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		intent   stripeObject
+		want     Result
+		declined bool
+		anyErr   bool
+	}{
+		{
+			name:   "authorised",
+			intent: stripeObject{ID: "pi_1", Status: "requires_capture", Amount: 5000},
+			want:   Result{ID: "pi_1", Status: StatusAuthorised, Amount: 50},
+		},
+		{
+			name:   "captured",
+			intent: stripeObject{ID: "pi_2", Status: "succeeded", Amount: 5000, AmountReceived: 4500},
+			want:   Result{ID: "pi_2", Status: StatusCaptured, Amount: 45},
+		},
+		{
+			name:   "voided",
+			intent: stripeObject{ID: "pi_3", Status: "canceled", Amount: 5000},
+			want:   Result{ID: "pi_3", Status: StatusVoided, Amount: 50},
+		},
+		{
+			name:   "processing",
+			intent: stripeObject{ID: "pi_4", Status: "processing", Amount: 5000},
+			want:   Result{ID: "pi_4", Status: StatusPending, Amount: 50},
+		},
+		{
+			name:   "3D Secure required",
+			intent: stripeObject{ID: "pi_5", Status: "requires_action", Amount: 5000, ClientSecret: "pi_5_secret"},
+			want:   Result{ID: "pi_5", Status: StatusActionRequired, Amount: 50, ClientSecret: "pi_5_secret"},
+		},
+		{
+			name:     "payment attempt failed",
+			intent:   stripeObject{ID: "pi_6", Status: "requires_payment_method", LastPaymentError: &paymentError{Code: "authentication_required", Message: "Authentication failed"}},
+			declined: true,
+		},
+		{
+			name:     "payment attempt failed without an error",
+			intent:   stripeObject{ID: "pi_7", Status: "requires_payment_method"},
+			declined: true,
+		},
+		{
+			name:   "unknown status",
+			intent: stripeObject{ID: "pi_8", Status: "requires_confirmation"},
+			anyErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := intentResult(test.intent)
+			if test.declined || test.anyErr {
+				if err == nil {
+					t.Fatalf("intentResult() returned no error, want one")
+				}
+				if _, declined := err.(*DeclinedError); declined != test.declined {
+					t.Fatalf("intentResult() error = %v, want declined %v", err, test.declined)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("intentResult() error = %v", err)
+			}
+			if result != test.want {
+				t.Errorf("intentResult() = %+v, want %+v", result, test.want)
+			}
+		})
+	}
+}
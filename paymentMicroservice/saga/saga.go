@@ -0,0 +1,315 @@
+package saga
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+// Saga states. Completed, Aborted, Compensated and Failed are terminal.
+const (
+	StatusStarted         = "Started"         // Saga persisted, booking not yet known to exist
+	StatusBookingCreated  = "BookingCreated"  // Booking reserved, payment not yet recorded
+	StatusPaymentRecorded = "PaymentRecorded" // Payment recorded, booking not yet confirmed
+	StatusAwaitingPayment = "AwaitingPayment" // Payment waiting for the customer, e.g. to pay by PayNow
+	StatusCompleted       = "Completed"       // Booking confirmed and invoice queued
+	StatusAborted         = "Aborted"         // Booking rejected, nothing to undo
+	StatusCompensating    = "Compensating"    // Undoing the steps taken so far
+	StatusCompensated     = "Compensated"     // All steps undone
+	StatusFailed          = "Failed"          // Recovery gave up and the saga needs manual attention
+)
+
+const (
+	pollInterval = 30 * time.Second // How often the recovery worker looks for stalled sagas
+	staleAfter   = 2 * time.Minute  // Sagas without progress for this long are considered stalled
+	payTimeout   = 15 * time.Minute // Sagas awaiting payment for this long are rolled back
+	batchSize    = 10               // Sagas claimed per poll
+	maxAttempts  = 5                // Recovery attempts before a saga is marked as failed
+)
+
+// Init connects to the payment database configured in .env. The payment service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (saga package)...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (saga package) successful.")
+}
+
+// Saga represents a row of the BookingSaga table
+type Saga struct {
+	SagaID         int       `json:"saga_id"`
+	Reference      string    `json:"reference"`
+	Status         string    `json:"status"`
+	UserID         int       `json:"user_id"`
+	VehicleID      int       `json:"vehicle_id"`
+	BookingDate    time.Time `json:"booking_date"`
+	ReturnDate     time.Time `json:"return_date"`
+	PaymentMethod  string    `json:"payment_method"`
+	Email          string    `json:"email"`
+	UserName       string    `json:"user_name"`
+	Locale         string    `json:"locale"`
+	BookingID      int       `json:"booking_id,omitempty"`
+	PaymentID      int       `json:"payment_id,omitempty"`
+	BasePrice      float64   `json:"base_price,omitempty"`      // Rental price before discounts
+	MemberDiscount float64   `json:"member_discount,omitempty"` // Amount taken off the booking by the member's tier discount
+	TotalPrice     float64   `json:"total_price,omitempty"`
+	PromoCode      string    `json:"promo_code,omitempty"`     // Promo code entered at checkout, as applied by the vehicle service
+	PromoDiscount  float64   `json:"promo_discount,omitempty"` // Amount taken off the booking by the promo code
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	UpdatedAt      string    `json:"updated_at"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Create persists a new saga in the Started state and assigns its ID and reference
+func Create(s *Saga) error {
+	reference := make([]byte, 16)
+	if _, err := rand.Read(reference); err != nil {
+		return err
+	}
+	s.Reference = hex.EncodeToString(reference)
+	s.Status = StatusStarted
+
+	result, err := db.Exec(`
+		INSERT INTO BookingSaga (reference, status, user_id, vehicle_id, booking_date, return_date, payment_method, email, user_name, locale, promo_code, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		s.Reference, s.Status, s.UserID, s.VehicleID, s.BookingDate, s.ReturnDate, s.PaymentMethod, s.Email, s.UserName, s.Locale, s.PromoCode, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sagaID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	s.SagaID = int(sagaID)
+	log.Printf("Saga %d started for user_id %d, vehicle_id %d.", s.SagaID, s.UserID, s.VehicleID)
+	return nil
+}
+
+// Save records the progress of a saga
+func Save(s *Saga) error {
+	return save(db, s)
+}
+
+// SaveTx records the progress of a saga in the transaction that performed the step, so that the
+// step and the saga state are committed together
+func SaveTx(tx *sql.Tx, s *Saga) error {
+	return save(tx, s)
+}
+
+// save writes the step outputs and state of a saga
+func save(exec execer, s *Saga) error {
+	_, err := exec.Exec(`
+		UPDATE BookingSaga
+		SET status = ?, booking_id = NULLIF(?, 0), payment_id = NULLIF(?, 0), base_price = ?, member_discount = ?, total_price = ?,
+			promo_code = NULLIF(?, ''), promo_discount = ?, last_error = NULLIF(?, ''), updated_at = ?
+		WHERE saga_id = ?`,
+		s.Status, s.BookingID, s.PaymentID, s.BasePrice, s.MemberDiscount, s.TotalPrice, s.PromoCode, s.PromoDiscount, s.LastError, time.Now(), s.SagaID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saga %d is %s.", s.SagaID, s.Status)
+	return nil
+}
+
+// StartRecovery finishes or rolls back stalled sagas until the process exits, starting with those
+// left in flight by a previous run. resume drives a saga to a terminal state and returns an error
+// if it has to be retried.
+func StartRecovery(resume func(s *Saga) error) {
+	log.Println("Starting saga recovery worker...")
+	recoverBatch(resume)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		recoverBatch(resume)
+	}
+}
+
+// recoverBatch claims up to batchSize stalled sagas and resumes them
+func recoverBatch(resume func(s *Saga) error) {
+	sagas, err := claimStalled()
+	if err != nil {
+		log.Printf("Error claiming stalled sagas: %v", err)
+		return
+	}
+
+	for _, s := range sagas {
+		log.Printf("Recovering saga %d from %s (attempt %d).", s.SagaID, s.Status, s.Attempts)
+		err := resume(s)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("Error recovering saga %d: %v", s.SagaID, err)
+		if s.Attempts >= maxAttempts {
+			s.Status = StatusFailed
+			log.Printf("Saga %d failed after %d recovery attempts and needs manual attention.", s.SagaID, s.Attempts)
+		}
+		s.LastError = err.Error()
+		if err := Save(s); err != nil {
+			log.Printf("Error saving saga %d: %v", s.SagaID, err)
+		}
+	}
+}
+
+// claimStalled loads stalled sagas and counts a recovery attempt on each. Touching updated_at
+// leases them to this worker, so other replicas skip them until they go stale again.
+func claimStalled() ([]*Saga, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT saga_id, reference, status, user_id, vehicle_id, booking_date, return_date, payment_method,
+			COALESCE(email, ''), COALESCE(user_name, ''), COALESCE(locale, ''),
+			COALESCE(booking_id, 0), COALESCE(payment_id, 0), COALESCE(base_price, 0), member_discount, COALESCE(total_price, 0), COALESCE(promo_code, ''), promo_discount, attempts, COALESCE(last_error, ''), updated_at
+		FROM BookingSaga
+		WHERE (status IN (?, ?, ?, ?) AND updated_at <= ?) OR (status = ? AND updated_at <= ?)
+		ORDER BY saga_id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`,
+		StatusStarted, StatusBookingCreated, StatusPaymentRecorded, StatusCompensating, time.Now().Add(-staleAfter),
+		StatusAwaitingPayment, time.Now().Add(-payTimeout), batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var sagas []*Saga
+	for rows.Next() {
+		s, err := scanSaga(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sagas = append(sagas, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, s := range sagas {
+		s.Attempts++
+		if _, err := tx.Exec("UPDATE BookingSaga SET attempts = ?, updated_at = ? WHERE saga_id = ?", s.Attempts, now, s.SagaID); err != nil {
+			return nil, err
+		}
+	}
+	return sagas, tx.Commit()
+}
+
+// FindByPaymentID returns the saga that recorded a booking payment, or sql.ErrNoRows if there is none
+func FindByPaymentID(paymentID int) (*Saga, error) {
+	rows, err := db.Query(`
+		SELECT saga_id, reference, status, user_id, vehicle_id, booking_date, return_date, payment_method,
+			COALESCE(email, ''), COALESCE(user_name, ''), COALESCE(locale, ''),
+			COALESCE(booking_id, 0), COALESCE(payment_id, 0), COALESCE(base_price, 0), member_discount, COALESCE(total_price, 0), COALESCE(promo_code, ''), promo_discount, attempts, COALESCE(last_error, ''), updated_at
+		FROM BookingSaga WHERE payment_id = ?`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanSaga(rows)
+}
+
+// scanSaga scans a BookingSaga row selected with the columns used by claimStalled, FindByPaymentID and ListSagas
+func scanSaga(rows *sql.Rows) (*Saga, error) {
+	var s Saga
+	var bookingDate, returnDate string
+	err := rows.Scan(&s.SagaID, &s.Reference, &s.Status, &s.UserID, &s.VehicleID, &bookingDate, &returnDate, &s.PaymentMethod,
+		&s.Email, &s.UserName, &s.Locale, &s.BookingID, &s.PaymentID, &s.BasePrice, &s.MemberDiscount, &s.TotalPrice, &s.PromoCode, &s.PromoDiscount, &s.Attempts, &s.LastError, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if s.BookingDate, err = time.Parse("2006-01-02 15:04:05", bookingDate); err != nil {
+		return nil, err
+	}
+	if s.ReturnDate, err = time.Parse("2006-01-02 15:04:05", returnDate); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSagas returns recent sagas, optionally filtered by status
+func ListSagas(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	query := `
+		SELECT saga_id, reference, status, user_id, vehicle_id, booking_date, return_date, payment_method,
+			COALESCE(email, ''), COALESCE(user_name, ''), COALESCE(locale, ''),
+			COALESCE(booking_id, 0), COALESCE(payment_id, 0), COALESCE(base_price, 0), member_discount, COALESCE(total_price, 0), COALESCE(promo_code, ''), promo_discount, attempts, COALESCE(last_error, ''), updated_at
+		FROM BookingSaga`
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY saga_id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying sagas: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sagas := []*Saga{}
+	for rows.Next() {
+		s, err := scanSaga(rows)
+		if err != nil {
+			log.Printf("Error scanning saga row: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		sagas = append(sagas, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sagas)
+}
@@ -0,0 +1,732 @@
+package subscription
+
+import (
+	"common/middleware"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+const (
+	pollInterval    = time.Hour        // How often the scheduler looks for memberships to renew, remind or expire
+	paymentInterval = time.Minute      // How often the scheduler looks for membership payments that timed out
+	payTimeout      = 15 * time.Minute // Membership payments not completed within this long are cancelled
+	batchSize       = 50               // Memberships handled per job per poll
+)
+
+// reminderDays is how many days before the end of a membership its renewal reminder is sent,
+// configurable with MEMBERSHIP_RENEWAL_REMINDER_DAYS
+var reminderDays = 7
+
+// columns are the MembershipPayment columns scanned by scanSubscription
+const columns = `membership_payment_id, user_id, membership_level, amount, COALESCE(plan_price, amount), refund_amount, refund_due,
+	COALESCE(payment_method, ''), COALESCE(provider_payment_id, ''), COALESCE(provider_payment_method, ''), COALESCE(email, ''), COALESCE(user_name, ''),
+	COALESCE(locale, ''), start_date, end_date, auto_renew, COALESCE(superseded_by, 0), COALESCE(renewal_of, 0)`
+
+// Init connects to the database configured in .env and loads the renewal reminder policy. The payment
+// service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (subscription package)...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (subscription package) successful.")
+
+	if days := os.Getenv("MEMBERSHIP_RENEWAL_REMINDER_DAYS"); days != "" {
+		value, err := strconv.Atoi(days)
+		if err != nil || value < 0 {
+			log.Fatalf("Invalid MEMBERSHIP_RENEWAL_REMINDER_DAYS: %q", days)
+		}
+		reminderDays = value
+	}
+	log.Printf("Membership renewal reminders are sent %d days before the end of a membership.", reminderDays)
+}
+
+// Subscription represents a paid membership period in the MembershipPayment table
+type Subscription struct {
+	PaymentID             int64
+	UserID                int
+	MembershipLevel       string
+	Amount                float64 // Amount charged, after credit for the unused days of the memberships it replaced
+	PlanPrice             float64 // Price of the plan, which its unused days are credited from
+	RefundAmount          float64
+	RefundDue             float64 // Refund of a plan change still to be made by the provider
+	PaymentMethod         string
+	ProviderPaymentID     string
+	ProviderPaymentMethod string // Payment method at the payment provider, charged again on renewal
+	Email                 string
+	UserName              string
+	Locale                string
+	StartDate             time.Time
+	EndDate               time.Time
+	AutoRenew             bool
+	SupersededBy          int64 // Membership payment that replaced it on a plan change, 0 if none
+	RenewalOf             int64 // Membership payment it renews, 0 if the customer paid for it at checkout
+}
+
+// InitialStatus returns the status a membership payment is recorded with before it is charged. A card
+// is charged synchronously by the request that records the payment, so it is Processing and webhooks
+// leave it alone; an asynchronous payment such as PayNow is Pending until the provider's webhook
+// reports it.
+func InitialStatus(paymentMethod string) string {
+	if paymentMethod == "PayNow" {
+		return "Pending"
+	}
+	return "Processing"
+}
+
+// StartScheduler renews, reminds and expires memberships, cancels timed out membership payments and
+// retries the refunds of plan changes until the process exits. renew charges a claimed renewal and
+// activates it, remind queues the reminder that a membership is about to end, expire downgrades the
+// user of a lapsed membership to Basic, cancel releases the funds of a payment that was not completed
+// in time and refund refunds part of a replaced membership, as for Replace. Each returns an error if
+// the step has to be retried, except cancel, whose payment is failed either way.
+func StartScheduler(renew, remind, expire, cancel func(s Subscription) error, refund func(s Subscription, amount float64) error) {
+	log.Println("Starting membership scheduler...")
+	cancelBatch(time.Now(), cancel)
+	runJobs(renew, remind, expire, refund)
+
+	jobs := time.NewTicker(pollInterval)
+	defer jobs.Stop()
+	payments := time.NewTicker(paymentInterval)
+	defer payments.Stop()
+	for {
+		select {
+		case <-jobs.C:
+			runJobs(renew, remind, expire, refund)
+		case <-payments.C:
+			cancelBatch(time.Now(), cancel)
+		}
+	}
+}
+
+// cancelBatch fails membership payments that have been Pending or Processing for longer than payTimeout,
+// e.g. a PayNow payment the customer never made or a card charge interrupted by a crash, and calls
+// cancel to release their funds. A payment the customer completes afterwards is refunded by the
+// webhook, as it is no longer Pending.
+func cancelBatch(now time.Time, cancel func(s Subscription) error) {
+	due, err := query(`
+		SELECT `+columns+` FROM MembershipPayment
+		WHERE payment_status IN ('Pending', 'Processing') AND created_at <= ?
+		LIMIT ?`, now.Add(-payTimeout), batchSize)
+	if err != nil {
+		log.Printf("Error querying timed out membership payments: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		// Failing the payment first claims it, so that a webhook arriving meanwhile cannot activate it
+		result, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Failed' WHERE membership_payment_id = ? AND payment_status IN ('Pending', 'Processing')", s.PaymentID)
+		if err != nil {
+			log.Printf("Error failing membership payment_id %d: %v", s.PaymentID, err)
+			continue
+		}
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			continue
+		}
+
+		log.Printf("Membership payment_id %d of user_id %d was not completed in time and has been failed.", s.PaymentID, s.UserID)
+		if err := cancel(s); err != nil {
+			log.Printf("Error cancelling membership payment_id %d with the payment provider: %v", s.PaymentID, err)
+		}
+	}
+}
+
+// runJobs runs each membership job once. Renewals run first so that a membership renewed on its last
+// day is not reminded about or expired.
+func runJobs(renew, remind, expire func(s Subscription) error, refund func(s Subscription, amount float64) error) {
+	today := time.Now()
+	renewBatch(today, renew)
+	remindBatch(today, remind)
+	expireBatch(today, expire)
+	refundBatch(refund)
+}
+
+// refundBatch retries the refunds of replaced memberships that failed when they were replaced. The
+// refund is recorded once the provider has made it; the provider's idempotency key keeps replicas
+// retrying the same refund from refunding it twice.
+func refundBatch(refund func(s Subscription, amount float64) error) {
+	due, err := query(`
+		SELECT `+columns+` FROM MembershipPayment
+		WHERE refund_due > 0 AND superseded_by IS NOT NULL
+		LIMIT ?`, batchSize)
+	if err != nil {
+		log.Printf("Error querying membership refunds due: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		if err := refund(s, s.RefundDue); err != nil {
+			log.Printf("Error refunding $%.2f of membership payment_id %d, will retry: %v", s.RefundDue, s.PaymentID, err)
+			continue
+		}
+		_, err := db.Exec(`
+			UPDATE MembershipPayment SET refund_amount = refund_amount + ?, refund_due = refund_due - ?
+			WHERE membership_payment_id = ? AND refund_due >= ?`, s.RefundDue, s.RefundDue, s.PaymentID, s.RefundDue)
+		if err != nil {
+			log.Printf("Error recording refund of membership payment_id %d: %v", s.PaymentID, err)
+			continue
+		}
+		log.Printf("Refunded $%.2f of membership payment_id %d replaced by payment_id %d.", s.RefundDue, s.PaymentID, s.SupersededBy)
+	}
+}
+
+// renewBatch renews auto-renewing memberships that end today, or ended yesterday if the scheduler did
+// not run in time. Each membership is renewed at most once; a failed renewal lapses at its end.
+func renewBatch(today time.Time, renew func(s Subscription) error) {
+	due, err := query(`
+		SELECT `+columns+` FROM MembershipPayment m
+		WHERE payment_status = 'Completed' AND auto_renew AND membership_level <> 'Basic' AND expired_at IS NULL AND superseded_by IS NULL
+			AND end_date BETWEEN ? AND ?
+			AND NOT EXISTS (SELECT 1 FROM MembershipPayment later WHERE later.user_id = m.user_id AND later.payment_status = 'Completed' AND later.end_date > m.end_date)
+			AND NOT EXISTS (SELECT 1 FROM MembershipPayment renewal WHERE renewal.renewal_of = m.membership_payment_id)
+		LIMIT ?`, today.AddDate(0, 0, -1).Format("2006-01-02"), today.Format("2006-01-02"), batchSize)
+	if err != nil {
+		log.Printf("Error querying memberships due for renewal: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		renewal, err := claimRenewal(s)
+		if err != nil {
+			log.Printf("Error claiming renewal of membership payment_id %d: %v", s.PaymentID, err)
+			continue
+		} else if renewal == nil {
+			continue
+		}
+
+		log.Printf("Renewing %s membership of user_id %d from payment_id %d as payment_id %d.", s.MembershipLevel, s.UserID, s.PaymentID, renewal.PaymentID)
+		if err := renew(*renewal); err != nil {
+			log.Printf("Error renewing membership payment_id %d: %v", s.PaymentID, err)
+			if _, err := db.Exec("UPDATE MembershipPayment SET payment_status = 'Failed' WHERE membership_payment_id = ? AND payment_status IN ('Pending', 'Processing')", renewal.PaymentID); err != nil {
+				log.Printf("Error failing membership renewal payment_id %d: %v", renewal.PaymentID, err)
+			}
+		}
+	}
+}
+
+// claimRenewal records the renewal of a membership as an uncharged payment for the next period, priced
+// from the plan catalogue. It returns nil if another replica has already claimed the renewal.
+func claimRenewal(s Subscription) (*Subscription, error) {
+	plan, err := GetPlan(s.MembershipLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	renewal := s
+	renewal.Amount, renewal.PlanPrice, renewal.RefundAmount, renewal.RefundDue, renewal.ProviderPaymentID = plan.Price, plan.Price, 0, 0, ""
+	renewal.StartDate, renewal.EndDate = s.EndDate, s.EndDate.AddDate(0, plan.DurationMonths, 0)
+	renewal.RenewalOf, renewal.SupersededBy = s.PaymentID, 0
+	result, err := db.Exec(`
+		INSERT INTO MembershipPayment (user_id, membership_level, amount, plan_price, payment_method, payment_status, provider_payment_method, auto_renew, renewal_of, email, user_name, locale, start_date, end_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, TRUE, ?, ?, ?, ?, ?, ?)`,
+		s.UserID, s.MembershipLevel, renewal.Amount, renewal.PlanPrice, s.PaymentMethod, InitialStatus(s.PaymentMethod), s.ProviderPaymentMethod, s.PaymentID, s.Email, s.UserName, s.Locale,
+		renewal.StartDate.Format("2006-01-02"), renewal.EndDate.Format("2006-01-02"))
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if renewal.PaymentID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return &renewal, nil
+}
+
+// remindBatch reminds users whose membership ends within reminderDays and has not been renewed
+func remindBatch(today time.Time, remind func(s Subscription) error) {
+	due, err := query(`
+		SELECT `+columns+` FROM MembershipPayment m
+		WHERE payment_status = 'Completed' AND membership_level <> 'Basic' AND reminder_sent_at IS NULL AND expired_at IS NULL AND superseded_by IS NULL
+			AND end_date BETWEEN ? AND ?
+			AND NOT EXISTS (SELECT 1 FROM MembershipPayment later WHERE later.user_id = m.user_id AND later.payment_status = 'Completed' AND later.end_date > m.end_date)
+		LIMIT ?`, today.Format("2006-01-02"), today.AddDate(0, 0, reminderDays).Format("2006-01-02"), batchSize)
+	if err != nil {
+		log.Printf("Error querying memberships due for a renewal reminder: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		if !claim(s.PaymentID, "reminder_sent_at") {
+			continue
+		}
+		if err := remind(s); err != nil {
+			log.Printf("Error reminding user_id %d of the renewal of membership payment_id %d: %v", s.UserID, s.PaymentID, err)
+			release(s.PaymentID, "reminder_sent_at")
+			continue
+		}
+		log.Printf("Reminded user_id %d that membership payment_id %d ends on %s.", s.UserID, s.PaymentID, s.EndDate.Format("2006-01-02"))
+	}
+}
+
+// expireBatch downgrades users whose membership has ended without being renewed
+func expireBatch(today time.Time, expire func(s Subscription) error) {
+	due, err := query(`
+		SELECT `+columns+` FROM MembershipPayment m
+		WHERE payment_status = 'Completed' AND membership_level <> 'Basic' AND expired_at IS NULL AND superseded_by IS NULL AND end_date < ?
+			AND NOT EXISTS (SELECT 1 FROM MembershipPayment later WHERE later.user_id = m.user_id AND later.payment_status = 'Completed' AND later.end_date > m.end_date)
+			AND NOT EXISTS (SELECT 1 FROM MembershipPayment renewal WHERE renewal.renewal_of = m.membership_payment_id AND renewal.payment_status IN ('Pending', 'Processing'))
+		LIMIT ?`, today.Format("2006-01-02"), batchSize)
+	if err != nil {
+		log.Printf("Error querying expired memberships: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		if !claim(s.PaymentID, "expired_at") {
+			continue
+		}
+		if err := expire(s); err != nil {
+			log.Printf("Error expiring membership payment_id %d of user_id %d: %v", s.PaymentID, s.UserID, err)
+			release(s.PaymentID, "expired_at")
+			continue
+		}
+		log.Printf("Membership payment_id %d of user_id %d expired on %s.", s.PaymentID, s.UserID, s.EndDate.Format("2006-01-02"))
+	}
+}
+
+// claim stamps a job column of a membership payment so that other replicas skip it, returning false
+// if it was already stamped. column is one of reminder_sent_at and expired_at.
+func claim(paymentID int64, column string) bool {
+	result, err := db.Exec("UPDATE MembershipPayment SET "+column+" = ? WHERE membership_payment_id = ? AND "+column+" IS NULL", time.Now(), paymentID)
+	if err != nil {
+		log.Printf("Error claiming membership payment_id %d: %v", paymentID, err)
+		return false
+	}
+	claimed, _ := result.RowsAffected()
+	return claimed == 1
+}
+
+// release clears a job column stamped by claim so that the job is retried at the next poll
+func release(paymentID int64, column string) {
+	if _, err := db.Exec("UPDATE MembershipPayment SET "+column+" = NULL WHERE membership_payment_id = ?", paymentID); err != nil {
+		log.Printf("Error releasing membership payment_id %d: %v", paymentID, err)
+	}
+}
+
+// query loads the memberships selected with columns
+func query(statement string, args ...interface{}) ([]Subscription, error) {
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// scanSubscription scans a MembershipPayment row selected with columns
+func scanSubscription(rows *sql.Rows) (Subscription, error) {
+	var s Subscription
+	var startDate, endDate string
+	err := rows.Scan(&s.PaymentID, &s.UserID, &s.MembershipLevel, &s.Amount, &s.PlanPrice, &s.RefundAmount, &s.RefundDue, &s.PaymentMethod,
+		&s.ProviderPaymentID, &s.ProviderPaymentMethod, &s.Email, &s.UserName, &s.Locale, &startDate, &endDate, &s.AutoRenew, &s.SupersededBy, &s.RenewalOf)
+	if err != nil {
+		return s, err
+	}
+	if s.StartDate, err = time.Parse("2006-01-02", startDate); err != nil {
+		return s, err
+	}
+	if s.EndDate, err = time.Parse("2006-01-02", endDate); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// lastPaid returns the paid membership of a user that ends last, if it has not ended by the given
+// day. This is the membership that renews or lapses next.
+func lastPaid(userID int, day time.Time) (*Subscription, error) {
+	subscriptions, err := query(`
+		SELECT `+columns+` FROM MembershipPayment
+		WHERE user_id = ? AND payment_status = 'Completed' AND superseded_by IS NULL AND end_date >= ?
+		ORDER BY end_date DESC, membership_payment_id DESC LIMIT 1`, userID, day.Format("2006-01-02"))
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+	return &subscriptions[0], nil
+}
+
+// active returns the paid membership of a user that covers the given day
+func active(userID int, day time.Time) (*Subscription, error) {
+	subscriptions, err := query(`
+		SELECT `+columns+` FROM MembershipPayment
+		WHERE user_id = ? AND payment_status = 'Completed' AND superseded_by IS NULL AND start_date <= ? AND end_date >= ?
+		ORDER BY start_date DESC, membership_payment_id DESC LIMIT 1`, userID, day.Format("2006-01-02"), day.Format("2006-01-02"))
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+	return &subscriptions[0], nil
+}
+
+// GetSubscription returns the active membership period of the user in the user_id query parameter
+func GetSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	period, err := active(userID, time.Now())
+	if err != nil {
+		log.Printf("Error querying active membership of user_id %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if period == nil {
+		http.Error(w, "No active membership", http.StatusNotFound)
+		return
+	}
+
+	// The membership renews or lapses at the end of the last period paid for
+	last, err := lastPaid(userID, time.Now())
+	if err != nil || last == nil {
+		log.Printf("Error querying current membership of user_id %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"membership_payment_id": period.PaymentID,
+		"membership_level":      period.MembershipLevel,
+		"payment_method":        period.PaymentMethod,
+		"start_date":            period.StartDate.Format("2006-01-02"),
+		"end_date":              period.EndDate.Format("2006-01-02"),
+		"paid_until":            last.EndDate.Format("2006-01-02"),
+		"auto_renew":            last.AutoRenew,
+	})
+}
+
+// SetAutoRenew opts the authenticated user's current membership in or out of automatic renewal.
+// Only memberships paid by card can renew automatically, as PayNow payments need the customer.
+func SetAutoRenew(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserID    int  `json:"user_id"`
+		AutoRenew bool `json:"auto_renew"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !middleware.AuthorizeUser(r, request.UserID) {
+		log.Printf("Rejected auto-renewal change for user_id=%d from another user", request.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	s, err := lastPaid(request.UserID, time.Now())
+	if err != nil {
+		log.Printf("Error querying current membership of user_id %d: %v", request.UserID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if s == nil || s.MembershipLevel == "Basic" {
+		http.Error(w, "No active paid membership", http.StatusNotFound)
+		return
+	}
+	if request.AutoRenew && (s.PaymentMethod != "Card" || s.ProviderPaymentMethod == "") {
+		http.Error(w, "Only memberships paid by card can renew automatically", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE MembershipPayment SET auto_renew = ? WHERE membership_payment_id = ?", request.AutoRenew, s.PaymentID); err != nil {
+		log.Printf("Error updating auto-renewal of membership payment_id %d: %v", s.PaymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Auto-renewal of membership payment_id %d set to %t.", s.PaymentID, request.AutoRenew)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"membership_payment_id": s.PaymentID,
+		"auto_renew":            request.AutoRenew,
+		"paid_until":            s.EndDate.Format("2006-01-02"),
+	})
+}
+
+// Errors returned by QuoteChange for plan changes that cannot be quoted
+var (
+	ErrUnknownPlan = errors.New("unknown membership plan")
+	ErrFreePlan    = errors.New("the Basic plan applies once a paid membership ends; turn off automatic renewal to return to it")
+)
+
+// Plan represents a row of the MembershipPlans table
+type Plan struct {
+	MembershipLevel string   `json:"membership_level"`
+	Price           float64  `json:"price"`
+	DurationMonths  int      `json:"duration_months"`
+	Perks           []string `json:"perks"`
+}
+
+// GetPlan returns the catalogue entry of a membership level, or ErrUnknownPlan
+func GetPlan(membershipLevel string) (Plan, error) {
+	plan := Plan{MembershipLevel: membershipLevel}
+	var perks []byte
+	err := db.QueryRow("SELECT price, duration_months, perks FROM MembershipPlans WHERE membership_level = ?", membershipLevel).
+		Scan(&plan.Price, &plan.DurationMonths, &perks)
+	if err == sql.ErrNoRows {
+		return plan, ErrUnknownPlan
+	} else if err != nil {
+		return plan, err
+	}
+	return plan, json.Unmarshal(perks, &plan.Perks)
+}
+
+// ListPlans returns the membership plan catalogue, cheapest first
+func ListPlans(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT membership_level, price, duration_months, perks FROM MembershipPlans ORDER BY price")
+	if err != nil {
+		log.Printf("Error querying membership plans: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	for rows.Next() {
+		var plan Plan
+		var perks []byte
+		if err := rows.Scan(&plan.MembershipLevel, &plan.Price, &plan.DurationMonths, &perks); err != nil {
+			log.Printf("Error scanning membership plan row: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(perks, &plan.Perks); err != nil {
+			log.Printf("Error decoding perks of the %s plan: %v", plan.MembershipLevel, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		plans = append(plans, plan)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plans)
+}
+
+// Quote prices a change of membership plan. The unused days of the memberships it replaces are
+// credited against the new plan, and credit beyond its price is refunded.
+type Quote struct {
+	UserID          int        `json:"user_id"`
+	CurrentLevel    string     `json:"current_level"`
+	MembershipLevel string     `json:"membership_level"`
+	Price           float64    `json:"price"`
+	Credit          float64    `json:"credit"`
+	AmountDue       float64    `json:"amount_due"`
+	Refund          float64    `json:"refund"`
+	StartDate       string     `json:"start_date"`
+	EndDate         string     `json:"end_date"`
+	Replaced        []Replaced `json:"replaced"`
+}
+
+// Replaced describes a membership ended early by a plan change
+type Replaced struct {
+	PaymentID       int64   `json:"membership_payment_id"`
+	MembershipLevel string  `json:"membership_level"`
+	UnusedDays      int     `json:"unused_days"`
+	Credit          float64 `json:"credit"`
+	Refund          float64 `json:"refund"`
+}
+
+// QuoteChange quotes changing a user's membership to another paid plan starting on the given day.
+// Every paid membership that has not ended is replaced and credited for its unused days. Buying the
+// current plan again renews it early, from the end of the last period paid for.
+func QuoteChange(userID int, membershipLevel string, day time.Time) (Quote, error) {
+	today := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	quote := Quote{UserID: userID, CurrentLevel: "Basic", MembershipLevel: membershipLevel, Replaced: []Replaced{}}
+
+	plan, err := GetPlan(membershipLevel)
+	if err != nil {
+		return quote, err
+	}
+	if plan.Price == 0 {
+		return quote, ErrFreePlan
+	}
+
+	current, err := active(userID, today)
+	if err != nil {
+		return quote, err
+	}
+	if current != nil {
+		quote.CurrentLevel = current.MembershipLevel
+	}
+	if quote.CurrentLevel == membershipLevel {
+		last, err := lastPaid(userID, today)
+		if err != nil {
+			return quote, err
+		}
+		quote.Price, quote.AmountDue = plan.Price, plan.Price
+		quote.StartDate = last.EndDate.Format("2006-01-02")
+		quote.EndDate = last.EndDate.AddDate(0, plan.DurationMonths, 0).Format("2006-01-02")
+		return quote, nil
+	}
+
+	unended, err := query(`
+		SELECT `+columns+` FROM MembershipPayment
+		WHERE user_id = ? AND payment_status = 'Completed' AND superseded_by IS NULL AND membership_level <> 'Basic' AND end_date > ?
+		ORDER BY end_date DESC, membership_payment_id DESC`, userID, today.Format("2006-01-02"))
+	if err != nil {
+		return quote, err
+	}
+
+	return prorate(quote, plan, unended, today), nil
+}
+
+// prorate completes a quote for replacing the unended paid memberships with plan from today
+func prorate(quote Quote, plan Plan, unended []Subscription, today time.Time) Quote {
+	// Credit the plan price of each unused day, from today or the start of memberships paid in advance.
+	// The plan price includes any credit a membership was itself paid with, which carries over.
+	refundable := make([]float64, 0, len(unended))
+	for _, s := range unended {
+		from := s.StartDate
+		if from.Before(today) {
+			from = today
+		}
+		unusedDays := int(s.EndDate.Sub(from).Hours() / 24)
+		totalDays := int(s.EndDate.Sub(s.StartDate).Hours() / 24)
+		if unusedDays <= 0 || totalDays <= 0 {
+			continue
+		}
+		credit := roundCents(math.Max(s.PlanPrice-s.RefundAmount-s.RefundDue, 0) * float64(unusedDays) / float64(totalDays))
+		quote.Credit += credit
+		// Only what was charged to the provider's payment, and not already refunded, can be refunded
+		cash := 0.0
+		if s.ProviderPaymentID != "" {
+			cash = math.Max(s.Amount-s.RefundAmount-s.RefundDue, 0)
+		}
+		refundable = append(refundable, math.Min(credit, cash))
+		quote.Replaced = append(quote.Replaced, Replaced{
+			PaymentID:       s.PaymentID,
+			MembershipLevel: s.MembershipLevel,
+			UnusedDays:      unusedDays,
+			Credit:          credit,
+		})
+	}
+
+	quote.Price = plan.Price
+	quote.Credit = roundCents(quote.Credit)
+	quote.AmountDue = roundCents(math.Max(plan.Price-quote.Credit, 0))
+	quote.StartDate = today.Format("2006-01-02")
+	quote.EndDate = today.AddDate(0, plan.DurationMonths, 0).Format("2006-01-02")
+
+	// Refund the excess credit from the payments of the memberships it came from, most recent first.
+	// Credit beyond what those payments can refund, which came from older plan changes, is forfeited.
+	remaining := roundCents(math.Max(quote.Credit-plan.Price, 0))
+	for i := range quote.Replaced {
+		quote.Replaced[i].Refund = roundCents(math.Min(remaining, refundable[i]))
+		remaining = roundCents(remaining - quote.Replaced[i].Refund)
+		quote.Refund = roundCents(quote.Refund + quote.Replaced[i].Refund)
+	}
+	return quote
+}
+
+// Replace ends the memberships replaced by a quote on the day the membership paid for by paymentID
+// starts, refunding their share of the quote's refund with refund. A refund that fails is recorded as
+// due and retried by the scheduler.
+func Replace(quote Quote, paymentID int64, refund func(s Subscription, amount float64) error) error {
+	for _, replaced := range quote.Replaced {
+		subscriptions, err := query(`
+			SELECT `+columns+` FROM MembershipPayment
+			WHERE membership_payment_id = ? AND superseded_by IS NULL`, replaced.PaymentID)
+		if err != nil {
+			return err
+		} else if len(subscriptions) == 0 {
+			continue
+		}
+
+		refunded, due := 0.0, 0.0
+		if replaced.Refund > 0 {
+			s := subscriptions[0]
+			s.SupersededBy = paymentID
+			if err := refund(s, replaced.Refund); err != nil {
+				log.Printf("Error refunding $%.2f of membership payment_id %d, left for retry: %v", replaced.Refund, replaced.PaymentID, err)
+				due = replaced.Refund
+			} else {
+				refunded = replaced.Refund
+			}
+		}
+
+		// Memberships paid in advance end as soon as they start
+		_, err = db.Exec(`
+			UPDATE MembershipPayment
+			SET end_date = GREATEST(start_date, ?), superseded_by = ?, refund_amount = refund_amount + ?, refund_due = refund_due + ?
+			WHERE membership_payment_id = ?`, quote.StartDate, paymentID, refunded, due, replaced.PaymentID)
+		if err != nil {
+			return err
+		}
+		log.Printf("Membership payment_id %d replaced by payment_id %d with $%.2f credit, $%.2f refunded and $%.2f due.", replaced.PaymentID, paymentID, replaced.Credit, refunded, due)
+	}
+	return nil
+}
+
+// GetQuote quotes changing the authenticated user's membership to the plan in the membership_level
+// query parameter
+func GetQuote(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !middleware.AuthorizeUser(r, userID) {
+		log.Printf("Rejected membership quote for user_id=%d from another user", userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	quote, err := QuoteChange(userID, r.URL.Query().Get("membership_level"), time.Now())
+	if err == ErrUnknownPlan || err == ErrFreePlan {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error quoting membership change of user_id %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,128 @@
+package subscription
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuoteChange(t *testing.T) {
+	today := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	premium := Plan{MembershipLevel: "Premium", Price: 30, DurationMonths: 1}
+	vip := Plan{MembershipLevel: "VIP", Price: 300, DurationMonths: 12}
+
+	tests := []struct {
+		name      string
+		plan      Plan
+		unended   []Subscription
+		credit    float64
+		amountDue float64
+		refund    float64
+		refunds   []float64
+		endDate   string
+	}{
+		{
+			name:      "no membership to replace",
+			plan:      vip,
+			amountDue: 300,
+			refunds:   []float64{},
+			endDate:   "2027-04-01",
+		},
+		{
+			name: "upgrade credits the unused days",
+			plan: vip,
+			unended: []Subscription{
+				{PaymentID: 1, MembershipLevel: "Premium", Amount: 30, PlanPrice: 30, ProviderPaymentID: "pi_mock", StartDate: day(2026, 3, 17), EndDate: day(2026, 4, 16)},
+			},
+			credit:    15,
+			amountDue: 285,
+			refunds:   []float64{0},
+			endDate:   "2027-04-01",
+		},
+		{
+			name: "downgrade refunds credit beyond the new price",
+			plan: premium,
+			unended: []Subscription{
+				{PaymentID: 2, MembershipLevel: "VIP", Amount: 365, PlanPrice: 365, ProviderPaymentID: "pi_mock", StartDate: day(2026, 1, 1), EndDate: day(2027, 1, 1)},
+			},
+			credit:  275,
+			refund:  245,
+			refunds: []float64{245},
+			endDate: "2026-05-01",
+		},
+		{
+			name: "membership paid in advance is credited in full, less refunds",
+			plan: vip,
+			unended: []Subscription{
+				{PaymentID: 3, MembershipLevel: "Premium", Amount: 30, PlanPrice: 30, ProviderPaymentID: "pi_mock", RefundAmount: 10, StartDate: day(2026, 5, 1), EndDate: day(2026, 5, 31)},
+			},
+			credit:    20,
+			amountDue: 280,
+			refunds:   []float64{0},
+			endDate:   "2027-04-01",
+		},
+		{
+			name: "membership paid with credit is credited at its plan price, refunding at most what was charged",
+			plan: premium,
+			unended: []Subscription{
+				{PaymentID: 6, MembershipLevel: "VIP", Amount: 65, PlanPrice: 365, ProviderPaymentID: "pi_mock", StartDate: day(2026, 1, 1), EndDate: day(2027, 1, 1)},
+			},
+			credit:  275,
+			refund:  65,
+			refunds: []float64{65},
+			endDate: "2026-05-01",
+		},
+		{
+			name: "membership paid entirely with credit is not refunded",
+			plan: premium,
+			unended: []Subscription{
+				{PaymentID: 7, MembershipLevel: "VIP", Amount: 0, PlanPrice: 365, StartDate: day(2026, 1, 1), EndDate: day(2027, 1, 1)},
+			},
+			credit:  275,
+			refunds: []float64{0},
+			endDate: "2026-05-01",
+		},
+		{
+			name: "refund taken from the most recent membership first",
+			plan: premium,
+			unended: []Subscription{
+				{PaymentID: 5, MembershipLevel: "VIP", Amount: 20, PlanPrice: 20, ProviderPaymentID: "pi_mock", StartDate: day(2026, 4, 1), EndDate: day(2026, 4, 21)},
+				{PaymentID: 4, MembershipLevel: "VIP", Amount: 80, PlanPrice: 80, ProviderPaymentID: "pi_mock", StartDate: day(2026, 3, 2), EndDate: day(2026, 5, 1)},
+			},
+			credit:  60,
+			refund:  30,
+			refunds: []float64{20, 10},
+			endDate: "2026-05-01",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			quote := prorate(Quote{Replaced: []Replaced{}}, test.plan, test.unended, today)
+			if quote.Price != test.plan.Price || quote.Credit != test.credit || quote.AmountDue != test.amountDue || quote.Refund != test.refund {
+				t.Errorf("prorate() = %+v, want credit %v, amount due %v and refund %v", quote, test.credit, test.amountDue, test.refund)
+			}
+			if quote.StartDate != "2026-04-01" || quote.EndDate != test.endDate {
+				t.Errorf("prorate() runs %s to %s, want 2026-04-01 to %s", quote.StartDate, quote.EndDate, test.endDate)
+			}
+			if len(quote.Replaced) != len(test.refunds) {
+				t.Fatalf("prorate() replaced %d memberships, want %d", len(quote.Replaced), len(test.refunds))
+			}
+			for i, replaced := range quote.Replaced {
+				if replaced.Refund != test.refunds[i] {
+					t.Errorf("prorate() refunds $%.2f of payment_id %d, want $%.2f", replaced.Refund, replaced.PaymentID, test.refunds[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInitialStatus(t *testing.T) {
+	for paymentMethod, want := range map[string]string{"Card": "Processing", "PayNow": "Pending"} {
+		if got := InitialStatus(paymentMethod); got != want {
+			t.Errorf("InitialStatus(%q) = %q, want %q", paymentMethod, got, want)
+		}
+	}
+}
@@ -2,11 +2,19 @@ module userMicroservice
 
 go 1.23.2
 
+require (
+	common v0.0.0
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/gorilla/handlers v1.5.2
+	github.com/gorilla/mux v1.8.1
+	github.com/joho/godotenv v1.5.1
+)
+
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
-	github.com/go-sql-driver/mysql v1.8.1 // indirect
-	github.com/gorilla/handlers v1.5.2 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/joho/godotenv v1.5.1
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
 )
+
+// Packages shared by the microservices
+replace common => ../common
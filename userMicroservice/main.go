@@ -1,6 +1,7 @@
 package main
 
 import (
+	"common/middleware"
 	"log"
 	"net/http"
 	"userMicroservice/membership"
@@ -11,24 +12,35 @@ import (
 )
 
 func main() {
+	// Load the JWT secret and internal API key used to authenticate requests
+	if err := middleware.Init(); err != nil {
+		log.Fatalf("Error initialising middleware: %v", err)
+	}
+
+	// Connect to the user database
+	profile.Init()
+	membership.Init()
+
 	// Initialize the router
 	router := mux.NewRouter()
 
 	// Membership endpoints
-	router.HandleFunc("/api/v1/user/membership/status", membership.GetMembershipStatus).Methods("GET")
-	router.HandleFunc("/api/v1/user/membership/update", membership.UpdateMembershipTier).Methods("PUT")
+	router.HandleFunc("/api/v1/user/membership/status", middleware.RequireAuth(membership.GetMembershipStatus)).Methods("GET")
+	router.HandleFunc("/api/v1/user/membership/level", middleware.RequireInternal(membership.GetMembershipLevel)).Methods("GET")
+	router.HandleFunc("/api/v1/user/membership/update", middleware.RequireInternalOrRole(membership.UpdateMembershipTier, middleware.RoleAdmin)).Methods("PUT")
 
 	// Profile management endpoints
-	router.HandleFunc("/api/v1/user/create", profile.CreateUser).Methods("POST")
-	router.HandleFunc("/api/v1/user/profile", profile.GetUserProfile).Methods("GET")
-	router.HandleFunc("/api/v1/user/profile/update", profile.UpdateUserProfile).Methods("PUT")
-	router.HandleFunc("/api/v1/user/rental-history", profile.GetRentalHistory).Methods("GET")
+	router.HandleFunc("/api/v1/user/create", middleware.RequireInternal(profile.CreateUser)).Methods("POST")
+	router.HandleFunc("/api/v1/user/password", middleware.RequireInternal(profile.UpdatePassword)).Methods("PUT")
+	router.HandleFunc("/api/v1/user/profile", middleware.RequireAuth(profile.GetUserProfile)).Methods("GET")
+	router.HandleFunc("/api/v1/user/profile/update", middleware.RequireAuth(profile.UpdateUserProfile)).Methods("PUT")
+	router.HandleFunc("/api/v1/user/rental-history", middleware.RequireAuth(profile.GetRentalHistory)).Methods("GET")
 
 	// Add CORS support
 	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://127.0.0.1:5100"}), // Update for allowed origins
+		handlers.AllowedOrigins([]string{"http://127.0.0.1:5100"}),         // Update for allowed origins
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "OPTIONS"}), // Update for allowed HTTP methods
-		handlers.AllowedHeaders([]string{"Content-Type"}), // Update for allowed headers
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}), // Update for allowed headers
 	)(router)
 
 	// Start the server
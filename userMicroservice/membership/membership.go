@@ -1,11 +1,15 @@
 package membership
 
 import (
+	"common/middleware"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
@@ -13,40 +17,50 @@ import (
 
 var db *sql.DB
 
-func init() {
-    // Load environment variables
-    err := godotenv.Load(".env")
-    if err != nil {
-        log.Fatalf("Error loading .env file: %v", err)
-    }
-
-    // Fetch DB connection string from environment variables
-    dbConnection := os.Getenv("DB_CONNECTION")
-    if dbConnection == "" {
-        log.Fatalf("DB_CONNECTION environment variable is not set")
-    }
-    log.Printf("DB_CONNECTION (membership package): %s", dbConnection) // Debugging
-
-    // Initialize the database connection
-    db, err = sql.Open("mysql", dbConnection)
-    if err != nil {
-        log.Fatalf("Error connecting to database: %v", err)
-    }
-
-    // Test the database connection
-    err = db.Ping()
-    if err != nil {
-        log.Fatalf("Database connection test failed: %v", err)
-    }
-    log.Println("Database connection (membership package) successful.")
+// membershipLevels lists the values accepted by the membership_level column of the User table
+var membershipLevels = []string{"Basic", "Premium", "VIP"}
+
+// Init connects to the user database configured in .env. The user service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Fetch DB connection string from environment variables
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+	log.Printf("DB_CONNECTION (membership package): %s", dbConnection) // Debugging
+
+	// Initialize the database connection
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (membership package) successful.")
 }
 
-// GetMembershipStatus retrieves the user's membership status
+// GetMembershipStatus retrieves the authenticated user's membership status and, for paid
+// memberships, the active subscription period recorded by the payment service
 func GetMembershipStatus(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	if userID := r.URL.Query().Get("user_id"); userID != "" && userID != strconv.Itoa(identity.UserID) {
+		log.Printf("User %d attempted to read the membership status of user %s", identity.UserID, userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	var membershipTier string
-	err := db.QueryRow("SELECT membership_level FROM User WHERE user_id = ?", userID).Scan(&membershipTier)
+	err := db.QueryRow("SELECT membership_level FROM User WHERE user_id = ?", identity.UserID).Scan(&membershipTier)
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -55,18 +69,83 @@ func GetMembershipStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The membership level is still returned if the subscription cannot be loaded
+	subscription, err := fetchSubscription(identity.UserID)
+	if err != nil {
+		log.Printf("Error fetching subscription of user %d: %v", identity.UserID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"membership_level": membershipTier})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"membership_level": membershipTier,
+		"subscription":     subscription,
+	})
 }
 
-// UpdateMembershipTier updates the membership level of a user
-func UpdateMembershipTier(w http.ResponseWriter, r *http.Request) {
-	dbConnection := os.Getenv("DB_CONNECTION")
-if dbConnection == "" {
-    log.Fatalf("DB_CONNECTION environment variable is not set")
+// GetMembershipLevel returns the membership level of the user_id in the query. It serves other
+// services pricing a booking for its user rather than for the caller.
+func GetMembershipLevel(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var membershipTier string
+	err = db.QueryRow("SELECT membership_level FROM User WHERE user_id = ?", userID).Scan(&membershipTier)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving membership level of user %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":          userID,
+		"membership_level": membershipTier,
+	})
 }
-log.Printf("DB_CONNECTION: %s", dbConnection) // Debug line
 
+// fetchSubscription returns the active subscription of a user from the payment service, or nil if
+// the user has no active paid membership
+func fetchSubscription(userID int) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://payment:5200/api/v1/membership/subscription?user_id=%d", userID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("payment service returned status %d", resp.StatusCode)
+	}
+
+	var subscription map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// UpdateMembershipTier updates the membership level of a user. Only admins and the payment
+// service, after a paid upgrade, may call it.
+func UpdateMembershipTier(w http.ResponseWriter, r *http.Request) {
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+	log.Printf("DB_CONNECTION: %s", dbConnection) // Debug line
 
 	log.Println("Received request to update membership tier")
 
@@ -84,6 +163,12 @@ log.Printf("DB_CONNECTION: %s", dbConnection) // Debug line
 
 	log.Printf("Decoded payload: user_id=%d, membership_tier=%s", payload.UserID, payload.MembershipTier)
 
+	if !isValidMembershipLevel(payload.MembershipTier) {
+		log.Printf("Rejected unknown membership tier %q", payload.MembershipTier)
+		http.Error(w, "Invalid membership tier", http.StatusBadRequest)
+		return
+	}
+
 	// Execute the SQL update
 	query := "UPDATE User SET membership_level = ? WHERE user_id = ?"
 	log.Printf("Executing query: %s with values (%s, %d)", query, payload.MembershipTier, payload.UserID)
@@ -115,4 +200,14 @@ log.Printf("DB_CONNECTION: %s", dbConnection) // Debug line
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message":"Membership level updated successfully"}`))
-}
\ No newline at end of file
+}
+
+// isValidMembershipLevel reports whether level is one of the membership levels
+func isValidMembershipLevel(level string) bool {
+	for _, valid := range membershipLevels {
+		if level == valid {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,13 @@
 package profile
 
 import (
+	"common/middleware"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
@@ -13,7 +15,8 @@ import (
 
 var db *sql.DB
 
-func init() {
+// Init connects to the user database configured in .env. The user service calls it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -76,9 +79,56 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("User created successfully"))
 }
 
-// GetUserProfile retrieves a user's profile information
+// UpdatePassword stores a new password hash sent by the authentication service after a password reset
+func UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"` // Already hashed by the authentication service
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.Password == "" {
+		log.Printf("Error decoding request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE User SET password = ? WHERE email = ?", req.Password, req.Email)
+	if err != nil {
+		log.Printf("Error updating password: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("Error fetching rows affected: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		// MySQL reports zero affected rows when the hash is unchanged, so confirm the user exists
+		var userID int
+		err = db.QueryRow("SELECT user_id FROM User WHERE email = ?", req.Email).Scan(&userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password updated successfully"))
+}
+
+// GetUserProfile retrieves the authenticated user's profile information
 func GetUserProfile(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	if userID := r.URL.Query().Get("user_id"); userID != "" && userID != strconv.Itoa(identity.UserID) {
+		log.Printf("User %d attempted to read the profile of user %s", identity.UserID, userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	var profile struct {
 		Name       string `json:"name"`
@@ -88,7 +138,7 @@ func GetUserProfile(w http.ResponseWriter, r *http.Request) {
 		Membership string `json:"membership_level"`
 	}
 
-	err := db.QueryRow("SELECT name, email, contact_number, address, membership_level FROM User WHERE user_id = ?", userID).Scan(&profile.Name, &profile.Email, &profile.Contact, &profile.Address, &profile.Membership)
+	err := db.QueryRow("SELECT name, email, contact_number, address, membership_level FROM User WHERE user_id = ?", identity.UserID).Scan(&profile.Name, &profile.Email, &profile.Contact, &profile.Address, &profile.Membership)
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -101,7 +151,7 @@ func GetUserProfile(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(profile)
 }
 
-// UpdateUserProfile updates a user's personal details
+// UpdateUserProfile updates the authenticated user's personal details
 func UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
 	var profile struct {
 		UserID  int    `json:"user_id"`
@@ -114,6 +164,12 @@ func UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !middleware.AuthorizeUser(r, profile.UserID) {
+		log.Printf("Rejected profile update for user_id=%d from another user", profile.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	_, err := db.Exec("UPDATE User SET name = ?, contact_number = ?, address = ? WHERE user_id = ?", profile.Name, profile.Contact, profile.Address, profile.UserID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -124,11 +180,16 @@ func UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Profile updated successfully"))
 }
 
-// GetRentalHistory retrieves a user's rental history
+// GetRentalHistory retrieves the authenticated user's rental history
 func GetRentalHistory(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	if userID := r.URL.Query().Get("user_id"); userID != "" && userID != strconv.Itoa(identity.UserID) {
+		log.Printf("User %d attempted to read the rental history of user %s", identity.UserID, userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
-	rows, err := db.Query("SELECT vehicle_id, rental_price_per_hour, created_at FROM Rentals WHERE user_id = ?", userID)
+	rows, err := db.Query("SELECT vehicle_id, rental_price_per_hour, created_at FROM Rentals WHERE user_id = ?", identity.UserID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -136,9 +197,9 @@ func GetRentalHistory(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	var history []struct {
-		VehicleID        int     `json:"vehicle_id"`
-		RentalPrice      float64 `json:"rental_price_per_hour"`
-		RentalDate       string  `json:"rental_date"`
+		VehicleID   int     `json:"vehicle_id"`
+		RentalPrice float64 `json:"rental_price_per_hour"`
+		RentalDate  string  `json:"rental_date"`
 	}
 	for rows.Next() {
 		var record struct {
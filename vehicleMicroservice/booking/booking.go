@@ -1,6 +1,7 @@
 package booking
 
 import (
+	"common/middleware"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -8,6 +9,10 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
+	"vehicleMicroservice/outbox"
+	"vehicleMicroservice/pricing"
+	"vehicleMicroservice/rates"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -16,7 +21,9 @@ import (
 
 var db *sql.DB
 
-func init() {
+// Init connects to the vehicle database and loads the return inspection window from .env. The vehicle
+// service calls it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -41,6 +48,15 @@ func init() {
 		log.Fatalf("Database connection test failed: %v", err)
 	}
 	log.Println("Database connection successful.")
+
+	if hours := os.Getenv("RETURN_INSPECTION_HOURS"); hours != "" {
+		value, err := strconv.ParseFloat(hours, 64)
+		if err != nil || value < 0 {
+			log.Fatalf("Invalid RETURN_INSPECTION_HOURS: %q", hours)
+		}
+		inspectionWindow = time.Duration(value * float64(time.Hour))
+	}
+	log.Printf("Returned vehicles not inspected within %v are billed from their last known state.", inspectionWindow)
 }
 
 // Booking represents the structure of a booking record
@@ -51,15 +67,57 @@ type Booking struct {
 	BookingDate string  `json:"booking_date"`
 	ReturnDate  string  `json:"return_date"`
 	TotalPrice  float64 `json:"total_price"`
+	Status      string  `json:"status"`
+}
+
+// Booking lifecycle states
+const (
+	StatusPendingPayment = "pending_payment"
+	StatusConfirmed      = "confirmed"
+	StatusActive         = "active"
+	StatusCompleted      = "completed"
+	StatusCancelled      = "cancelled"
+	StatusNoShow         = "no_show"
+)
+
+// transitions lists the states each booking state may move to; completed, cancelled and no_show are final
+var transitions = map[string][]string{
+	StatusPendingPayment: {StatusConfirmed, StatusCancelled},
+	StatusConfirmed:      {StatusActive, StatusCancelled, StatusNoShow},
+	StatusActive:         {StatusCompleted},
 }
 
+// transitionColumns maps each state to the column recording when a booking entered it
+var transitionColumns = map[string]string{
+	StatusConfirmed: "confirmed_at",
+	StatusActive:    "started_at",
+	StatusCompleted: "completed_at",
+	StatusCancelled: "cancelled_at",
+	StatusNoShow:    "no_show_at",
+}
+
+const (
+	tripStartGracePeriod = 15 * time.Minute    // How early before the booked start a trip may be started
+	noShowGracePeriod    = 30 * time.Minute    // How long after the booked start a confirmed booking becomes a no-show
+	maxBookingLength     = 30 * 24 * time.Hour // Longest booking accepted, which bounds the hours priced per quote
+	pendingPaymentTTL    = 30 * time.Minute    // How long a booking no payment saga owns may wait for payment
+	sweepInterval        = 5 * time.Minute     // How often the sweeper looks for bookings to act on
+	sweepBatchSize       = 50                  // Bookings handled per sweep
+)
+
+// inspectionWindow is how long fleet operators have to inspect a returned vehicle before the trip is
+// billed from the vehicle's last known state, configurable with RETURN_INSPECTION_HOURS
+var inspectionWindow = 24 * time.Hour
+
 func CreateBooking(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		VehicleID   int     `json:"vehicle_id"`
-		UserID      int     `json:"user_id"`
-		BookingDate string  `json:"booking_date"`
-		ReturnDate  string  `json:"return_date"`
-		TotalPrice  float64 `json:"total_price"`
+		VehicleID        int      `json:"vehicle_id"`
+		UserID           int      `json:"user_id"`
+		BookingDate      string   `json:"booking_date"`
+		ReturnDate       string   `json:"return_date"`
+		TotalPrice       *float64 `json:"total_price"`       // Total the client was quoted, checked against the server-side price
+		PromoCode        string   `json:"promo_code"`        // Promo code entered at checkout, empty for none
+		PaymentReference string   `json:"payment_reference"` // Payment saga reference, used to release the booking if payment fails; internal callers only
 	}
 
 	// Decode the JSON request
@@ -68,11 +126,61 @@ func CreateBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Bookings may only be created for the authenticated user
+	if !middleware.AuthorizeUser(r, payload.UserID) {
+		log.Printf("Rejected booking for user_id=%d from another user", payload.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Only the payment saga may tie a booking to a saga, which exempts it from the abandoned booking sweep
+	if payload.PaymentReference != "" && !middleware.IsInternal(r) {
+		log.Printf("Rejected payment reference on a booking for user_id=%d from outside the payment service", payload.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	startTime, endTime, ok := parseBookingInterval(w, payload.BookingDate, payload.ReturnDate)
+	if !ok {
+		return
+	}
+
+	// Price the booking server-side; the client's total is only used to detect a stale quote
+	promo := pricing.Promotion{Code: payload.PromoCode, UserID: payload.UserID}
+	quote, ok := quoteBooking(w, payload.VehicleID, startTime, endTime, promo, payload.TotalPrice)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the vehicle and make sure the slot is still free before inserting
+	conflict, err := findConflictingBooking(tx, payload.VehicleID, 0, startTime, endTime)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error checking for overlapping bookings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if conflict != nil {
+		log.Printf("Rejected booking of vehicle %d, slot overlaps %s to %s", payload.VehicleID, conflict.BookingDate, conflict.ReturnDate)
+		respondBookingConflict(w, conflict)
+		return
+	}
+
 	// Insert the booking into the database
-	result, err := db.Exec(`
-		INSERT INTO Bookings (vehicle_id, user_id, booking_date, return_date, total_price)
-		VALUES (?, ?, ?, ?, ?)`,
-		payload.VehicleID, payload.UserID, payload.BookingDate, payload.ReturnDate, payload.TotalPrice)
+	result, err := tx.Exec(`
+		INSERT INTO Bookings (vehicle_id, user_id, booking_date, return_date, total_price, promo_code, payment_reference)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))`,
+		payload.VehicleID, payload.UserID, startTime, endTime, quote.TotalPrice, quote.PromoCode, payload.PaymentReference)
 	if err != nil {
 		log.Printf("Error creating booking: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -87,13 +195,26 @@ func CreateBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Respond with the booking ID
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing booking: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with the booking ID and the price it was booked at
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf(`{"booking_id": %d}`, bookingID)))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"booking_id":  bookingID,
+		"total_price": quote.TotalPrice,
+		"quote":       quote,
+	})
 }
 
-
-// ModifyBooking allows users to modify an existing booking
+// ModifyBooking allows users to modify an existing booking. The new interval is priced server-side and
+// recorded as a pending modification, which holds the new slot while the payment service charges or
+// refunds the difference from what was paid. The booking takes the new interval once the settlement is
+// confirmed; a declined charge rejects the modification and leaves the booking unchanged.
 func ModifyBooking(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	bookingID, err := strconv.Atoi(params["id"])
@@ -103,9 +224,9 @@ func ModifyBooking(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var payload struct {
-		StartDateTime string  `json:"start_date_time"`
-		EndDateTime   string  `json:"end_date_time"`
-		TotalPrice    float64 `json:"total_price"`
+		StartDateTime string   `json:"start_date_time"`
+		EndDateTime   string   `json:"end_date_time"`
+		TotalPrice    *float64 `json:"total_price"` // New total the client was quoted, checked against the server-side price
 	}
 
 	// Decode and validate payload
@@ -114,48 +235,973 @@ func ModifyBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if payload.StartDateTime == "" || payload.EndDateTime == "" || payload.TotalPrice <= 0 {
+	if payload.StartDateTime == "" || payload.EndDateTime == "" {
 		http.Error(w, "Missing or invalid fields in the input", http.StatusBadRequest)
 		return
 	}
 
-	// Update the booking in the database
-	_, err = db.Exec(`
-		UPDATE Bookings 
-		SET booking_date = ?, return_date = ?, total_price = ?
-		WHERE booking_id = ?`,
-		payload.StartDateTime, payload.EndDateTime, payload.TotalPrice, bookingID)
+	startTime, endTime, ok := parseBookingInterval(w, payload.StartDateTime, payload.EndDateTime)
+	if !ok {
+		return
+	}
+
+	if !authorizeBookingOwner(w, r, bookingID) {
+		return
+	}
+
+	var vehicleID, userID int
+	var promoCode string
+	err = db.QueryRow("SELECT vehicle_id, user_id, COALESCE(promo_code, '') FROM Bookings WHERE booking_id = ?", bookingID).
+		Scan(&vehicleID, &userID, &promoCode)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving booking: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Price the new interval server-side before taking any locks, keeping the booking's promo code
+	promo := pricing.Promotion{Code: promoCode, UserID: userID, BookingID: bookingID}
+	quote, ok := quoteBooking(w, vehicleID, startTime, endTime, promo, payload.TotalPrice)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error updating booking: %v", err)
+		log.Printf("Error starting transaction: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	// Lock the vehicle and make sure the new slot does not clash with any other booking
+	conflict, err := findConflictingBooking(tx, vehicleID, bookingID, startTime, endTime)
+	if err != nil {
+		log.Printf("Error checking for overlapping bookings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if conflict != nil {
+		log.Printf("Rejected modification of booking %d, slot overlaps %s to %s", bookingID, conflict.BookingDate, conflict.ReturnDate)
+		respondBookingConflict(w, conflict)
+		return
+	}
+
+	// Only bookings whose trip has not started can be rescheduled, one modification at a time
+	var status string
+	err = tx.QueryRow("SELECT status FROM Bookings WHERE booking_id = ? FOR UPDATE", bookingID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving booking status: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status != StatusPendingPayment && status != StatusConfirmed {
+		http.Error(w, fmt.Sprintf("A %s booking cannot be modified", status), http.StatusConflict)
+		return
+	}
+	var modification, pending int
+	err = tx.QueryRow("SELECT COALESCE(MAX(modification), 0) + 1, COUNT(CASE WHEN status = 'Pending' THEN 1 END) FROM BookingModifications WHERE booking_id = ?", bookingID).
+		Scan(&modification, &pending)
+	if err != nil {
+		log.Printf("Error retrieving modifications of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if pending > 0 {
+		http.Error(w, "A previous modification of this booking is still being settled", http.StatusConflict)
+		return
+	}
+
+	// Record the modification with its settlement, so that the settlement is sent if and only if the
+	// modification is stored. A promo code that no longer applies is dropped, and the payment service
+	// releases its redemption with the settlement.
+	_, err = tx.Exec(`
+		INSERT INTO BookingModifications (booking_id, modification, vehicle_id, booking_date, return_date, total_price, promo_code)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		bookingID, modification, vehicleID, startTime, endTime, quote.TotalPrice, quote.PromoCode)
+	if err != nil {
+		log.Printf("Error storing modification of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	requestID, err := outbox.EnqueueSettlement(tx, bookingID, modification, map[string]interface{}{
+		"modification":   modification,
+		"total_price":    quote.TotalPrice,
+		"discount":       quote.Discount + quote.PromoDiscount,
+		"promo_code":     quote.PromoCode,
+		"promo_discount": quote.PromoDiscount,
+		"booking_date":   startTime.Format("2006-01-02 15:04:05"),
+		"return_date":    endTime.Format("2006-01-02 15:04:05"),
+	}, r.Header.Get("Accept-Language"))
+	if err != nil {
+		log.Printf("Error queueing settlement of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing modification of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The settlement stays queued in the outbox if it cannot be sent now, and the sweeper applies the
+	// modification once the worker has settled it
+	settlement, err := outbox.Deliver(requestID)
+	if declined, ok := err.(*outbox.DeclinedError); ok {
+		log.Printf("Supplementary charge for booking %d declined: %s", bookingID, declined.Message)
+		if err := resolveModification(bookingID, modification, false, declined.Message); err != nil {
+			log.Printf("Error rejecting modification %d of booking %d: %v", modification, bookingID, err)
+		}
+		http.Error(w, declined.Message, http.StatusPaymentRequired)
+		return
+	} else if err != nil {
+		log.Printf("Error settling modification %d of booking %d, left for retry: %v", modification, bookingID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "Booking modification is pending settlement",
+			"modification": modification,
+			"total_price":  quote.TotalPrice,
+			"quote":        quote,
+		})
+		return
+	}
 
+	if err := resolveModification(bookingID, modification, true, ""); err != nil {
+		log.Printf("Error applying modification %d of booking %d, left for the sweeper: %v", modification, bookingID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Booking updated successfully"))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Booking updated successfully",
+		"modification": modification,
+		"total_price":  quote.TotalPrice,
+		"quote":        quote,
+		"settlement":   settlement,
+	})
+}
+
+// resolveModification applies a pending booking modification once its settlement is confirmed, moving
+// the booking to its new interval and price, or rejects it when its charge was declined. A
+// modification that is no longer pending is left as it is.
+func resolveModification(bookingID, modification int, settled bool, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the booking first, in the same order as ModifyBooking
+	var status string
+	if err := tx.QueryRow("SELECT status FROM Bookings WHERE booking_id = ? FOR UPDATE", bookingID).Scan(&status); err != nil {
+		return err
+	}
+	var pending, startTime, endTime string
+	var totalPrice float64
+	var promoCode sql.NullString
+	err = tx.QueryRow(`
+		SELECT status, booking_date, return_date, total_price, promo_code
+		FROM BookingModifications WHERE booking_id = ? AND modification = ? FOR UPDATE`,
+		bookingID, modification).Scan(&pending, &startTime, &endTime, &totalPrice, &promoCode)
+	if err != nil {
+		return err
+	}
+	if pending != "Pending" {
+		return nil
+	}
+
+	if settled {
+		_, err = tx.Exec("UPDATE Bookings SET booking_date = ?, return_date = ?, total_price = ?, promo_code = ? WHERE booking_id = ?",
+			startTime, endTime, totalPrice, promoCode, bookingID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE BookingModifications SET status = 'Applied', resolved_at = ? WHERE booking_id = ? AND modification = ?",
+				time.Now(), bookingID, modification)
+		}
+	} else {
+		_, err = tx.Exec("UPDATE BookingModifications SET status = 'Rejected', rejection_reason = ?, resolved_at = ? WHERE booking_id = ? AND modification = ?",
+			reason, time.Now(), bookingID, modification)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if settled {
+		log.Printf("Modification %d of booking %d applied, now %s to %s for $%.2f", modification, bookingID, startTime, endTime, totalPrice)
+	} else {
+		log.Printf("Modification %d of booking %d rejected: %s", modification, bookingID, reason)
+	}
+	return nil
+}
+
+// GetQuote returns an itemised server-side price for renting a vehicle between start_date and end_date,
+// applying the optional promo_code
+func GetQuote(w http.ResponseWriter, r *http.Request) {
+	vehicleID, err := strconv.Atoi(r.URL.Query().Get("vehicle_id"))
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, ok := parseBookingInterval(w, r.URL.Query().Get("start_date"), r.URL.Query().Get("end_date"))
+	if !ok {
+		return
+	}
+
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	promo := pricing.Promotion{Code: r.URL.Query().Get("promo_code"), UserID: identity.UserID}
+	quote, ok := quoteBooking(w, vehicleID, startTime, endTime, promo, nil)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
 }
 
+// quoteBooking prices a booking and, when the client sent the total it was quoted, rejects the
+// request with 422 and a fresh quote if the totals differ. A promo code that cannot be applied is
+// also rejected with 422 and the reason. It writes the error response and returns false on failure.
+func quoteBooking(w http.ResponseWriter, vehicleID int, start, end time.Time, promo pricing.Promotion, clientTotal *float64) (pricing.Quote, bool) {
+	quote, err := pricing.Calculate(vehicleID, start, end, promo)
+	if err == pricing.ErrVehicleNotFound {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return pricing.Quote{}, false
+	} else if rejected, ok := err.(*pricing.PromoRejectedError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": rejected.Reason,
+		})
+		return pricing.Quote{}, false
+	} else if err != nil {
+		log.Printf("Error pricing booking: %v", err)
+		http.Error(w, "Failed to price booking", http.StatusBadGateway)
+		return pricing.Quote{}, false
+	}
 
-// CancelBooking allows users to cancel an existing booking
+	if clientTotal != nil && !quote.Matches(*clientTotal) {
+		log.Printf("Rejected client total %.2f for vehicle %d, server price is %.2f", *clientTotal, vehicleID, quote.TotalPrice)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "The quoted price does not match the current price",
+			"quote": quote,
+		})
+		return pricing.Quote{}, false
+	}
+	return quote, true
+}
+
+// bookingConflict describes the interval of an existing booking that clashes with a requested slot
+type bookingConflict struct {
+	BookingDate string `json:"booking_date"`
+	ReturnDate  string `json:"return_date"`
+}
+
+// parseBookingInterval parses the start and end of a booking, accepting both the datetime-local
+// format sent by the frontend and the MySQL format sent by the payment service. It writes a 400
+// response and returns false when either is invalid, the end is not after the start or the booking is
+// longer than maxBookingLength.
+func parseBookingInterval(w http.ResponseWriter, start, end string) (time.Time, time.Time, bool) {
+	startTime, err := parseBookingTime(start)
+	if err != nil {
+		http.Error(w, "Invalid booking start time", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	endTime, err := parseBookingTime(end)
+	if err != nil {
+		http.Error(w, "Invalid booking end time", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	if !endTime.After(startTime) {
+		http.Error(w, "Booking end time must be after the start time", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	if endTime.Sub(startTime) > maxBookingLength {
+		http.Error(w, fmt.Sprintf("Bookings cannot be longer than %.0f days", maxBookingLength.Hours()/24), http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return startTime, endTime, true
+}
+
+// parseBookingTime parses a booking timestamp in any of the formats used by the clients
+func parseBookingTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		var parsed time.Time
+		if parsed, err = time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// findConflictingBooking locks the vehicle row for the rest of the transaction, so that concurrent
+// bookings of the same vehicle are serialised, and returns the first booking other than
+// excludeBookingID that overlaps the interval. The new slot of a modification still being settled is
+// taken as well. It returns sql.ErrNoRows if the vehicle does not exist.
+func findConflictingBooking(tx *sql.Tx, vehicleID, excludeBookingID int, start, end time.Time) (*bookingConflict, error) {
+	var lockedID int
+	err := tx.QueryRow("SELECT vehicle_id FROM Vehicles WHERE vehicle_id = ? FOR UPDATE", vehicleID).Scan(&lockedID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only slots ending after the requested start can clash; slotConflicts decides which of them do
+	rows, err := tx.Query(`
+		SELECT booking_id, status, booking_date, return_date
+		FROM Bookings
+		WHERE vehicle_id = ? AND return_date > ?
+		UNION ALL
+		SELECT booking_id, ?, booking_date, return_date
+		FROM BookingModifications
+		WHERE vehicle_id = ? AND status = 'Pending' AND return_date > ?
+		ORDER BY booking_date`,
+		vehicleID, start, slotPendingModification, vehicleID, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slot bookingSlot
+		var bookingDate, returnDate string
+		if err := rows.Scan(&slot.BookingID, &slot.Status, &bookingDate, &returnDate); err != nil {
+			return nil, err
+		}
+		if slot.Start, err = time.Parse("2006-01-02 15:04:05", bookingDate); err == nil {
+			slot.End, err = time.Parse("2006-01-02 15:04:05", returnDate)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if slotConflicts(slot, excludeBookingID, start, end) {
+			return &bookingConflict{BookingDate: bookingDate, ReturnDate: returnDate}, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// slotPendingModification is the status of the new slot of a modification that is still being settled
+const slotPendingModification = "pending_modification"
+
+// bookingSlot is the interval a booking, or a pending modification of one, holds a vehicle for
+type bookingSlot struct {
+	BookingID int
+	Status    string // Status of the booking, or slotPendingModification
+	Start     time.Time
+	End       time.Time
+}
+
+// slotConflicts reports whether a slot keeps the vehicle from being booked between start and end.
+// Cancelled bookings and no-shows release their slot, the booking being modified does not clash with
+// itself, and intervals that only touch do not overlap.
+func slotConflicts(slot bookingSlot, excludeBookingID int, start, end time.Time) bool {
+	if slot.BookingID == excludeBookingID || slot.Status == StatusCancelled || slot.Status == StatusNoShow {
+		return false
+	}
+	return slot.Start.Before(end) && slot.End.After(start)
+}
+
+// respondBookingConflict responds with 409 Conflict and the interval that is already taken
+func respondBookingConflict(w http.ResponseWriter, conflict *bookingConflict) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    "The vehicle is already booked during the requested time",
+		"conflict": conflict,
+	})
+}
+
+// CancelBooking allows users to cancel a booking whose trip has not started. The booking is kept
+// with the cancelled status so that it remains part of the user's history.
 func CancelBooking(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	bookingID, err := strconv.Atoi(params["id"])
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if !authorizeBookingOwner(w, r, bookingID) {
+		return
+	}
+
+	// The refund is queued with the cancellation, so that it is retried until the payment service takes it
+	var requestID int64
+	_, cancelledAt, ok := transitionBooking(w, bookingID, StatusCancelled, nil, func(tx *sql.Tx, booking lockedBooking, now time.Time) error {
+		var err error
+		requestID, err = outbox.Enqueue(tx, bookingID, outbox.KindRefund, map[string]interface{}{
+			"booking_date": booking.BookingDate.Format("2006-01-02 15:04:05"),
+			"cancelled_at": now.Format("2006-01-02 15:04:05"),
+		}, r.Header.Get("Accept-Language"))
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	// The refund stays queued in the outbox if it cannot be sent now
+	refund, err := outbox.Deliver(requestID)
 	if err != nil {
-		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		log.Printf("Error refunding cancelled booking %d, left for retry: %v", bookingID, err)
+	}
+
+	respondBookingStatus(w, bookingID, StatusCancelled, cancelledAt, map[string]interface{}{"refund": refund})
+}
+
+// ConfirmBooking confirms a booking once it has been paid for. Only the payment service calls it, and
+// it may retry, so confirming a confirmed booking succeeds without changing it.
+func ConfirmBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var status string
+	var confirmedAt sql.NullString
+	err := db.QueryRow("SELECT status, confirmed_at FROM Bookings WHERE booking_id = ?", bookingID).Scan(&status, &confirmedAt)
+	if err == nil && status == StatusConfirmed {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"booking_id":   bookingID,
+			"status":       status,
+			"confirmed_at": confirmedAt.String,
+		})
+		return
+	}
+
+	updateBookingStatus(w, bookingID, StatusConfirmed, nil)
+}
+
+// ReleaseBooking cancels the booking created by a payment saga that is being rolled back. Only the
+// payment service calls it. Releasing a cancelled booking succeeds, and 404 means the saga never
+// created a booking.
+func ReleaseBooking(w http.ResponseWriter, r *http.Request) {
+	reference := mux.Vars(r)["reference"]
+
+	var bookingID int
+	var status string
+	err := db.QueryRow("SELECT booking_id, status FROM Bookings WHERE payment_reference = ?", reference).Scan(&bookingID, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving booking with payment reference %s: %v", reference, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if status == StatusCancelled {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"booking_id": bookingID,
+			"status":     status,
+		})
+		return
+	}
+
+	log.Printf("Releasing booking %d of payment reference %s", bookingID, reference)
+	updateBookingStatus(w, bookingID, StatusCancelled, nil)
+}
+
+// StartTrip marks a confirmed booking as active when the user picks up the vehicle
+func StartTrip(w http.ResponseWriter, r *http.Request) {
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if !authorizeBookingOwner(w, r, bookingID) {
+		return
+	}
+
+	updateBookingStatus(w, bookingID, StatusActive, func(booking lockedBooking, now time.Time) string {
+		if now.Before(booking.BookingDate.Add(-tripStartGracePeriod)) {
+			return "The trip cannot be started more than 15 minutes before the booked start time"
+		}
+		if !now.Before(booking.ReturnDate) {
+			return "The booked period has already ended"
+		}
+		return ""
+	})
+}
+
+// EndTrip marks an active booking as completed when the user returns the vehicle. The trip is billed
+// once a fleet operator has inspected the vehicle, or from its last known state if nobody has within
+// the inspection window, so that the renter cannot report the charge level and cleanliness they are
+// billed for.
+func EndTrip(w http.ResponseWriter, r *http.Request) {
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if !authorizeBookingOwner(w, r, bookingID) {
+		return
+	}
+
+	_, returnedAt, ok := transitionBooking(w, bookingID, StatusCompleted, nil, nil)
+	if !ok {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM Bookings WHERE booking_id = ?", bookingID)
+	respondBookingStatus(w, bookingID, StatusCompleted, returnedAt, map[string]interface{}{
+		"bill":                nil,
+		"inspection_deadline": returnedAt.Add(inspectionWindow).Format("2006-01-02 15:04:05"),
+	})
+}
+
+// InspectReturn lets fleet operators record the charge level and cleanliness of a returned vehicle,
+// which bill the trip. The final bill is queued in the payment outbox with the inspection and sent
+// straight away; if the payment service cannot be reached, the outbox retries it.
+func InspectReturn(w http.ResponseWriter, r *http.Request) {
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var inspection struct {
+		ChargeLevel       *int   `json:"charge_level"`
+		CleanlinessStatus string `json:"cleanliness_status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&inspection); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if inspection.ChargeLevel == nil || *inspection.ChargeLevel < 0 || *inspection.ChargeLevel > 100 {
+		http.Error(w, "Charge level must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if inspection.CleanlinessStatus != "Clean" && inspection.CleanlinessStatus != "Needs Cleaning" {
+		http.Error(w, "Cleanliness status must be Clean or Needs Cleaning", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error deleting booking: %v", err)
+		log.Printf("Error starting transaction: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Booking cancelled successfully"))
+	trip, err := lockReturnedTrip(tx, bookingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if trip.Status != StatusCompleted {
+		http.Error(w, fmt.Sprintf("A %s booking cannot be inspected", trip.Status), http.StatusConflict)
+		return
+	}
+	if trip.Billed {
+		http.Error(w, "The return of this booking has already been billed", http.StatusConflict)
+		return
+	}
+
+	inspectedAt := time.Now()
+	state, requestID, err := recordVehicleReturn(tx, bookingID, trip, inspection.ChargeLevel, inspection.CleanlinessStatus, &inspectedAt)
+	if err != nil {
+		log.Printf("Error recording inspection of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing inspection of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Return of booking %d inspected at %d%% charge, %s", bookingID, state.ChargeLevel, state.CleanlinessStatus)
+
+	// The bill stays queued in the outbox if it cannot be sent now
+	bill, err := outbox.Deliver(requestID)
+	if err != nil {
+		log.Printf("Error billing trip of booking %d, left for retry: %v", bookingID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"booking_id":         bookingID,
+		"inspected_at":       inspectedAt.Format("2006-01-02 15:04:05"),
+		"charge_level":       state.ChargeLevel,
+		"cleanliness_status": state.CleanlinessStatus,
+		"bill":               bill,
+	})
+}
+
+// returnedTrip holds the fields of a completed booking locked to bill its return
+type returnedTrip struct {
+	lockedBooking
+	ReturnedAt time.Time
+	Billed     bool // Whether the return has been inspected or billed without an inspection
+}
+
+// lockReturnedTrip locks a booking to bill its return. It returns sql.ErrNoRows if the booking does
+// not exist.
+func lockReturnedTrip(tx *sql.Tx, bookingID int) (returnedTrip, error) {
+	var trip returnedTrip
+	var bookingDate, returnDate string
+	var completedAt sql.NullString
+	err := tx.QueryRow(`
+		SELECT vehicle_id, status, booking_date, return_date, completed_at, return_charge_level IS NOT NULL
+		FROM Bookings WHERE booking_id = ? FOR UPDATE`, bookingID).
+		Scan(&trip.VehicleID, &trip.Status, &bookingDate, &returnDate, &completedAt, &trip.Billed)
+	if err != nil {
+		return trip, err
+	}
+	if trip.BookingDate, err = time.Parse("2006-01-02 15:04:05", bookingDate); err == nil {
+		trip.ReturnDate, err = time.Parse("2006-01-02 15:04:05", returnDate)
+	}
+	if err == nil && completedAt.Valid {
+		trip.ReturnedAt, err = time.Parse("2006-01-02 15:04:05", completedAt.String)
+	}
+	return trip, err
+}
+
+// vehicleReturn holds the state of a vehicle when it was returned
+type vehicleReturn struct {
+	ChargeLevel       int
+	CleanlinessStatus string
+	PricePerHour      float64
+}
+
+// recordVehicleReturn updates the vehicle with the charge level and cleanliness found at return,
+// keeping its last known values for those not given, records them on the booking and queues the final
+// bill of the trip in the payment outbox, with the late and unused hours priced by the rate periods they
+// fall in. inspectedAt is nil when the return is billed without an
+// inspection. It returns the state billed and the ID of the queued request.
+func recordVehicleReturn(tx *sql.Tx, bookingID int, trip returnedTrip, chargeLevel *int, cleanlinessStatus string, inspectedAt *time.Time) (vehicleReturn, int64, error) {
+	var state vehicleReturn
+	_, err := tx.Exec("UPDATE Vehicles SET charge_level = COALESCE(?, charge_level), cleanliness_status = COALESCE(NULLIF(?, ''), cleanliness_status) WHERE vehicle_id = ?",
+		chargeLevel, cleanlinessStatus, trip.VehicleID)
+	if err != nil {
+		return state, 0, err
+	}
+
+	// Vehicles without a known charge level or cleanliness are assumed to be fully charged and clean
+	var level sql.NullInt64
+	var cleanliness sql.NullString
+	err = tx.QueryRow("SELECT charge_level, cleanliness_status, rental_price_per_hour FROM Vehicles WHERE vehicle_id = ?", trip.VehicleID).
+		Scan(&level, &cleanliness, &state.PricePerHour)
+	if err != nil {
+		return state, 0, err
+	}
+	state.ChargeLevel, state.CleanlinessStatus = 100, "Clean"
+	if level.Valid {
+		state.ChargeLevel = int(level.Int64)
+	}
+	if cleanliness.Valid {
+		state.CleanlinessStatus = cleanliness.String
+	}
+
+	_, err = tx.Exec("UPDATE Bookings SET return_charge_level = ?, return_cleanliness_status = ?, inspected_at = ? WHERE booking_id = ?",
+		state.ChargeLevel, state.CleanlinessStatus, inspectedAt, bookingID)
+	if err != nil {
+		return state, 0, err
+	}
+
+	requestID, err := outbox.Enqueue(tx, bookingID, outbox.KindFinalise, map[string]interface{}{
+		"booking_date":       trip.BookingDate.Format("2006-01-02 15:04:05"),
+		"return_date":        trip.ReturnDate.Format("2006-01-02 15:04:05"),
+		"returned_at":        trip.ReturnedAt.Format("2006-01-02 15:04:05"),
+		"price_per_hour":     state.PricePerHour,
+		"late_price":         rates.LatePrice(state.PricePerHour, trip.ReturnDate, trip.ReturnedAt),
+		"unused_price":       rates.UnusedPrice(state.PricePerHour, trip.BookingDate, trip.ReturnDate, trip.ReturnedAt),
+		"charge_level":       state.ChargeLevel,
+		"cleanliness_status": state.CleanlinessStatus,
+	}, "")
+	return state, requestID, err
+}
+
+// StartSweeper bills returns nobody inspected within the inspection window, cancels unpaid bookings
+// that hold a vehicle without a payment saga and resolves modifications the outbox worker has settled
+// until the process exits
+func StartSweeper() {
+	log.Println("Starting booking sweeper...")
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := billUninspectedReturns(); err != nil {
+			log.Printf("Error billing uninspected returns: %v", err)
+		}
+		if err := cancelAbandonedBookings(); err != nil {
+			log.Printf("Error cancelling abandoned bookings: %v", err)
+		}
+		if err := resolveSettledModifications(); err != nil {
+			log.Printf("Error resolving settled modifications: %v", err)
+		}
+	}
+}
+
+// resolveSettledModifications applies the pending modifications whose settlement the outbox worker
+// has completed, and rejects those whose charge was declined
+func resolveSettledModifications() error {
+	rows, err := db.Query(`
+		SELECT m.booking_id, m.modification, o.status, COALESCE(o.last_error, '')
+		FROM BookingModifications m
+		JOIN PaymentOutbox o ON o.booking_id = m.booking_id AND o.kind = ? AND o.modification = m.modification
+		WHERE m.status = 'Pending' AND o.status IN ('Completed', 'Rejected')
+		LIMIT ?`,
+		outbox.KindSettle, sweepBatchSize)
+	if err != nil {
+		return err
+	}
+	type settledModification struct {
+		bookingID, modification int
+		status, reason          string
+	}
+	var due []settledModification
+	for rows.Next() {
+		var settled settledModification
+		if err := rows.Scan(&settled.bookingID, &settled.modification, &settled.status, &settled.reason); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, settled)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, settled := range due {
+		if err := resolveModification(settled.bookingID, settled.modification, settled.status == "Completed", settled.reason); err != nil {
+			log.Printf("Error resolving modification %d of booking %d: %v", settled.modification, settled.bookingID, err)
+		}
+	}
+	return nil
+}
+
+// cancelAbandonedBookings cancels the bookings left pending payment for longer than pendingPaymentTTL
+// that no payment saga will confirm or release, freeing their slots. Bookings created by a saga are
+// released by the saga's own compensation.
+func cancelAbandonedBookings() error {
+	now := time.Now()
+	result, err := db.Exec(`
+		UPDATE Bookings SET status = ?, cancelled_at = ?
+		WHERE status = ? AND payment_reference IS NULL AND created_at < ?
+		LIMIT ?`,
+		StatusCancelled, now, StatusPendingPayment, now.Add(-pendingPaymentTTL), sweepBatchSize)
+	if err != nil {
+		return err
+	}
+	if cancelled, err := result.RowsAffected(); err == nil && cancelled > 0 {
+		log.Printf("Cancelled %d bookings left pending payment for over %v", cancelled, pendingPaymentTTL)
+	}
+	return nil
+}
+
+// billUninspectedReturns bills the trips returned more than inspectionWindow ago that no fleet operator
+// has inspected, from the last known state of their vehicles
+func billUninspectedReturns() error {
+	rows, err := db.Query(`
+		SELECT booking_id FROM Bookings
+		WHERE status = ? AND return_charge_level IS NULL AND completed_at < ?
+		ORDER BY completed_at
+		LIMIT ?`,
+		StatusCompleted, time.Now().Add(-inspectionWindow), sweepBatchSize)
+	if err != nil {
+		return err
+	}
+	var due []int
+	for rows.Next() {
+		var bookingID int
+		if err := rows.Scan(&bookingID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, bookingID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, bookingID := range due {
+		if err := billUninspectedReturn(bookingID); err != nil {
+			log.Printf("Error billing uninspected return of booking %d: %v", bookingID, err)
+		}
+	}
+	return nil
+}
+
+// billUninspectedReturn queues the final bill of a returned trip from its vehicle's last known state
+func billUninspectedReturn(bookingID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	trip, err := lockReturnedTrip(tx, bookingID)
+	if err != nil {
+		return err
+	}
+	if trip.Status != StatusCompleted || trip.Billed {
+		return nil
+	}
+	state, _, err := recordVehicleReturn(tx, bookingID, trip, nil, "", nil)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Return of booking %d billed without inspection at %d%% charge, %s", bookingID, state.ChargeLevel, state.CleanlinessStatus)
+	return nil
+}
+
+// MarkNoShow lets fleet operators record that a confirmed booking was never picked up
+func MarkNoShow(w http.ResponseWriter, r *http.Request) {
+	bookingID, ok := bookingIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	updateBookingStatus(w, bookingID, StatusNoShow, func(booking lockedBooking, now time.Time) string {
+		if now.Before(booking.BookingDate.Add(noShowGracePeriod)) {
+			return "A booking can only be marked as a no-show 30 minutes after its start time"
+		}
+		return ""
+	})
 }
 
+// lockedBooking holds the fields of a booking locked for a status transition
+type lockedBooking struct {
+	VehicleID   int
+	Status      string
+	BookingDate time.Time
+	ReturnDate  time.Time
+}
+
+// updateBookingStatus moves a booking to a new lifecycle state and writes the response
+func updateBookingStatus(w http.ResponseWriter, bookingID int, to string, guard func(booking lockedBooking, now time.Time) string) {
+	if _, at, ok := transitionBooking(w, bookingID, to, guard, nil); ok {
+		respondBookingStatus(w, bookingID, to, at, nil)
+	}
+}
+
+// transitionBooking moves a booking to a new lifecycle state, returning the booking as it was and the
+// time of the transition. The booking row is locked while the transition is validated, and guard may
+// veto it with a reason for the client. record, if given, stores what the transition entails in the same
+// transaction. On failure the error response has already been written.
+func transitionBooking(w http.ResponseWriter, bookingID int, to string, guard func(booking lockedBooking, now time.Time) string, record func(tx *sql.Tx, booking lockedBooking, now time.Time) error) (lockedBooking, time.Time, bool) {
+	var booking lockedBooking
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return booking, time.Time{}, false
+	}
+	defer tx.Rollback()
+
+	var bookingDate, returnDate string
+	err = tx.QueryRow("SELECT vehicle_id, status, booking_date, return_date FROM Bookings WHERE booking_id = ? FOR UPDATE", bookingID).
+		Scan(&booking.VehicleID, &booking.Status, &bookingDate, &returnDate)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return booking, time.Time{}, false
+	} else if err != nil {
+		log.Printf("Error retrieving booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return booking, time.Time{}, false
+	}
+	if booking.BookingDate, err = time.Parse("2006-01-02 15:04:05", bookingDate); err == nil {
+		booking.ReturnDate, err = time.Parse("2006-01-02 15:04:05", returnDate)
+	}
+	if err != nil {
+		log.Printf("Error parsing dates of booking %d: %v", bookingID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return booking, time.Time{}, false
+	}
+
+	if !canTransition(booking.Status, to) {
+		log.Printf("Rejected transition of booking %d from %s to %s", bookingID, booking.Status, to)
+		http.Error(w, fmt.Sprintf("A %s booking cannot become %s", booking.Status, to), http.StatusConflict)
+		return booking, time.Time{}, false
+	}
+
+	now := time.Now()
+	if guard != nil {
+		if reason := guard(booking, now); reason != "" {
+			log.Printf("Rejected transition of booking %d to %s: %s", bookingID, to, reason)
+			http.Error(w, reason, http.StatusConflict)
+			return booking, time.Time{}, false
+		}
+	}
+
+	// The column name comes from transitionColumns, never from the request
+	_, err = tx.Exec("UPDATE Bookings SET status = ?, "+transitionColumns[to]+" = ? WHERE booking_id = ?", to, now, bookingID)
+	if err != nil {
+		log.Printf("Error updating status of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return booking, time.Time{}, false
+	}
+	if record != nil {
+		if err := record(tx, booking, now); err != nil {
+			log.Printf("Error recording transition of booking %d to %s: %v", bookingID, to, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return booking, time.Time{}, false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing status of booking %d: %v", bookingID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return booking, time.Time{}, false
+	}
+
+	log.Printf("Booking %d moved from %s to %s", bookingID, booking.Status, to)
+	return booking, now, true
+}
+
+// respondBookingStatus writes the new state of a booking, along with any extra fields
+func respondBookingStatus(w http.ResponseWriter, bookingID int, status string, at time.Time, extra map[string]interface{}) {
+	response := map[string]interface{}{
+		"booking_id":              bookingID,
+		"status":                  status,
+		transitionColumns[status]: at.Format("2006-01-02 15:04:05"),
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// canTransition reports whether a booking may move from one lifecycle state to another
+func canTransition(from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// bookingIDFromPath parses the booking ID in the URL, writing a 400 response if it is invalid
+func bookingIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return bookingID, true
+}
 
 // GetBooking retrieves details of a specific booking
 func GetBooking(w http.ResponseWriter, r *http.Request) {
@@ -167,22 +1213,31 @@ func GetBooking(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var booking struct {
-		BookingID      int     `json:"booking_id"`
-		VehicleID      int     `json:"vehicle_id"`
-		UserID         int     `json:"user_id"`
-		BookingDate    string  `json:"booking_date"`
-		ReturnDate     string  `json:"return_date"`
-		TotalPrice     float64 `json:"total_price"`
-		Model          string  `json:"model"`
-		Location       string  `json:"location"`
-		ChargeLevel    int     `json:"charge_level"`
+		BookingID   int     `json:"booking_id"`
+		VehicleID   int     `json:"vehicle_id"`
+		UserID      int     `json:"user_id"`
+		BookingDate string  `json:"booking_date"`
+		ReturnDate  string  `json:"return_date"`
+		TotalPrice  float64 `json:"total_price"`
+		Model       string  `json:"model"`
+		Location    string  `json:"location"`
+		ChargeLevel int     `json:"charge_level"`
+		Status      string  `json:"status"`
+		CreatedAt   string  `json:"created_at"`
+		ConfirmedAt *string `json:"confirmed_at,omitempty"`
+		StartedAt   *string `json:"started_at,omitempty"`
+		CompletedAt *string `json:"completed_at,omitempty"`
+		CancelledAt *string `json:"cancelled_at,omitempty"`
+		NoShowAt    *string `json:"no_show_at,omitempty"`
 	}
 
 	err = db.QueryRow(`
 		SELECT 
 			b.booking_id, b.vehicle_id, b.user_id, 
 			b.booking_date, b.return_date, b.total_price,
-			v.model, v.location, v.charge_level
+			v.model, v.location, v.charge_level,
+			b.status, b.created_at, b.confirmed_at, b.started_at,
+			b.completed_at, b.cancelled_at, b.no_show_at
 		FROM Bookings b
 		JOIN Vehicles v ON b.vehicle_id = v.vehicle_id
 		WHERE b.booking_id = ?`, bookingID).
@@ -196,6 +1251,13 @@ func GetBooking(w http.ResponseWriter, r *http.Request) {
 			&booking.Model,
 			&booking.Location,
 			&booking.ChargeLevel,
+			&booking.Status,
+			&booking.CreatedAt,
+			&booking.ConfirmedAt,
+			&booking.StartedAt,
+			&booking.CompletedAt,
+			&booking.CancelledAt,
+			&booking.NoShowAt,
 		)
 
 	if err == sql.ErrNoRows {
@@ -207,10 +1269,38 @@ func GetBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !middleware.AuthorizeUserOrRole(r, booking.UserID, middleware.RoleFleetOperator, middleware.RoleAdmin) {
+		log.Printf("Rejected access to booking %d from another user", bookingID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(booking)
 }
 
+// authorizeBookingOwner checks that the booking exists and belongs to the authenticated user,
+// or that the caller is a fleet operator or admin, writing the error response and returning false otherwise
+func authorizeBookingOwner(w http.ResponseWriter, r *http.Request, bookingID int) bool {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM Bookings WHERE booking_id = ?", bookingID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Error retrieving booking owner: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+
+	if !middleware.AuthorizeUserOrRole(r, ownerID, middleware.RoleFleetOperator, middleware.RoleAdmin) {
+		log.Printf("Rejected access to booking %d from another user", bookingID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // GetBookingsByUserID retrieves all bookings for a specific user
 func GetBookingsByUserID(w http.ResponseWriter, r *http.Request) {
 	log.Println("GetBookingsByUserID: Start processing request") // Debug: Start of function
@@ -226,11 +1316,18 @@ func GetBookingsByUserID(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("GetBookingsByUserID: Converted user ID: %d\n", userID) // Debug: Valid ID
 
+	if !middleware.AuthorizeUserOrRole(r, userID, middleware.RoleFleetOperator, middleware.RoleAdmin) {
+		log.Printf("GetBookingsByUserID: Rejected request for user ID %d from another user\n", userID) // Debug: Forbidden
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	rows, err := db.Query(`
 		SELECT 
 			b.booking_id, b.vehicle_id, b.user_id, 
 			b.booking_date, b.return_date, b.total_price,
-			v.model, v.location, v.charge_level, v.rental_price_per_hour
+			v.model, v.location, v.charge_level, v.rental_price_per_hour,
+			b.status
 		FROM Bookings b
 		JOIN Vehicles v ON b.vehicle_id = v.vehicle_id
 		WHERE b.user_id = ?`, userID)
@@ -243,30 +1340,32 @@ func GetBookingsByUserID(w http.ResponseWriter, r *http.Request) {
 	log.Println("GetBookingsByUserID: Query executed successfully") // Debug: Query success
 
 	var bookings []struct {
-		BookingID         int     `json:"booking_id"`
-		VehicleID         int     `json:"vehicle_id"`
-		UserID            int     `json:"user_id"`
-		BookingDate       string  `json:"booking_date"`
-		ReturnDate        string  `json:"return_date"`
-		TotalPrice        float64 `json:"total_price"`
-		Model             string  `json:"model"`
-		Location          string  `json:"location"`
-		ChargeLevel       int     `json:"charge_level"`
+		BookingID          int     `json:"booking_id"`
+		VehicleID          int     `json:"vehicle_id"`
+		UserID             int     `json:"user_id"`
+		BookingDate        string  `json:"booking_date"`
+		ReturnDate         string  `json:"return_date"`
+		TotalPrice         float64 `json:"total_price"`
+		Model              string  `json:"model"`
+		Location           string  `json:"location"`
+		ChargeLevel        int     `json:"charge_level"`
 		RentalPricePerHour float64 `json:"rental_price_per_hour"`
+		Status             string  `json:"status"`
 	}
 
 	for rows.Next() {
 		var booking struct {
-			BookingID         int     `json:"booking_id"`
-			VehicleID         int     `json:"vehicle_id"`
-			UserID            int     `json:"user_id"`
-			BookingDate       string  `json:"booking_date"`
-			ReturnDate        string  `json:"return_date"`
-			TotalPrice        float64 `json:"total_price"`
-			Model             string  `json:"model"`
-			Location          string  `json:"location"`
-			ChargeLevel       int     `json:"charge_level"`
+			BookingID          int     `json:"booking_id"`
+			VehicleID          int     `json:"vehicle_id"`
+			UserID             int     `json:"user_id"`
+			BookingDate        string  `json:"booking_date"`
+			ReturnDate         string  `json:"return_date"`
+			TotalPrice         float64 `json:"total_price"`
+			Model              string  `json:"model"`
+			Location           string  `json:"location"`
+			ChargeLevel        int     `json:"charge_level"`
 			RentalPricePerHour float64 `json:"rental_price_per_hour"`
+			Status             string  `json:"status"`
 		}
 		if err := rows.Scan(
 			&booking.BookingID,
@@ -279,6 +1378,7 @@ func GetBookingsByUserID(w http.ResponseWriter, r *http.Request) {
 			&booking.Location,
 			&booking.ChargeLevel,
 			&booking.RentalPricePerHour,
+			&booking.Status,
 		); err != nil {
 			log.Printf("GetBookingsByUserID: Error scanning row: %v\n", err) // Debug: Scan error
 			http.Error(w, "Database error", http.StatusInternalServerError)
@@ -323,7 +1423,8 @@ func GetBookingsByVehicleID(w http.ResponseWriter, r *http.Request) {
 		SELECT 
 			b.booking_date, b.return_date
 		FROM Bookings b
-		WHERE b.vehicle_id = ?`, vehicleID)
+		WHERE b.vehicle_id = ?
+		AND b.status NOT IN ('cancelled', 'no_show')`, vehicleID)
 	if err != nil {
 		log.Printf("GetBookingsByVehicleID: Error retrieving bookings by vehicle ID: %v\n", err) // Debug: Query error
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -365,4 +1466,4 @@ func GetBookingsByVehicleID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("GetBookingsByVehicleID: Response sent successfully") // Debug: End of function
-}
\ No newline at end of file
+}
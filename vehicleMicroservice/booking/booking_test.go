@@ -0,0 +1,260 @@
+package booking
+
+import (
+	"common/middleware"
+	"common/sqltest"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlotConflicts(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2026, 3, 4, hour, 0, 0, 0, time.UTC)
+	}
+	start, end := at(10), at(14)
+
+	tests := []struct {
+		name string
+		slot bookingSlot
+		want bool
+	}{
+		{name: "same interval", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(10), End: at(14)}, want: true},
+		{name: "overlaps the start", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(8), End: at(11)}, want: true},
+		{name: "overlaps the end", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(13), End: at(16)}, want: true},
+		{name: "inside", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(11), End: at(12)}, want: true},
+		{name: "around", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(9), End: at(15)}, want: true},
+		{name: "ends at the start", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(8), End: at(10)}, want: false},
+		{name: "starts at the end", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(14), End: at(16)}, want: false},
+		{name: "before", slot: bookingSlot{BookingID: 1, Status: StatusConfirmed, Start: at(6), End: at(8)}, want: false},
+		{name: "pending payment", slot: bookingSlot{BookingID: 1, Status: StatusPendingPayment, Start: at(10), End: at(14)}, want: true},
+		{name: "active", slot: bookingSlot{BookingID: 1, Status: StatusActive, Start: at(9), End: at(11)}, want: true},
+		{name: "completed", slot: bookingSlot{BookingID: 1, Status: StatusCompleted, Start: at(9), End: at(11)}, want: true},
+		{name: "cancelled", slot: bookingSlot{BookingID: 1, Status: StatusCancelled, Start: at(10), End: at(14)}, want: false},
+		{name: "no-show", slot: bookingSlot{BookingID: 1, Status: StatusNoShow, Start: at(10), End: at(14)}, want: false},
+		{name: "pending modification of another booking", slot: bookingSlot{BookingID: 1, Status: slotPendingModification, Start: at(12), End: at(16)}, want: true},
+		{name: "booking being modified", slot: bookingSlot{BookingID: 7, Status: StatusConfirmed, Start: at(10), End: at(14)}, want: false},
+		{name: "pending modification of the booking being modified", slot: bookingSlot{BookingID: 7, Status: slotPendingModification, Start: at(12), End: at(16)}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := slotConflicts(test.slot, 7, start, end); got != test.want {
+				t.Errorf("slotConflicts(%+v) = %v, want %v", test.slot, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindConflictingBooking(t *testing.T) {
+	start := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+	lockVehicle := sqltest.Statement{
+		Contains: "FROM Vehicles WHERE vehicle_id = ? FOR UPDATE",
+		Args:     []driver.Value{int64(3)},
+		Columns:  []string{"vehicle_id"},
+		Rows:     [][]driver.Value{{int64(3)}},
+	}
+	slots := func(rows ...[]driver.Value) sqltest.Statement {
+		return sqltest.Statement{
+			Contains: "UNION ALL",
+			Args:     []driver.Value{int64(3), start, slotPendingModification, int64(3), start},
+			Columns:  []string{"booking_id", "status", "booking_date", "return_date"},
+			Rows:     rows,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		statements []sqltest.Statement
+		want       *bookingConflict
+		wantErr    error
+	}{
+		{
+			name:       "unknown vehicle",
+			statements: []sqltest.Statement{{Contains: "FROM Vehicles WHERE vehicle_id = ? FOR UPDATE", Columns: []string{"vehicle_id"}}},
+			wantErr:    sql.ErrNoRows,
+		},
+		{
+			name:       "no bookings",
+			statements: []sqltest.Statement{lockVehicle, slots()},
+		},
+		{
+			name: "only released, touching or own slots",
+			statements: []sqltest.Statement{lockVehicle, slots(
+				[]driver.Value{int64(1), StatusCancelled, "2026-03-04 09:00:00", "2026-03-04 12:00:00"},
+				[]driver.Value{int64(7), slotPendingModification, "2026-03-04 11:00:00", "2026-03-04 15:00:00"},
+				[]driver.Value{int64(2), StatusConfirmed, "2026-03-04 14:00:00", "2026-03-04 16:00:00"},
+			)},
+		},
+		{
+			name: "first clashing slot",
+			statements: []sqltest.Statement{lockVehicle, slots(
+				[]driver.Value{int64(1), StatusNoShow, "2026-03-04 09:00:00", "2026-03-04 12:00:00"},
+				[]driver.Value{int64(4), slotPendingModification, "2026-03-04 12:00:00", "2026-03-04 18:00:00"},
+				[]driver.Value{int64(2), StatusConfirmed, "2026-03-04 13:00:00", "2026-03-04 16:00:00"},
+			)},
+			want: &bookingConflict{BookingDate: "2026-03-04 12:00:00", ReturnDate: "2026-03-04 18:00:00"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db = sqltest.Open(t, test.statements...)
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			conflict, err := findConflictingBooking(tx, 3, 7, start, end)
+			if err != test.wantErr {
+				t.Fatalf("findConflictingBooking() error = %v, want %v", err, test.wantErr)
+			}
+			if (conflict == nil) != (test.want == nil) || (conflict != nil && *conflict != *test.want) {
+				t.Errorf("findConflictingBooking() = %+v, want %+v", conflict, test.want)
+			}
+		})
+	}
+}
+
+func TestRespondBookingConflict(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondBookingConflict(w, &bookingConflict{BookingDate: "2026-03-04 12:00:00", ReturnDate: "2026-03-04 18:00:00"})
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	var response struct {
+		Conflict bookingConflict `json:"conflict"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Conflict.BookingDate != "2026-03-04 12:00:00" || response.Conflict.ReturnDate != "2026-03-04 18:00:00" {
+		t.Errorf("conflict = %+v, want the clashing interval", response.Conflict)
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{StatusPendingPayment, StatusConfirmed}: true,
+		{StatusPendingPayment, StatusCancelled}: true,
+		{StatusConfirmed, StatusActive}:         true,
+		{StatusConfirmed, StatusCancelled}:      true,
+		{StatusConfirmed, StatusNoShow}:         true,
+		{StatusActive, StatusCompleted}:         true,
+	}
+	states := []string{StatusPendingPayment, StatusConfirmed, StatusActive, StatusCompleted, StatusCancelled, StatusNoShow}
+
+	for _, from := range states {
+		for _, to := range states {
+			if got, want := canTransition(from, to), allowed[[2]string{from, to}]; got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestTransitionBooking(t *testing.T) {
+	lockBooking := func(status string) sqltest.Statement {
+		return sqltest.Statement{
+			Contains: "FROM Bookings WHERE booking_id = ? FOR UPDATE",
+			Args:     []driver.Value{int64(7)},
+			Columns:  []string{"vehicle_id", "status", "booking_date", "return_date"},
+			Rows:     [][]driver.Value{{int64(3), status, "2026-03-04 10:00:00", "2026-03-04 14:00:00"}},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		to         string
+		guard      func(booking lockedBooking, now time.Time) string
+		statements []sqltest.Statement
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name: "allowed transition records its timestamp",
+			to:   StatusActive,
+			statements: []sqltest.Statement{lockBooking(StatusConfirmed), {
+				Contains:     "UPDATE Bookings SET status = ?, started_at = ? WHERE booking_id = ?",
+				Args:         []driver.Value{StatusActive, sqltest.Any, int64(7)},
+				RowsAffected: 1,
+			}},
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "final state",
+			to:         StatusCancelled,
+			statements: []sqltest.Statement{lockBooking(StatusCompleted)},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "skipped state",
+			to:         StatusCompleted,
+			statements: []sqltest.Statement{lockBooking(StatusConfirmed)},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "guard rejects",
+			to:   StatusActive,
+			guard: func(booking lockedBooking, now time.Time) string {
+				return "Too early"
+			},
+			statements: []sqltest.Statement{lockBooking(StatusConfirmed)},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "unknown booking",
+			to:         StatusConfirmed,
+			statements: []sqltest.Statement{{Contains: "FROM Bookings WHERE booking_id = ? FOR UPDATE", Columns: []string{"vehicle_id", "status", "booking_date", "return_date"}}},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db = sqltest.Open(t, test.statements...)
+			w := httptest.NewRecorder()
+
+			booking, _, ok := transitionBooking(w, 7, test.to, test.guard, nil)
+			if ok != test.wantOK {
+				t.Fatalf("transitionBooking() ok = %v, want %v", ok, test.wantOK)
+			}
+			if w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+			if ok && booking.VehicleID != 3 {
+				t.Errorf("booking = %+v, want vehicle 3", booking)
+			}
+		})
+	}
+}
+
+func TestCreateBookingRejectsPaymentReferenceFromUsers(t *testing.T) {
+	validateToken := middleware.ValidateToken
+	defer func() { middleware.ValidateToken = validateToken }()
+	middleware.ValidateToken = func(token string) (middleware.Identity, error) {
+		return middleware.Identity{UserID: 5}, nil
+	}
+
+	// A made-up saga reference would keep the booking out of the abandoned booking sweep
+	db = sqltest.Open(t)
+	body := `{"vehicle_id": 3, "user_id": 5, "booking_date": "2026-03-04 10:00:00", "return_date": "2026-03-04 14:00:00", "payment_reference": "made-up"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/vehicle/booking", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+
+	middleware.RequireAuth(CreateBooking)(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"common/idempotency"
+	"common/middleware"
 	"log"
 	"net/http"
 	"vehicleMicroservice/booking"
+	"vehicleMicroservice/outbox"
+	"vehicleMicroservice/pricing"
+	"vehicleMicroservice/rates"
 	"vehicleMicroservice/vehicle"
 
 	"github.com/gorilla/handlers"
@@ -11,30 +16,68 @@ import (
 )
 
 func main() {
+	// Load the JWT secret and internal API key used to authenticate requests
+	if err := middleware.Init(); err != nil {
+		log.Fatalf("Error initialising middleware: %v", err)
+	}
+
+	// Connect to the database storing idempotency keys
+	if err := idempotency.Init(); err != nil {
+		log.Fatalf("Error initialising idempotency keys: %v", err)
+	}
+
+	// Load the pricing rules and public holidays
+	rates.Init()
+
+	// Connect to the vehicle database and load the return inspection window
+	vehicle.Init()
+	pricing.Init()
+	booking.Init()
+	outbox.Init()
+
 	// Initialize the router
 	router := mux.NewRouter()
 
 	// Vehicle endpoints
 	router.HandleFunc("/api/v1/vehicle/availability", vehicle.GetAvailableVehicles).Methods("GET")
 	router.HandleFunc("/api/v1/vehicle/status", vehicle.GetVehicleStatus).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle/quote", middleware.RequireAuth(booking.GetQuote)).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle/{id:[0-9]+}/status", middleware.RequireRole(vehicle.UpdateVehicleStatus, middleware.RoleFleetOperator, middleware.RoleAdmin)).Methods("PUT")
 
 	// Booking endpoints
-	router.HandleFunc("/api/v1/vehicle/booking", booking.CreateBooking).Methods("POST")
-	router.HandleFunc("/api/v1/vehicle/booking/{id}", booking.GetBooking).Methods("GET")
-	router.HandleFunc("/api/v1/vehicle/booking/{id}", booking.ModifyBooking).Methods("PUT")
-	router.HandleFunc("/api/v1/vehicle/booking/{id}", booking.CancelBooking).Methods("DELETE")
-	router.HandleFunc("/api/v1/vehicle/booking/user/{user_id}", booking.GetBookingsByUserID).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle/booking", middleware.RequireAuth(idempotency.Wrap(booking.CreateBooking))).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}", middleware.RequireAuth(booking.GetBooking)).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}", middleware.RequireAuth(booking.ModifyBooking)).Methods("PUT")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}", middleware.RequireAuth(booking.CancelBooking)).Methods("DELETE")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}/confirm", middleware.RequireInternal(booking.ConfirmBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/reference/{reference}/release", middleware.RequireInternal(booking.ReleaseBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}/start", middleware.RequireAuth(booking.StartTrip)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}/end", middleware.RequireAuth(booking.EndTrip)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}/inspection", middleware.RequireRole(booking.InspectReturn, middleware.RoleFleetOperator, middleware.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/{id}/no-show", middleware.RequireRole(booking.MarkNoShow, middleware.RoleFleetOperator, middleware.RoleAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/vehicle/booking/user/{user_id}", middleware.RequireAuth(booking.GetBookingsByUserID)).Methods("GET")
 	router.HandleFunc("/api/v1/vehicle/booking/vehicle/{vehicle_id}", booking.GetBookingsByVehicleID).Methods("GET")
 
-
+	// Payment outbox endpoints for inspecting and replaying failed refunds and final bills
+	router.HandleFunc("/api/v1/vehicle/payment-outbox", middleware.RequireInternalOrRole(outbox.ListRequests, middleware.RoleFinance, middleware.RoleAdmin)).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle/payment-outbox/{id:[0-9]+}/replay", middleware.RequireInternalOrRole(outbox.ReplayRequest, middleware.RoleFinance, middleware.RoleAdmin)).Methods("POST")
 
 	// Add CORS support
 	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://127.0.0.1:5150"}), // Allowed origins
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}), // Allowed methods
-		handlers.AllowedHeaders([]string{"Content-Type"}), // Allowed headers
+		handlers.AllowedOrigins([]string{"http://127.0.0.1:5150"}),                            // Allowed origins
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),          // Allowed methods
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Idempotency-Key"}), // Allowed headers
 	)(router)
 
+	// Purge expired idempotency keys
+	go idempotency.StartCleanup()
+
+	// Send queued refunds and final bills to the payment service
+	go outbox.StartWorker()
+
+	// Bill returns nobody inspected in time and cancel bookings abandoned before payment
+	go booking.StartSweeper()
+
 	// Start the server
 	log.Println("Vehicle Microservice is running on port 5150...")
 	log.Fatal(http.ListenAndServe(":5150", corsHandler))
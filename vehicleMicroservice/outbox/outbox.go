@@ -0,0 +1,373 @@
+package outbox
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+const (
+	pollInterval = 10 * time.Second // How often the worker looks for due requests
+	batchSize    = 10               // Requests claimed per poll
+	maxAttempts  = 10               // Attempts before a request is dead-lettered
+	baseBackoff  = 30 * time.Second // Delay after the first failed attempt, doubled on every retry
+	maxBackoff   = time.Hour        // Upper bound for the retry delay
+	claimLease   = time.Minute      // How long a claimed request is hidden from other workers while it is sent
+)
+
+// Kinds of payment request, each posted to its payment service endpoint
+const (
+	KindRefund   = "Refund"   // Refund of a cancelled booking under the cancellation policy
+	KindSettle   = "Settle"   // Settlement of the price difference of a booking modification
+	KindFinalise = "Finalise" // Final bill of a completed trip, captured against its hold
+)
+
+// endpoints maps each kind of request to the payment service endpoint of its booking
+var endpoints = map[string]string{
+	KindRefund:   "http://payment:5200/api/v1/payment/booking/%d/refund",
+	KindSettle:   "http://payment:5200/api/v1/payment/booking/%d/settle",
+	KindFinalise: "http://payment:5200/api/v1/payment/booking/%d/finalise",
+}
+
+// Init connects to the vehicle database configured in .env. The vehicle service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection (outbox package)...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection (outbox package) successful.")
+}
+
+// Request represents a row of the PaymentOutbox table
+type Request struct {
+	RequestID     int             `json:"request_id"`
+	BookingID     int             `json:"booking_id"`
+	Kind          string          `json:"kind"`
+	Modification  int             `json:"modification,omitempty"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt string          `json:"next_attempt_at"`
+	LastError     *string         `json:"last_error,omitempty"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+	CompletedAt   *string         `json:"completed_at,omitempty"`
+}
+
+// Enqueue stores a payment request about a booking in the transaction that makes it necessary, so that
+// the request is sent if and only if the transaction commits. A booking has at most one request of each
+// kind; enqueueing it again returns the existing request. locale is the Accept-Language the payment
+// service answers the customer in.
+func Enqueue(tx *sql.Tx, bookingID int, kind string, payload map[string]interface{}, locale string) (int64, error) {
+	return enqueue(tx, bookingID, kind, 0, payload, locale)
+}
+
+// EnqueueSettlement stores the settlement of a booking modification like Enqueue. A booking has one
+// settlement per modification, and the payment service settles each modification once.
+func EnqueueSettlement(tx *sql.Tx, bookingID, modification int, payload map[string]interface{}, locale string) (int64, error) {
+	return enqueue(tx, bookingID, KindSettle, modification, payload, locale)
+}
+
+// enqueue stores a request of the given kind, and of the given modification for settlements
+func enqueue(tx *sql.Tx, bookingID int, kind string, modification int, payload map[string]interface{}, locale string) (int64, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO PaymentOutbox (booking_id, kind, modification, payload, locale, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), 'Pending', ?)
+		ON DUPLICATE KEY UPDATE request_id = LAST_INSERT_ID(request_id)`,
+		bookingID, kind, modification, body, locale, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	requestID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("%s request %d for booking %d queued in the payment outbox.", kind, requestID, bookingID)
+	return requestID, nil
+}
+
+// DeclinedError is returned when the payment service's provider declines a charge. A declined request
+// is rejected rather than retried.
+type DeclinedError struct {
+	Message string
+}
+
+func (err *DeclinedError) Error() string {
+	return err.Message
+}
+
+// Deliver sends a queued request straight away, so that the caller can show its outcome, and returns
+// the payment service's response. A declined request is reported as a *DeclinedError. A request that
+// fails otherwise, or that a worker is already sending, is left for the worker to retry and reported
+// with an error.
+func Deliver(requestID int64) (map[string]interface{}, error) {
+	delivered, response, err := attempt(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if !delivered {
+		return nil, fmt.Errorf("payment request %d is being sent by another worker", requestID)
+	}
+	return response, nil
+}
+
+// StartWorker sends due payment requests until the process exits
+func StartWorker() {
+	log.Println("Starting payment outbox worker...")
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := processBatch(); err != nil {
+			log.Printf("Error processing payment outbox: %v", err)
+		}
+	}
+}
+
+// processBatch attempts up to batchSize due requests
+func processBatch() error {
+	rows, err := db.Query(`
+		SELECT request_id FROM PaymentOutbox
+		WHERE status = 'Pending' AND next_attempt_at <= ?
+		ORDER BY request_id
+		LIMIT ?`,
+		time.Now(), batchSize)
+	if err != nil {
+		return err
+	}
+	var due []int64
+	for rows.Next() {
+		var requestID int64
+		if err := rows.Scan(&requestID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, requestID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, requestID := range due {
+		if _, _, err := attempt(requestID); err != nil {
+			log.Printf("Payment request %d failed: %v", requestID, err)
+		}
+	}
+	return nil
+}
+
+// attempt claims a pending request and posts it to the payment service, recording the outcome. The
+// claim pushes the request's next attempt back by claimLease, so that no other worker sends it in the
+// meantime, and no lock is held while the payment service is called. It reports false if the request
+// is not pending or another worker has claimed it.
+func attempt(requestID int64) (bool, map[string]interface{}, error) {
+	now := time.Now()
+	result, err := db.Exec(`
+		UPDATE PaymentOutbox SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE request_id = ? AND status = 'Pending' AND next_attempt_at <= ?`,
+		now.Add(claimLease), requestID, now)
+	if err != nil {
+		return false, nil, err
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		return false, nil, nil
+	}
+
+	var bookingID, attempts int
+	var kind string
+	var payload []byte
+	var locale sql.NullString
+	err = db.QueryRow("SELECT booking_id, kind, payload, locale, attempts FROM PaymentOutbox WHERE request_id = ?", requestID).
+		Scan(&bookingID, &kind, &payload, &locale, &attempts)
+	if err != nil {
+		return true, nil, err
+	}
+
+	response, sendErr := post(fmt.Sprintf(endpoints[kind], bookingID), payload, locale.String)
+	_, declined := sendErr.(*DeclinedError)
+	switch {
+	case sendErr == nil:
+		responseJSON, _ := json.Marshal(response)
+		_, err = db.Exec(`
+			UPDATE PaymentOutbox SET status = 'Completed', response = ?, completed_at = ?, last_error = NULL
+			WHERE request_id = ?`,
+			responseJSON, time.Now(), requestID)
+		log.Printf("%s request %d for booking %d completed.", kind, requestID, bookingID)
+	case declined:
+		_, err = db.Exec("UPDATE PaymentOutbox SET status = 'Rejected', last_error = ?, completed_at = ? WHERE request_id = ?",
+			sendErr.Error(), time.Now(), requestID)
+		log.Printf("%s request %d for booking %d declined: %v", kind, requestID, bookingID, sendErr)
+	case attempts >= maxAttempts:
+		_, err = db.Exec("UPDATE PaymentOutbox SET status = 'Dead', last_error = ? WHERE request_id = ?", sendErr.Error(), requestID)
+		log.Printf("%s request %d for booking %d dead-lettered after %d attempts: %v", kind, requestID, bookingID, attempts, sendErr)
+	default:
+		_, err = db.Exec("UPDATE PaymentOutbox SET next_attempt_at = ?, last_error = ? WHERE request_id = ?",
+			time.Now().Add(backoff(attempts)), sendErr.Error(), requestID)
+		log.Printf("%s request %d for booking %d failed (attempt %d), will retry: %v", kind, requestID, bookingID, attempts, sendErr)
+	}
+	if err != nil {
+		return true, nil, err
+	}
+	return true, response, sendErr
+}
+
+// post sends a request to the payment service and decodes the response. A 404 means the booking was
+// never paid for and is reported as a nil response, and a 402 as a *DeclinedError.
+func post(apiURL string, payload []byte, locale string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", locale)
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode == http.StatusPaymentRequired {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &DeclinedError{Message: strings.TrimSpace(string(body))}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s returned status %d: %s", req.URL.Path, resp.StatusCode, string(body))
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// backoff returns the delay before the next attempt after the given number of failures
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff << uint(attempts-1)
+	if delay > maxBackoff || delay <= 0 {
+		return maxBackoff
+	}
+	return delay
+}
+
+// ListRequests returns payment requests, optionally filtered by status (Pending, Completed, Rejected or Dead)
+func ListRequests(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	query := `
+		SELECT request_id, booking_id, kind, modification, status, attempts, next_attempt_at, last_error, response, created_at, completed_at
+		FROM PaymentOutbox`
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY request_id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying payment outbox: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []Request{}
+	for rows.Next() {
+		var request Request
+		var lastError, response, completedAt sql.NullString
+		if err := rows.Scan(&request.RequestID, &request.BookingID, &request.Kind, &request.Modification, &request.Status, &request.Attempts,
+			&request.NextAttemptAt, &lastError, &response, &request.CreatedAt, &completedAt); err != nil {
+			log.Printf("Error scanning payment outbox row: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if lastError.Valid {
+			request.LastError = &lastError.String
+		}
+		if response.Valid {
+			request.Response = json.RawMessage(response.String)
+		}
+		if completedAt.Valid {
+			request.CompletedAt = &completedAt.String
+		}
+		requests = append(requests, request)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// ReplayRequest puts a dead-lettered payment request back into the queue for immediate delivery. The
+// payment service endpoints are idempotent, so a request is never applied twice.
+func ReplayRequest(w http.ResponseWriter, r *http.Request) {
+	requestID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE PaymentOutbox SET status = 'Pending', attempts = 0, next_attempt_at = ?, last_error = NULL
+		WHERE request_id = ? AND status = 'Dead'`,
+		time.Now(), requestID)
+	if err != nil {
+		log.Printf("Error replaying payment request %d: %v", requestID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Dead-lettered payment request not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Payment request %d queued for replay.", requestID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf(`{"message": "Payment request queued for replay", "request_id": %d}`, requestID)))
+}
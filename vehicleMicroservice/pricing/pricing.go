@@ -0,0 +1,372 @@
+package pricing
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"vehicleMicroservice/rates"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+var db *sql.DB
+
+const (
+	membershipLevelURL = "http://user:5100/api/v1/user/membership/level"     // Membership level of a user
+	discountURL        = "http://payment:5200/api/v1/payment/discount"       // Discount percentage of a membership level
+	promoURL           = "http://payment:5200/api/v1/payment/promo/evaluate" // Discount of a promo code on a booking
+)
+
+// ErrVehicleNotFound is returned when quoting a vehicle that does not exist
+var ErrVehicleNotFound = errors.New("vehicle not found")
+
+// PromoRejectedError is returned when the payment service will not apply a promo code, with the reason
+// to show the customer
+type PromoRejectedError struct {
+	Reason string
+}
+
+func (err *PromoRejectedError) Error() string {
+	return err.Reason
+}
+
+// Init connects to the vehicle database configured in .env. The vehicle service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Initialize database connection
+	dbConnection := os.Getenv("DB_CONNECTION")
+	if dbConnection == "" {
+		log.Fatalf("DB_CONNECTION environment variable is not set")
+	}
+
+	log.Println("Initializing database connection...")
+	db, err = sql.Open("mysql", dbConnection)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Database connection test failed: %v", err)
+	}
+	log.Println("Database connection successful.")
+}
+
+// Kinds of quote line items
+const (
+	KindRental         = "rental"          // Hours charged at one rate
+	KindDailyCap       = "daily_cap"       // Reduction keeping 24 hours of the rental within the daily cap
+	KindMemberDiscount = "member_discount" // Discount of the membership level
+	KindPromo          = "promo"           // Discount of the promo code
+)
+
+// LineItem represents one line of an itemised quote
+type LineItem struct {
+	Kind        string  `json:"kind"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// Quote represents the server-side price of renting a vehicle over an interval
+type Quote struct {
+	VehicleID           int              `json:"vehicle_id"`
+	StartDate           string           `json:"start_date"`
+	EndDate             string           `json:"end_date"`
+	DurationHours       float64          `json:"duration_hours"`
+	PricePerHour        float64          `json:"price_per_hour"`       // Standard hourly rate of the vehicle
+	LocationUtilisation float64          `json:"location_utilisation"` // Percentage of the vehicles at the location booked over the rental
+	SurgeMultiplier     float64          `json:"surge_multiplier"`
+	HourlyBreakdown     []rates.Hour     `json:"hourly_breakdown"`
+	DailyCaps           []rates.DailyCap `json:"daily_caps,omitempty"`
+	BasePrice           float64          `json:"base_price"` // Rental price before discounts
+	MembershipLevel     string           `json:"membership_level"`
+	DiscountPercentage  float64          `json:"discount_percentage"`
+	Discount            float64          `json:"discount"`
+	PromoCode           string           `json:"promo_code,omitempty"`
+	PromoDiscount       float64          `json:"promo_discount"`
+	PromoRejection      string           `json:"promo_rejection,omitempty"` // Why the promo code of a modified booking was dropped
+	TotalPrice          float64          `json:"total_price"`
+	LineItems           []LineItem       `json:"line_items"`
+}
+
+// Promotion identifies the user a quote is for and the promo code to apply to it
+type Promotion struct {
+	Code      string // Promo code entered by the customer, empty for none
+	UserID    int    // User the booking is for, whose membership level is discounted and who redeems the code
+	BookingID int    // Booking being modified, 0 for a new booking; it does not count towards its location's utilisation
+}
+
+// Matches reports whether a total supplied by the client agrees with the quote to the cent
+func (quote Quote) Matches(total float64) bool {
+	return math.Abs(roundCents(total)-quote.TotalPrice) < 0.005
+}
+
+// Calculate prices a rental of the vehicle from start to end for promo.UserID. Each hour is charged by
+// the pricing rules of the rates package from the vehicle's hourly rate in the Vehicles table and the
+// utilisation of its location. The membership level of the booking's user, whoever is making the
+// request, comes from the user service and the discounts of the level and of any promo code from the
+// payment service. A promo code that cannot be applied returns a *PromoRejectedError, except when
+// modifying a booking, which is then priced without it and told why in PromoRejection.
+func Calculate(vehicleID int, start, end time.Time, promo Promotion) (Quote, error) {
+	var pricePerHour float64
+	var location string
+	err := db.QueryRow("SELECT rental_price_per_hour, COALESCE(location, '') FROM Vehicles WHERE vehicle_id = ?", vehicleID).Scan(&pricePerHour, &location)
+	if err == sql.ErrNoRows {
+		return Quote{}, ErrVehicleNotFound
+	} else if err != nil {
+		return Quote{}, err
+	}
+
+	membershipLevel, err := fetchMembershipLevel(promo.UserID)
+	if err != nil {
+		return Quote{}, fmt.Errorf("error fetching membership level: %v", err)
+	}
+	discountPercentage, err := fetchDiscountPercentage(membershipLevel)
+	if err != nil {
+		return Quote{}, fmt.Errorf("error fetching discount: %v", err)
+	}
+
+	utilisation, err := locationUtilisation(location, start, end, promo.BookingID)
+	if err != nil {
+		return Quote{}, fmt.Errorf("error fetching location utilisation: %v", err)
+	}
+
+	// Rentals are charged for the exact booked duration rather than whole hours
+	durationHours := end.Sub(start).Hours()
+	breakdown := rates.Price(pricePerHour, start, end, utilisation)
+	basePrice := breakdown.Total
+	discount := roundCents(basePrice * discountPercentage / 100)
+
+	quote := Quote{
+		VehicleID:           vehicleID,
+		StartDate:           start.Format("2006-01-02 15:04:05"),
+		EndDate:             end.Format("2006-01-02 15:04:05"),
+		DurationHours:       math.Round(durationHours*100) / 100,
+		PricePerHour:        pricePerHour,
+		LocationUtilisation: math.Round(utilisation*100) / 100,
+		SurgeMultiplier:     breakdown.SurgeMultiplier,
+		HourlyBreakdown:     breakdown.Hours,
+		DailyCaps:           breakdown.DailyCaps,
+		BasePrice:           basePrice,
+		MembershipLevel:     membershipLevel,
+		DiscountPercentage:  discountPercentage,
+		Discount:            discount,
+		TotalPrice:          roundCents(basePrice - discount),
+		LineItems:           rentalLineItems(breakdown),
+	}
+
+	// Apply the promo code on top of, or instead of, the member discount
+	var promoDescription string
+	if promo.Code != "" {
+		applied, err := fetchPromotion(promo, vehicleID, location, basePrice, discount)
+		rejected, isRejected := err.(*PromoRejectedError)
+		switch {
+		case isRejected && promo.BookingID != 0:
+			log.Printf("Promo code %s of booking %d no longer applies: %s", promo.Code, promo.BookingID, rejected.Reason)
+			quote.PromoRejection = rejected.Reason
+		case isRejected:
+			return Quote{}, err
+		case err != nil:
+			return Quote{}, fmt.Errorf("error applying promo code: %v", err)
+		default:
+			quote.PromoCode = applied.Code
+			quote.PromoDiscount = applied.Discount
+			quote.Discount = applied.MemberDiscount
+			quote.TotalPrice = roundCents(basePrice - quote.Discount - quote.PromoDiscount)
+			promoDescription = applied.Description
+		}
+	}
+
+	if quote.Discount > 0 {
+		quote.LineItems = append(quote.LineItems, LineItem{
+			Kind:        KindMemberDiscount,
+			Description: fmt.Sprintf("%s member discount (%.0f%%)", membershipLevel, discountPercentage),
+			Amount:      -quote.Discount,
+		})
+	}
+	if quote.PromoCode != "" {
+		quote.LineItems = append(quote.LineItems, LineItem{
+			Kind:        KindPromo,
+			Description: fmt.Sprintf("Promo code %s: %s", quote.PromoCode, promoDescription),
+			Amount:      -quote.PromoDiscount,
+		})
+	}
+	return quote, nil
+}
+
+// rentalLineItems summarises the hourly breakdown of a rental as one line per rate, followed by the
+// reductions of the daily cap
+func rentalLineItems(breakdown rates.Breakdown) []LineItem {
+	var lineItems []LineItem
+	var hours []float64
+	index := make(map[string]int)
+	for _, hour := range breakdown.Hours {
+		period := hour.Period
+		if hour.Holiday != "" {
+			period = fmt.Sprintf("%s (%s)", hour.Period, hour.Holiday)
+		}
+		key := fmt.Sprintf("%s@%.2f", period, hour.Rate)
+		i, ok := index[key]
+		if !ok {
+			i = len(lineItems)
+			index[key] = i
+			lineItems = append(lineItems, LineItem{Kind: KindRental})
+			hours = append(hours, 0)
+		}
+		hours[i] += hour.Hours
+		lineItems[i].Amount = roundCents(lineItems[i].Amount + hour.Amount)
+		lineItems[i].Description = fmt.Sprintf("%s rental, %.2f hours at $%.2f per hour", period, hours[i], hour.Rate)
+	}
+	for _, dailyCap := range breakdown.DailyCaps {
+		lineItems = append(lineItems, LineItem{
+			Kind:        KindDailyCap,
+			Description: fmt.Sprintf("Daily cap for day %d, at most $%.2f per 24 hours", dailyCap.Day, dailyCap.Cap),
+			Amount:      -dailyCap.Reduction,
+		})
+	}
+	return lineItems
+}
+
+// locationUtilisation returns the percentage of the vehicles at a location that are booked at some time
+// between start and end, leaving out the booking being modified
+func locationUtilisation(location string, start, end time.Time, excludeBookingID int) (float64, error) {
+	if location == "" {
+		return 0, nil
+	}
+
+	var vehicles, booked int
+	err := db.QueryRow(`
+		SELECT COUNT(DISTINCT v.vehicle_id), COUNT(DISTINCT b.vehicle_id)
+		FROM Vehicles v
+		LEFT JOIN Bookings b ON b.vehicle_id = v.vehicle_id AND b.booking_id <> ?
+			AND b.status NOT IN ('completed', 'cancelled', 'no_show')
+			AND b.booking_date < ? AND b.return_date > ?
+		WHERE v.location = ?`,
+		excludeBookingID, end, start, location).Scan(&vehicles, &booked)
+	if err != nil || vehicles == 0 {
+		return 0, err
+	}
+	return float64(booked) * 100 / float64(vehicles), nil
+}
+
+// fetchMembershipLevel asks the user service for the membership level of a user
+func fetchMembershipLevel(userID int) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?user_id=%d", membershipLevelURL, userID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	var status struct {
+		MembershipLevel string `json:"membership_level"`
+	}
+	if err := getJSON(req, &status); err != nil {
+		return "", err
+	}
+	return status.MembershipLevel, nil
+}
+
+// fetchDiscountPercentage asks the payment service for the discount of a membership level
+func fetchDiscountPercentage(membershipLevel string) (float64, error) {
+	req, err := http.NewRequest("GET", discountURL+"?membership_level="+url.QueryEscape(membershipLevel), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var discount struct {
+		DiscountPercentage float64 `json:"discount_percentage"`
+	}
+	if err := getJSON(req, &discount); err != nil {
+		return 0, err
+	}
+	return discount.DiscountPercentage, nil
+}
+
+// promotionResult is the payment service's evaluation of a promo code
+type promotionResult struct {
+	Code           string  `json:"code"`
+	Description    string  `json:"description"`
+	Discount       float64 `json:"discount"`
+	MemberDiscount float64 `json:"member_discount"`
+}
+
+// fetchPromotion asks the payment service what a promo code takes off a booking priced at subtotal
+// with the given member discount. A code the payment service rejects returns a *PromoRejectedError.
+func fetchPromotion(promo Promotion, vehicleID int, location string, subtotal, memberDiscount float64) (promotionResult, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"code":            promo.Code,
+		"user_id":         promo.UserID,
+		"booking_id":      promo.BookingID,
+		"vehicle_id":      vehicleID,
+		"location":        location,
+		"subtotal":        subtotal,
+		"member_discount": memberDiscount,
+	})
+	req, err := http.NewRequest("POST", promoURL, bytes.NewBuffer(body))
+	if err != nil {
+		return promotionResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Api-Key", os.Getenv("INTERNAL_API_KEY"))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return promotionResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		var rejection struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&rejection); err != nil {
+			return promotionResult{}, fmt.Errorf("error decoding promo code rejection: %v", err)
+		}
+		return promotionResult{}, &PromoRejectedError{Reason: rejection.Error}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return promotionResult{}, fmt.Errorf("unexpected status from %s: %s", req.URL.Host, resp.Status)
+	}
+
+	var result promotionResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return promotionResult{}, err
+	}
+	return result, nil
+}
+
+// getJSON sends the request and decodes a 200 OK JSON response into v
+func getJSON(req *http.Request, v interface{}) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,307 @@
+package rates
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Rate periods, in order of precedence when an hour falls into several
+const (
+	PeriodPublicHoliday = "Public holiday"
+	PeriodWeekend       = "Weekend"
+	PeriodPeak          = "Peak"
+	PeriodOffPeak       = "Off-peak"
+	PeriodStandard      = "Standard"
+)
+
+// Pricing rules, configurable with the environment variables named beside each rule. Peak and off-peak
+// hours only apply on weekdays that are not public holidays.
+var (
+	peakHours               = "07-10,17-20"                   // PEAK_HOURS: hour ranges [from, to) charged at the peak rate
+	peakMultiplier          = 1.25                            // PEAK_MULTIPLIER: multiple of the hourly rate charged in peak hours
+	offPeakHours            = "00-06"                         // OFF_PEAK_HOURS: hour ranges [from, to) charged at the off-peak rate
+	offPeakMultiplier       = 0.8                             // OFF_PEAK_MULTIPLIER: multiple of the hourly rate charged in off-peak hours
+	weekendMultiplier       = 1.2                             // WEEKEND_MULTIPLIER: multiple of the hourly rate charged on Saturdays and Sundays
+	publicHolidayMultiplier = 1.3                             // PUBLIC_HOLIDAY_MULTIPLIER: multiple of the hourly rate charged on public holidays
+	publicHolidaysFile      = "rates/sg_public_holidays.json" // PUBLIC_HOLIDAYS_FILE: JSON calendar of public holidays
+	dailyCapHours           = 10.0                            // DAILY_CAP_HOURS: no 24 hours of a rental cost more than this many hours at the standard rate, 0 for no cap
+	surgeUtilisation        = 70.0                            // SURGE_UTILISATION_PERCENT: share of a location's vehicles booked from which surge pricing applies
+	surgeMultiplier         = 1.2                             // SURGE_MULTIPLIER: multiple of the hourly rate charged under surge pricing
+)
+
+var (
+	peak     [24]bool          // Hours of the day in peak
+	offPeak  [24]bool          // Hours of the day in off-peak
+	holidays map[string]string // Names of the public holidays by date
+)
+
+// Init loads the pricing rules and public holidays from .env. The vehicle service calls it from main.
+func Init() {
+	// Load environment variables
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// Load the pricing rules, keeping the defaults for unset variables
+	peak = envHours("PEAK_HOURS", peakHours)
+	peakMultiplier = envFloat("PEAK_MULTIPLIER", peakMultiplier, 0, 10)
+	offPeak = envHours("OFF_PEAK_HOURS", offPeakHours)
+	offPeakMultiplier = envFloat("OFF_PEAK_MULTIPLIER", offPeakMultiplier, 0, 10)
+	weekendMultiplier = envFloat("WEEKEND_MULTIPLIER", weekendMultiplier, 0, 10)
+	publicHolidayMultiplier = envFloat("PUBLIC_HOLIDAY_MULTIPLIER", publicHolidayMultiplier, 0, 10)
+	dailyCapHours = envFloat("DAILY_CAP_HOURS", dailyCapHours, 0, 24)
+	surgeUtilisation = envFloat("SURGE_UTILISATION_PERCENT", surgeUtilisation, 0, 100)
+	surgeMultiplier = envFloat("SURGE_MULTIPLIER", surgeMultiplier, 1, 10)
+	for hour := range peak {
+		if peak[hour] && offPeak[hour] {
+			log.Fatalf("Hour %02d is in both PEAK_HOURS and OFF_PEAK_HOURS", hour)
+		}
+	}
+
+	if file := os.Getenv("PUBLIC_HOLIDAYS_FILE"); file != "" {
+		publicHolidaysFile = file
+	}
+	holidays, err = loadHolidays(publicHolidaysFile)
+	if err != nil {
+		log.Fatalf("Error loading public holidays: %v", err)
+	}
+	// Bookings can be quoted up to a year ahead, so the calendar has to reach that far
+	if last, covered := coversYear(holidays, time.Now()); !covered {
+		log.Printf("WARNING: the public holidays in %s end on %s and do not cover the next 12 months; later holidays are priced as ordinary days until the calendar is updated.", publicHolidaysFile, last)
+	}
+
+	log.Printf("Pricing rules: peak %s at %.2fx, off-peak %s at %.2fx, weekends at %.2fx, %d public holidays at %.2fx, daily cap of %.1f hours, %.2fx surge from %.0f%% utilisation.",
+		peakHours, peakMultiplier, offPeakHours, offPeakMultiplier, weekendMultiplier, len(holidays), publicHolidayMultiplier, dailyCapHours, surgeMultiplier, surgeUtilisation)
+}
+
+// envFloat reads a numeric environment variable between min and max, returning def if it is unset
+func envFloat(name string, def, min, max float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < min || parsed > max {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return parsed
+}
+
+// envHours reads a list of hour ranges such as "07-10,17-20" from an environment variable, returning the
+// hours of the day they cover. def is used if the variable is unset, and an empty value covers no hours.
+func envHours(name string, def string) [24]bool {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		value = def
+	}
+
+	var hours [24]bool
+	for _, hourRange := range strings.Split(value, ",") {
+		hourRange = strings.TrimSpace(hourRange)
+		if hourRange == "" {
+			continue
+		}
+		bounds := strings.Split(hourRange, "-")
+		if len(bounds) != 2 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil || from < 0 || from > 23 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || to <= from || to > 24 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		for hour := from; hour < to; hour++ {
+			hours[hour] = true
+		}
+	}
+	return hours
+}
+
+// loadHolidays reads a JSON calendar of public holidays, a list of {"date": "2006-01-02", "name": ...}
+func loadHolidays(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var calendar []struct {
+		Date string `json:"date"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &calendar); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", file, err)
+	}
+
+	loaded := make(map[string]string, len(calendar))
+	for _, holiday := range calendar {
+		if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+			return nil, fmt.Errorf("invalid date %q in %s", holiday.Date, file)
+		}
+		loaded[holiday.Date] = holiday.Name
+	}
+	return loaded, nil
+}
+
+// coversYear reports whether a holiday calendar reaches the 12 months from now, and returns its last date
+func coversYear(calendar map[string]string, now time.Time) (string, bool) {
+	last := ""
+	for date := range calendar {
+		if date > last {
+			last = date
+		}
+	}
+	// A calendar lists the holidays of whole years, so it covers up to the end of the year of its last date
+	return last, last != "" && last[:4] >= now.AddDate(1, 0, 0).Format("2006")
+}
+
+// Hour is the charge for one hour of a rental, or the part of it that was booked
+type Hour struct {
+	Start      string  `json:"start"`
+	End        string  `json:"end"`
+	Hours      float64 `json:"hours"`
+	Period     string  `json:"period"`
+	Holiday    string  `json:"holiday,omitempty"`
+	Multiplier float64 `json:"multiplier"`    // Multiple of the standard hourly rate, including any surge
+	Rate       float64 `json:"rate_per_hour"` // Hourly rate charged
+	Amount     float64 `json:"amount"`
+}
+
+// DailyCap is the reduction that keeps 24 hours of a rental within the daily cap
+type DailyCap struct {
+	Day       int     `json:"day"` // 1 for the first 24 hours of the rental
+	Charged   float64 `json:"charged"`
+	Cap       float64 `json:"cap"`
+	Reduction float64 `json:"reduction"`
+}
+
+// Breakdown is the rental price of a booking before discounts, hour by hour
+type Breakdown struct {
+	Hours           []Hour     `json:"hours"`
+	DailyCaps       []DailyCap `json:"daily_caps,omitempty"`
+	SurgeMultiplier float64    `json:"surge_multiplier"`
+	Total           float64    `json:"total"`
+}
+
+// Price charges a rental from start to end at pricePerHour, the vehicle's standard hourly rate. Each
+// hour is charged at the rate of its period, times the surge multiplier if utilisation, the percentage
+// of the location's vehicles booked over the rental, reaches the surge threshold. Every 24 hours of the
+// rental are then capped at dailyCapHours at the standard rate. Dates are compared on the wall clock
+// they were booked in.
+func Price(pricePerHour float64, start, end time.Time, utilisation float64) Breakdown {
+	breakdown := Breakdown{SurgeMultiplier: 1}
+	if surgeUtilisation > 0 && utilisation >= surgeUtilisation {
+		breakdown.SurgeMultiplier = surgeMultiplier
+	}
+
+	var dayCharged float64
+	day := 0
+	dayCap := roundCents(pricePerHour * dailyCapHours)
+	for from := start; from.Before(end); {
+		// Hours are split on the hour and where each 24 hours of the rental end
+		to := from.Truncate(time.Hour).Add(time.Hour)
+		dayEnd := start.Add(time.Duration(day+1) * 24 * time.Hour)
+		if dayEnd.Before(to) {
+			to = dayEnd
+		}
+		if end.Before(to) {
+			to = end
+		}
+
+		period, holiday, multiplier := periodOf(from)
+		multiplier *= breakdown.SurgeMultiplier
+		hours := to.Sub(from).Hours()
+		hour := Hour{
+			Start:      from.Format("2006-01-02 15:04:05"),
+			End:        to.Format("2006-01-02 15:04:05"),
+			Hours:      math.Round(hours*100) / 100,
+			Period:     period,
+			Holiday:    holiday,
+			Multiplier: math.Round(multiplier*100) / 100,
+			Rate:       roundCents(pricePerHour * multiplier),
+			Amount:     roundCents(pricePerHour * multiplier * hours),
+		}
+		breakdown.Hours = append(breakdown.Hours, hour)
+		breakdown.Total += hour.Amount
+		dayCharged += hour.Amount
+
+		from = to
+		if !from.Before(dayEnd) || !from.Before(end) {
+			if dailyCapHours > 0 && dayCharged > dayCap {
+				breakdown.DailyCaps = append(breakdown.DailyCaps, DailyCap{
+					Day:       day + 1,
+					Charged:   roundCents(dayCharged),
+					Cap:       dayCap,
+					Reduction: roundCents(dayCharged - dayCap),
+				})
+				breakdown.Total -= dayCharged - dayCap
+			}
+			dayCharged = 0
+			day++
+		}
+	}
+	breakdown.Total = roundCents(breakdown.Total)
+	return breakdown
+}
+
+// LatePrice returns the price of the started hours by which a rental returned at returnedAt overran its
+// return date, before any late return multiplier. Late hours are priced like booked ones, without surge.
+func LatePrice(pricePerHour float64, returnDate, returnedAt time.Time) float64 {
+	hours := math.Ceil(returnedAt.Sub(returnDate).Hours())
+	if hours < 1 {
+		return 0
+	}
+	return Price(pricePerHour, returnDate, returnDate.Add(time.Duration(hours)*time.Hour), 0).Total
+}
+
+// UnusedPrice returns what the whole hours of a rental left unused by an early return contributed to its
+// price: the price of the booking less the price of the booking without them. Hours in a day that reached
+// the daily cap therefore contribute only what they added above the cap. Unused time is measured from the
+// later of the booked start and the actual return.
+func UnusedPrice(pricePerHour float64, bookingDate, returnDate, returnedAt time.Time) float64 {
+	unusedFrom := returnedAt
+	if unusedFrom.Before(bookingDate) {
+		unusedFrom = bookingDate
+	}
+	hours := math.Floor(returnDate.Sub(unusedFrom).Hours())
+	if hours < 1 {
+		return 0
+	}
+	usedUntil := returnDate.Add(-time.Duration(hours) * time.Hour)
+	booked := Price(pricePerHour, bookingDate, returnDate, 0).Total
+	used := Price(pricePerHour, bookingDate, usedUntil, 0).Total
+	return math.Max(roundCents(booked-used), 0)
+}
+
+// periodOf returns the rate period of the hour starting at t, the name of its public holiday if any,
+// and its multiple of the standard hourly rate
+func periodOf(t time.Time) (string, string, float64) {
+	if name, ok := holidays[t.Format("2006-01-02")]; ok {
+		return PeriodPublicHoliday, name, publicHolidayMultiplier
+	}
+	if weekday := t.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		return PeriodWeekend, "", weekendMultiplier
+	}
+	if peak[t.Hour()] {
+		return PeriodPeak, "", peakMultiplier
+	}
+	if offPeak[t.Hour()] {
+		return PeriodOffPeak, "", offPeakMultiplier
+	}
+	return PeriodStandard, "", 1
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
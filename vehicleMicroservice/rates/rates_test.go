@@ -0,0 +1,129 @@
+package rates
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	peak = envHours("PEAK_HOURS", peakHours)
+	offPeak = envHours("OFF_PEAK_HOURS", offPeakHours)
+	holidays = map[string]string{"2026-05-01": "Labour Day"}
+	m.Run()
+}
+
+func TestPrice(t *testing.T) {
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name        string
+		start, end  time.Time
+		utilisation float64
+		total       float64
+		hours       int
+		dailyCaps   int
+		surge       float64
+	}{
+		{name: "weekday standard hours", start: at(3, 4, 11, 0), end: at(3, 4, 13, 0), total: 20, hours: 2, surge: 1},
+		{name: "weekday peak hours", start: at(3, 4, 7, 0), end: at(3, 4, 9, 0), total: 25, hours: 2, surge: 1},
+		{name: "weekday off-peak hours", start: at(3, 4, 4, 0), end: at(3, 4, 6, 0), total: 16, hours: 2, surge: 1},
+		{name: "part hours across the end of peak", start: at(3, 4, 9, 30), end: at(3, 4, 10, 15), total: 8.75, hours: 2, surge: 1},
+		{name: "weekend", start: at(3, 7, 10, 0), end: at(3, 7, 12, 0), total: 24, hours: 2, surge: 1},
+		{name: "public holiday on a weekday", start: at(5, 1, 10, 0), end: at(5, 1, 12, 0), total: 26, hours: 2, surge: 1},
+		{name: "surge at the utilisation threshold", start: at(3, 4, 11, 0), end: at(3, 4, 13, 0), utilisation: 70, total: 24, hours: 2, surge: 1.2},
+		{name: "no surge below the threshold", start: at(3, 4, 11, 0), end: at(3, 4, 13, 0), utilisation: 69.9, total: 20, hours: 2, surge: 1},
+		{name: "24 hours capped", start: at(3, 4, 0, 0), end: at(3, 5, 0, 0), total: 100, hours: 24, dailyCaps: 1, surge: 1},
+		{name: "each 24 hours capped separately", start: at(3, 4, 0, 0), end: at(3, 6, 2, 0), total: 216, hours: 50, dailyCaps: 2, surge: 1},
+		{name: "empty interval", start: at(3, 4, 11, 0), end: at(3, 4, 11, 0), total: 0, hours: 0, surge: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breakdown := Price(10, test.start, test.end, test.utilisation)
+			if breakdown.Total != test.total {
+				t.Errorf("Price() total = %v, want %v", breakdown.Total, test.total)
+			}
+			if len(breakdown.Hours) != test.hours {
+				t.Errorf("Price() has %d hours, want %d", len(breakdown.Hours), test.hours)
+			}
+			if len(breakdown.DailyCaps) != test.dailyCaps {
+				t.Errorf("Price() has %d daily caps, want %d: %+v", len(breakdown.DailyCaps), test.dailyCaps, breakdown.DailyCaps)
+			}
+			if breakdown.SurgeMultiplier != test.surge {
+				t.Errorf("Price() surge multiplier = %v, want %v", breakdown.SurgeMultiplier, test.surge)
+			}
+		})
+	}
+}
+
+func TestEnvHours(t *testing.T) {
+	t.Setenv("TEST_HOURS", "07-10, 22-24")
+	hours := envHours("TEST_HOURS", "")
+	for hour, want := range map[int]bool{6: false, 7: true, 9: true, 10: false, 21: false, 22: true, 23: true} {
+		if hours[hour] != want {
+			t.Errorf("envHours() hour %d = %v, want %v", hour, hours[hour], want)
+		}
+	}
+}
+
+func TestLatePrice(t *testing.T) {
+	returnDate := time.Date(2026, 3, 4, 16, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		returnedAt time.Time
+		want       float64
+	}{
+		{name: "returned on time", returnedAt: returnDate, want: 0},
+		{name: "returned early", returnedAt: returnDate.Add(-time.Hour), want: 0},
+		{name: "started hours into peak", returnedAt: returnDate.Add(90 * time.Minute), want: 22.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := LatePrice(10, returnDate, test.returnedAt); got != test.want {
+				t.Errorf("LatePrice() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnusedPrice(t *testing.T) {
+	start := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		returnDate time.Time
+		returnedAt time.Time
+		want       float64
+	}{
+		{name: "returned on time", returnDate: start.Add(4 * time.Hour), returnedAt: start.Add(4 * time.Hour), want: 0},
+		{name: "part hour unused", returnDate: start.Add(4 * time.Hour), returnedAt: start.Add(3*time.Hour + 30*time.Minute), want: 0},
+		{name: "unused whole hours", returnDate: start.Add(4 * time.Hour), returnedAt: start.Add(90 * time.Minute), want: 20},
+		{name: "returned before the booked start", returnDate: start.Add(4 * time.Hour), returnedAt: start.Add(-time.Hour), want: 40},
+		{name: "unused hours of a capped day add only what exceeds the cap", returnDate: start.Add(24 * time.Hour), returnedAt: start.Add(time.Hour), want: 90},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := UnusedPrice(10, start, test.returnDate, test.returnedAt); got != test.want {
+				t.Errorf("UnusedPrice() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCoversYear(t *testing.T) {
+	now := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	if last, covered := coversYear(map[string]string{"2026-01-01": "", "2026-12-25": ""}, now); covered || last != "2026-12-25" {
+		t.Errorf("coversYear() = %s, %v, want 2026-12-25, false", last, covered)
+	}
+	if _, covered := coversYear(map[string]string{"2027-12-25": ""}, now); !covered {
+		t.Error("coversYear() = false for a calendar of next year")
+	}
+	if _, covered := coversYear(nil, now); covered {
+		t.Error("coversYear() = true for an empty calendar")
+	}
+}
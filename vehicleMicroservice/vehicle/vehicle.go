@@ -6,15 +6,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 var db *sql.DB
 
-func init() {
+// Init connects to the vehicle database configured in .env. The vehicle service calls it from main.
+func Init() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -43,12 +46,12 @@ func init() {
 
 // Vehicle represents the structure of a vehicle record
 type Vehicle struct {
-	VehicleID           int     `json:"vehicle_id"`
-	Model               string  `json:"model"`
-	Location            string  `json:"location"`
-	ChargeLevel         *int64  `json:"charge_level,omitempty"`
-	CleanlinessStatus   string  `json:"cleanliness_status"`
-	RentalPricePerHour  float64 `json:"rental_price_per_hour"`
+	VehicleID          int     `json:"vehicle_id"`
+	Model              string  `json:"model"`
+	Location           string  `json:"location"`
+	ChargeLevel        *int64  `json:"charge_level,omitempty"`
+	CleanlinessStatus  string  `json:"cleanliness_status"`
+	RentalPricePerHour float64 `json:"rental_price_per_hour"`
 }
 
 func GetAvailableVehicles(w http.ResponseWriter, r *http.Request) {
@@ -105,6 +108,7 @@ func GetAvailableVehicles(w http.ResponseWriter, r *http.Request) {
 			SELECT COUNT(*)
 			FROM Bookings
 			WHERE vehicle_id = ?
+			AND status NOT IN ('cancelled', 'no_show')
 			AND (booking_date < ? AND return_date > ?)`,
 			vehicle.VehicleID, endDate, startDate).Scan(&count)
 		if err != nil {
@@ -129,6 +133,7 @@ func GetAvailableVehicles(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Available vehicles response sent successfully.")
 }
+
 // GetVehicleStatus retrieves the status of all vehicles
 func GetVehicleStatus(w http.ResponseWriter, r *http.Request) {
 	log.Println("Fetching vehicle status...")
@@ -166,3 +171,58 @@ func GetVehicleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Vehicle status response sent successfully.")
 }
+
+// UpdateVehicleStatus lets fleet operators update the location, charge level and cleanliness of a vehicle.
+// Fields omitted from the request body are left unchanged.
+func UpdateVehicleStatus(w http.ResponseWriter, r *http.Request) {
+	log.Println("Updating vehicle status...")
+
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Location          *string `json:"location"`
+		ChargeLevel       *int64  `json:"charge_level"`
+		CleanlinessStatus *string `json:"cleanliness_status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Printf("Error decoding request body: %v", err)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if payload.ChargeLevel != nil && (*payload.ChargeLevel < 0 || *payload.ChargeLevel > 100) {
+		http.Error(w, "Charge level must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if payload.CleanlinessStatus != nil && *payload.CleanlinessStatus != "Clean" && *payload.CleanlinessStatus != "Needs Cleaning" {
+		http.Error(w, "Invalid cleanliness status", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE Vehicles
+		SET location = COALESCE(?, location),
+			charge_level = COALESCE(?, charge_level),
+			cleanliness_status = COALESCE(?, cleanliness_status)
+		WHERE vehicle_id = ?`,
+		payload.Location, payload.ChargeLevel, payload.CleanlinessStatus, vehicleID)
+	if err != nil {
+		log.Printf("Error updating vehicle status: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Vehicles WHERE vehicle_id = ?)", vehicleID).Scan(&exists); err != nil || !exists {
+			http.Error(w, "Vehicle not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	log.Printf("Vehicle %d status updated.", vehicleID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle status updated successfully"})
+}